@@ -0,0 +1,62 @@
+package main
+
+import (
+	"distributed-db/shared"
+	"encoding/json"
+	"net/http"
+)
+
+var (
+	readPolicy = shared.BalanceRoundRobin
+	// readMaxLag leaves slaves further behind out of read balancing; zero
+	// fields are not checked.
+	readMaxLag   lagThresholds
+	readBalancer *shared.Balancer
+)
+
+func setupReadBalancer() error {
+	policy, err := shared.ParseBalancePolicy(readPolicy, readMaxLag.Ops, readMaxLag.Seconds)
+	if err != nil {
+		return err
+	}
+	readBalancer = shared.NewBalancer(policy)
+	refreshReadBackends()
+	return nil
+}
+
+// refreshReadBackends offers the balancer every connected slave that serves
+// HTTP, with its current lag.
+func refreshReadBackends() {
+	lags := make(map[string]shared.SlaveLag)
+	for _, lag := range computeLag() {
+		lags[lag.NodeID] = lag
+	}
+	var backends []shared.Backend
+	for _, info := range slaves.Snapshot() {
+		if info.State != shared.SlaveConnected || info.HTTPAddr == "" {
+			continue
+		}
+		backends = append(backends, shared.Backend{
+			ID:         info.NodeID,
+			Addr:       info.HTTPAddr,
+			LagOps:     lags[info.NodeID].LagOps,
+			LagSeconds: lags[info.NodeID].LagSeconds,
+		})
+	}
+	readBalancer.SetBackends(backends)
+}
+
+// handleBalancer serves GET /api/balancer, the read balancing policy and
+// what it has seen of each slave.
+func handleBalancer(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	refreshReadBackends()
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"policy":   readBalancer.Policy(),
+		"backends": readBalancer.Stats(),
+	})
+}
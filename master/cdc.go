@@ -0,0 +1,212 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"distributed-db/shared"
+	"encoding/json"
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"time"
+)
+
+// cdcKeepAlive is how long a change stream may stay silent before the
+// master sends a keep-alive.
+const cdcKeepAlive = 15 * time.Second
+
+// cdcCtx ends every change stream when the master shuts down.
+var cdcCtx, stopCDC = context.WithCancel(context.Background())
+
+// streamChanges sends the change events after cursor, in log order, then
+// waits for new writes until ctx ends or send fails. keepAlive is called
+// when the stream has been idle for cdcKeepAlive.
+func streamChanges(ctx context.Context, cursor shared.ChangeCursor, send func(shared.ChangeEvent) error, keepAlive func() error) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	stop := context.AfterFunc(cdcCtx, cancel)
+	defer stop()
+
+	// A cursor inside a write resumes with the rest of its events.
+	position := cursor.Position
+	if position > 0 {
+		position--
+	}
+	idle := time.NewTimer(cdcKeepAlive)
+	defer idle.Stop()
+	for {
+		changed := replLog.Changed()
+		entries := replLog.Since(position, fetchBatchSize)
+		if len(entries) == 0 {
+			select {
+			case <-ctx.Done():
+				return nil
+			case <-changed:
+			case <-idle.C:
+				if err := keepAlive(); err != nil {
+					return err
+				}
+				idle.Reset(cdcKeepAlive)
+			}
+			continue
+		}
+		for _, entry := range entries {
+			for _, ev := range shared.ChangeEvents(entry) {
+				if !cursor.After(ev) {
+					continue
+				}
+				if err := send(ev); err != nil {
+					return err
+				}
+			}
+			position = entry.Position
+		}
+		idle.Reset(cdcKeepAlive)
+	}
+}
+
+// endCursor is the cursor after the last write in the log.
+func endCursor() shared.ChangeCursor {
+	return shared.ChangeCursor{Position: replLog.LastPosition(), Index: math.MaxInt}
+}
+
+// changeCursor reads where an HTTP subscriber resumes: the Last-Event-ID a
+// reconnecting EventSource sends, else the from parameter. Without either
+// the stream starts at the end of the log.
+func changeCursor(r *http.Request) (shared.ChangeCursor, error) {
+	from := r.Header.Get("Last-Event-ID")
+	if from == "" {
+		from = r.URL.Query().Get("from")
+	}
+	if from == "" {
+		return endCursor(), nil
+	}
+	return shared.ParseChangeCursor(from)
+}
+
+// handleChangeStream serves GET /api/cdc/stream, the change events as
+// Server-Sent Events.
+func handleChangeStream(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	cursor, err := changeCursor(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "Streaming not supported", http.StatusInternalServerError)
+		return
+	}
+	http.NewResponseController(w).SetWriteDeadline(time.Time{})
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	logEvent("CDC", "Change stream opened", map[string]interface{}{"remote": r.RemoteAddr, "from": cursor.Position, "transport": "sse"})
+	err = streamChanges(r.Context(), cursor, func(ev shared.ChangeEvent) error {
+		data, err := json.Marshal(ev)
+		if err != nil {
+			return err
+		}
+		if _, err := fmt.Fprintf(w, "id: %s\nevent: change\ndata: %s\n\n", ev.ID, data); err != nil {
+			return err
+		}
+		flusher.Flush()
+		return nil
+	}, func() error {
+		if _, err := fmt.Fprint(w, ": keep-alive\n\n"); err != nil {
+			return err
+		}
+		flusher.Flush()
+		return nil
+	})
+	logChangeStreamClosed(r.RemoteAddr, err)
+}
+
+// handleChangeSocket serves GET /api/cdc/ws, the change events as WebSocket
+// text messages.
+func handleChangeSocket(w http.ResponseWriter, r *http.Request) {
+	cursor, err := changeCursor(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	ws, err := shared.UpgradeWebSocket(w, r)
+	if err != nil {
+		return
+	}
+	defer ws.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		<-ws.Closed()
+		cancel()
+	}()
+
+	logEvent("CDC", "Change stream opened", map[string]interface{}{"remote": r.RemoteAddr, "from": cursor.Position, "transport": "websocket"})
+	err = streamChanges(ctx, cursor, func(ev shared.ChangeEvent) error {
+		data, err := json.Marshal(ev)
+		if err != nil {
+			return err
+		}
+		return ws.WriteText(data)
+	}, ws.Ping)
+	logChangeStreamClosed(r.RemoteAddr, err)
+}
+
+// subscribeChanges streams change events to a TCP client that sent
+// MsgSubscribe, one JSON event per line after an ok response. Blank lines
+// keep the connection alive; anything the client sends ends the stream.
+func subscribeChanges(conn net.Conn, scanner *bufio.Scanner, req shared.DBRequest) {
+	cursor := endCursor()
+	if req.Cursor != "" {
+		var err error
+		if cursor, err = shared.ParseChangeCursor(req.Cursor); err != nil {
+			writeSlaveResponse(conn, shared.DBResponse{Status: "error", Message: err.Error()})
+			return
+		}
+	}
+	writeSlaveResponse(conn, shared.DBResponse{Status: "ok", Message: "Subscribed", Position: replLog.LastPosition()})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		scanner.Scan()
+		cancel()
+	}()
+
+	remote := conn.RemoteAddr().String()
+	logEvent("CDC", "Change stream opened", map[string]interface{}{"remote": remote, "from": cursor.Position, "transport": "tcp"})
+	write := func(line []byte) error {
+		conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
+		_, err := conn.Write(append(line, '\n'))
+		return err
+	}
+	err := streamChanges(ctx, cursor, func(ev shared.ChangeEvent) error {
+		data, err := json.Marshal(ev)
+		if err != nil {
+			return err
+		}
+		return write(data)
+	}, func() error {
+		return write(nil)
+	})
+	logChangeStreamClosed(remote, err)
+}
+
+func logChangeStreamClosed(remote string, err error) {
+	data := map[string]string{"remote": remote}
+	if err != nil {
+		data["error"] = err.Error()
+	}
+	logEvent("CDC", "Change stream closed", data)
+}
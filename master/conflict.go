@@ -0,0 +1,538 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"distributed-db/shared"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// maxRecentConflicts bounds the conflicts kept in memory for review;
+	// the conflict log keeps them all.
+	maxRecentConflicts  = 1000
+	conflictHookTimeout = 5 * time.Second
+)
+
+var (
+	conflictPolicy  = shared.ConflictLastWriterWins
+	conflictHookURL string
+	conflictLogPath = "conflicts.jsonl"
+
+	conflicts *conflictLog
+	// mergedSeqs holds, per slave, the last partitioned write merged into
+	// the log, so a batch sent again is not merged twice. Guarded by writeMu.
+	mergedSeqs = make(map[string]int64)
+
+	conflictHookClient = &http.Client{Timeout: conflictHookTimeout}
+
+	conflictsFound = shared.DefaultMetrics.Counter("ddb_conflicts_total",
+		"Rows written both by a partitioned slave and on the master, by resolution.", "policy", "resolution")
+)
+
+// conflictLog appends every conflict to a file and keeps the latest in
+// memory for /api/conflicts.
+type conflictLog struct {
+	mu     sync.Mutex
+	file   *os.File
+	recent []shared.Conflict
+}
+
+func openConflictLog(path string) (*conflictLog, error) {
+	l := &conflictLog{}
+	if file, err := os.Open(path); err == nil {
+		scanner := bufio.NewScanner(file)
+		scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+		for scanner.Scan() {
+			var c shared.Conflict
+			if err := json.Unmarshal(scanner.Bytes(), &c); err != nil {
+				file.Close()
+				return nil, fmt.Errorf("corrupt conflict log entry: %v", err)
+			}
+			l.add(c)
+		}
+		file.Close()
+		if err := scanner.Err(); err != nil {
+			return nil, fmt.Errorf("failed to read conflict log: %v", err)
+		}
+	} else if !os.IsNotExist(err) {
+		return nil, fmt.Errorf("failed to open conflict log: %v", err)
+	}
+
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open conflict log: %v", err)
+	}
+	l.file = file
+	return l, nil
+}
+
+func (l *conflictLog) add(c shared.Conflict) {
+	l.recent = append(l.recent, c)
+	if len(l.recent) > maxRecentConflicts {
+		l.recent = append([]shared.Conflict(nil), l.recent[len(l.recent)-maxRecentConflicts:]...)
+	}
+}
+
+func (l *conflictLog) record(c shared.Conflict) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	data, err := json.Marshal(c)
+	if err != nil {
+		return fmt.Errorf("failed to encode conflict: %v", err)
+	}
+	if _, err := l.file.Write(append(data, '\n')); err != nil {
+		return fmt.Errorf("failed to write conflict log: %v", err)
+	}
+	l.add(c)
+	return nil
+}
+
+// list returns the recent conflicts, oldest first, optionally only those
+// from one slave or on one table.
+func (l *conflictLog) list(node, table string) []shared.Conflict {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	out := []shared.Conflict{}
+	for _, c := range l.recent {
+		if (node == "" || c.NodeID == node) && (table == "" || strings.EqualFold(c.Table, table)) {
+			out = append(out, c)
+		}
+	}
+	return out
+}
+
+func setupConflicts() error {
+	if conflictPolicy == shared.ConflictHook && conflictHookURL == "" {
+		return fmt.Errorf("-conflict-policy hook needs -conflict-hook")
+	}
+	var err error
+	if conflicts, err = openConflictLog(conflictLogPath); err != nil {
+		return err
+	}
+	for position := int64(0); ; {
+		entries := replLog.Since(position, fetchBatchSize)
+		if len(entries) == 0 {
+			break
+		}
+		for _, entry := range entries {
+			if entry.Origin != "" && entry.OriginSeq > mergedSeqs[entry.Origin] {
+				mergedSeqs[entry.Origin] = entry.OriginSeq
+			}
+		}
+		position = entries[len(entries)-1].Position
+	}
+	return nil
+}
+
+// handleReconcile merges the writes node, the slave the connection belongs
+// to, took while partitioned, in order. Writes merged before are skipped, so
+// a slave that lost the response can simply send them again.
+//
+// Conflicts are found and settled without holding writeMu, since the
+// conflict hook can take seconds. The merge then checks under the lock that
+// the master has not changed any of the rows since, and plans again if it
+// has.
+func handleReconcile(db *shared.DBHandler, node string, req shared.DBRequest) shared.DBResponse {
+	if raftNode != nil {
+		return shared.DBResponse{Status: "error", Message: "Merging partitioned writes is not available with Raft"}
+	}
+	if node == "" {
+		return shared.DBResponse{Status: "error", Message: "Reconciliation from unregistered slave"}
+	}
+	if err := replLog.Flush(); err != nil {
+		return shared.DBResponse{Status: "error", Message: fmt.Sprintf("writes are suspended: %v", err)}
+	}
+
+	writeMu.Lock()
+	done := mergedSeqs[node]
+	writeMu.Unlock()
+	var writes []shared.LocalWrite
+	for _, w := range req.Writes {
+		if w.Seq > done {
+			writes = append(writes, w)
+		}
+	}
+
+	found := []shared.Conflict{}
+	merged := 0
+	if len(writes) > 0 {
+		ctx := context.Background()
+		index := newChangeIndex(node, writes)
+		for attempt := 1; ; attempt++ {
+			plans := planMerges(ctx, db, node, writes, index)
+
+			writeMu.Lock()
+			planned := index.position
+			index.update()
+			if index.touchedAfter(planned, writes) {
+				writeMu.Unlock()
+				if attempt == maxMergeAttempts {
+					return shared.DBResponse{Status: "error", Message: "The master kept changing the rows being merged; try again"}
+				}
+				continue
+			}
+			var err error
+			found, merged, err = mergePlansLocked(ctx, db, node, plans)
+			writeMu.Unlock()
+			if err != nil {
+				return shared.DBResponse{Status: "error", Message: err.Error(), Conflicts: found}
+			}
+			break
+		}
+	}
+	logEvent("REPLICATION", "Merged partitioned writes", map[string]interface{}{
+		"node_id":   node,
+		"merged":    merged,
+		"conflicts": len(found),
+	})
+	return shared.DBResponse{
+		Status:    "ok",
+		Message:   fmt.Sprintf("Merged %d writes with %d conflicts", merged, len(found)),
+		Position:  replLog.LastPosition(),
+		Conflicts: found,
+	}
+}
+
+// mergePlansLocked merges plans in order, skipping writes merged before,
+// and returns the conflicts and number of writes merged.
+func mergePlansLocked(ctx context.Context, db *shared.DBHandler, node string, plans []mergePlan) ([]shared.Conflict, int, error) {
+	found := []shared.Conflict{}
+	merged := 0
+	for _, plan := range plans {
+		if plan.write.Seq <= mergedSeqs[node] {
+			continue
+		}
+		if err := mergeWriteLocked(ctx, db, node, plan); err != nil {
+			logEvent("ERROR", "Failed to merge partitioned write", map[string]interface{}{
+				"node_id": node,
+				"seq":     plan.write.Seq,
+				"error":   err.Error(),
+			})
+			return found, merged, fmt.Errorf("Failed to merge write %d: %v", plan.write.Seq, err)
+		}
+		found = append(found, plan.found...)
+		merged++
+	}
+	return found, merged, nil
+}
+
+// maxMergeAttempts bounds how often a batch is planned again because the
+// master changed its rows meanwhile.
+const maxMergeAttempts = 3
+
+// mergePlan is one partitioned write with its conflicts settled: the rows
+// to write and the conflicts to record.
+type mergePlan struct {
+	write shared.LocalWrite
+	apply []shared.RowChange
+	found []shared.Conflict
+}
+
+// planMerges settles the conflicts of writes against the master's changes
+// in index. A row the master also changed after a write's base position is
+// a conflict, settled by the conflict policy; the other rows are written as
+// the slave left them.
+func planMerges(ctx context.Context, db *shared.DBHandler, node string, writes []shared.LocalWrite, index *changeIndex) []mergePlan {
+	plans := make([]mergePlan, 0, len(writes))
+	for _, w := range writes {
+		plan := mergePlan{write: w, apply: []shared.RowChange{}}
+		for i, change := range w.Changes {
+			remote, ok := index.last(change, w.Base)
+			if !ok {
+				plan.apply = append(plan.apply, change)
+				continue
+			}
+			c := shared.Conflict{
+				ID:             fmt.Sprintf("%s:%d:%d", node, w.Seq, i),
+				Time:           time.Now().UnixMilli(),
+				NodeID:         node,
+				Seq:            w.Seq,
+				Query:          w.Query,
+				DB:             change.DB,
+				Table:          change.Table,
+				Local:          change,
+				LocalVersion:   w.Version,
+				Remote:         remote.change,
+				RemoteQuery:    remote.query,
+				RemotePosition: remote.position,
+				RemoteVersion:  remote.version,
+				Policy:         conflictPolicy,
+			}
+			c.Applied = resolveConflict(ctx, db, &c)
+			if c.Applied != nil {
+				plan.apply = append(plan.apply, *c.Applied)
+			}
+			plan.found = append(plan.found, c)
+		}
+		plans = append(plans, plan)
+	}
+	return plans
+}
+
+// mergeWriteLocked applies one planned partitioned write. The write is
+// logged with its HLC even when no row of it survives, which records it as
+// merged. If the rows are written but the entry cannot be saved yet, the
+// log keeps the entry and appends it before anything else, so the write
+// still counts as merged and is not applied a second time.
+func mergeWriteLocked(ctx context.Context, db *shared.DBHandler, node string, plan mergePlan) error {
+	w := plan.write
+	if err := db.ApplyRowChanges(ctx, plan.apply); err != nil {
+		return err
+	}
+	entry, err := replLog.AppendWrite(shared.ReplicationEntry{
+		Query:     w.Query,
+		Captured:  true,
+		Changes:   plan.apply,
+		HLC:       w.Version,
+		Origin:    node,
+		OriginSeq: w.Seq,
+	})
+	mergedSeqs[node] = w.Seq
+
+	for _, c := range plan.found {
+		conflictsFound.Inc(c.Policy, c.Resolution)
+		logEvent("CONFLICT", "Resolved write conflict", map[string]interface{}{
+			"id":              c.ID,
+			"table":           c.Table,
+			"key":             c.Local.KeyValues(),
+			"local_version":   c.LocalVersion.String(),
+			"remote_version":  c.RemoteVersion.String(),
+			"remote_position": c.RemotePosition,
+			"resolution":      c.Resolution,
+		})
+		if err := conflicts.record(c); err != nil {
+			logEvent("ERROR", "Failed to record conflict", map[string]string{"id": c.ID, "error": err.Error()})
+		}
+	}
+	if err != nil {
+		return fmt.Errorf("write merged but is not in the replication log yet: %v", err)
+	}
+	logEvent("REPLICATION", "Appended merged write to replication log", map[string]interface{}{
+		"position": entry.Position,
+		"node_id":  node,
+		"seq":      w.Seq,
+		"rows":     len(plan.apply),
+	})
+	return nil
+}
+
+// remoteChange is the master's latest change to a row: a captured row
+// change, or an uncaptured statement on the row's table.
+type remoteChange struct {
+	position int64
+	version  shared.HLC
+	change   *shared.RowChange
+	query    string
+}
+
+// changeIndex indexes what the master logged that did not come from node:
+// the last change to each row by row ID, the last uncaptured statement on
+// each table, and the last uncaptured statement whose tables are unknown.
+// It is built once for a batch, from the lowest base position among its
+// writes, and extended with update.
+type changeIndex struct {
+	node     string
+	position int64
+	rows     map[string]remoteChange
+	tables   map[string]remoteChange
+	anyTable *remoteChange
+}
+
+func newChangeIndex(node string, writes []shared.LocalWrite) *changeIndex {
+	index := &changeIndex{
+		node:     node,
+		position: writes[0].Base,
+		rows:     make(map[string]remoteChange),
+		tables:   make(map[string]remoteChange),
+	}
+	for _, w := range writes {
+		if w.Base < index.position {
+			index.position = w.Base
+		}
+	}
+	index.update()
+	return index
+}
+
+// update adds the entries logged since the index was last brought up to
+// date.
+func (x *changeIndex) update() {
+	for {
+		entries := replLog.Since(x.position, fetchBatchSize)
+		if len(entries) == 0 {
+			return
+		}
+		for _, entry := range entries {
+			if entry.Origin == x.node {
+				continue
+			}
+			rc := remoteChange{position: entry.Position, version: entry.HLC}
+			if entry.Captured {
+				for i := range entry.Changes {
+					r := rc
+					r.change = &entry.Changes[i]
+					x.rows[shared.RowID(entry.Changes[i])] = r
+				}
+				continue
+			}
+			rc.query = entry.Query
+			names := shared.ReferencedTables(entry.Query)
+			if len(names) == 0 {
+				x.anyTable = &rc
+			}
+			for _, name := range names {
+				x.tables[name] = rc
+			}
+		}
+		x.position = entries[len(entries)-1].Position
+	}
+}
+
+// last returns the master's latest change to c's row logged after position.
+func (x *changeIndex) last(c shared.RowChange, position int64) (remoteChange, bool) {
+	r, ok := lastRemoteChange(c, x.rows, x.tables, x.anyTable)
+	if !ok || r.position <= position {
+		return remoteChange{}, false
+	}
+	return r, true
+}
+
+// touchedAfter reports whether the master changed a row of writes after
+// position.
+func (x *changeIndex) touchedAfter(position int64, writes []shared.LocalWrite) bool {
+	for _, w := range writes {
+		for _, c := range w.Changes {
+			if _, ok := x.last(c, position); ok {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func lastRemoteChange(c shared.RowChange, rows, tables map[string]remoteChange, anyTable *remoteChange) (remoteChange, bool) {
+	var last remoteChange
+	found := false
+	candidates := []*remoteChange{anyTable}
+	if r, ok := rows[shared.RowID(c)]; ok {
+		candidates = append(candidates, &r)
+	}
+	if r, ok := tables[strings.ToLower(c.Table)]; ok {
+		candidates = append(candidates, &r)
+	}
+	for _, r := range candidates {
+		if r != nil && r.position > last.position {
+			last, found = *r, true
+		}
+	}
+	return last, found
+}
+
+// resolveConflict settles c under the conflict policy and returns the
+// change to write for it. When the master's row stands it is written again
+// as it is now, which brings the slave back to it however the master
+// changed it.
+func resolveConflict(ctx context.Context, db *shared.DBHandler, c *shared.Conflict) *shared.RowChange {
+	local := c.Local
+	base := shared.RowChange{DB: local.DB, Table: local.Table, Key: local.Key}
+
+	resolution, row, err := decideConflict(c)
+	if err != nil {
+		c.Error = err.Error()
+	}
+	c.Resolution = resolution
+	switch resolution {
+	case shared.ResolvedLocal:
+		return &local
+	case shared.ResolvedMerged:
+		if row == nil {
+			base.Op, base.Before = shared.RowDelete, shared.KeyImage(local)
+			return &base
+		}
+		for col, v := range shared.KeyImage(local) {
+			if _, ok := row[col]; !ok {
+				row[col] = v
+			}
+		}
+		base.Op, base.After = shared.RowUpdate, row
+		return &base
+	}
+
+	current, err := db.CurrentRow(ctx, local.DB, local.Table, local.Key, local.KeyValues())
+	if err != nil {
+		c.Error = fmt.Sprintf("failed to read the master's row: %v", err)
+		return nil
+	}
+	if current == nil {
+		base.Op, base.Before = shared.RowDelete, shared.KeyImage(local)
+	} else {
+		base.Op, base.After = shared.RowUpdate, current
+	}
+	return &base
+}
+
+// decideConflict applies the conflict policy. Under last-writer-wins the
+// write with the later HLC wins and ties keep the master's row. A hook
+// that fails or answers nonsense keeps the master's row.
+func decideConflict(c *shared.Conflict) (string, map[string]interface{}, error) {
+	switch conflictPolicy {
+	case shared.ConflictMasterWins:
+		return shared.ResolvedMaster, nil, nil
+	case shared.ConflictHook:
+		decision, err := callConflictHook(*c)
+		if err != nil {
+			return shared.ResolvedMaster, nil, fmt.Errorf("conflict hook failed, keeping the master's row: %v", err)
+		}
+		return decision.Resolution, decision.Row, nil
+	}
+	if c.LocalVersion > c.RemoteVersion {
+		return shared.ResolvedLocal, nil, nil
+	}
+	return shared.ResolvedMaster, nil, nil
+}
+
+// callConflictHook posts c to the conflict hook and returns its decision.
+func callConflictHook(c shared.Conflict) (shared.ConflictDecision, error) {
+	data, err := json.Marshal(c)
+	if err != nil {
+		return shared.ConflictDecision{}, err
+	}
+	resp, err := conflictHookClient.Post(conflictHookURL, "application/json", bytes.NewReader(data))
+	if err != nil {
+		return shared.ConflictDecision{}, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return shared.ConflictDecision{}, fmt.Errorf("hook returned %s", resp.Status)
+	}
+	var decision shared.ConflictDecision
+	if err := json.NewDecoder(resp.Body).Decode(&decision); err != nil {
+		return shared.ConflictDecision{}, fmt.Errorf("invalid hook response: %v", err)
+	}
+	switch decision.Resolution {
+	case shared.ResolvedLocal, shared.ResolvedMaster, shared.ResolvedMerged:
+		return decision, nil
+	}
+	return shared.ConflictDecision{}, fmt.Errorf("unknown resolution %q", decision.Resolution)
+}
+
+// handleConflicts serves GET /api/conflicts, the recent conflicts for
+// review, optionally filtered by node and table.
+func handleConflicts(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(conflicts.list(r.URL.Query().Get("node"), r.URL.Query().Get("table")))
+}
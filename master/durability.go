@@ -0,0 +1,103 @@
+package main
+
+import (
+	"distributed-db/shared"
+	"fmt"
+	"time"
+)
+
+type durabilityPolicy struct {
+	Mode string
+	// SemiSyncAcks is how many slaves must confirm receipt in semi-sync mode.
+	SemiSyncAcks int
+	// SyncQuorum makes sync mode wait for a majority of connected slaves
+	// instead of all of them.
+	SyncQuorum bool
+	// Timeout bounds the wait; after it the write is reported as async.
+	Timeout time.Duration
+}
+
+var durability = durabilityPolicy{
+	Mode:         shared.DurabilityAsync,
+	SemiSyncAcks: 1,
+	Timeout:      2 * time.Second,
+}
+
+func validDurability(mode string) bool {
+	switch mode {
+	case shared.DurabilityAsync, shared.DurabilitySemiSync, shared.DurabilitySync:
+		return true
+	}
+	return false
+}
+
+// awaitDurability waits until the write at position meets the durability the
+// request asked for (or the server default) and records the outcome in resp.
+// If the slaves do not confirm in time the write stays committed on the
+// master and the response reports it as degraded to async.
+func awaitDurability(req shared.DBRequest, position int64, resp *shared.DBResponse) {
+	mode := durability.Mode
+	if req.Durability != "" {
+		mode = req.Durability
+	}
+	resp.Durability = shared.DurabilityAsync
+	if mode == shared.DurabilityAsync || position == 0 {
+		return
+	}
+	if !validDurability(mode) {
+		resp.Degraded = true
+		resp.Message += fmt.Sprintf(" (unknown durability %q, acknowledged as async)", mode)
+		return
+	}
+
+	applied := mode == shared.DurabilitySync
+	deadline := time.NewTimer(durability.Timeout)
+	defer deadline.Stop()
+	var connected, required int
+	for {
+		changed := slaves.Changed()
+		var acked int
+		acked, connected = slaves.Acked(position, applied)
+		required = durability.SemiSyncAcks
+		if req.MinAcks > 0 {
+			required = req.MinAcks
+		}
+		if applied {
+			required = connected
+			if durability.SyncQuorum {
+				required = connected/2 + 1
+			}
+			if required == 0 {
+				required = 1
+			}
+		}
+		resp.Acks = acked
+		if acked >= required {
+			resp.Durability = mode
+			return
+		}
+		// Too few slaves are connected to ever ack in time; waiting would
+		// only delay every write by the full timeout.
+		if connected < required {
+			break
+		}
+
+		select {
+		case <-changed:
+		case <-deadline.C:
+			resp.Degraded = true
+			resp.Message += fmt.Sprintf(" (%s timed out after %s with %d of %d acks, acknowledged as async)",
+				mode, durability.Timeout, acked, required)
+			logEvent("REPLICATION", "Durability degraded to async", map[string]interface{}{
+				"mode":     mode,
+				"position": position,
+				"acks":     acked,
+				"required": required,
+			})
+			return
+		}
+	}
+
+	resp.Degraded = true
+	resp.Message += fmt.Sprintf(" (%s requested but %d slaves are connected and %d must ack, acknowledged as async)", mode, connected, required)
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"distributed-db/shared"
+	"fmt"
+)
+
+// readinessChecks decide whether the master should receive traffic: MySQL
+// must answer, every committed write must be in the replication log and
+// writes must be able to reach the configured durability.
+func readinessChecks(db *shared.DBHandler) func() []shared.HealthCheck {
+	return func() []shared.HealthCheck {
+		checks := []shared.HealthCheck{
+			shared.ShutdownCheck(&drain),
+			{Name: "mysql", Check: db.Ping},
+			{Name: "replication_log", Check: replLog.Flush},
+		}
+		if raftNode != nil {
+			return append(checks, shared.RaftLeaderCheck(raftNode))
+		}
+		return append(checks, shared.HealthCheck{Name: "durability", Check: checkDurability})
+	}
+}
+
+// checkDurability fails when too few slaves are connected for writes to
+// meet the default durability without degrading to async. Async writes need
+// no slave, so it always passes for them.
+func checkDurability() error {
+	_, connected := slaves.Acked(0, false)
+	required := 0
+	switch durability.Mode {
+	case shared.DurabilitySemiSync:
+		required = durability.SemiSyncAcks
+	case shared.DurabilitySync:
+		required = 1
+	}
+	if connected < required {
+		return fmt.Errorf("%d of %d slaves required for %s writes connected", connected, required, durability.Mode)
+	}
+	return nil
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"distributed-db/shared"
+	"sync"
+	"time"
+)
+
+type lagThresholds struct {
+	Ops     int64
+	Seconds float64
+}
+
+var (
+	lagWarn = lagThresholds{Ops: 1000, Seconds: 30}
+
+	laggingMu sync.Mutex
+	lagging   = make(map[string]bool)
+)
+
+// computeLag reports how far each slave is behind the master. Lag in seconds
+// is the age of the oldest entry the slave has not applied yet, so a slave
+// that is caught up has zero lag however long ago it last received a write.
+func computeLag() []shared.SlaveLag {
+	masterPos := replLog.LastPosition()
+	now := time.Now()
+
+	var lags []shared.SlaveLag
+	for _, info := range slaves.Snapshot() {
+		lag := shared.SlaveLag{
+			NodeID:         info.NodeID,
+			State:          info.State,
+			Position:       info.Position,
+			MasterPosition: masterPos,
+			AckedAt:        info.PositionAt,
+		}
+		if masterPos > info.Position {
+			lag.LagOps = masterPos - info.Position
+			if next, ok := replLog.Entry(info.Position + 1); ok {
+				lag.LagSeconds = now.Sub(time.UnixMilli(next.Timestamp)).Seconds()
+			}
+		}
+		lag.Lagging = (lagWarn.Ops > 0 && lag.LagOps > lagWarn.Ops) ||
+			(lagWarn.Seconds > 0 && lag.LagSeconds > lagWarn.Seconds)
+		lags = append(lags, lag)
+	}
+	return lags
+}
+
+// startLagMonitor logs a warning when a slave crosses the lag threshold and
+// again when it catches back up.
+func startLagMonitor() {
+	ticker := time.NewTicker(shared.HeartbeatInterval)
+	go func() {
+		for range ticker.C {
+			checkLag()
+		}
+	}()
+}
+
+func checkLag() {
+	laggingMu.Lock()
+	defer laggingMu.Unlock()
+
+	for _, lag := range computeLag() {
+		was := lagging[lag.NodeID]
+		switch {
+		case lag.Lagging && !was:
+			logEvent("WARNING", "Slave replication lag above threshold", lag)
+		case !lag.Lagging && was:
+			logEvent("REPLICATION", "Slave replication lag back within threshold", lag)
+		}
+		lagging[lag.NodeID] = lag.Lagging
+	}
+}
@@ -2,17 +2,83 @@ package main
 
 import (
 	"distributed-db/shared"
+	"flag"
 	"log"
 )
 
 func main() {
+	dbConfig := shared.NewDBConfig("Kaido440", "5277859MoKaido!", "127.0.0.1", "3307")
+	dbConfig.RegisterFlags(flag.CommandLine)
+	flag.StringVar(&masterNodeID, "node-id", masterNodeID, "node ID recorded in log entries")
+	logOptions.RegisterFlags(flag.CommandLine)
+	raftID := flag.String("raft-id", "", "this node's ID in the raft group (defaults to -node-id)")
+	raftPeers := flag.String("raft-peers", "", "comma separated id=host:port HTTP addresses of all raft members, including this node; empty disables raft")
+	raftDir := flag.String("raft-dir", "raft", "directory for persisted raft state")
+	flag.StringVar(&durability.Mode, "durability", durability.Mode, "default write durability: async, semi-sync or sync")
+	flag.IntVar(&durability.SemiSyncAcks, "semi-sync-acks", durability.SemiSyncAcks, "slaves that must receive a write in semi-sync mode")
+	flag.BoolVar(&durability.SyncQuorum, "sync-quorum", false, "in sync mode wait for a majority of slaves instead of all")
+	flag.DurationVar(&durability.Timeout, "durability-timeout", durability.Timeout, "how long to wait for slaves before degrading a write to async")
+	traceExport := flag.String("trace-export", "", "export spans as OTLP/JSON to this file or http(s) collector URL; empty disables tracing export")
+	flag.DurationVar(&slowQueryThreshold, "slow-query-threshold", slowQueryThreshold, "log statements slower than this to the slow query log (0 disables)")
+	flag.StringVar(&shardMapPath, "shard-map", shardMapPath, "file holding the shard groups and sharded tables")
+	flag.StringVar(&txnLogPath, "txn-log", txnLogPath, "coordinator log of distributed transactions")
+	flag.DurationVar(&queryTimeout, "query-timeout", queryTimeout, "default limit on a query's run time; requests may set timeout_ms (0 disables)")
+	flag.DurationVar(&shutdownTimeout, "shutdown-timeout", shutdownTimeout, "how long to drain queries and slave connections on SIGINT/SIGTERM")
+	flag.Int64Var(&lagWarn.Ops, "lag-warn-ops", lagWarn.Ops, "warn when a slave is more than this many entries behind (0 disables)")
+	flag.Float64Var(&lagWarn.Seconds, "lag-warn-seconds", lagWarn.Seconds, "warn when a slave is more than this many seconds behind (0 disables)")
+	flag.StringVar(&readPolicy, "read-balancer", readPolicy, "how reads are spread over slaves: round-robin, least-outstanding, latency-weighted or consistent-hash")
+	flag.Int64Var(&readMaxLag.Ops, "read-max-lag-ops", 0, "leave slaves more than this many entries behind out of read balancing (0 disables)")
+	flag.Float64Var(&readMaxLag.Seconds, "read-max-lag-seconds", 0, "leave slaves more than this many seconds behind out of read balancing (0 disables)")
+	flag.BoolVar(&readProxy, "read-proxy", false, "send SELECTs arriving over HTTP to a slave; requests may set prefer=master or prefer=slave")
+	flag.StringVar(&conflictPolicy, "conflict-policy", conflictPolicy, "how conflicting rows from slaves partitioned in multi-writer mode are settled: lww, master-wins or hook")
+	flag.StringVar(&conflictHookURL, "conflict-hook", "", "URL the hook policy posts each conflict to")
+	flag.StringVar(&conflictLogPath, "conflict-log", conflictLogPath, "file every write conflict is appended to")
+	flag.Parse()
+
+	if !validDurability(durability.Mode) {
+		log.Fatalf("Invalid -durability %q", durability.Mode)
+	}
+
+	if !shared.ValidConflictPolicy(conflictPolicy) {
+		log.Fatalf("Invalid -conflict-policy %q", conflictPolicy)
+	}
+
+	if _, err := shared.ParseLogLevel(logOptions.Level); err != nil {
+		log.Fatalf("Invalid -log-level: %v", err)
+	}
+
+	if *raftPeers != "" {
+		if *raftID == "" {
+			*raftID = masterNodeID
+		}
+		peers, err := shared.ParseRaftPeers(*raftPeers)
+		if err != nil {
+			log.Fatalf("Invalid -raft-peers: %v", err)
+		}
+		raftOpts = &raftOptions{ID: *raftID, Peers: peers, Dir: *raftDir}
+	}
+
+	if *traceExport != "" {
+		if err := setupTracing(*traceExport); err != nil {
+			log.Fatalf("Failed to set up tracing: %v", err)
+		}
+	}
+
 	log.Printf("Initializing database connection...")
-	config := shared.NewDBConfig("Kaido440", "5277859MoKaido!", "127.0.0.1", "3307")
-	dbHandler, err := shared.NewDBHandler(config)
+	dbHandler, err := shared.NewDBHandler(dbConfig)
 	if err != nil {
 		log.Fatalf("Error initializing database: %v", err)
 	}
 	log.Printf("Database connection initialized successfully")
 
 	StartWebServer(dbHandler)
+
+	if tracer != nil {
+		if err := tracer.Close(); err != nil {
+			log.Printf("Failed to flush traces: %v", err)
+		}
+	}
+	if err := dbHandler.Close(); err != nil {
+		log.Printf("Failed to close database: %v", err)
+	}
 }
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"distributed-db/shared"
+)
+
+var heartbeatFailures = shared.DefaultMetrics.Counter("ddb_heartbeat_failures_total",
+	"Slaves marked suspect or dead by the failure detector.", "node_id", "state")
+
+func registerMetrics(db *shared.DBHandler) {
+	shared.RegisterDBMetrics(db)
+
+	shared.DefaultMetrics.GaugeFunc("ddb_slaves", "Registered slaves by connection state.",
+		[]string{"state"}, func() []shared.MetricSample {
+			counts := map[string]float64{
+				shared.SlaveConnected:    0,
+				shared.SlaveSuspect:      0,
+				shared.SlaveDead:         0,
+				shared.SlaveDisconnected: 0,
+			}
+			for _, info := range slaves.Snapshot() {
+				counts[info.State]++
+			}
+			var samples []shared.MetricSample
+			for state, n := range counts {
+				samples = append(samples, shared.MetricSample{Labels: []string{state}, Value: n})
+			}
+			return samples
+		})
+
+	shared.DefaultMetrics.GaugeFunc("ddb_replication_position", "Last position in this node's replication log.",
+		nil, func() []shared.MetricSample {
+			return []shared.MetricSample{{Value: float64(replLog.LastPosition())}}
+		})
+
+	shared.DefaultMetrics.GaugeFunc("ddb_replication_lag_ops", "Replication entries each slave has not applied yet.",
+		[]string{"node_id"}, func() []shared.MetricSample {
+			var samples []shared.MetricSample
+			for _, lag := range computeLag() {
+				samples = append(samples, shared.MetricSample{Labels: []string{lag.NodeID}, Value: float64(lag.LagOps)})
+			}
+			return samples
+		})
+
+	shared.DefaultMetrics.GaugeFunc("ddb_replication_lag_seconds", "Age of the oldest entry each slave has not applied yet.",
+		[]string{"node_id"}, func() []shared.MetricSample {
+			var samples []shared.MetricSample
+			for _, lag := range computeLag() {
+				samples = append(samples, shared.MetricSample{Labels: []string{lag.NodeID}, Value: lag.LagSeconds})
+			}
+			return samples
+		})
+}
@@ -0,0 +1,35 @@
+package main
+
+import (
+	"distributed-db/shared"
+	"time"
+)
+
+// queryTimeout bounds statements whose request does not set timeout_ms.
+var queryTimeout = 30 * time.Second
+
+// cancelQuery stops the statement running for requestID, whether it came in
+// over HTTP or from a slave, and whether it runs here or on another shard
+// group, or was proxied to a slave. A SELECT scattered across shards may be
+// running in both places.
+func cancelQuery(db *shared.DBHandler, requestID string) error {
+	err := db.CancelQuery(requestID)
+	if err == shared.ErrQueryNotRunning {
+		err = cancelProxied(requestID)
+	}
+	if remoteErr := cancelRemote(requestID); remoteErr != shared.ErrQueryNotRunning && (err == shared.ErrQueryNotRunning || remoteErr != nil) {
+		err = remoteErr
+	}
+	if err == nil {
+		logEvent("QUERY", "Cancelled query", map[string]string{"request_id": requestID})
+	}
+	return err
+}
+
+// handleCancel answers a slave's cancel message.
+func handleCancel(db *shared.DBHandler, req shared.DBRequest) shared.DBResponse {
+	if err := cancelQuery(db, req.RequestID); err != nil {
+		return shared.DBResponse{Status: "error", Message: err.Error(), RequestID: req.RequestID}
+	}
+	return shared.DBResponse{Status: "ok", Message: "Query cancelled", RequestID: req.RequestID}
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"distributed-db/shared"
+	"time"
+)
+
+var (
+	profiler           *shared.QueryProfiler
+	slowQueryThreshold = 200 * time.Millisecond
+)
+
+const slowQueryLogPath = "master_slow_queries.jsonl"
+
+func setupProfiler(db *shared.DBHandler) error {
+	var err error
+	profiler, err = shared.NewQueryProfiler(slowQueryThreshold, masterNodeID, slowQueryLogPath, logOptions)
+	if err != nil {
+		return err
+	}
+	profiler.Explain = db.EstimateRowsExamined
+	return nil
+}
+
+// queryTimer times one statement sent to MySQL, as a child span of the
+// request and as a sample for the query statistics.
+type queryTimer struct {
+	span   *shared.Span
+	origin string
+	query  string
+	start  time.Time
+}
+
+func startQuery(parent *shared.Span, origin, query string) *queryTimer {
+	span := shared.StartSpan("mysql.query", shared.SpanClient, parent.Context())
+	span.SetAttribute("db.system", "mysql")
+	span.SetAttribute("db.statement", query)
+	return &queryTimer{span: span, origin: origin, query: query, start: time.Now()}
+}
+
+func (t *queryTimer) Done(rowsReturned, rowsAffected int64, err error) {
+	t.span.Finish(err)
+	profiler.Record(shared.QueryRecord{
+		Query:        t.query,
+		Origin:       t.origin,
+		Start:        t.start,
+		Duration:     time.Since(t.start),
+		RowsReturned: rowsReturned,
+		RowsAffected: rowsAffected,
+		Err:          err,
+		TraceID:      t.span.TraceID,
+	})
+}
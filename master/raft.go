@@ -0,0 +1,100 @@
+package main
+
+import (
+	"context"
+	"distributed-db/shared"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+type raftOptions struct {
+	ID    string
+	Peers map[string]string
+	Dir   string
+}
+
+var (
+	raftOpts *raftOptions
+	raftNode *shared.RaftNode
+)
+
+// startRaft joins the Raft group when one is configured. From then on the
+// group decides whether this process is the master, and every write is
+// committed through the Raft log before it is applied.
+func startRaft(db *shared.DBHandler, mux *http.ServeMux) error {
+	if raftOpts == nil {
+		return nil
+	}
+
+	applied, err := db.RaftAppliedIndex(context.Background(), raftOpts.ID)
+	if err != nil {
+		return err
+	}
+	node, err := shared.NewRaftNode(shared.RaftConfig{
+		ID:        raftOpts.ID,
+		Peers:     raftOpts.Peers,
+		Transport: shared.NewHTTPRaftTransport(time.Second, validToken),
+		StateDir:  raftOpts.Dir,
+		Applied:   applied,
+		Apply: func(entry shared.RaftEntry) (interface{}, error) {
+			writeMu.Lock()
+			defer writeMu.Unlock()
+
+			w := shared.DecodeRaftWrite(entry.Data)
+			ctx := shared.WithRaftIndex(context.Background(), raftOpts.ID, entry.Index)
+			affected, changes, captured := w.Affected, w.Changes, w.Captured
+			var err error
+			if captured {
+				err = db.ApplyRowChanges(ctx, changes)
+			} else {
+				affected, changes, captured, err = db.ExecCapture(ctx, w.Query)
+			}
+			if err != nil {
+				return nil, err
+			}
+			position, err := recordWriteLocked(w.Query, changes, captured)
+			if err != nil {
+				return nil, err
+			}
+			return writeResult{Affected: affected, Position: position}, nil
+		},
+		OnLeaderChange: func(leaderID string) {
+			logEvent("RAFT", "Leader changed", map[string]string{
+				"leader": leaderID,
+				"self":   raftOpts.ID,
+			})
+		},
+	})
+	if err != nil {
+		return err
+	}
+	raftNode = node
+	raftNode.RegisterHTTP(mux, validToken)
+	logEvent("RAFT", "Joined raft group", map[string]interface{}{
+		"id":    raftOpts.ID,
+		"peers": raftOpts.Peers,
+	})
+	return nil
+}
+
+// isLeader reports whether this process currently acts as the master.
+// Without Raft the master binary always leads.
+func isLeader() bool {
+	return raftNode == nil || raftNode.IsLeader()
+}
+
+// proposeWrite captures the rows query changes and proposes them, so every
+// member writes the rows this leader computed.
+func proposeWrite(ctx context.Context, db *shared.DBHandler, query string) (writeResult, error) {
+	value, err := shared.ProposeRaftWrite(ctx, raftNode, db, query)
+	if err == shared.ErrNotLeader {
+		leader, addr := raftNode.Leader()
+		return writeResult{}, fmt.Errorf("this node is not the master; current leader is %q at %s", leader, addr)
+	}
+	if err != nil {
+		return writeResult{}, err
+	}
+	result, _ := value.(writeResult)
+	return result, nil
+}
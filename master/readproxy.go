@@ -0,0 +1,173 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"distributed-db/shared"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+var (
+	// readProxy sends SELECTs arriving over HTTP to a slave picked by the
+	// read balancer. Requests can override it with prefer.
+	readProxy bool
+
+	proxyClient = &http.Client{}
+
+	// proxiedReads maps the request IDs of reads running on slaves to the
+	// cancel of their forwarded request, which ends the slave's statement.
+	proxiedMu    sync.Mutex
+	proxiedReads = make(map[string]context.CancelFunc)
+)
+
+// wantsProxy reports whether req should be read from a slave, taking its
+// prefer hint over the readProxy setting.
+func wantsProxy(req shared.DBRequest) bool {
+	if shared.StatementKind(req.Query) != "SELECT" {
+		return false
+	}
+	switch req.Prefer {
+	case shared.PreferMaster:
+		return false
+	case shared.PreferSlave:
+	default:
+		if !readProxy {
+			return false
+		}
+	}
+	// Sharded tables are read through the shard router, which knows which
+	// groups hold the rows.
+	if shardMap != nil {
+		if plan, err := shared.PlanShardedStatement(shardMap, req.Query); err != nil || plan != nil {
+			return false
+		}
+	}
+	return true
+}
+
+// proxyRead runs a SELECT on a slave chosen by the read balancer. It
+// reports false when no slave could answer, leaving the read to the master.
+// SQL errors from the slave are returned like any other result.
+func proxyRead(req shared.DBRequest) (shared.DBResponse, bool) {
+	refreshReadBackends()
+	backend, done, err := readBalancer.Pick(req.Query)
+	if err != nil {
+		logEvent("PROXY", "No slave to read from, executing on master", map[string]string{"query": req.Query})
+		return shared.DBResponse{}, false
+	}
+	if req.RequestID == "" {
+		req.RequestID = shared.NewRequestID()
+	}
+
+	span := shared.StartSpan("master.proxy", shared.SpanClient, req.SpanContext())
+	span.SetAttribute("db.statement", req.Query)
+	span.SetAttribute("peer.node_id", backend.ID)
+	resp, err := forwardRead(span, backend, req)
+	done(err)
+	span.FinishResponse(resp, err)
+	if err != nil {
+		logSpanEvent(span, "WARNING", "Proxied read failed, executing on master", map[string]string{
+			"slave": backend.ID,
+			"error": err.Error(),
+		})
+		return shared.DBResponse{}, false
+	}
+	logSpanEvent(span, "PROXY", "Read served by slave", map[string]string{
+		"slave":  backend.ID,
+		"status": resp.Status,
+	})
+	resp.Replica = backend.ID
+	resp.TraceID = span.TraceID
+	resp.RequestID = req.RequestID
+	return resp, true
+}
+
+func forwardRead(span *shared.Span, backend shared.Backend, req shared.DBRequest) (shared.DBResponse, error) {
+	timeout := req.Timeout(queryTimeout)
+	var ctx context.Context
+	var cancel context.CancelFunc
+	if timeout > 0 {
+		ctx, cancel = context.WithTimeout(context.Background(), timeout+shardResponseMargin)
+	} else {
+		ctx, cancel = context.WithCancel(context.Background())
+	}
+	defer cancel()
+	trackProxied(req.RequestID, cancel)
+	defer untrackProxied(req.RequestID)
+
+	body, err := json.Marshal(shared.DBRequest{
+		Query:     req.Query,
+		Token:     validToken,
+		FromSlave: "master",
+		IsSelect:  true,
+		Role:      shared.RoleProxy,
+		RequestID: req.RequestID,
+		TimeoutMs: timeout.Milliseconds(),
+	})
+	if err != nil {
+		return shared.DBResponse{}, fmt.Errorf("failed to marshal request: %v", err)
+	}
+	httpReq, err := http.NewRequestWithContext(ctx, http.MethodPost, "http://"+backend.Addr+"/api/query", bytes.NewReader(body))
+	if err != nil {
+		return shared.DBResponse{}, err
+	}
+	httpReq.Header.Set("Content-Type", "application/json")
+	httpReq.Header.Set(shared.TraceparentHeader, span.Context().Traceparent())
+
+	httpResp, err := proxyClient.Do(httpReq)
+	if err != nil {
+		// A timed out or cancelled read is answered, not retried on the
+		// master.
+		switch ctx.Err() {
+		case context.DeadlineExceeded:
+			err = shared.ErrQueryTimedOut
+		case context.Canceled:
+			err = shared.ErrQueryCancelled
+		default:
+			return shared.DBResponse{}, err
+		}
+		return shared.DBResponse{Status: "error", Message: fmt.Sprintf("%v (request %s)", err, req.RequestID)}, nil
+	}
+	defer httpResp.Body.Close()
+	if httpResp.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(io.LimitReader(httpResp.Body, 1024))
+		return shared.DBResponse{}, fmt.Errorf("slave %s returned %s: %s", backend.ID, httpResp.Status, strings.TrimSpace(string(msg)))
+	}
+	var resp shared.DBResponse
+	if err := json.NewDecoder(httpResp.Body).Decode(&resp); err != nil {
+		return shared.DBResponse{}, fmt.Errorf("invalid response from slave %s: %v", backend.ID, err)
+	}
+	return resp, nil
+}
+
+func trackProxied(requestID string, cancel context.CancelFunc) {
+	proxiedMu.Lock()
+	defer proxiedMu.Unlock()
+
+	proxiedReads[requestID] = cancel
+}
+
+func untrackProxied(requestID string) {
+	proxiedMu.Lock()
+	defer proxiedMu.Unlock()
+
+	delete(proxiedReads, requestID)
+}
+
+// cancelProxied stops a read running on a slave by dropping the request
+// forwarded to it.
+func cancelProxied(requestID string) error {
+	proxiedMu.Lock()
+	cancel, ok := proxiedReads[requestID]
+	proxiedMu.Unlock()
+	if !ok {
+		return shared.ErrQueryNotRunning
+	}
+	cancel()
+	return nil
+}
@@ -0,0 +1,592 @@
+package main
+
+import (
+	"distributed-db/shared"
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// rebalanceBatch is how many rows are read or written per statement
+	// while moving rows.
+	rebalanceBatch = 500
+	// cutoverBacklog is how many replication log entries may still be
+	// waiting when writes are blocked for the cutover.
+	cutoverBacklog   = 100
+	maxCatchUpRounds = 20
+)
+
+var (
+	rebalanceMu   sync.Mutex
+	rebalanceJobs []*rebalanceJob
+
+	// tableGates let a rebalance hold off statements on a sharded table
+	// while it switches the table's owner.
+	tableGatesMu sync.Mutex
+	tableGates   = make(map[string]*sync.RWMutex)
+)
+
+func tableGate(name string) *sync.RWMutex {
+	tableGatesMu.Lock()
+	defer tableGatesMu.Unlock()
+
+	name = strings.ToLower(name)
+	gate, ok := tableGates[name]
+	if !ok {
+		gate = &sync.RWMutex{}
+		tableGates[name] = gate
+	}
+	return gate
+}
+
+type rebalanceStatus struct {
+	ID      string   `json:"id"`
+	Table   string   `json:"table"`
+	Target  string   `json:"target"`
+	Sources []string `json:"sources"`
+	// Phase is staging, copying, catching_up, cutover, cleanup, done or
+	// failed.
+	Phase       string `json:"phase"`
+	RowsCopied  int64  `json:"rows_copied"`
+	RowsSynced  int64  `json:"rows_synced"`
+	RowsDeleted int64  `json:"rows_deleted"`
+	// Positions is how far each source's replication log has been applied.
+	Positions map[string]int64 `json:"positions"`
+	BlockedMs int64            `json:"blocked_ms,omitempty"`
+	Started   time.Time        `json:"started"`
+	Finished  *time.Time       `json:"finished,omitempty"`
+	Error     string           `json:"error,omitempty"`
+}
+
+// rebalanceJob moves rows of a sharded table to another group while the
+// table stays in use. Rows are copied into a staging table on the target,
+// kept current from the sources' replication logs, and merged into the
+// table while statements on it are briefly held off.
+type rebalanceJob struct {
+	mu     sync.Mutex
+	status rebalanceStatus
+
+	db       *shared.DBHandler
+	from, to *shared.ShardedTable
+	// table and staging are the quoted names of the table and of the
+	// table the target collects the moving rows in.
+	table   string
+	staging string
+	// where limits reads on a source to the moving keys, where SQL can
+	// express them.
+	where string
+	// keys records the moving keys copied from each source, so they can be
+	// deleted there after the cutover.
+	keys map[string]map[string]bool
+}
+
+func (j *rebalanceJob) update(fn func(s *rebalanceStatus)) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	fn(&j.status)
+}
+
+func (j *rebalanceJob) setPhase(phase string) {
+	j.update(func(s *rebalanceStatus) { s.Phase = phase })
+	logEvent("SHARD", "Rebalance phase", map[string]string{"id": j.status.ID, "table": j.status.Table, "phase": phase})
+}
+
+func (j *rebalanceJob) Status() rebalanceStatus {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	s := j.status
+	s.Positions = make(map[string]int64, len(j.status.Positions))
+	for k, v := range j.status.Positions {
+		s.Positions[k] = v
+	}
+	return s
+}
+
+// startRebalance validates req and starts moving the rows in the background.
+func startRebalance(db *shared.DBHandler, req shared.RebalanceRequest) (*rebalanceJob, error) {
+	table := shardMap.Table(req.Table)
+	if table == nil {
+		return nil, fmt.Errorf("%s is not a sharded table", req.Table)
+	}
+	if _, ok := shardMap.Group(req.Target); !ok {
+		return nil, fmt.Errorf("unknown shard group %q", req.Target)
+	}
+	to, err := table.Reassign(req)
+	if err != nil {
+		return nil, err
+	}
+
+	sources := make(map[string]bool)
+	key := shared.QuoteIdent(table.ShardKey)
+	where := ""
+	if table.Strategy == shared.ShardByRange {
+		owner, _ := table.Owner(strconv.FormatInt(*req.SplitAt, 10))
+		sources[owner] = true
+		where = fmt.Sprintf("%s >= %d", key, *req.SplitAt)
+		if upper, ok := to.RangeOf(*req.SplitAt); ok {
+			where += fmt.Sprintf(" AND %s < %d", key, upper)
+		}
+	} else {
+		for _, b := range req.Buckets {
+			if table.Buckets[b] != req.Target {
+				sources[table.Buckets[b]] = true
+			}
+		}
+	}
+
+	rebalanceMu.Lock()
+	defer rebalanceMu.Unlock()
+	if activeRebalance(table.Name()) != nil {
+		return nil, fmt.Errorf("table %s is already being rebalanced", table.Name())
+	}
+	j := &rebalanceJob{
+		status: rebalanceStatus{
+			ID:        shared.NewRequestID(),
+			Table:     table.Name(),
+			Target:    req.Target,
+			Sources:   make([]string, 0, len(sources)),
+			Phase:     "staging",
+			Positions: make(map[string]int64),
+			Started:   time.Now(),
+		},
+		db:      db,
+		from:    table,
+		to:      to,
+		table:   shared.QuoteIdent(table.DBName) + "." + shared.QuoteIdent(table.TableName),
+		staging: shared.QuoteIdent(table.DBName) + "." + shared.QuoteIdent("__ddb_rebalance_"+table.TableName),
+		where:   where,
+		keys:    make(map[string]map[string]bool),
+	}
+	for g := range sources {
+		j.status.Sources = append(j.status.Sources, g)
+		j.keys[g] = make(map[string]bool)
+	}
+	sort.Strings(j.status.Sources)
+	rebalanceJobs = append(rebalanceJobs, j)
+	go j.run()
+	return j, nil
+}
+
+// activeRebalance returns the unfinished job on table, if any. The caller
+// must hold rebalanceMu.
+func activeRebalance(table string) *rebalanceJob {
+	for _, j := range rebalanceJobs {
+		s := j.Status()
+		if strings.EqualFold(s.Table, table) && s.Finished == nil {
+			return j
+		}
+	}
+	return nil
+}
+
+func rebalancing(table string) bool {
+	rebalanceMu.Lock()
+	defer rebalanceMu.Unlock()
+
+	return activeRebalance(table) != nil
+}
+
+func (j *rebalanceJob) run() {
+	err := j.execute()
+	now := time.Now()
+	j.update(func(s *rebalanceStatus) {
+		s.Finished = &now
+		s.Phase = "done"
+		if err != nil {
+			s.Phase = "failed"
+			s.Error = err.Error()
+		}
+	})
+	s := j.Status()
+	if err != nil {
+		j.exec(s.Target, "DROP TABLE IF EXISTS "+j.staging)
+		logEvent("ERROR", "Rebalance failed", s)
+		return
+	}
+	logEvent("SHARD", "Rebalance finished", s)
+}
+
+func (j *rebalanceJob) execute() error {
+	target := j.status.Target
+	for _, query := range []string{
+		"DROP TABLE IF EXISTS " + j.staging,
+		fmt.Sprintf("CREATE TABLE %s LIKE %s", j.staging, j.table),
+	} {
+		if err := j.exec(target, query); err != nil {
+			return err
+		}
+	}
+
+	// Positions are taken before copying, so every write the copy may have
+	// missed is replayed from the log.
+	positions := make(map[string]int64)
+	for _, src := range j.status.Sources {
+		_, last, err := j.fetchLog(src, math.MaxInt64)
+		if err != nil {
+			return err
+		}
+		positions[src] = last
+	}
+
+	j.setPhase("copying")
+	for _, src := range j.status.Sources {
+		if err := j.copyRows(src); err != nil {
+			return err
+		}
+	}
+
+	j.setPhase("catching_up")
+	for round := 0; round < maxCatchUpRounds; round++ {
+		n, err := j.catchUp(positions)
+		if err != nil {
+			return err
+		}
+		if n <= cutoverBacklog {
+			break
+		}
+	}
+
+	j.setPhase("cutover")
+	gate := tableGate(j.from.Name())
+	gate.Lock()
+	blocked := time.Now()
+	err := j.cutover(positions)
+	gate.Unlock()
+	j.update(func(s *rebalanceStatus) { s.BlockedMs = time.Since(blocked).Milliseconds() })
+	if err != nil {
+		return err
+	}
+
+	j.setPhase("cleanup")
+	return j.exec(target, "DROP TABLE IF EXISTS "+j.staging)
+}
+
+// cutover applies the last logged writes, moves the staged rows into the
+// table on the target, switches the shard map and removes the rows from the
+// sources. The map is saved before anything is deleted, so a failure never
+// leaves rows only on a group the map does not route them to. The caller
+// holds the table's gate.
+func (j *rebalanceJob) cutover(positions map[string]int64) error {
+	if _, err := j.catchUp(positions); err != nil {
+		return err
+	}
+	target := j.status.Target
+	if err := j.exec(target, fmt.Sprintf("INSERT INTO %s SELECT * FROM %s", j.table, j.staging)); err != nil {
+		return err
+	}
+	if err := shardMap.PutTable(j.to); err != nil {
+		// Undo the merge so no rows are left on two groups.
+		if undo := j.deleteMoving(target); undo != nil {
+			return fmt.Errorf("failed to save shard map: %v; rows on %s could not be removed again: %v", err, target, undo)
+		}
+		return fmt.Errorf("failed to save shard map: %v", err)
+	}
+
+	// The rows now live on the target; copies left on a source are stale
+	// and only reported.
+	var failed []string
+	for _, src := range j.status.Sources {
+		if err := j.deleteMoving(src); err != nil {
+			failed = append(failed, fmt.Sprintf("%s: %v", src, err))
+		}
+	}
+	if len(failed) > 0 {
+		return fmt.Errorf("shard map switched to %s, but moved rows remain on %s", target, strings.Join(failed, "; "))
+	}
+	return nil
+}
+
+// moving reports whether the row with key moves from group src.
+func (j *rebalanceJob) moving(src, key string) bool {
+	from, err := j.from.Owner(key)
+	if err != nil || from != src {
+		return false
+	}
+	to, err := j.to.Owner(key)
+	return err == nil && to == j.status.Target
+}
+
+func (j *rebalanceJob) exec(group, query string) error {
+	resp := runOnGroup(j.db, group, shared.DBRequest{Query: query, RequestID: shared.NewRequestID()})
+	if resp.Status != "ok" {
+		return fmt.Errorf("shard group %s: %s", group, resp.Message)
+	}
+	return nil
+}
+
+func (j *rebalanceJob) query(group, query string) ([]string, [][]interface{}, error) {
+	resp := runOnGroup(j.db, group, shared.DBRequest{Query: query, RequestID: shared.NewRequestID()})
+	if resp.Status != "ok" {
+		return nil, nil, fmt.Errorf("shard group %s: %s", group, resp.Message)
+	}
+	return resp.Header, resp.Rows, nil
+}
+
+// copyRows copies the moving rows of src into the staging table, reading
+// them in shard key order. Rows sharing a key are read together, so paging
+// by key works when the key is not unique.
+func (j *rebalanceJob) copyRows(src string) error {
+	key := shared.QuoteIdent(j.from.ShardKey)
+	base := key + " IS NOT NULL"
+	if j.where != "" {
+		base += " AND " + j.where
+	}
+
+	cond := base
+	for {
+		header, rows, err := j.query(src, fmt.Sprintf("SELECT * FROM %s WHERE %s ORDER BY %s LIMIT %d", j.table, cond, key, rebalanceBatch))
+		if err != nil {
+			return err
+		}
+		if len(rows) == 0 {
+			return nil
+		}
+		col := columnIndex(header, j.from.ShardKey)
+		if col < 0 {
+			return fmt.Errorf("shard group %s returned no %s column", src, j.from.ShardKey)
+		}
+		last := rowKey(rows[len(rows)-1][col])
+		full := len(rows) == rebalanceBatch
+		if full {
+			for len(rows) > 0 && rowKey(rows[len(rows)-1][col]) == last {
+				rows = rows[:len(rows)-1]
+			}
+			_, same, err := j.query(src, fmt.Sprintf("SELECT * FROM %s WHERE %s = %s", j.table, key, shared.SQLValue(last)))
+			if err != nil {
+				return err
+			}
+			rows = append(rows, same...)
+		}
+
+		n, err := j.stage(src, header, col, rows)
+		if err != nil {
+			return err
+		}
+		j.update(func(s *rebalanceStatus) { s.RowsCopied += n })
+		if !full {
+			return nil
+		}
+		cond = fmt.Sprintf("%s AND %s > %s", base, key, shared.SQLValue(last))
+	}
+}
+
+// stage inserts the moving ones of rows into the staging table.
+func (j *rebalanceJob) stage(src string, header []string, col int, rows [][]interface{}) (int64, error) {
+	cols := make([]string, len(header))
+	for i, h := range header {
+		cols[i] = shared.QuoteIdent(h)
+	}
+	var tuples []string
+	for _, row := range rows {
+		k := rowKey(row[col])
+		if !j.moving(src, k) {
+			continue
+		}
+		j.keys[src][k] = true
+		values := make([]string, len(row))
+		for i, v := range row {
+			values[i] = shared.SQLValue(v)
+		}
+		tuples = append(tuples, "("+strings.Join(values, ", ")+")")
+	}
+	for start := 0; start < len(tuples); start += rebalanceBatch {
+		end := min(start+rebalanceBatch, len(tuples))
+		query := fmt.Sprintf("INSERT INTO %s (%s) VALUES %s", j.staging, strings.Join(cols, ", "), strings.Join(tuples[start:end], ", "))
+		if err := j.exec(j.status.Target, query); err != nil {
+			return 0, err
+		}
+	}
+	return int64(len(tuples)), nil
+}
+
+// catchUp reads each source's replication log from positions onward and
+// copies the current version of every moving row a logged write touched,
+// taken from the rows the write changed or, when they were not captured,
+// from the statement.
+// It returns the number of entries read.
+func (j *rebalanceJob) catchUp(positions map[string]int64) (int, error) {
+	total := 0
+	for _, src := range j.status.Sources {
+		for {
+			entries, last, err := j.fetchLog(src, positions[src])
+			if err != nil {
+				return total, err
+			}
+			keys := make(map[string]bool)
+			for _, e := range entries {
+				touched := shared.ChangeKeys(j.from, e.Changes)
+				if !e.Captured {
+					var err error
+					if touched, _, err = shared.StatementKeys(j.from, e.Query); err != nil {
+						return total, fmt.Errorf("position %d on %s: %v", e.Position, src, err)
+					}
+				}
+				for _, k := range touched {
+					if j.moving(src, k) {
+						keys[k] = true
+					}
+				}
+			}
+			if err := j.resync(src, keys); err != nil {
+				return total, err
+			}
+			if len(entries) > 0 {
+				positions[src] = entries[len(entries)-1].Position
+			}
+			total += len(entries)
+			pos := positions[src]
+			j.update(func(s *rebalanceStatus) { s.Positions[src] = pos })
+			if len(entries) == 0 || pos >= last {
+				break
+			}
+		}
+	}
+	return total, nil
+}
+
+// resync replaces the staged rows with keys by their current version on
+// src.
+func (j *rebalanceJob) resync(src string, keys map[string]bool) error {
+	list := make([]string, 0, len(keys))
+	for k := range keys {
+		list = append(list, shared.SQLValue(k))
+		j.keys[src][k] = true
+	}
+	key := shared.QuoteIdent(j.from.ShardKey)
+	for start := 0; start < len(list); start += rebalanceBatch {
+		in := strings.Join(list[start:min(start+rebalanceBatch, len(list))], ", ")
+		if err := j.exec(j.status.Target, fmt.Sprintf("DELETE FROM %s WHERE %s IN (%s)", j.staging, key, in)); err != nil {
+			return err
+		}
+		header, rows, err := j.query(src, fmt.Sprintf("SELECT * FROM %s WHERE %s IN (%s)", j.table, key, in))
+		if err != nil {
+			return err
+		}
+		if len(rows) == 0 {
+			continue
+		}
+		n, err := j.stage(src, header, columnIndex(header, j.from.ShardKey), rows)
+		if err != nil {
+			return err
+		}
+		j.update(func(s *rebalanceStatus) { s.RowsSynced += n })
+	}
+	return nil
+}
+
+// deleteMoving deletes the moving rows from the table on group.
+func (j *rebalanceJob) deleteMoving(group string) error {
+	key := shared.QuoteIdent(j.from.ShardKey)
+	if j.where != "" {
+		return j.exec(group, fmt.Sprintf("DELETE FROM %s WHERE %s", j.table, j.where))
+	}
+	var list []string
+	for src, keys := range j.keys {
+		if group != src && group != j.status.Target {
+			continue
+		}
+		for k := range keys {
+			list = append(list, shared.SQLValue(k))
+		}
+	}
+	for start := 0; start < len(list); start += rebalanceBatch {
+		end := min(start+rebalanceBatch, len(list))
+		if err := j.exec(group, fmt.Sprintf("DELETE FROM %s WHERE %s IN (%s)", j.table, key, strings.Join(list[start:end], ", "))); err != nil {
+			return err
+		}
+		if group != j.status.Target {
+			j.update(func(s *rebalanceStatus) { s.RowsDeleted += int64(end - start) })
+		}
+	}
+	return nil
+}
+
+// fetchLog returns replication log entries of group after position, and
+// the group's last position.
+func (j *rebalanceJob) fetchLog(groupID string, position int64) ([]shared.ReplicationEntry, int64, error) {
+	group, ok := shardMap.Group(groupID)
+	if !ok {
+		return nil, 0, fmt.Errorf("unknown shard group %q", groupID)
+	}
+	if group.Local() {
+		return replLog.Since(position, fetchBatchSize), replLog.LastPosition(), nil
+	}
+	resp, err := clientFor(group).Do(shared.DBRequest{
+		Type:      shared.MsgFetch,
+		Token:     validToken,
+		FromSlave: "master",
+		Position:  position,
+	}, 10*time.Second)
+	if err != nil {
+		return nil, 0, fmt.Errorf("shard group %s: %v", groupID, err)
+	}
+	if resp.Status != "ok" {
+		return nil, 0, fmt.Errorf("shard group %s: %s", groupID, resp.Message)
+	}
+	return resp.Entries, resp.Position, nil
+}
+
+func columnIndex(header []string, name string) int {
+	for i, h := range header {
+		if strings.EqualFold(h, name) {
+			return i
+		}
+	}
+	return -1
+}
+
+// rowKey gives a shard key read back from MySQL in the form Owner expects.
+func rowKey(v interface{}) string {
+	if f, ok := v.(float64); ok {
+		return strconv.FormatFloat(f, 'f', -1, 64)
+	}
+	return fmt.Sprint(v)
+}
+
+// handleRebalance serves GET /api/shards/rebalance, the progress of every
+// rebalance since startup, and POST, which starts one.
+func handleRebalance(db *shared.DBHandler) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		switch r.Method {
+		case http.MethodGet:
+			rebalanceMu.Lock()
+			jobs := append([]*rebalanceJob(nil), rebalanceJobs...)
+			rebalanceMu.Unlock()
+			statuses := make([]rebalanceStatus, len(jobs))
+			for i, j := range jobs {
+				statuses[i] = j.Status()
+			}
+			json.NewEncoder(w).Encode(statuses)
+		case http.MethodPost:
+			var req shared.RebalanceRequest
+			if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+				http.Error(w, "Invalid request", http.StatusBadRequest)
+				return
+			}
+			j, err := startRebalance(db, req)
+			if err != nil {
+				w.WriteHeader(http.StatusBadRequest)
+				json.NewEncoder(w).Encode(shared.DBResponse{Status: "error", Message: err.Error()})
+				return
+			}
+			s := j.Status()
+			logEvent("SHARD", "Rebalance started", s)
+			json.NewEncoder(w).Encode(shared.DBResponse{
+				Status:    "ok",
+				Message:   fmt.Sprintf("Moving rows of %s from %s to %s", s.Table, strings.Join(s.Sources, ", "), s.Target),
+				RequestID: s.ID,
+			})
+		default:
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		}
+	}
+}
@@ -0,0 +1,300 @@
+package main
+
+import (
+	"distributed-db/shared"
+	"fmt"
+	"net"
+	"sort"
+	"sync"
+	"time"
+)
+
+type slaveEntry struct {
+	info shared.SlaveInfo
+	conn net.Conn
+}
+
+// slaveRegistry tracks slaves by the node ID they choose themselves, so
+// several slaves behind one IP no longer overwrite each other.
+type slaveRegistry struct {
+	mu      sync.Mutex
+	slaves  map[string]*slaveEntry
+	events  []shared.SlaveEvent
+	onEvent func(shared.SlaveEvent)
+	changed chan struct{}
+}
+
+const maxSlaveEvents = 200
+
+func newSlaveRegistry() *slaveRegistry {
+	return &slaveRegistry{
+		slaves:  make(map[string]*slaveEntry),
+		changed: make(chan struct{}),
+	}
+}
+
+// Changed returns a channel that is closed the next time a slave reports a
+// new replication position.
+func (r *slaveRegistry) Changed() <-chan struct{} {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return r.changed
+}
+
+func (r *slaveRegistry) notifyLocked() {
+	close(r.changed)
+	r.changed = make(chan struct{})
+}
+
+// setPositionLocked records an applied position, which also implies the
+// slave has received everything up to it.
+func (r *slaveRegistry) setPositionLocked(entry *slaveEntry, position int64) {
+	entry.info.PositionAt = time.Now()
+	entry.info.Position = position
+	if position > entry.info.Received {
+		entry.info.Received = position
+	}
+	r.notifyLocked()
+}
+
+// Ack records that a slave has received entries up to position.
+func (r *slaveRegistry) Ack(nodeID string, received int64) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	entry, ok := r.slaves[nodeID]
+	if !ok {
+		return false
+	}
+	entry.info.LastHeartbeat = time.Now()
+	if received > entry.info.Received {
+		entry.info.Received = received
+		r.notifyLocked()
+	}
+	return true
+}
+
+// MinReceived returns the lowest position every registered slave has
+// received, or 0 when none is registered. Disconnected slaves count too,
+// since they resume from where they stopped.
+func (r *slaveRegistry) MinReceived() int64 {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	var min int64
+	first := true
+	for _, entry := range r.slaves {
+		if first || entry.info.Received < min {
+			min = entry.info.Received
+			first = false
+		}
+	}
+	return min
+}
+
+// Acked counts connected slaves that have received (or, when applied is
+// set, applied) the entry at position, along with the number of connected
+// slaves that could have.
+func (r *slaveRegistry) Acked(position int64, applied bool) (acked, connected int) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for _, entry := range r.slaves {
+		if entry.info.State != shared.SlaveConnected {
+			continue
+		}
+		connected++
+		reached := entry.info.Received
+		if applied {
+			reached = entry.info.Position
+		}
+		if reached >= position {
+			acked++
+		}
+	}
+	return acked, connected
+}
+
+// setState moves a slave to a new state and records the transition. The
+// caller must hold r.mu; listeners are invoked after it is released via the
+// returned events.
+func (r *slaveRegistry) setState(entry *slaveEntry, state, reason string) []shared.SlaveEvent {
+	if entry.info.State == state {
+		return nil
+	}
+	event := shared.SlaveEvent{
+		NodeID: entry.info.NodeID,
+		From:   entry.info.State,
+		To:     state,
+		Reason: reason,
+		Time:   time.Now(),
+	}
+	entry.info.State = state
+	r.events = append(r.events, event)
+	if len(r.events) > maxSlaveEvents {
+		r.events = r.events[len(r.events)-maxSlaveEvents:]
+	}
+	return []shared.SlaveEvent{event}
+}
+
+func (r *slaveRegistry) emit(events []shared.SlaveEvent) {
+	if r.onEvent == nil {
+		return
+	}
+	for _, event := range events {
+		r.onEvent(event)
+	}
+}
+
+// Events returns the most recent state transitions, oldest first.
+func (r *slaveRegistry) Events() []shared.SlaveEvent {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return append([]shared.SlaveEvent(nil), r.events...)
+}
+
+func (r *slaveRegistry) Register(info shared.SlaveInfo, conn net.Conn) {
+	r.mu.Lock()
+	now := time.Now()
+	info.ConnectedAt = now
+	info.LastHeartbeat = now
+	entry, ok := r.slaves[info.NodeID]
+	if ok {
+		if entry.conn != nil && entry.conn != conn {
+			entry.conn.Close()
+		}
+		info.State = entry.info.State
+	} else {
+		info.State = "new"
+	}
+	entry = &slaveEntry{info: info, conn: conn}
+	r.slaves[info.NodeID] = entry
+	events := r.setState(entry, shared.SlaveConnected, "registered")
+	r.mu.Unlock()
+
+	r.emit(events)
+}
+
+// Heartbeat records a heartbeat from a slave, reviving it if the failure
+// detector had marked it suspect or dead.
+func (r *slaveRegistry) Heartbeat(nodeID, status string, position int64) bool {
+	r.mu.Lock()
+	entry, ok := r.slaves[nodeID]
+	if !ok {
+		r.mu.Unlock()
+		return false
+	}
+	entry.info.LastHeartbeat = time.Now()
+	r.setPositionLocked(entry, position)
+	entry.info.NodeStatus = status
+	var events []shared.SlaveEvent
+	if entry.conn != nil {
+		events = r.setState(entry, shared.SlaveConnected, "heartbeat received")
+	}
+	r.mu.Unlock()
+
+	r.emit(events)
+	return true
+}
+
+// CheckLiveness marks slaves whose last heartbeat is older than suspectAfter
+// as suspect and older than deadAfter as dead.
+func (r *slaveRegistry) CheckLiveness(suspectAfter, deadAfter time.Duration) {
+	r.mu.Lock()
+	var events []shared.SlaveEvent
+	now := time.Now()
+	for _, entry := range r.slaves {
+		silence := now.Sub(entry.info.LastHeartbeat)
+		switch {
+		case silence > deadAfter && entry.info.State != shared.SlaveDead:
+			events = append(events, r.setState(entry, shared.SlaveDead,
+				fmt.Sprintf("no heartbeat for %s", silence.Round(time.Second)))...)
+		case silence > suspectAfter && entry.info.State == shared.SlaveConnected:
+			events = append(events, r.setState(entry, shared.SlaveSuspect,
+				fmt.Sprintf("no heartbeat for %s", silence.Round(time.Second)))...)
+		}
+	}
+	r.mu.Unlock()
+
+	r.emit(events)
+}
+
+// Touch records activity from a slave and, when position is non-negative,
+// its latest replication position.
+func (r *slaveRegistry) Touch(nodeID string, position int64) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	entry, ok := r.slaves[nodeID]
+	if !ok {
+		return false
+	}
+	entry.info.LastHeartbeat = time.Now()
+	if position >= 0 {
+		r.setPositionLocked(entry, position)
+	}
+	return true
+}
+
+// Disconnect marks the slave as disconnected, but only when conn is still the
+// connection the slave registered with; a reconnect may already have replaced it.
+func (r *slaveRegistry) Disconnect(nodeID string, conn net.Conn) bool {
+	r.mu.Lock()
+	entry, ok := r.slaves[nodeID]
+	if !ok || entry.conn != conn {
+		r.mu.Unlock()
+		return false
+	}
+	entry.conn = nil
+	events := r.setState(entry, shared.SlaveDisconnected, "connection closed")
+	r.mu.Unlock()
+
+	r.emit(events)
+	return true
+}
+
+func (r *slaveRegistry) Get(nodeID string) (shared.SlaveInfo, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	entry, ok := r.slaves[nodeID]
+	if !ok {
+		return shared.SlaveInfo{}, false
+	}
+	return entry.info, true
+}
+
+func (r *slaveRegistry) Snapshot() []shared.SlaveInfo {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	list := make([]shared.SlaveInfo, 0, len(r.slaves))
+	for _, entry := range r.slaves {
+		list = append(list, entry.info)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].NodeID < list[j].NodeID })
+	return list
+}
+
+// RemoveInactive drops slaves that have not been heard from within maxAge
+// and returns their node IDs.
+func (r *slaveRegistry) RemoveInactive(maxAge time.Duration) []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	var removed []string
+	now := time.Now()
+	for id, entry := range r.slaves {
+		if now.Sub(entry.info.LastHeartbeat) > maxAge {
+			if entry.conn != nil {
+				entry.conn.Close()
+			}
+			delete(r.slaves, id)
+			removed = append(removed, id)
+		}
+	}
+	sort.Strings(removed)
+	return removed
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"context"
+	"distributed-db/shared"
+	"fmt"
+	"sync"
+	"time"
+)
+
+const fetchBatchSize = 500
+
+var (
+	replLog *shared.ReplicationLog
+	writeMu sync.Mutex
+)
+
+// executeWrite runs a data-changing statement and appends it to the
+// replication log, with the rows it changed, once it has committed. Writes
+// are serialized so the log order matches the order MySQL applied them in.
+// With Raft enabled the statement is proposed instead and applied when the
+// group commits it, which ctx cannot interrupt once the entry is in the log.
+// Writes are refused while the log is missing committed writes.
+func executeWrite(ctx context.Context, db *shared.DBHandler, query string) (writeResult, error) {
+	if err := replLog.Flush(); err != nil {
+		return writeResult{}, fmt.Errorf("writes are suspended: %v", err)
+	}
+	if raftNode != nil {
+		return proposeWrite(ctx, db, query)
+	}
+
+	writeMu.Lock()
+	defer writeMu.Unlock()
+
+	affected, changes, captured, err := db.ExecCapture(ctx, query)
+	if err != nil {
+		return writeResult{}, err
+	}
+	position, err := recordWriteLocked(query, changes, captured)
+	if err != nil {
+		return writeResult{}, err
+	}
+	return writeResult{Affected: affected, Position: position}, nil
+}
+
+type writeResult struct {
+	Affected int64
+	// Position is the write's replication log position.
+	Position int64
+}
+
+// recordWriteLocked appends a write to the replication log with the rows
+// it changed, if they were captured. The write has already committed, so
+// on failure the log keeps its entry for the next append and the error
+// tells the caller it was not logged yet.
+func recordWriteLocked(query string, changes []shared.RowChange, captured bool) (int64, error) {
+	entry, err := replLog.AppendChanges(query, changes, captured)
+	if err != nil {
+		logEvent("ERROR", "Failed to append to replication log", map[string]string{
+			"query": query,
+			"error": err.Error(),
+		})
+		return 0, fmt.Errorf("write committed but is not in the replication log yet: %v", err)
+	}
+	logEvent("REPLICATION", "Appended to replication log", map[string]interface{}{
+		"position": entry.Position,
+		"query":    query,
+		"rows":     len(changes),
+		"captured": captured,
+	})
+	return entry.Position, nil
+}
+
+// handleFetch answers a request for entries after an applied position,
+// waiting up to shared.FetchWait when it is already caught up. The position
+// is recorded for node, the slave the connection belongs to, if any.
+func handleFetch(node string, req shared.DBRequest) shared.DBResponse {
+	if node != "" {
+		slaves.Touch(node, req.Position)
+		replLog.Release(slaves.MinReceived())
+	}
+
+	changed := replLog.Changed()
+	entries := replLog.Since(req.Position, fetchBatchSize)
+	if len(entries) == 0 {
+		select {
+		case <-changed:
+			entries = replLog.Since(req.Position, fetchBatchSize)
+		case <-time.After(shared.FetchWait):
+		}
+	}
+
+	return shared.DBResponse{
+		Status:   "ok",
+		Message:  fmt.Sprintf("%d entries", len(entries)),
+		Position: replLog.LastPosition(),
+		Entries:  entries,
+	}
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"distributed-db/shared"
+	"fmt"
+	"strings"
+	"sync"
+)
+
+// scatterSelect runs a SELECT on every one of groups in parallel and merges
+// their results. It fails as a whole if any group fails, since a partial
+// result would be silently wrong.
+func scatterSelect(db *shared.DBHandler, groups []string, req shared.DBRequest) shared.DBResponse {
+	plan, err := shared.PlanScatter(req.Query)
+	if err != nil {
+		return shared.DBResponse{Status: "error", Message: err.Error()}
+	}
+	req.Query = plan.ShardQuery
+
+	results := make([]shared.DBResponse, len(groups))
+	var wg sync.WaitGroup
+	for i, group := range groups {
+		wg.Add(1)
+		go func(i int, group string) {
+			defer wg.Done()
+			results[i] = runOnGroup(db, group, req)
+		}(i, group)
+	}
+	wg.Wait()
+
+	var failed []string
+	for _, r := range results {
+		if r.Status != "ok" {
+			failed = append(failed, fmt.Sprintf("%s: %s", r.Shard, r.Message))
+		}
+	}
+	if len(failed) > 0 {
+		return shared.DBResponse{Status: "error", Message: "Select failed on shard groups: " + strings.Join(failed, "; ")}
+	}
+	return plan.Merge(results)
+}
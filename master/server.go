@@ -2,16 +2,19 @@ package main
 
 import (
 	"bufio"
+	"context"
 	"distributed-db/shared"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io/ioutil"
 	"log"
 	"net"
 	"net/http"
 	"os"
+	"os/signal"
 	"strings"
-	"sync"
+	"syscall"
 	"time"
 
 	_ "github.com/go-sql-driver/mysql"
@@ -20,34 +23,49 @@ import (
 const validToken = "secret-token"
 
 var (
-	dbHandler       *shared.DBHandler
-	masterIP        string
-	connectedSlaves = make(map[string]string)
-	slavesMutex     sync.Mutex
-	logFile         *os.File
+	dbHandler    *shared.DBHandler
+	masterIP     string
+	slaves       = newSlaveRegistry()
+	logFile      *shared.RotatingFile
+	logger       *shared.Logger
+	logOptions   = shared.DefaultLogOptions()
+	masterNodeID = "master"
 )
 
+const logPath = "master_log.txt"
+
 func setupLogging() error {
 	var err error
-	logFile, err = os.OpenFile("master_log.txt", os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	logger, logFile, err = logOptions.Open(logPath, masterNodeID)
 	if err != nil {
 		return fmt.Errorf("failed to open log file: %v", err)
 	}
 
-	log.SetOutput(logFile)
-	log.SetFlags(log.Ldate | log.Ltime | log.Lmicroseconds)
+	log.SetOutput(logger.StdWriter("SYSTEM"))
+	log.SetFlags(0)
 
 	return nil
 }
 
-func logEvent(eventType, message string, data interface{}) {
-	timestamp := time.Now().Format("2006-01-02 15:04:05.000")
-	logEntry := fmt.Sprintf("[%s] [%s] %s", timestamp, eventType, message)
-	if data != nil {
-		dataJSON, _ := json.Marshal(data)
-		logEntry += fmt.Sprintf(" Data: %s", string(dataJSON))
+func eventLevel(eventType string) shared.LogLevel {
+	switch eventType {
+	case "ERROR":
+		return shared.LevelError
+	case "WARNING":
+		return shared.LevelWarn
+	case "HTTP", "FILE":
+		return shared.LevelDebug
 	}
-	log.Println(logEntry)
+	return shared.LevelInfo
+}
+
+func logEvent(eventType, message string, data interface{}) {
+	logger.Log(eventLevel(eventType), eventType, message, data)
+}
+
+// logSpanEvent logs an event that belongs to a traced request.
+func logSpanEvent(span *shared.Span, eventType, message string, data interface{}) {
+	logger.LogSpan(span.Context(), eventLevel(eventType), eventType, message, data)
 }
 
 func isMasterQuery(query string) bool {
@@ -63,7 +81,48 @@ func StartWebServer(db *shared.DBHandler) {
 
 	logEvent("SYSTEM", "Starting web server", nil)
 
+	var err error
+	replLog, err = shared.OpenReplicationLog("replication_log.jsonl")
+	if err != nil {
+		logEvent("ERROR", "Failed to open replication log", map[string]string{"error": err.Error()})
+		log.Fatalf("Failed to open replication log: %v", err)
+	}
+	defer replLog.Close()
+
+	if err := setupSharding(); err != nil {
+		logEvent("ERROR", "Failed to load shard map", map[string]string{"error": err.Error()})
+		log.Fatalf("Failed to load shard map: %v", err)
+	}
+
+	if err := setupReadBalancer(); err != nil {
+		logEvent("ERROR", "Invalid read balancer", map[string]string{"error": err.Error()})
+		log.Fatalf("Invalid read balancer: %v", err)
+	}
+
+	if err := setupTransactions(db); err != nil {
+		logEvent("ERROR", "Failed to open transaction log", map[string]string{"error": err.Error()})
+		log.Fatalf("Failed to open transaction log: %v", err)
+	}
+
+	if err := setupConflicts(); err != nil {
+		logEvent("ERROR", "Failed to open conflict log", map[string]string{"error": err.Error()})
+		log.Fatalf("Failed to open conflict log: %v", err)
+	}
+
+	if err := setupProfiler(db); err != nil {
+		logEvent("ERROR", "Failed to open slow query log", map[string]string{"error": err.Error()})
+		log.Fatalf("Failed to open slow query log: %v", err)
+	}
+	defer profiler.Close()
+
 	mux := http.NewServeMux()
+	profiler.RegisterHandlers(mux)
+	registerShardHandlers(mux, db)
+
+	if err := startRaft(db, mux); err != nil {
+		logEvent("ERROR", "Failed to start raft", map[string]string{"error": err.Error()})
+		log.Fatalf("Failed to start raft: %v", err)
+	}
 
 	webDir := "./web"
 	if _, err := os.Stat(webDir); os.IsNotExist(err) {
@@ -132,82 +191,79 @@ func StartWebServer(db *shared.DBHandler) {
 
 	mux.HandleFunc("/connect", handleConnect)
 
+	registerMetrics(db)
+	mux.Handle("/metrics", shared.MetricsHandler())
+	mux.HandleFunc("/healthz", shared.HealthHandler(masterNodeID, nil))
+	mux.HandleFunc("/readyz", shared.HealthHandler(masterNodeID, readinessChecks(db)))
+
 	mux.HandleFunc("/api/slaves", func(w http.ResponseWriter, r *http.Request) {
-		slavesMutex.Lock()
-		defer slavesMutex.Unlock()
 		w.Header().Set("Content-Type", "application/json")
-		json.NewEncoder(w).Encode(connectedSlaves)
+		json.NewEncoder(w).Encode(slaves.Snapshot())
 	})
 
-	mux.HandleFunc("/api/logs", func(w http.ResponseWriter, r *http.Request) {
-		if r.Method != http.MethodGet {
-			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
-			return
-		}
-
-		file, err := os.Open("master_log.txt")
-		if err != nil {
-			http.Error(w, "Failed to read logs", http.StatusInternalServerError)
-			return
-		}
-		defer file.Close()
-
-		var logs []map[string]interface{}
-		scanner := bufio.NewScanner(file)
-		for scanner.Scan() {
-			line := scanner.Text()
-			if strings.HasPrefix(line, "[") {
-				parts := strings.SplitN(line, "] ", 3)
-				if len(parts) >= 3 {
-					timestamp := strings.TrimPrefix(parts[0], "[")
-					typeAndMessage := strings.SplitN(parts[1], "] ", 2)
-					if len(typeAndMessage) >= 2 {
-						logType := strings.TrimPrefix(typeAndMessage[0], "[")
-						message := typeAndMessage[1]
-
-						logEntry := map[string]interface{}{
-							"timestamp": timestamp,
-							"type":      logType,
-							"message":   message,
-						}
-
-						if strings.Contains(message, "Data:") {
-							dataParts := strings.SplitN(message, "Data:", 2)
-							if len(dataParts) == 2 {
-								logEntry["message"] = strings.TrimSpace(dataParts[0])
-								var data interface{}
-								if err := json.Unmarshal([]byte(dataParts[1]), &data); err == nil {
-									logEntry["data"] = data
-								}
-							}
-						}
-
-						logs = append(logs, logEntry)
-					}
-				}
-			}
+	mux.HandleFunc("/api/replication/status", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		role := "master"
+		if !isLeader() {
+			role = "slave"
 		}
+		json.NewEncoder(w).Encode(shared.ReplicationStatus{
+			NodeID:   masterNodeID,
+			Role:     role,
+			Position: replLog.LastPosition(),
+			ReplAddr: masterIP + ":8083",
+		})
+	})
 
-		for i, j := 0, len(logs)-1; i < j; i, j = i+1, j-1 {
-			logs[i], logs[j] = logs[j], logs[i]
-		}
+	mux.HandleFunc("/api/replication/lag", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(computeLag())
+	})
 
+	mux.HandleFunc("/api/slaves/events", func(w http.ResponseWriter, r *http.Request) {
 		w.Header().Set("Content-Type", "application/json")
-		json.NewEncoder(w).Encode(logs)
+		json.NewEncoder(w).Encode(slaves.Events())
 	})
 
-	go func() {
-		listener, err := net.Listen("tcp", ":8083")
-		if err != nil {
-			log.Fatalf("Failed to start TCP server: %v", err)
+	mux.HandleFunc("/api/admin/pool", shared.PoolStatsHandler(db))
+	mux.HandleFunc("/api/balancer", handleBalancer)
+	mux.HandleFunc("/api/transactions", handleTransactions(db))
+	mux.HandleFunc("/api/queries/running", shared.RunningQueriesHandler(db))
+	mux.HandleFunc("/api/queries/cancel", shared.CancelQueryHandler(func(requestID string) error {
+		return cancelQuery(db, requestID)
+	}))
+
+	mux.HandleFunc("/api/logs", shared.LogsHandler(logPath))
+	mux.HandleFunc("/api/logs/stream", shared.LogStreamHandler(logger))
+	mux.HandleFunc("/api/cdc/stream", handleChangeStream)
+	mux.HandleFunc("/api/cdc/ws", handleChangeSocket)
+	mux.HandleFunc("/api/conflicts", handleConflicts)
+
+	slaves.onEvent = func(event shared.SlaveEvent) {
+		eventType := "SLAVE"
+		if event.To == shared.SlaveSuspect || event.To == shared.SlaveDead {
+			eventType = "ERROR"
+			heartbeatFailures.Inc(event.NodeID, event.To)
 		}
-		defer listener.Close()
+		logEvent(eventType, "Slave state changed", event)
+	}
+	startFailureDetector()
+	startLagMonitor()
+	cleanupInactiveSlaves()
 
+	listener, err := net.Listen("tcp", ":8083")
+	if err != nil {
+		log.Fatalf("Failed to start TCP server: %v", err)
+	}
+	go func() {
 		log.Printf("TCP server listening on :8083")
 
 		for {
 			conn, err := listener.Accept()
 			if err != nil {
+				if errors.Is(err, net.ErrClosed) {
+					return
+				}
 				log.Printf("Error accepting connection: %v", err)
 				continue
 			}
@@ -218,12 +274,23 @@ func StartWebServer(db *shared.DBHandler) {
 	log.Printf("Starting HTTP server on :8082")
 	server := &http.Server{
 		Addr:    ":8082",
-		Handler: corsMiddleware(mux),
+		Handler: shared.InstrumentHTTP(corsMiddleware(mux)),
 	}
+	server.RegisterOnShutdown(logger.CloseSubscribers)
+	server.RegisterOnShutdown(stopCDC)
 
-	if err := server.ListenAndServe(); err != nil {
-		log.Fatalf("Failed to start HTTP server: %v", err)
-	}
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	go func() {
+		if err := server.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			log.Fatalf("Failed to start HTTP server: %v", err)
+		}
+	}()
+
+	<-ctx.Done()
+	// A second signal kills the process instead of waiting for the drain.
+	stop()
+	shutdown(server, listener)
 }
 
 func handleQueryRequest(w http.ResponseWriter, r *http.Request, db *shared.DBHandler) {
@@ -254,11 +321,25 @@ func handleQueryRequest(w http.ResponseWriter, r *http.Request, db *shared.DBHan
 		"type":  "local",
 	})
 
+	if !req.SpanContext().Valid() {
+		sc := shared.SpanContextFromHeader(r.Header)
+		req.TraceID, req.SpanID = sc.TraceID, sc.SpanID
+	}
+
 	req.Token = "secret-token"
 	req.FromSlave = "master"
 	req.IsSelect = strings.HasPrefix(strings.ToUpper(strings.TrimSpace(req.Query)), "SELECT")
+	if prefer := r.URL.Query().Get("prefer"); prefer != "" {
+		req.Prefer = prefer
+	}
 
-	resp := HandleLocalQuery(req, db)
+	resp, proxied := shared.DBResponse{}, false
+	if wantsProxy(req) {
+		resp, proxied = proxyRead(req)
+	}
+	if !proxied {
+		resp = HandleLocalQuery(req, db)
+	}
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(resp)
 
@@ -268,25 +349,24 @@ func handleQueryRequest(w http.ResponseWriter, r *http.Request, db *shared.DBHan
 	})
 }
 
+// startFailureDetector periodically checks slave heartbeats. A slave is
+// suspect after missing three heartbeats and dead after missing six.
+func startFailureDetector() {
+	ticker := time.NewTicker(shared.HeartbeatInterval)
+	go func() {
+		for range ticker.C {
+			slaves.CheckLiveness(3*shared.HeartbeatInterval, 6*shared.HeartbeatInterval)
+		}
+	}()
+}
+
 func cleanupInactiveSlaves() {
 	ticker := time.NewTicker(30 * time.Second)
 	go func() {
 		for range ticker.C {
-			slavesMutex.Lock()
-			now := time.Now()
-			for ip, lastSeenStr := range connectedSlaves {
-				lastSeen, err := time.Parse(time.RFC3339, lastSeenStr)
-				if err != nil {
-					log.Printf("Error parsing last seen time for slave %s: %v", ip, err)
-					delete(connectedSlaves, ip)
-					continue
-				}
-				if now.Sub(lastSeen) > 2*time.Minute {
-					log.Printf("Removing inactive slave: %s (last seen: %s)", ip, lastSeenStr)
-					delete(connectedSlaves, ip)
-				}
+			for _, id := range slaves.RemoveInactive(2 * time.Minute) {
+				logEvent("SLAVE", "Removed inactive slave", map[string]string{"node_id": id})
 			}
-			slavesMutex.Unlock()
 		}
 	}()
 }
@@ -306,146 +386,281 @@ func handleSlave(conn net.Conn, db *shared.DBHandler, logger *os.File) {
 		"ip":      slaveIP,
 	})
 
-	slavesMutex.Lock()
-	connectedSlaves[slaveIP] = time.Now().Format(time.RFC3339)
-	slavesMutex.Unlock()
-
+	shared.TCPConnections.Add(1)
+	trackSlaveConn(conn)
+	nodeID := ""
 	defer func() {
+		shared.TCPConnections.Add(-1)
+		untrackSlaveConn(conn)
 		conn.Close()
-		slavesMutex.Lock()
-		delete(connectedSlaves, slaveIP)
-		slavesMutex.Unlock()
+		if nodeID != "" {
+			slaves.Disconnect(nodeID, conn)
+		}
 		logEvent("SLAVE", "Slave disconnected", map[string]string{
 			"address": slaveAddr,
 			"ip":      slaveIP,
+			"node_id": nodeID,
 		})
 	}()
 
 	scanner := bufio.NewScanner(conn)
-	for scanner.Scan() {
-		line := scanner.Text()
-		if line == "" {
-			continue
+	// Batches of partitioned writes can be far longer than a query.
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	var subscribe *shared.DBRequest
+	for subscribe == nil && scanner.Scan() {
+		if !drain.Enter() {
+			writeSlaveResponse(conn, shared.DBResponse{Status: shared.StatusShuttingDown, Message: "Master is shutting down"})
+			return
 		}
+		func() {
+			defer drain.Leave()
+			line := scanner.Text()
+			if line == "" {
+				return
+			}
 
-		logEvent("SLAVE", "Received request from slave", map[string]string{
-			"address": slaveAddr,
-			"ip":      slaveIP,
-			"request": line,
-		})
+			if strings.HasPrefix(line, "GET") || strings.HasPrefix(line, "POST") || strings.HasPrefix(line, "PUT") || strings.HasPrefix(line, "DELETE") {
+				log.Printf("Received HTTP request on TCP port, ignoring: %s", line)
+				return
+			}
 
-		if strings.HasPrefix(line, "GET") || strings.HasPrefix(line, "POST") || strings.HasPrefix(line, "PUT") || strings.HasPrefix(line, "DELETE") {
-			log.Printf("Received HTTP request on TCP port, ignoring: %s", line)
-			continue
-		}
+			var req shared.DBRequest
+			err := json.Unmarshal([]byte(line), &req)
+			if err != nil {
+				log.Printf("Invalid request format: %v\nRequest content: %s", err, line)
+				resp := shared.DBResponse{
+					Status:  "error",
+					Message: fmt.Sprintf("Invalid request format: %v", err),
+				}
+				respData, _ := json.Marshal(resp)
+				conn.Write(append(respData, '\n'))
+				return
+			}
 
-		var req shared.DBRequest
-		err := json.Unmarshal([]byte(line), &req)
-		if err != nil {
-			log.Printf("Invalid request format: %v\nRequest content: %s", err, line)
-			resp := shared.DBResponse{
-				Status:  "error",
-				Message: fmt.Sprintf("Invalid request format: %v", err),
+			if req.Type != shared.MsgHeartbeat && req.Type != shared.MsgFetch && req.Type != shared.MsgAck && req.Type != shared.MsgReconcile && req.Type != shared.MsgAttach {
+				logEvent("SLAVE", "Received request from slave", map[string]string{
+					"address": slaveAddr,
+					"ip":      slaveIP,
+					"request": line,
+				})
 			}
-			respData, _ := json.Marshal(resp)
-			conn.Write(append(respData, '\n'))
-			continue
-		}
 
-		if req.Token != validToken {
-			log.Printf("Invalid token from %s", req.FromSlave)
-			resp := shared.DBResponse{
-				Status:  "error",
-				Message: "Invalid token",
+			if req.Token != validToken {
+				log.Printf("Invalid token from %s", req.FromSlave)
+				resp := shared.DBResponse{
+					Status:  "error",
+					Message: "Invalid token",
+				}
+				respData, _ := json.Marshal(resp)
+				conn.Write(append(respData, '\n'))
+				return
 			}
-			respData, _ := json.Marshal(resp)
-			conn.Write(append(respData, '\n'))
-			continue
-		}
 
-		if req.FromSlave != "master" && req.FromSlave != "" {
-			slavesMutex.Lock()
-			connectedSlaves[req.FromSlave] = time.Now().Format(time.RFC3339)
-			slavesMutex.Unlock()
-			logEvent("SLAVE", "Updated slave connection", map[string]string{
-				"slave": req.FromSlave,
-				"ip":    slaveIP,
-				"time":  time.Now().Format(time.RFC3339),
-			})
-		}
+			if req.Type == shared.MsgRegister {
+				if req.NodeID == "" {
+					writeSlaveResponse(conn, shared.DBResponse{Status: "error", Message: "Registration requires a node_id"})
+					return
+				}
+				if nodeID != "" && nodeID != req.NodeID {
+					slaves.Disconnect(nodeID, conn)
+				}
+				nodeID = req.NodeID
+				slaves.Register(shared.SlaveInfo{
+					NodeID:   req.NodeID,
+					Address:  slaveAddr,
+					HTTPAddr: req.HTTPAddr,
+					ReplAddr: req.ReplAddr,
+					Version:  req.Version,
+					Position: req.Position,
+				}, conn)
+				logEvent("SLAVE", "Slave registered", map[string]interface{}{
+					"node_id":   req.NodeID,
+					"address":   slaveAddr,
+					"http_addr": req.HTTPAddr,
+					"version":   req.Version,
+					"position":  req.Position,
+				})
+				writeSlaveResponse(conn, shared.DBResponse{Status: "ok", Message: "Registered", Role: "slave"})
+				return
+			}
 
-		if isMasterQuery(req.Query) && req.FromSlave != "master" {
-			log.Printf("Rejected master-only query from %s", req.FromSlave)
-			resp := shared.DBResponse{
-				Status:  "error",
-				Message: "Only master can create/drop databases/tables",
+			if req.Type == shared.MsgHeartbeat {
+				if nodeID == "" || !slaves.Heartbeat(nodeID, req.Status, req.Position) {
+					writeSlaveResponse(conn, shared.DBResponse{Status: "error", Message: "Heartbeat from unregistered slave"})
+					return
+				}
+				resp := shared.DBResponse{
+					Status:   "ok",
+					Message:  "alive",
+					Position: replLog.LastPosition(),
+					Peers:    slaves.Snapshot(),
+				}
+				if shardMap != nil {
+					resp.Sharded = shardMap.TableNames()
+				}
+				writeSlaveResponse(conn, resp)
+				return
 			}
-			respData, _ := json.Marshal(resp)
-			conn.Write(append(respData, '\n'))
-			continue
-		}
 
-		log.Printf("[%s] Executing query: %s", req.FromSlave, req.Query)
-		if logger != nil {
-			logger.WriteString(fmt.Sprintf("[%s] %s\n", req.FromSlave, req.Query))
-		}
+			if req.Type == shared.MsgAttach {
+				if req.NodeID == "" || !slaves.Touch(req.NodeID, -1) {
+					writeSlaveResponse(conn, shared.DBResponse{Status: "error", Message: "Attach from unregistered slave"})
+					return
+				}
+				nodeID = req.NodeID
+				writeSlaveResponse(conn, shared.DBResponse{Status: "ok", Message: "Attached"})
+				return
+			}
 
-		resp := shared.DBResponse{}
-		if req.IsSelect {
-			rows, err := db.QueryRows(req.Query)
-			if err != nil {
-				resp.Status = "error"
-				resp.Message = err.Error()
-			} else {
-				cols, _ := rows.Columns()
-				resp.Header = cols
-				for rows.Next() {
-					colsVals := make([]interface{}, len(cols))
-					colsPtrs := make([]interface{}, len(cols))
-					for i := range colsVals {
-						colsPtrs[i] = &colsVals[i]
-					}
-					rows.Scan(colsPtrs...)
-
-					strRow := make([]interface{}, len(cols))
-					for i, val := range colsVals {
-						if b, ok := val.([]byte); ok {
-							strRow[i] = string(b)
-						} else {
-							strRow[i] = val
-						}
-					}
-					resp.Rows = append(resp.Rows, strRow)
+			if req.Type == shared.MsgFetch {
+				writeSlaveResponse(conn, handleFetch(nodeID, req))
+				return
+			}
+
+			if req.Type == shared.MsgAck {
+				if nodeID == "" || !slaves.Ack(nodeID, req.Position) {
+					writeSlaveResponse(conn, shared.DBResponse{Status: "error", Message: "Ack from unregistered slave"})
+					return
 				}
-				resp.Status = "ok"
-				resp.Message = "Select executed successfully"
+				replLog.Release(slaves.MinReceived())
+				writeSlaveResponse(conn, shared.DBResponse{Status: "ok", Message: "ack"})
+				return
 			}
-		} else {
-			affected, err := db.ExecuteQuery(req.Query)
+
+			if req.Type == shared.MsgCancel {
+				writeSlaveResponse(conn, handleCancel(db, req))
+				return
+			}
+
+			if req.Type == shared.MsgXAPrepare || req.Type == shared.MsgXACommit || req.Type == shared.MsgXARollback {
+				writeSlaveResponse(conn, handleXA(db, req))
+				return
+			}
+
+			if req.Type == shared.MsgReconcile {
+				writeSlaveResponse(conn, handleReconcile(db, nodeID, req))
+				return
+			}
+
+			// The stream outlives the request, so it runs once this one has
+			// left the drain group.
+			if req.Type == shared.MsgSubscribe {
+				subscribe = &req
+				return
+			}
+
+			if req.FromSlave != "master" && req.FromSlave != "" {
+				// Slaves that never registered are tracked by their connection
+				// address, which is unique even when several share one host.
+				if nodeID == "" {
+					nodeID = slaveAddr
+					slaves.Register(shared.SlaveInfo{NodeID: nodeID, Address: slaveAddr}, conn)
+				} else {
+					slaves.Touch(nodeID, -1)
+				}
+			}
+
+			if isMasterQuery(req.Query) && req.FromSlave != "master" {
+				log.Printf("Rejected master-only query from %s", req.FromSlave)
+				resp := shared.DBResponse{
+					Status:  "error",
+					Message: "Only master can create/drop databases/tables",
+				}
+				respData, _ := json.Marshal(resp)
+				conn.Write(append(respData, '\n'))
+				return
+			}
+
+			span := shared.StartSpan("master.query", shared.SpanServer, req.SpanContext())
+			span.SetAttribute("db.statement", req.Query)
+			span.SetAttribute("peer.node_id", nodeID)
+			logSpanEvent(span, "QUERY", "Executing query from slave", map[string]string{
+				"from":  req.FromSlave,
+				"query": req.Query,
+			})
+			if logger != nil {
+				logger.WriteString(fmt.Sprintf("[%s] %s\n", req.FromSlave, req.Query))
+			}
+
+			if req.RequestID == "" {
+				req.RequestID = shared.NewRequestID()
+			}
+			resp, routed, release := routeSharded(span, req, db)
+			if !routed {
+				resp = executeSlaveQuery(span, req, db)
+			}
+			release()
+			logSpanEvent(span, "QUERY", "Query from slave completed", map[string]string{
+				"status":  resp.Status,
+				"message": resp.Message,
+			})
+			span.FinishResponse(resp, nil)
+
+			respData, err := json.Marshal(resp)
 			if err != nil {
-				resp.Status = "error"
-				resp.Message = err.Error()
-			} else {
-				resp.Status = "ok"
-				resp.Message = fmt.Sprintf("Query executed successfully. Rows affected: %d", affected)
+				log.Printf("Error marshaling response: %v", err)
+				return
 			}
-		}
+			respData = append(respData, '\n')
+			if _, err := conn.Write(respData); err != nil {
+				log.Printf("Error sending response: %v", err)
+				return
+			}
+		}()
+	}
+
+	if subscribe != nil {
+		subscribeChanges(conn, scanner, *subscribe)
+		return
+	}
+	if err := scanner.Err(); err != nil {
+		log.Printf("Error reading from connection: %v", err)
+	}
+}
+
+// executeSlaveQuery runs a query a slave forwarded against the local
+// database.
+func executeSlaveQuery(span *shared.Span, req shared.DBRequest, db *shared.DBHandler) shared.DBResponse {
+	ctx, cancel := req.QueryContext(queryTimeout)
+	defer cancel()
 
-		respData, err := json.Marshal(resp)
+	resp := shared.DBResponse{TraceID: span.TraceID, RequestID: req.RequestID}
+	timer := startQuery(span, req.FromSlave, req.Query)
+	if req.IsSelect {
+		cols, rows, err := db.SelectRowsContext(ctx, req.Query)
+		timer.Done(int64(len(rows)), 0, err)
 		if err != nil {
-			log.Printf("Error marshaling response: %v", err)
-			continue
+			resp.Status = "error"
+			resp.Message = err.Error()
+		} else {
+			resp.Header = cols
+			resp.Rows = rows
+			resp.Status = "ok"
+			resp.Message = "Select executed successfully"
 		}
-		respData = append(respData, '\n')
-		if _, err := conn.Write(respData); err != nil {
-			log.Printf("Error sending response: %v", err)
-			continue
+	} else {
+		result, err := executeWrite(ctx, db, req.Query)
+		timer.Done(0, result.Affected, err)
+		if err != nil {
+			resp.Status = "error"
+			resp.Message = err.Error()
+		} else {
+			resp.Status = "ok"
+			resp.Message = fmt.Sprintf("Query executed successfully. Rows affected: %d", result.Affected)
+			resp.Position = result.Position
+			awaitDurability(req, result.Position, &resp)
 		}
 	}
+	return resp
+}
 
-	if err := scanner.Err(); err != nil {
-		log.Printf("Error reading from connection: %v", err)
+func writeSlaveResponse(conn net.Conn, resp shared.DBResponse) error {
+	respData, err := json.Marshal(resp)
+	if err != nil {
+		return err
 	}
+	_, err = conn.Write(append(respData, '\n'))
+	return err
 }
 
 func serveStatic(w http.ResponseWriter, r *http.Request) {
@@ -472,7 +687,11 @@ func handleConnect(w http.ResponseWriter, r *http.Request) {
 	}
 
 	role := "slave"
-	if req.IP == masterIP || req.IP == "127.0.0.1" {
+	if raftNode != nil {
+		if raftNode.IsLeader() {
+			role = "master"
+		}
+	} else if req.IP == masterIP || req.IP == "127.0.0.1" {
 		role = "master"
 	}
 
@@ -511,7 +730,7 @@ func handleQuery(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
-	rows, err := dbHandler.QueryRows(req.Query)
+	rows, err := dbHandler.QueryRowsContext(r.Context(), req.Query)
 	if err != nil {
 		response := shared.DBResponse{
 			Status:  "error",
@@ -576,17 +795,26 @@ func handleQuery(w http.ResponseWriter, r *http.Request) {
 }
 
 func HandleLocalQuery(req shared.DBRequest, db *shared.DBHandler) shared.DBResponse {
-	logEvent("QUERY", "Starting query execution", map[string]string{
+	span := shared.StartSpan("master.query", shared.SpanServer, req.SpanContext())
+	span.SetAttribute("db.statement", req.Query)
+	logSpanEvent(span, "QUERY", "Starting query execution", map[string]string{
 		"query": req.Query,
 		"from":  req.FromSlave,
 		"type":  "local",
 	})
 
-	resp := shared.DBResponse{}
+	if req.RequestID == "" {
+		req.RequestID = shared.NewRequestID()
+	}
+	ctx, cancel := req.QueryContext(queryTimeout)
+	defer cancel()
+
+	resp := shared.DBResponse{TraceID: span.TraceID, RequestID: req.RequestID}
+	defer func() { span.FinishResponse(resp, nil) }()
 
 	if (strings.HasPrefix(strings.ToUpper(req.Query), "CREATE") || strings.HasPrefix(strings.ToUpper(req.Query), "DROP")) &&
 		req.FromSlave != "master" {
-		logEvent("ERROR", "Unauthorized query attempt", map[string]string{
+		logSpanEvent(span, "ERROR", "Unauthorized query attempt", map[string]string{
 			"query":  req.Query,
 			"from":   req.FromSlave,
 			"reason": "Only master can create/drop databases/tables",
@@ -596,67 +824,60 @@ func HandleLocalQuery(req shared.DBRequest, db *shared.DBHandler) shared.DBRespo
 		return resp
 	}
 
+	routed, ok, release := routeSharded(span, req, db)
+	defer release()
+	if ok {
+		resp = routed
+		return resp
+	}
+
 	if req.IsSelect {
-		logEvent("QUERY", "Executing SELECT query", map[string]string{
+		logSpanEvent(span, "QUERY", "Executing SELECT query", map[string]string{
 			"query": req.Query,
 		})
-		rows, err := db.QueryRows(req.Query)
+		timer := startQuery(span, req.FromSlave, req.Query)
+		cols, rows, err := db.SelectRowsContext(ctx, req.Query)
+		timer.Done(int64(len(rows)), 0, err)
 		if err != nil {
-			logEvent("ERROR", "SELECT query failed", map[string]string{
+			logSpanEvent(span, "ERROR", "SELECT query failed", map[string]string{
 				"query": req.Query,
 				"error": err.Error(),
 			})
 			resp.Status = "error"
 			resp.Message = err.Error()
 		} else {
-			cols, _ := rows.Columns()
 			resp.Header = cols
-			rowCount := 0
-			for rows.Next() {
-				colsVals := make([]interface{}, len(cols))
-				colsPtrs := make([]interface{}, len(cols))
-				for i := range colsVals {
-					colsPtrs[i] = &colsVals[i]
-				}
-				rows.Scan(colsPtrs...)
-
-				strRow := make([]interface{}, len(cols))
-				for i, val := range colsVals {
-					if b, ok := val.([]byte); ok {
-						strRow[i] = string(b)
-					} else {
-						strRow[i] = val
-					}
-				}
-				resp.Rows = append(resp.Rows, strRow)
-				rowCount++
-			}
-			logEvent("QUERY", "SELECT query completed successfully", map[string]string{
+			resp.Rows = rows
+			logSpanEvent(span, "QUERY", "SELECT query completed successfully", map[string]string{
 				"query":         req.Query,
-				"rows_returned": fmt.Sprintf("%d", rowCount),
+				"rows_returned": fmt.Sprintf("%d", len(rows)),
 			})
 			resp.Status = "ok"
 			resp.Message = "Select executed"
 		}
 	} else {
-		logEvent("QUERY", "Executing non-SELECT query", map[string]string{
+		logSpanEvent(span, "QUERY", "Executing non-SELECT query", map[string]string{
 			"query": req.Query,
 		})
-		affected, err := db.ExecuteQuery(req.Query)
+		timer := startQuery(span, req.FromSlave, req.Query)
+		result, err := executeWrite(ctx, db, req.Query)
+		timer.Done(0, result.Affected, err)
 		if err != nil {
-			logEvent("ERROR", "Query execution failed", map[string]string{
+			logSpanEvent(span, "ERROR", "Query execution failed", map[string]string{
 				"query": req.Query,
 				"error": err.Error(),
 			})
 			resp.Status = "error"
 			resp.Message = err.Error()
 		} else {
-			logEvent("QUERY", "Query executed successfully", map[string]string{
+			logSpanEvent(span, "QUERY", "Query executed successfully", map[string]string{
 				"query":         req.Query,
-				"rows_affected": fmt.Sprintf("%d", affected),
+				"rows_affected": fmt.Sprintf("%d", result.Affected),
 			})
 			resp.Status = "ok"
 			resp.Message = "Query executed successfully"
+			resp.Position = result.Position
+			awaitDurability(req, result.Position, &resp)
 		}
 	}
 	return resp
@@ -682,7 +903,7 @@ func handleCreateDatabase(w http.ResponseWriter, r *http.Request, db *shared.DBH
 
 	logEvent("DATABASE", "Attempting to create database", map[string]string{"db_name": req.DBName})
 
-	if err := db.CreateDatabase(req.DBName); err != nil {
+	if _, err := executeWrite(context.Background(), db, fmt.Sprintf("CREATE DATABASE IF NOT EXISTS %s", req.DBName)); err != nil {
 		logEvent("ERROR", "Database creation failed", map[string]string{
 			"db_name": req.DBName,
 			"error":   err.Error(),
@@ -727,7 +948,12 @@ func handleCreateTable(w http.ResponseWriter, r *http.Request, db *shared.DBHand
 		"db_name":    req.DBName,
 	})
 
-	if err := db.CreateTable(&req); err != nil {
+	if req.ShardKey != "" {
+		handleCreateShardedTable(w, db, &req)
+		return
+	}
+
+	if _, err := executeWrite(context.Background(), db, shared.CreateTableQuery(&req)); err != nil {
 		logEvent("ERROR", "Table creation failed", map[string]string{
 			"table_name": req.TableName,
 			"db_name":    req.DBName,
@@ -755,6 +981,24 @@ func handleCreateTable(w http.ResponseWriter, r *http.Request, db *shared.DBHand
 	json.NewEncoder(w).Encode(response)
 }
 
+func handleCreateShardedTable(w http.ResponseWriter, db *shared.DBHandler, req *shared.CreateTableRequest) {
+	response := shared.DBResponse{Status: "ok"}
+	table, err := createShardedTable(db, req)
+	if err != nil {
+		logEvent("ERROR", "Sharded table creation failed", map[string]string{
+			"table_name": req.TableName,
+			"db_name":    req.DBName,
+			"error":      err.Error(),
+		})
+		response.Status = "error"
+		response.Message = fmt.Sprintf("Failed to create sharded table: %v", err)
+	} else {
+		response.Message = fmt.Sprintf("Table %s sharded by %s across %s", table.Name(), table.ShardKey, strings.Join(table.Groups(), ", "))
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
 func handleReplication(w http.ResponseWriter, r *http.Request, db *shared.DBHandler) {
 	logEvent("REPLICATION", "Received replication request", nil)
 
@@ -771,14 +1015,14 @@ func handleReplication(w http.ResponseWriter, r *http.Request, db *shared.DBHand
 		return
 	}
 
-	logEvent("REPLICATION", "Starting replication", map[string]string{
-		"operation": req.Operation,
+	logEvent("REPLICATION", "Starting replication", map[string]interface{}{
+		"rows": len(req.Changes),
 	})
 
 	if err := db.ReplicateData(&req); err != nil {
-		logEvent("ERROR", "Replication failed", map[string]string{
-			"operation": req.Operation,
-			"error":     err.Error(),
+		logEvent("ERROR", "Replication failed", map[string]interface{}{
+			"rows":  len(req.Changes),
+			"error": err.Error(),
 		})
 		response := shared.ReplicationResponse{
 			Status:  "error",
@@ -789,13 +1033,13 @@ func handleReplication(w http.ResponseWriter, r *http.Request, db *shared.DBHand
 		return
 	}
 
-	logEvent("REPLICATION", "Replication completed successfully", map[string]string{
-		"operation": req.Operation,
+	logEvent("REPLICATION", "Replication completed successfully", map[string]interface{}{
+		"rows": len(req.Changes),
 	})
 
 	response := shared.ReplicationResponse{
 		Status:  "ok",
-		Message: fmt.Sprintf("Data replicated successfully for operation %s", req.Operation),
+		Message: fmt.Sprintf("Data replicated successfully: %d rows", len(req.Changes)),
 	}
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(response)
@@ -0,0 +1,377 @@
+package main
+
+import (
+	"bufio"
+	"distributed-db/shared"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	shardMap     *shared.ShardMap
+	shardMapPath = "shard_map.json"
+
+	shardClientsMu sync.Mutex
+	shardClients   = make(map[string]*shardClient)
+
+	// remoteQueries maps the request IDs of statements running on other
+	// shard groups to those groups, so they can be cancelled from here.
+	remoteMu      sync.Mutex
+	remoteQueries = make(map[string][]string)
+)
+
+// shardResponseMargin is added to a statement's timeout when waiting for
+// another group's master, leaving time for its durability wait.
+const shardResponseMargin = 5 * time.Second
+
+func setupSharding() error {
+	var err error
+	shardMap, err = shared.LoadShardMap(shardMapPath)
+	return err
+}
+
+// shardClient keeps idle connections to one shard group's master.
+type shardClient struct {
+	addr string
+	idle chan *shardConn
+}
+
+type shardConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func clientFor(group shared.ShardGroup) *shardClient {
+	shardClientsMu.Lock()
+	defer shardClientsMu.Unlock()
+
+	c, ok := shardClients[group.Master]
+	if !ok {
+		c = &shardClient{addr: group.Master, idle: make(chan *shardConn, 8)}
+		shardClients[group.Master] = c
+	}
+	return c
+}
+
+func (c *shardClient) get() (*shardConn, error) {
+	select {
+	case conn := <-c.idle:
+		return conn, nil
+	default:
+	}
+	conn, err := net.DialTimeout("tcp", c.addr, 5*time.Second)
+	if err != nil {
+		return nil, err
+	}
+	return &shardConn{Conn: conn, r: bufio.NewReader(conn)}, nil
+}
+
+func (c *shardClient) put(conn *shardConn) {
+	conn.SetDeadline(time.Time{})
+	select {
+	case c.idle <- conn:
+	default:
+		conn.Close()
+	}
+}
+
+// Do sends one request to the group's master and waits up to timeout, plus
+// a margin, for the answer. A zero timeout waits indefinitely.
+func (c *shardClient) Do(req shared.DBRequest, timeout time.Duration) (shared.DBResponse, error) {
+	conn, err := c.get()
+	if err != nil {
+		return shared.DBResponse{}, fmt.Errorf("failed to connect to %s: %v", c.addr, err)
+	}
+	if timeout > 0 {
+		conn.SetDeadline(time.Now().Add(timeout + shardResponseMargin))
+	}
+
+	data, err := json.Marshal(req)
+	if err != nil {
+		c.put(conn)
+		return shared.DBResponse{}, fmt.Errorf("failed to marshal request: %v", err)
+	}
+	if _, err := conn.Write(append(data, '\n')); err != nil {
+		conn.Close()
+		return shared.DBResponse{}, fmt.Errorf("failed to send request: %v", err)
+	}
+	line, err := conn.r.ReadBytes('\n')
+	if err != nil {
+		conn.Close()
+		return shared.DBResponse{}, fmt.Errorf("failed to read response: %v", err)
+	}
+	var resp shared.DBResponse
+	if err := json.Unmarshal(line, &resp); err != nil {
+		conn.Close()
+		return shared.DBResponse{}, fmt.Errorf("invalid response: %v", err)
+	}
+	if resp.Status == shared.StatusShuttingDown {
+		conn.Close()
+		return shared.DBResponse{}, fmt.Errorf("master is shutting down")
+	}
+	c.put(conn)
+	return resp, nil
+}
+
+func trackRemote(requestID, group string) {
+	remoteMu.Lock()
+	defer remoteMu.Unlock()
+
+	remoteQueries[requestID] = append(remoteQueries[requestID], group)
+}
+
+func untrackRemote(requestID, group string) {
+	remoteMu.Lock()
+	defer remoteMu.Unlock()
+
+	groups := remoteQueries[requestID]
+	for i, g := range groups {
+		if g == group {
+			groups = append(groups[:i], groups[i+1:]...)
+			break
+		}
+	}
+	if len(groups) == 0 {
+		delete(remoteQueries, requestID)
+	} else {
+		remoteQueries[requestID] = groups
+	}
+}
+
+// cancelRemote asks every group running requestID to cancel it.
+func cancelRemote(requestID string) error {
+	remoteMu.Lock()
+	groups := append([]string(nil), remoteQueries[requestID]...)
+	remoteMu.Unlock()
+	if len(groups) == 0 {
+		return shared.ErrQueryNotRunning
+	}
+
+	var failed []string
+	for _, id := range groups {
+		group, ok := shardMap.Group(id)
+		if !ok {
+			continue
+		}
+		resp, err := clientFor(group).Do(shared.DBRequest{
+			Type:      shared.MsgCancel,
+			Token:     validToken,
+			FromSlave: "master",
+			RequestID: requestID,
+		}, 10*time.Second)
+		if err != nil {
+			failed = append(failed, fmt.Sprintf("%s: %v", id, err))
+		} else if resp.Status != "ok" {
+			failed = append(failed, fmt.Sprintf("%s: %s", id, resp.Message))
+		}
+	}
+	if len(failed) > 0 {
+		return fmt.Errorf("failed to cancel on shard groups: %s", strings.Join(failed, "; "))
+	}
+	return nil
+}
+
+// localGroup returns the ID of the shard group this master leads.
+func localGroup() string {
+	for _, id := range shardMap.GroupIDs() {
+		if group, _ := shardMap.Group(id); group.Local() {
+			return id
+		}
+	}
+	return ""
+}
+
+// runOnGroup executes req on one shard group, locally or on its master.
+func runOnGroup(db *shared.DBHandler, groupID string, req shared.DBRequest) shared.DBResponse {
+	group, ok := shardMap.Group(groupID)
+	if !ok {
+		return shared.DBResponse{Status: "error", Message: fmt.Sprintf("unknown shard group %q", groupID), Shard: groupID}
+	}
+	req.Role = shared.RoleShard
+	req.FromSlave = "master"
+	req.IsSelect = shared.StatementKind(req.Query) == "SELECT"
+
+	var resp shared.DBResponse
+	if group.Local() {
+		resp = HandleLocalQuery(req, db)
+	} else {
+		req.Token = validToken
+		trackRemote(req.RequestID, group.ID)
+		var err error
+		resp, err = clientFor(group).Do(req, req.Timeout(queryTimeout))
+		untrackRemote(req.RequestID, group.ID)
+		if err != nil {
+			resp = shared.DBResponse{Status: "error", Message: fmt.Sprintf("shard group %s: %v", group.ID, err)}
+		}
+	}
+	resp.Shard = group.ID
+	return resp
+}
+
+// routeSharded sends statements on sharded tables to the groups owning their
+// rows. It reports false when the statement should run here as usual: it
+// touches no sharded table, or only rows held by the local group. The caller
+// must call release once the statement has run; until then a rebalance
+// cannot move the table's rows.
+func routeSharded(span *shared.Span, req shared.DBRequest, db *shared.DBHandler) (resp shared.DBResponse, routed bool, release func()) {
+	release = func() {}
+	if req.Role == shared.RoleShard || shardMap == nil {
+		return shared.DBResponse{}, false, release
+	}
+	plan, err := shared.PlanShardedStatement(shardMap, req.Query)
+	if err == nil && plan != nil {
+		// Plan again once in, as a rebalance may have just moved the rows.
+		gate := tableGate(plan.Table.Name())
+		gate.RLock()
+		release = gate.RUnlock
+		plan, err = shared.PlanShardedStatement(shardMap, req.Query)
+	}
+	if err != nil {
+		return shared.DBResponse{Status: "error", Message: err.Error(), TraceID: span.TraceID, RequestID: req.RequestID}, true, release
+	}
+	if plan == nil {
+		return shared.DBResponse{}, false, release
+	}
+	// A SELECT that does not pin the shard key reads every shard.
+	groups := plan.Groups
+	if len(groups) == 0 && plan.Kind == "SELECT" {
+		groups = plan.Table.Groups()
+	}
+	span.SetAttribute("shard.table", plan.Table.Name())
+	span.SetAttribute("shard.groups", strings.Join(groups, ","))
+
+	switch {
+	case plan.Broadcast && rebalancing(plan.Table.Name()):
+		resp = shared.DBResponse{Status: "error", Message: fmt.Sprintf("table %s is being rebalanced", plan.Table.Name())}
+	case plan.Broadcast:
+		resp = runBroadcast(db, plan, req)
+	case len(groups) == 0:
+		resp = shared.DBResponse{
+			Status:  "error",
+			Message: fmt.Sprintf("statement on sharded table %s must filter on shard key %s", plan.Table.Name(), plan.Table.ShardKey),
+		}
+	case len(groups) > 1 && plan.Kind == "SELECT":
+		resp = scatterSelect(db, groups, req)
+	case len(groups) > 1:
+		work := make(map[string][]string)
+		for _, group := range groups {
+			work[group] = []string{plan.Statements[group]}
+		}
+		resp = runTransaction(db, work, req)
+	default:
+		if group, _ := shardMap.Group(groups[0]); group.Local() {
+			return shared.DBResponse{}, false, release
+		}
+		if query, ok := plan.Statements[groups[0]]; ok {
+			req.Query = query
+		}
+		resp = runOnGroup(db, groups[0], req)
+	}
+	logSpanEvent(span, "SHARD", "Routed statement on sharded table", map[string]string{
+		"table":  plan.Table.Name(),
+		"groups": strings.Join(groups, ","),
+		"status": resp.Status,
+	})
+	resp.TraceID = span.TraceID
+	resp.RequestID = req.RequestID
+	return resp, true, release
+}
+
+// runBroadcast runs DDL on every group holding part of the table, dropping
+// the table from the shard map once a DROP has succeeded everywhere.
+func runBroadcast(db *shared.DBHandler, plan *shared.ShardPlan, req shared.DBRequest) shared.DBResponse {
+	var failed []string
+	for _, group := range plan.Groups {
+		req.Query = plan.Statements[group]
+		if resp := runOnGroup(db, group, req); resp.Status != "ok" {
+			failed = append(failed, fmt.Sprintf("%s: %s", group, resp.Message))
+		}
+	}
+	if len(failed) > 0 {
+		return shared.DBResponse{Status: "error", Message: "Failed on shard groups: " + strings.Join(failed, "; ")}
+	}
+	if plan.Kind == "DROP" {
+		if err := shardMap.RemoveTable(plan.Table.Name()); err != nil {
+			return shared.DBResponse{Status: "error", Message: fmt.Sprintf("Dropped on all shard groups but failed to update shard map: %v", err)}
+		}
+	}
+	return shared.DBResponse{
+		Status:  "ok",
+		Message: fmt.Sprintf("Executed on %d shard groups", len(plan.Groups)),
+	}
+}
+
+// createShardedTable creates the table on every shard group and records it
+// in the shard map.
+func createShardedTable(db *shared.DBHandler, req *shared.CreateTableRequest) (*shared.ShardedTable, error) {
+	if shardMap.Table(req.DBName+"."+req.TableName) != nil {
+		return nil, fmt.Errorf("table %s.%s is already sharded", req.DBName, req.TableName)
+	}
+	table, err := shared.NewShardedTable(req, shardMap.GroupIDs())
+	if err != nil {
+		return nil, err
+	}
+
+	statements := []string{
+		fmt.Sprintf("CREATE DATABASE IF NOT EXISTS %s", req.DBName),
+		shared.CreateTableQuery(req),
+	}
+	for _, group := range table.Groups() {
+		for _, query := range statements {
+			resp := runOnGroup(db, group, shared.DBRequest{Query: query, RequestID: shared.NewRequestID()})
+			if resp.Status != "ok" {
+				return nil, fmt.Errorf("shard group %s: %s", group, resp.Message)
+			}
+		}
+	}
+	if err := shardMap.PutTable(table); err != nil {
+		return nil, err
+	}
+	logEvent("SHARD", "Created sharded table", map[string]interface{}{
+		"table":     table.Name(),
+		"shard_key": table.ShardKey,
+		"strategy":  table.Strategy,
+		"groups":    table.Groups(),
+	})
+	return table, nil
+}
+
+// registerShardHandlers serves GET /api/shards, the shard map, POST
+// /api/shards/groups, which adds or updates a shard group, and
+// /api/shards/rebalance.
+func registerShardHandlers(mux *http.ServeMux, db *shared.DBHandler) {
+	mux.HandleFunc("/api/shards/rebalance", handleRebalance(db))
+	mux.HandleFunc("/api/shards", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(shardMap)
+	})
+	mux.HandleFunc("/api/shards/groups", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		var group shared.ShardGroup
+		if err := json.NewDecoder(r.Body).Decode(&group); err != nil {
+			http.Error(w, "Invalid request", http.StatusBadRequest)
+			return
+		}
+		resp := shared.DBResponse{Status: "ok", Message: fmt.Sprintf("Shard group %s saved", group.ID)}
+		if err := shardMap.SetGroup(group); err != nil {
+			resp = shared.DBResponse{Status: "error", Message: err.Error()}
+			w.WriteHeader(http.StatusBadRequest)
+		} else {
+			logEvent("SHARD", "Shard group saved", group)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(resp)
+	})
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"context"
+	"distributed-db/shared"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+var (
+	// drain counts slave requests being served; it is closed when the
+	// master starts shutting down.
+	drain           shared.DrainGroup
+	shutdownTimeout = 15 * time.Second
+
+	slaveConnsMu sync.Mutex
+	slaveConns   = make(map[net.Conn]struct{})
+)
+
+func trackSlaveConn(conn net.Conn) {
+	slaveConnsMu.Lock()
+	defer slaveConnsMu.Unlock()
+
+	slaveConns[conn] = struct{}{}
+}
+
+func untrackSlaveConn(conn net.Conn) {
+	slaveConnsMu.Lock()
+	defer slaveConnsMu.Unlock()
+
+	delete(slaveConns, conn)
+}
+
+func openSlaveConns() int {
+	slaveConnsMu.Lock()
+	defer slaveConnsMu.Unlock()
+
+	return len(slaveConns)
+}
+
+// shutdown stops accepting work, lets in-flight HTTP requests and slave
+// queries finish, and tells each slave the master is going away by
+// answering its next request with StatusShuttingDown. Whatever is still
+// open when shutdownTimeout expires is closed.
+func shutdown(server *http.Server, listener net.Listener) {
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+
+	logEvent("SYSTEM", "Shutting down", map[string]string{"timeout": shutdownTimeout.String()})
+	drain.Close()
+	listener.Close()
+
+	if err := server.Shutdown(ctx); err != nil {
+		logEvent("WARNING", "HTTP requests still running at shutdown deadline", map[string]string{"error": err.Error()})
+	}
+	if err := drain.Wait(ctx); err != nil {
+		logEvent("WARNING", "Slave queries still running at shutdown deadline", nil)
+	}
+
+	ticker := time.NewTicker(100 * time.Millisecond)
+	defer ticker.Stop()
+wait:
+	for openSlaveConns() > 0 {
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			break wait
+		}
+	}
+
+	slaveConnsMu.Lock()
+	if len(slaveConns) > 0 {
+		logEvent("WARNING", "Closing slave connections at shutdown deadline", map[string]int{"connections": len(slaveConns)})
+	}
+	for conn := range slaveConns {
+		conn.Close()
+	}
+	slaveConnsMu.Unlock()
+
+	if raftNode != nil {
+		raftNode.Stop()
+	}
+	logEvent("SYSTEM", "Shutdown complete", nil)
+	logFile.Sync()
+}
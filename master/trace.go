@@ -0,0 +1,15 @@
+package main
+
+import "distributed-db/shared"
+
+var tracer *shared.OTLPExporter
+
+func setupTracing(target string) error {
+	var err error
+	tracer, err = shared.NewOTLPExporter("ddb-master", masterNodeID, target)
+	if err != nil {
+		return err
+	}
+	shared.SetSpanExporter(tracer)
+	return nil
+}
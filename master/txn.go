@@ -0,0 +1,564 @@
+package main
+
+import (
+	"bufio"
+	"distributed-db/shared"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Coordinator states of a distributed transaction. Once the committing
+// record is on disk the transaction commits everywhere, however often the
+// coordinator restarts; before that it is rolled back.
+const (
+	txnPreparing  = "preparing"
+	txnCommitting = "committing"
+	txnAborting   = "aborting"
+	txnCommitted  = "committed"
+	txnAborted    = "aborted"
+)
+
+// txnRetryInterval is how often unresolved transactions are retried.
+const txnRetryInterval = 5 * time.Second
+
+var (
+	txnLogPath   = "txn_log.jsonl"
+	preparedPath = "xa_prepared.json"
+
+	txns     *txnLog
+	prepared *preparedStore
+)
+
+type txnRecord struct {
+	XID    string   `json:"xid"`
+	State  string   `json:"state"`
+	Groups []string `json:"groups,omitempty"`
+	Time   int64    `json:"time"`
+}
+
+// txnLog is the coordinator's log of distributed transactions. Each state
+// change is synced to disk before the transaction moves on.
+type txnLog struct {
+	mu   sync.Mutex
+	file *os.File
+	// open holds the latest record of every unresolved transaction.
+	open map[string]txnRecord
+	// active marks transactions a request is still driving, which the
+	// retry loop leaves alone.
+	active map[string]bool
+}
+
+// openTxnLog reads the log at path and rewrites it with just the
+// unresolved transactions.
+func openTxnLog(path string) (*txnLog, error) {
+	l := &txnLog{open: make(map[string]txnRecord), active: make(map[string]bool)}
+	if file, err := os.Open(path); err == nil {
+		scanner := bufio.NewScanner(file)
+		for scanner.Scan() {
+			var rec txnRecord
+			if err := json.Unmarshal(scanner.Bytes(), &rec); err != nil {
+				file.Close()
+				return nil, fmt.Errorf("corrupt transaction log entry: %v", err)
+			}
+			l.apply(rec)
+		}
+		file.Close()
+		if err := scanner.Err(); err != nil {
+			return nil, fmt.Errorf("failed to read transaction log: %v", err)
+		}
+	} else if !os.IsNotExist(err) {
+		return nil, fmt.Errorf("failed to open transaction log: %v", err)
+	}
+
+	tmp := path + ".tmp"
+	file, err := os.Create(tmp)
+	if err != nil {
+		return nil, fmt.Errorf("failed to compact transaction log: %v", err)
+	}
+	l.file = file
+	for _, rec := range l.open {
+		if err := l.write(rec); err != nil {
+			file.Close()
+			return nil, err
+		}
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		file.Close()
+		return nil, fmt.Errorf("failed to compact transaction log: %v", err)
+	}
+	return l, nil
+}
+
+func (l *txnLog) apply(rec txnRecord) {
+	if rec.Groups == nil {
+		rec.Groups = l.open[rec.XID].Groups
+	}
+	if rec.State == txnCommitted || rec.State == txnAborted {
+		delete(l.open, rec.XID)
+	} else {
+		l.open[rec.XID] = rec
+	}
+}
+
+func (l *txnLog) write(rec txnRecord) error {
+	data, err := json.Marshal(rec)
+	if err != nil {
+		return fmt.Errorf("failed to encode transaction record: %v", err)
+	}
+	if _, err := l.file.Write(append(data, '\n')); err != nil {
+		return fmt.Errorf("failed to write transaction log: %v", err)
+	}
+	if err := l.file.Sync(); err != nil {
+		return fmt.Errorf("failed to sync transaction log: %v", err)
+	}
+	return nil
+}
+
+// record persists a new state of transaction xid.
+func (l *txnLog) record(xid, state string, groups []string) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	rec := txnRecord{XID: xid, State: state, Groups: groups, Time: time.Now().UnixMilli()}
+	if err := l.write(rec); err != nil {
+		return err
+	}
+	l.apply(rec)
+	return nil
+}
+
+func (l *txnLog) setActive(xid string, active bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if active {
+		l.active[xid] = true
+	} else {
+		delete(l.active, xid)
+	}
+}
+
+// pending returns the unresolved transactions no request is driving.
+func (l *txnLog) pending() []txnRecord {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	var recs []txnRecord
+	for xid, rec := range l.open {
+		if !l.active[xid] {
+			recs = append(recs, rec)
+		}
+	}
+	return recs
+}
+
+func (l *txnLog) snapshot() []txnRecord {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	recs := make([]txnRecord, 0, len(l.open))
+	for _, rec := range l.open {
+		recs = append(recs, rec)
+	}
+	sort.Slice(recs, func(i, j int) bool { return recs[i].Time < recs[j].Time })
+	return recs
+}
+
+// preparedStore keeps the writes of the XA transactions this master has
+// prepared as a participant, with the rows they changed, so they reach the
+// replication log when the transaction commits, even after a restart.
+type preparedStore struct {
+	mu   sync.Mutex
+	path string
+	txns map[string][]shared.XAWrite
+}
+
+func loadPreparedStore(path string) (*preparedStore, error) {
+	s := &preparedStore{path: path, txns: make(map[string][]shared.XAWrite)}
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read prepared transactions: %v", err)
+	}
+	if err := json.Unmarshal(data, &s.txns); err != nil {
+		return nil, fmt.Errorf("invalid prepared transactions file: %v", err)
+	}
+	return s, nil
+}
+
+func (s *preparedStore) saveLocked() error {
+	data, err := json.Marshal(s.txns)
+	if err != nil {
+		return fmt.Errorf("failed to encode prepared transactions: %v", err)
+	}
+	// The file is synced before the rename so a crash cannot leave an
+	// empty file in place of the writes of a prepared transaction.
+	tmp := s.path + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to write prepared transactions: %v", err)
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return fmt.Errorf("failed to write prepared transactions: %v", err)
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return fmt.Errorf("failed to sync prepared transactions: %v", err)
+	}
+	if err := f.Close(); err != nil {
+		return fmt.Errorf("failed to write prepared transactions: %v", err)
+	}
+	return os.Rename(tmp, s.path)
+}
+
+func (s *preparedStore) put(xid string, writes []shared.XAWrite) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.txns[xid] = writes
+	if err := s.saveLocked(); err != nil {
+		delete(s.txns, xid)
+		return err
+	}
+	return nil
+}
+
+// take removes and returns the writes of xid.
+func (s *preparedStore) take(xid string) []shared.XAWrite {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	writes, ok := s.txns[xid]
+	if !ok {
+		return nil
+	}
+	delete(s.txns, xid)
+	if err := s.saveLocked(); err != nil {
+		logEvent("ERROR", "Failed to save prepared transactions", map[string]string{"error": err.Error()})
+	}
+	return writes
+}
+
+func setupTransactions(db *shared.DBHandler) error {
+	var err error
+	if txns, err = openTxnLog(txnLogPath); err != nil {
+		return err
+	}
+	if prepared, err = loadPreparedStore(preparedPath); err != nil {
+		return err
+	}
+	go retryTransactions(db)
+	return nil
+}
+
+// retryTransactions finishes transactions left unresolved by a crash or by
+// groups that could not be reached.
+func retryTransactions(db *shared.DBHandler) {
+	for {
+		for _, rec := range txns.pending() {
+			commit := rec.State == txnCommitting
+			if err := finishTransaction(db, rec.XID, rec.Groups, commit); err != nil {
+				logEvent("WARNING", "Transaction still unresolved", map[string]interface{}{
+					"xid":   rec.XID,
+					"state": rec.State,
+					"error": err.Error(),
+				})
+				continue
+			}
+			logEvent("TXN", "Resolved transaction", map[string]interface{}{"xid": rec.XID, "committed": commit})
+		}
+		time.Sleep(txnRetryInterval)
+	}
+}
+
+// runTransaction writes work, the statements to run on each shard group,
+// atomically with two-phase commit over MySQL XA.
+func runTransaction(db *shared.DBHandler, work map[string][]string, req shared.DBRequest) shared.DBResponse {
+	if raftNode != nil {
+		return shared.DBResponse{Status: "error", Message: "distributed transactions are not supported with raft"}
+	}
+	xid := shared.NewXID()
+	groups := make([]string, 0, len(work))
+	for g := range work {
+		groups = append(groups, g)
+	}
+	sort.Strings(groups)
+
+	txns.setActive(xid, true)
+	defer txns.setActive(xid, false)
+	if err := txns.record(xid, txnPreparing, groups); err != nil {
+		return shared.DBResponse{Status: "error", Message: err.Error()}
+	}
+
+	results := make([]shared.DBResponse, len(groups))
+	var wg sync.WaitGroup
+	for i, group := range groups {
+		wg.Add(1)
+		go func(i int, group string) {
+			defer wg.Done()
+			prep := req
+			prep.Type = shared.MsgXAPrepare
+			prep.XID = xid
+			prep.Statements = work[group]
+			results[i] = sendXA(db, group, prep)
+		}(i, group)
+	}
+	wg.Wait()
+
+	var failed []string
+	var affected int64
+	for i, r := range results {
+		if r.Status != "ok" {
+			failed = append(failed, fmt.Sprintf("%s: %s", groups[i], r.Message))
+		}
+		affected += r.Affected
+	}
+	decision := txnCommitting
+	if len(failed) > 0 {
+		decision = txnAborting
+	}
+	if err := txns.record(xid, decision, nil); err != nil {
+		failed = append(failed, err.Error())
+		decision = txnAborting
+	}
+
+	commit := decision == txnCommitting
+	err := finishTransaction(db, xid, groups, commit)
+	logEvent("TXN", "Transaction finished", map[string]interface{}{
+		"xid":       xid,
+		"groups":    groups,
+		"committed": commit,
+		"failed":    failed,
+	})
+	if !commit {
+		msg := "Transaction rolled back: " + strings.Join(failed, "; ")
+		if err != nil {
+			msg += fmt.Sprintf(" (rollback pending: %v)", err)
+		}
+		return shared.DBResponse{Status: "error", Message: msg, RequestID: req.RequestID}
+	}
+	resp := shared.DBResponse{
+		Status:    "ok",
+		Message:   fmt.Sprintf("Transaction %s committed on %s, %d rows affected", xid, strings.Join(groups, ", "), affected),
+		RequestID: req.RequestID,
+	}
+	if err != nil {
+		resp.Message += fmt.Sprintf("; commit pending on some groups: %v", err)
+	}
+	return resp
+}
+
+// finishTransaction commits or rolls back xid on every group and, once all
+// have, records the outcome.
+func finishTransaction(db *shared.DBHandler, xid string, groups []string, commit bool) error {
+	msg, final := shared.MsgXARollback, txnAborted
+	if commit {
+		msg, final = shared.MsgXACommit, txnCommitted
+	}
+	var failed []string
+	for _, group := range groups {
+		if r := sendXA(db, group, shared.DBRequest{Type: msg, XID: xid}); r.Status != "ok" {
+			failed = append(failed, fmt.Sprintf("%s: %s", group, r.Message))
+		}
+	}
+	if len(failed) > 0 {
+		return fmt.Errorf("%s", strings.Join(failed, "; "))
+	}
+	return txns.record(xid, final, nil)
+}
+
+// sendXA delivers a two-phase commit message to a shard group's master,
+// handling it directly for the local group.
+func sendXA(db *shared.DBHandler, groupID string, req shared.DBRequest) shared.DBResponse {
+	group, ok := shardMap.Group(groupID)
+	if !ok {
+		return shared.DBResponse{Status: "error", Message: fmt.Sprintf("unknown shard group %q", groupID)}
+	}
+	if group.Local() {
+		return handleXA(db, req)
+	}
+	req.Token = validToken
+	req.FromSlave = "master"
+	resp, err := clientFor(group).Do(req, req.Timeout(queryTimeout))
+	if err != nil {
+		return shared.DBResponse{Status: "error", Message: err.Error()}
+	}
+	return resp
+}
+
+// handleXA runs a two-phase commit step as a participant.
+func handleXA(db *shared.DBHandler, req shared.DBRequest) shared.DBResponse {
+	var err error
+	resp := shared.DBResponse{Status: "ok", RequestID: req.RequestID}
+	switch req.Type {
+	case shared.MsgXAPrepare:
+		resp.Affected, err = prepareLocal(db, req)
+		resp.Message = "Prepared"
+	case shared.MsgXACommit:
+		err = commitLocal(db, req.XID)
+		resp.Message = "Committed"
+	case shared.MsgXARollback:
+		if _, err = db.XARollback(req.XID); err == nil {
+			prepared.take(req.XID)
+		}
+		resp.Message = "Rolled back"
+	}
+	if err != nil {
+		return shared.DBResponse{Status: "error", Message: err.Error(), RequestID: req.RequestID}
+	}
+	return resp
+}
+
+func prepareLocal(db *shared.DBHandler, req shared.DBRequest) (int64, error) {
+	if raftNode != nil {
+		return 0, fmt.Errorf("distributed transactions are not supported with raft")
+	}
+	// The writes and their rows are saved before PREPARE, so a crash right
+	// after it still knows what to replicate on commit.
+	ctx, cancel := req.QueryContext(queryTimeout)
+	defer cancel()
+	affected, err := db.XAPrepare(ctx, req.XID, req.Statements, func(writes []shared.XAWrite) error {
+		return prepared.put(req.XID, writes)
+	})
+	if err != nil {
+		prepared.take(req.XID)
+		return 0, err
+	}
+	return affected, nil
+}
+
+// commitLocal commits a prepared transaction and appends its writes to the
+// replication log, keeping the log in commit order.
+func commitLocal(db *shared.DBHandler, xid string) error {
+	writeMu.Lock()
+	defer writeMu.Unlock()
+
+	found, err := db.XACommit(xid)
+	if err != nil {
+		return err
+	}
+	// A transaction MySQL no longer knows but whose writes are still kept
+	// was committed by an earlier attempt that did not get to log them;
+	// only a commit decision reaches here, and a rollback drops the writes.
+	writes := prepared.take(xid)
+	if !found && len(writes) > 0 {
+		logEvent("TXN", "Logging writes of a transaction committed earlier", map[string]interface{}{
+			"xid":    xid,
+			"writes": len(writes),
+		})
+	}
+	// Every write is recorded even after a failure, since the log keeps
+	// the entries it could not persist and appends them in order later.
+	var logErr error
+	for _, w := range writes {
+		if _, err := recordWriteLocked(w.Query, w.Changes, w.Captured); err != nil && logErr == nil {
+			logErr = err
+		}
+	}
+	return logErr
+}
+
+// planTransaction assigns each of statements to the shard groups owning its
+// rows; statements on tables that are not sharded run on the local group.
+// The returned release lets rebalances proceed again.
+func planTransaction(statements []string) (map[string][]string, func(), error) {
+	var tables []string
+	for _, query := range statements {
+		switch shared.StatementKind(query) {
+		case "INSERT", "REPLACE", "UPDATE", "DELETE":
+		default:
+			return nil, nil, fmt.Errorf("transactions may only contain INSERT, REPLACE, UPDATE and DELETE: %s", query)
+		}
+		plan, err := shared.PlanShardedStatement(shardMap, query)
+		if err != nil {
+			return nil, nil, err
+		}
+		if plan != nil {
+			tables = append(tables, strings.ToLower(plan.Table.Name()))
+		}
+	}
+	// Gates are taken in name order so two transactions cannot wait on
+	// each other behind a rebalance.
+	sort.Strings(tables)
+	var gates []*sync.RWMutex
+	for i, name := range tables {
+		if i == 0 || tables[i-1] != name {
+			gate := tableGate(name)
+			gate.RLock()
+			gates = append(gates, gate)
+		}
+	}
+	release := func() {
+		for _, gate := range gates {
+			gate.RUnlock()
+		}
+	}
+
+	local := localGroup()
+	work := make(map[string][]string)
+	for _, query := range statements {
+		plan, err := shared.PlanShardedStatement(shardMap, query)
+		if err != nil {
+			release()
+			return nil, nil, err
+		}
+		if plan == nil {
+			work[local] = append(work[local], query)
+			continue
+		}
+		if len(plan.Groups) == 0 {
+			release()
+			return nil, nil, fmt.Errorf("statement on sharded table %s must filter on shard key %s", plan.Table.Name(), plan.Table.ShardKey)
+		}
+		for _, group := range plan.Groups {
+			work[group] = append(work[group], plan.Statements[group])
+		}
+	}
+	return work, release, nil
+}
+
+// handleTransactions serves POST /api/transactions, which runs the request's
+// statements as one transaction, and GET, which lists unresolved
+// transactions this master coordinates and XA transactions its database
+// holds prepared.
+func handleTransactions(db *shared.DBHandler) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		switch r.Method {
+		case http.MethodGet:
+			xids, err := db.XARecover()
+			status := map[string]interface{}{"coordinator": txns.snapshot(), "prepared": xids}
+			if err != nil {
+				status["prepared_error"] = err.Error()
+			}
+			json.NewEncoder(w).Encode(status)
+		case http.MethodPost:
+			var req shared.DBRequest
+			if err := json.NewDecoder(r.Body).Decode(&req); err != nil || len(req.Statements) == 0 {
+				http.Error(w, "Invalid request", http.StatusBadRequest)
+				return
+			}
+			if req.RequestID == "" {
+				req.RequestID = shared.NewRequestID()
+			}
+			work, release, err := planTransaction(req.Statements)
+			if err != nil {
+				json.NewEncoder(w).Encode(shared.DBResponse{Status: "error", Message: err.Error(), RequestID: req.RequestID})
+				return
+			}
+			defer release()
+			json.NewEncoder(w).Encode(runTransaction(db, work, req))
+		default:
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		}
+	}
+}
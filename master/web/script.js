@@ -183,13 +183,13 @@ async function loadSlaves() {
     try {
         const res = await fetch('/api/slaves');
         const data = await res.json();
-        if (Object.keys(data).length === 0) {
+        if (!data || data.length === 0) {
             div.innerHTML = "No slaves connected.";
             return;
         }
-        let html = "<table><tr><th>IP</th><th>Last Seen</th></tr>";
-        for (const [ip, lastSeen] of Object.entries(data)) {
-            html += `<tr><td>${ip}</td><td>${lastSeen}</td></tr>`;
+        let html = "<table><tr><th>Node ID</th><th>Address</th><th>HTTP</th><th>Version</th><th>Position</th><th>State</th><th>Node Status</th><th>Connected</th><th>Last Heartbeat</th></tr>";
+        for (const slave of data) {
+            html += `<tr><td>${slave.node_id}</td><td>${slave.address}</td><td>${slave.http_addr || ''}</td><td>${slave.version || ''}</td><td>${slave.position}</td><td>${slave.state}</td><td>${slave.node_status || ''}</td><td>${new Date(slave.connected_at).toLocaleString()}</td><td>${new Date(slave.last_heartbeat).toLocaleString()}</td></tr>`;
         }
         html += "</table>";
         div.innerHTML = html;
@@ -198,6 +198,162 @@ async function loadSlaves() {
     }
 }
 
+async function loadLag() {
+    const div = document.getElementById('lagList');
+    try {
+        const res = await fetch('/api/replication/lag');
+        const data = await res.json();
+        if (!data || data.length === 0) {
+            div.innerHTML = "No slaves connected.";
+            return;
+        }
+        let html = "<table><tr><th>Node ID</th><th>State</th><th>Position</th><th>Master Position</th><th>Lag (ops)</th><th>Lag (s)</th><th>Last Ack</th></tr>";
+        for (const lag of data) {
+            const cls = lag.lagging ? ' class="lagging"' : '';
+            html += `<tr${cls}><td>${lag.node_id}</td><td>${lag.state}</td><td>${lag.position}</td><td>${lag.master_position}</td><td>${lag.lag_ops}</td><td>${lag.lag_seconds.toFixed(1)}</td><td>${new Date(lag.acked_at).toLocaleString()}</td></tr>`;
+        }
+        html += "</table>";
+        div.innerHTML = html;
+    } catch (e) {
+        div.innerHTML = "Error loading replication lag.";
+    }
+}
+
+function escapeHTML(text) {
+    const div = document.createElement('div');
+    div.textContent = text;
+    return div.innerHTML;
+}
+
+async function loadQueryStats() {
+    const div = document.getElementById('queryStatsList');
+    const sort = document.getElementById('statsSort').value;
+    try {
+        const res = await fetch(`/api/queries/stats?limit=50&sort=${sort}`);
+        const data = await res.json();
+        if (!data || data.length === 0) {
+            div.innerHTML = "No queries recorded yet.";
+            return;
+        }
+        let html = "<table><tr><th>Fingerprint</th><th>Count</th><th>Errors</th><th>Slow</th><th>Mean (ms)</th><th>p50 (ms)</th><th>p99 (ms)</th><th>Max (ms)</th><th>Total (ms)</th><th>Rows Returned</th><th>Rows Affected</th></tr>";
+        for (const s of data) {
+            html += `<tr><td title="${escapeHTML(s.example)}">${escapeHTML(s.fingerprint)}</td><td>${s.count}</td><td>${s.errors}</td><td>${s.slow_count}</td><td>${s.mean_ms.toFixed(2)}</td><td>${s.p50_ms.toFixed(2)}</td><td>${s.p99_ms.toFixed(2)}</td><td>${s.max_ms.toFixed(2)}</td><td>${s.total_ms.toFixed(1)}</td><td>${s.rows_returned}</td><td>${s.rows_affected}</td></tr>`;
+        }
+        html += "</table>";
+        div.innerHTML = html;
+    } catch (e) {
+        div.innerHTML = "Error loading query statistics.";
+    }
+}
+
+async function loadSlowQueries() {
+    const div = document.getElementById('slowQueryList');
+    try {
+        const res = await fetch('/api/queries/slow?limit=20');
+        const data = await res.json();
+        if (!data || data.length === 0) {
+            div.innerHTML = "No slow queries.";
+            return;
+        }
+        let html = "<table><tr><th>Time</th><th>Query</th><th>Duration (ms)</th><th>Rows Examined</th><th>Rows Returned</th><th>Rows Affected</th><th>Origin</th><th>Error</th></tr>";
+        for (const q of data) {
+            html += `<tr><td>${new Date(q.timestamp).toLocaleString()}</td><td>${escapeHTML(q.query)}</td><td>${q.duration_ms.toFixed(1)}</td><td>${q.rows_examined}</td><td>${q.rows_returned}</td><td>${q.rows_affected}</td><td>${q.origin}</td><td>${escapeHTML(q.error || '')}</td></tr>`;
+        }
+        html += "</table>";
+        div.innerHTML = html;
+    } catch (e) {
+        div.innerHTML = "Error loading slow queries.";
+    }
+}
+
+async function resetQueryStats() {
+    await fetch('/api/queries/stats', { method: 'DELETE' });
+    loadQueryStats();
+}
+
+const logLimit = 50;
+let logOffset = 0;
+let logStream = null;
+
+function logFilterParams() {
+    const params = new URLSearchParams();
+    const fields = { type: 'logTypes', level: 'logLevel', since: 'logSince', q: 'logSearch' };
+    for (const [name, id] of Object.entries(fields)) {
+        const value = document.getElementById(id).value.trim();
+        if (value) params.set(name, value);
+    }
+    return params;
+}
+
+function logRow(entry) {
+    const data = entry.data ? JSON.stringify(entry.data) : '';
+    return `<tr class="log-${entry.level}"><td>${new Date(entry.timestamp).toLocaleString()}</td><td>${entry.level}</td><td>${entry.type}</td><td>${entry.message}</td><td>${data}</td></tr>`;
+}
+
+const logHeader = "<tr><th>Time</th><th>Level</th><th>Type</th><th>Message</th><th>Data</th></tr>";
+
+async function loadLogs(offset) {
+    const div = document.getElementById('logList');
+    logOffset = Math.max(0, offset);
+    const params = logFilterParams();
+    params.set('limit', logLimit);
+    params.set('offset', logOffset);
+    try {
+        const res = await fetch('/api/logs?' + params);
+        if (!res.ok) {
+            div.innerHTML = await res.text();
+            return;
+        }
+        const data = await res.json();
+        const total = parseInt(res.headers.get('X-Total-Count') || '0', 10);
+        document.getElementById('logPage').textContent =
+            total === 0 ? '' : `${logOffset + 1}-${logOffset + data.length} of ${total}`;
+        if (data.length === 0) {
+            div.innerHTML = "No matching log entries.";
+            return;
+        }
+        div.innerHTML = "<table id=\"logTable\">" + logHeader + data.map(logRow).join('') + "</table>";
+    } catch (e) {
+        div.innerHTML = "Error loading logs.";
+    }
+}
+
+function toggleLogTail() {
+    if (logStream) {
+        logStream.close();
+        logStream = null;
+    }
+    if (!document.getElementById('logTail').checked) {
+        return;
+    }
+    const div = document.getElementById('logList');
+    div.innerHTML = "<table id=\"logTable\">" + logHeader + "</table>";
+    document.getElementById('logPage').textContent = 'Live';
+    logStream = new EventSource('/api/logs/stream?' + logFilterParams());
+    logStream.onmessage = (event) => {
+        const table = document.getElementById('logTable');
+        const header = table.rows[0];
+        header.insertAdjacentHTML('afterend', logRow(JSON.parse(event.data)));
+        while (table.rows.length > 500) {
+            table.deleteRow(table.rows.length - 1);
+        }
+    };
+}
+
+document.addEventListener('DOMContentLoaded', () => {
+    loadSlaves();
+    loadLag();
+    loadLogs(0);
+    loadQueryStats();
+    loadSlowQueries();
+    setInterval(() => {
+        loadSlaves();
+        loadLag();
+        loadQueryStats();
+        loadSlowQueries();
+    }, 5000);
+});
+
 // Drop database
 async function dropDatabase() {
     const dbName = document.getElementById('dropDbName').value;
@@ -0,0 +1,354 @@
+package shared
+
+import (
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"math"
+	"math/rand"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Read balancing policies accepted by ParseBalancePolicy.
+const (
+	BalanceRoundRobin       = "round-robin"
+	BalanceLeastOutstanding = "least-outstanding"
+	BalanceLatencyWeighted  = "latency-weighted"
+	BalanceConsistentHash   = "consistent-hash"
+)
+
+// Values of DBRequest.Prefer.
+const (
+	PreferMaster = "master"
+	PreferSlave  = "slave"
+)
+
+// RoleProxy marks a SELECT the master forwards to a slave, which runs it
+// locally instead of sending it back to the master.
+const RoleProxy = "proxy"
+
+// ErrNoBackend is returned by Pick when there is nothing to pick from.
+var ErrNoBackend = errors.New("no backend available")
+
+// latencyDecay weighs each new latency sample in a backend's moving
+// average.
+const latencyDecay = 0.2
+
+// Backend is a server a Balancer can send reads to.
+type Backend struct {
+	ID   string `json:"id"`
+	Addr string `json:"addr"`
+	// LagOps and LagSeconds are how far the backend's data is behind.
+	LagOps     int64   `json:"lag_ops"`
+	LagSeconds float64 `json:"lag_seconds"`
+}
+
+// BackendStats is a Backend with what its balancer has seen of it.
+type BackendStats struct {
+	Backend
+	Outstanding int64   `json:"outstanding"`
+	LatencyMs   float64 `json:"latency_ms"`
+	Requests    int64   `json:"requests"`
+	Errors      int64   `json:"errors"`
+}
+
+// BalancePolicy chooses among backends, all of which are candidates. key
+// identifies the request for policies that keep related requests together.
+// It returns an index into backends.
+type BalancePolicy interface {
+	Name() string
+	Pick(key string, backends []BackendStats) int
+}
+
+// Balancer spreads requests over a changing set of backends, tracking their
+// outstanding requests and latency for the policy.
+type Balancer struct {
+	mu       sync.Mutex
+	policy   BalancePolicy
+	backends []*BackendStats
+}
+
+func NewBalancer(policy BalancePolicy) *Balancer {
+	return &Balancer{policy: policy}
+}
+
+func (b *Balancer) Policy() string {
+	return b.policy.Name()
+}
+
+// SetBackends replaces the set of backends, keeping the statistics of those
+// already known.
+func (b *Balancer) SetBackends(backends []Backend) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	known := make(map[string]*BackendStats, len(b.backends))
+	for _, s := range b.backends {
+		known[s.ID] = s
+	}
+	next := make([]*BackendStats, 0, len(backends))
+	for _, be := range backends {
+		s, ok := known[be.ID]
+		if !ok {
+			s = &BackendStats{}
+		}
+		s.Backend = be
+		next = append(next, s)
+	}
+	sort.Slice(next, func(i, j int) bool { return next[i].ID < next[j].ID })
+	b.backends = next
+}
+
+// Pick chooses a backend for the request identified by key. The caller
+// must call done with the request's outcome.
+func (b *Balancer) Pick(key string) (Backend, func(err error), error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if len(b.backends) == 0 {
+		return Backend{}, nil, ErrNoBackend
+	}
+	candidates := make([]BackendStats, len(b.backends))
+	for i, s := range b.backends {
+		candidates[i] = *s
+	}
+	s := b.backends[b.policy.Pick(key, candidates)]
+	s.Outstanding++
+	s.Requests++
+
+	start := time.Now()
+	var once sync.Once
+	done := func(err error) {
+		once.Do(func() {
+			b.mu.Lock()
+			defer b.mu.Unlock()
+
+			s.Outstanding--
+			if err != nil {
+				s.Errors++
+				return
+			}
+			ms := float64(time.Since(start).Microseconds()) / 1000
+			if s.LatencyMs == 0 {
+				s.LatencyMs = ms
+			} else {
+				s.LatencyMs += latencyDecay * (ms - s.LatencyMs)
+			}
+		})
+	}
+	return s.Backend, done, nil
+}
+
+func (b *Balancer) Stats() []BackendStats {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	stats := make([]BackendStats, len(b.backends))
+	for i, s := range b.backends {
+		stats[i] = *s
+	}
+	return stats
+}
+
+// ParseBalancePolicy returns the named policy. A positive maxLagOps or
+// maxLagSeconds makes it lag-aware.
+func ParseBalancePolicy(name string, maxLagOps int64, maxLagSeconds float64) (BalancePolicy, error) {
+	var policy BalancePolicy
+	switch name {
+	case BalanceRoundRobin:
+		policy = &RoundRobin{}
+	case BalanceLeastOutstanding:
+		policy = LeastOutstanding{}
+	case BalanceLatencyWeighted:
+		policy = LatencyWeighted{}
+	case BalanceConsistentHash:
+		policy = &ConsistentHash{Replicas: 100}
+	default:
+		return nil, fmt.Errorf("unknown balance policy %q", name)
+	}
+	if maxLagOps > 0 || maxLagSeconds > 0 {
+		policy = LagAware{MaxOps: maxLagOps, MaxSeconds: maxLagSeconds, Then: policy}
+	}
+	return policy, nil
+}
+
+// RoundRobin takes the backends in turn.
+type RoundRobin struct {
+	mu   sync.Mutex
+	next int
+}
+
+func (p *RoundRobin) Name() string { return BalanceRoundRobin }
+
+func (p *RoundRobin) Pick(key string, backends []BackendStats) int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	i := p.next % len(backends)
+	p.next = i + 1
+	return i
+}
+
+// LeastOutstanding takes the backend with the fewest requests in flight,
+// the faster one on a tie.
+type LeastOutstanding struct{}
+
+func (LeastOutstanding) Name() string { return BalanceLeastOutstanding }
+
+func (LeastOutstanding) Pick(key string, backends []BackendStats) int {
+	best := 0
+	for i, s := range backends[1:] {
+		b := backends[best]
+		if s.Outstanding < b.Outstanding || (s.Outstanding == b.Outstanding && s.LatencyMs < b.LatencyMs) {
+			best = i + 1
+		}
+	}
+	return best
+}
+
+// LatencyWeighted picks at random, weighting each backend by the inverse of
+// its average latency. Backends without samples yet are weighted like the
+// fastest one, so they get tried.
+type LatencyWeighted struct{}
+
+func (LatencyWeighted) Name() string { return BalanceLatencyWeighted }
+
+func (LatencyWeighted) Pick(key string, backends []BackendStats) int {
+	fastest := 0.0
+	for _, s := range backends {
+		if s.LatencyMs > 0 && (fastest == 0 || s.LatencyMs < fastest) {
+			fastest = s.LatencyMs
+		}
+	}
+	weights := make([]float64, len(backends))
+	total := 0.0
+	for i, s := range backends {
+		latency := s.LatencyMs
+		if latency == 0 {
+			latency = fastest
+		}
+		weights[i] = 1 / (latency + 0.1)
+		total += weights[i]
+	}
+	r := rand.Float64() * total
+	for i, w := range weights {
+		if r < w {
+			return i
+		}
+		r -= w
+	}
+	return len(backends) - 1
+}
+
+// ConsistentHash sends requests with the same key to the same backend, and
+// moves only a small share of keys when backends come or go.
+type ConsistentHash struct {
+	// Replicas is the number of points each backend has on the ring.
+	Replicas int
+
+	mu      sync.Mutex
+	members string
+	ring    []hashPoint
+}
+
+type hashPoint struct {
+	hash uint32
+	id   string
+}
+
+func (p *ConsistentHash) Name() string { return BalanceConsistentHash }
+
+// hash32 is FNV-1a followed by murmur3's finalizer, which spreads keys
+// differing only in their last bytes around the ring.
+func hash32(s string) uint32 {
+	h := fnv.New32a()
+	h.Write([]byte(s))
+	x := h.Sum32()
+	x ^= x >> 16
+	x *= 0x85ebca6b
+	x ^= x >> 13
+	x *= 0xc2b2ae35
+	x ^= x >> 16
+	return x
+}
+
+func (p *ConsistentHash) Pick(key string, backends []BackendStats) int {
+	ids := make([]string, len(backends))
+	for i, s := range backends {
+		ids[i] = s.ID
+	}
+
+	p.mu.Lock()
+	if members := strings.Join(ids, "\x00"); members != p.members {
+		p.members = members
+		p.ring = p.ring[:0]
+		for _, id := range ids {
+			for r := 0; r < max(p.Replicas, 1); r++ {
+				p.ring = append(p.ring, hashPoint{hash32(fmt.Sprintf("%s#%d", id, r)), id})
+			}
+		}
+		sort.Slice(p.ring, func(i, j int) bool { return p.ring[i].hash < p.ring[j].hash })
+	}
+	h := hash32(key)
+	i := sort.Search(len(p.ring), func(i int) bool { return p.ring[i].hash >= h })
+	if i == len(p.ring) {
+		i = 0
+	}
+	id := p.ring[i].id
+	p.mu.Unlock()
+
+	for i, s := range backends {
+		if s.ID == id {
+			return i
+		}
+	}
+	return 0
+}
+
+// LagAware leaves out backends further behind than MaxOps entries or
+// MaxSeconds, then lets Then choose. When every backend is too far behind
+// it takes the least lagged, measuring each lag as a share of its limit.
+type LagAware struct {
+	MaxOps     int64
+	MaxSeconds float64
+	Then       BalancePolicy
+}
+
+func (p LagAware) Name() string { return "lag-aware " + p.Then.Name() }
+
+func (p LagAware) Pick(key string, backends []BackendStats) int {
+	var fresh []int
+	least := 0
+	for i, s := range backends {
+		if (p.MaxOps <= 0 || s.LagOps <= p.MaxOps) && (p.MaxSeconds <= 0 || s.LagSeconds <= p.MaxSeconds) {
+			fresh = append(fresh, i)
+		}
+		if p.overshoot(s) < p.overshoot(backends[least]) {
+			least = i
+		}
+	}
+	if len(fresh) == 0 {
+		return least
+	}
+	candidates := make([]BackendStats, len(fresh))
+	for i, idx := range fresh {
+		candidates[i] = backends[idx]
+	}
+	return fresh[p.Then.Pick(key, candidates)]
+}
+
+// overshoot is how far s is behind relative to the limits that are set, the
+// worse of the two when both are.
+func (p LagAware) overshoot(s BackendStats) float64 {
+	worst := 0.0
+	if p.MaxOps > 0 {
+		worst = float64(s.LagOps) / float64(p.MaxOps)
+	}
+	if p.MaxSeconds > 0 {
+		worst = math.Max(worst, s.LagSeconds/p.MaxSeconds)
+	}
+	return worst
+}
@@ -0,0 +1,251 @@
+package shared
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+)
+
+func backendsWith(stats ...BackendStats) []BackendStats {
+	for i := range stats {
+		if stats[i].ID == "" {
+			stats[i].ID = fmt.Sprintf("s%d", i)
+		}
+	}
+	return stats
+}
+
+func TestBalancePolicies(t *testing.T) {
+	tests := []struct {
+		name     string
+		policy   BalancePolicy
+		backends []BackendStats
+		// want is the index picked by consecutive calls.
+		want []int
+	}{
+		{
+			name:     "round robin takes turns",
+			policy:   &RoundRobin{},
+			backends: backendsWith(BackendStats{}, BackendStats{}, BackendStats{}),
+			want:     []int{0, 1, 2, 0},
+		},
+		{
+			name:     "least outstanding",
+			policy:   LeastOutstanding{},
+			backends: backendsWith(BackendStats{Outstanding: 3}, BackendStats{Outstanding: 1}, BackendStats{Outstanding: 2}),
+			want:     []int{1},
+		},
+		{
+			name:     "least outstanding prefers the faster on a tie",
+			policy:   LeastOutstanding{},
+			backends: backendsWith(BackendStats{Outstanding: 1, LatencyMs: 9}, BackendStats{Outstanding: 1, LatencyMs: 2}),
+			want:     []int{1},
+		},
+		{
+			name:   "lag aware leaves out lagging backends",
+			policy: LagAware{MaxOps: 10, Then: &RoundRobin{}},
+			backends: backendsWith(
+				BackendStats{Backend: Backend{LagOps: 50}},
+				BackendStats{Backend: Backend{LagOps: 5}},
+				BackendStats{Backend: Backend{LagOps: 10}},
+			),
+			want: []int{1, 2, 1},
+		},
+		{
+			name:   "lag aware checks seconds too",
+			policy: LagAware{MaxOps: 10, MaxSeconds: 1, Then: &RoundRobin{}},
+			backends: backendsWith(
+				BackendStats{Backend: Backend{LagOps: 1, LagSeconds: 5}},
+				BackendStats{Backend: Backend{LagOps: 9, LagSeconds: 0.5}},
+			),
+			want: []int{1, 1},
+		},
+		{
+			name:   "all lagging falls back to the least lagged entries",
+			policy: LagAware{MaxOps: 10, Then: &RoundRobin{}},
+			backends: backendsWith(
+				BackendStats{Backend: Backend{LagOps: 50}},
+				BackendStats{Backend: Backend{LagOps: 20}},
+			),
+			want: []int{1, 1},
+		},
+		{
+			name:   "all lagging falls back to the least lagged seconds",
+			policy: LagAware{MaxSeconds: 1, Then: &RoundRobin{}},
+			backends: backendsWith(
+				BackendStats{Backend: Backend{LagSeconds: 30}},
+				BackendStats{Backend: Backend{LagSeconds: 2}},
+			),
+			want: []int{1, 1},
+		},
+		{
+			name:   "all lagging weighs both limits",
+			policy: LagAware{MaxOps: 10, MaxSeconds: 1, Then: &RoundRobin{}},
+			backends: backendsWith(
+				BackendStats{Backend: Backend{LagOps: 11, LagSeconds: 40}},
+				BackendStats{Backend: Backend{LagOps: 30, LagSeconds: 2}},
+			),
+			want: []int{1},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for call, want := range tt.want {
+				if got := tt.policy.Pick("key", tt.backends); got != want {
+					t.Errorf("call %d picked %d, want %d", call, got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestLatencyWeighted(t *testing.T) {
+	tests := []struct {
+		name     string
+		backends []BackendStats
+		// minShare is the least share of picks the first backend must get.
+		minShare float64
+		maxShare float64
+	}{
+		{
+			name:     "faster backend gets most reads",
+			backends: backendsWith(BackendStats{LatencyMs: 1}, BackendStats{LatencyMs: 20}),
+			minShare: 0.85,
+			maxShare: 1,
+		},
+		{
+			name:     "unsampled backend is weighted like the fastest",
+			backends: backendsWith(BackendStats{}, BackendStats{LatencyMs: 5}),
+			minShare: 0.4,
+			maxShare: 0.6,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			const picks = 4000
+			first := 0
+			for i := 0; i < picks; i++ {
+				if (LatencyWeighted{}).Pick("", tt.backends) == 0 {
+					first++
+				}
+			}
+			if share := float64(first) / picks; share < tt.minShare || share > tt.maxShare {
+				t.Errorf("first backend got %.2f of reads, want between %.2f and %.2f", share, tt.minShare, tt.maxShare)
+			}
+		})
+	}
+}
+
+func TestConsistentHash(t *testing.T) {
+	all := backendsWith(BackendStats{}, BackendStats{}, BackendStats{}, BackendStats{})
+	p := &ConsistentHash{Replicas: 100}
+
+	keys := make([]string, 1000)
+	before := make(map[string]string, len(keys))
+	counts := make(map[string]int)
+	for i := range keys {
+		keys[i] = fmt.Sprintf("SELECT * FROM t WHERE id = %d", i)
+		id := all[p.Pick(keys[i], all)].ID
+		before[keys[i]] = id
+		counts[id]++
+	}
+	for _, b := range all {
+		if counts[b.ID] < len(keys)/len(all)/2 {
+			t.Errorf("%s got %d of %d keys", b.ID, counts[b.ID], len(keys))
+		}
+	}
+	for _, key := range keys[:50] {
+		if got := all[p.Pick(key, all)].ID; got != before[key] {
+			t.Errorf("%q moved from %s to %s without a membership change", key, before[key], got)
+		}
+	}
+
+	// Dropping a backend moves only the keys it held.
+	rest := append([]BackendStats{}, all[:2]...)
+	rest = append(rest, all[3])
+	for _, key := range keys {
+		got := rest[p.Pick(key, rest)].ID
+		if before[key] != all[2].ID && got != before[key] {
+			t.Errorf("%q moved from %s to %s when %s left", key, before[key], got, all[2].ID)
+		}
+	}
+}
+
+func TestParseBalancePolicy(t *testing.T) {
+	tests := []struct {
+		name       string
+		maxOps     int64
+		maxSeconds float64
+		want       string
+		wantErr    bool
+	}{
+		{name: BalanceRoundRobin, want: "round-robin"},
+		{name: BalanceLeastOutstanding, want: "least-outstanding"},
+		{name: BalanceLatencyWeighted, want: "latency-weighted"},
+		{name: BalanceConsistentHash, want: "consistent-hash"},
+		{name: BalanceRoundRobin, maxOps: 10, want: "lag-aware round-robin"},
+		{name: BalanceConsistentHash, maxSeconds: 2, want: "lag-aware consistent-hash"},
+		{name: "random", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.want, func(t *testing.T) {
+			policy, err := ParseBalancePolicy(tt.name, tt.maxOps, tt.maxSeconds)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("ParseBalancePolicy(%q) = %s, want an error", tt.name, policy.Name())
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if policy.Name() != tt.want {
+				t.Errorf("Name() = %q, want %q", policy.Name(), tt.want)
+			}
+		})
+	}
+}
+
+func TestBalancerTracksRequests(t *testing.T) {
+	b := NewBalancer(LeastOutstanding{})
+	if _, _, err := b.Pick("q"); !errors.Is(err, ErrNoBackend) {
+		t.Fatalf("Pick without backends: got %v, want ErrNoBackend", err)
+	}
+	b.SetBackends([]Backend{{ID: "b", Addr: "b:1"}, {ID: "a", Addr: "a:1"}})
+
+	first, doneFirst, err := b.Pick("q")
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, doneSecond, _ := b.Pick("q")
+	if first.ID != "a" || second.ID != "b" {
+		t.Errorf("picked %s then %s, want a then b", first.ID, second.ID)
+	}
+	doneFirst(nil)
+	doneFirst(nil)
+	doneSecond(errors.New("lost"))
+
+	// New backends keep the statistics of those already known.
+	b.SetBackends([]Backend{{ID: "a", Addr: "a:2"}, {ID: "b", Addr: "b:1"}, {ID: "c", Addr: "c:1"}})
+	tests := []struct {
+		id          string
+		addr        string
+		outstanding int64
+		requests    int64
+		errors      int64
+	}{
+		{id: "a", addr: "a:2", requests: 1},
+		{id: "b", addr: "b:1", requests: 1, errors: 1},
+		{id: "c", addr: "c:1"},
+	}
+	stats := b.Stats()
+	if len(stats) != len(tests) {
+		t.Fatalf("%d backends, want %d", len(stats), len(tests))
+	}
+	for i, tt := range tests {
+		s := stats[i]
+		if s.ID != tt.id || s.Addr != tt.addr || s.Outstanding != tt.outstanding || s.Requests != tt.requests || s.Errors != tt.errors {
+			t.Errorf("stats[%d] = %+v, want %+v", i, s, tt)
+		}
+	}
+}
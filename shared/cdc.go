@@ -0,0 +1,83 @@
+package shared
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// ChangeStatement is the Op of a change event for a write whose rows were
+// not captured; the event carries the statement instead of row images.
+const ChangeStatement = "statement"
+
+// ChangeEvent is one change published to change data capture subscribers.
+// Events are ordered by Position, the write's replication log position, and
+// then by Index within the write. ID is "position:index".
+type ChangeEvent struct {
+	ID        string                 `json:"id"`
+	Position  int64                  `json:"position"`
+	Index     int                    `json:"index"`
+	Timestamp int64                  `json:"timestamp"`
+	DB        string                 `json:"db,omitempty"`
+	Table     string                 `json:"table,omitempty"`
+	Op        string                 `json:"op"`
+	Key       []string               `json:"key,omitempty"`
+	Before    map[string]interface{} `json:"before,omitempty"`
+	After     map[string]interface{} `json:"after,omitempty"`
+	Query     string                 `json:"query,omitempty"`
+}
+
+// ChangeEvents returns the events of a replication log entry.
+func ChangeEvents(entry ReplicationEntry) []ChangeEvent {
+	base := ChangeEvent{Position: entry.Position, Timestamp: entry.Timestamp}
+	if !entry.Captured {
+		ev := base
+		ev.ID = fmt.Sprintf("%d:0", entry.Position)
+		ev.Op = ChangeStatement
+		ev.Query = entry.Query
+		if tables := ReferencedTables(entry.Query); len(tables) > 0 {
+			ev.Table = tables[0]
+		}
+		return []ChangeEvent{ev}
+	}
+	events := make([]ChangeEvent, len(entry.Changes))
+	for i, c := range entry.Changes {
+		ev := base
+		ev.ID = fmt.Sprintf("%d:%d", entry.Position, i)
+		ev.Index = i
+		ev.DB, ev.Table, ev.Op, ev.Key = c.DB, c.Table, c.Op, c.Key
+		ev.Before, ev.After = c.Before, c.After
+		events[i] = ev
+	}
+	return events
+}
+
+// ChangeCursor is where a subscription resumes: after event Index of the
+// write at Position.
+type ChangeCursor struct {
+	Position int64
+	Index    int
+}
+
+// ParseChangeCursor reads a cursor given as an event ID, "position:index",
+// or as a bare position, which resumes after every event of that write.
+func ParseChangeCursor(s string) (ChangeCursor, error) {
+	pos, index, partial := strings.Cut(strings.TrimSpace(s), ":")
+	c := ChangeCursor{Index: math.MaxInt}
+	var err error
+	if c.Position, err = strconv.ParseInt(pos, 10, 64); err != nil || c.Position < 0 {
+		return ChangeCursor{}, fmt.Errorf("invalid change cursor %q", s)
+	}
+	if partial {
+		if c.Index, err = strconv.Atoi(index); err != nil || c.Index < 0 {
+			return ChangeCursor{}, fmt.Errorf("invalid change cursor %q", s)
+		}
+	}
+	return c, nil
+}
+
+// After reports whether ev comes after the cursor.
+func (c ChangeCursor) After(ev ChangeEvent) bool {
+	return ev.Position > c.Position || (ev.Position == c.Position && ev.Index > c.Index)
+}
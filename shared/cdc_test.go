@@ -0,0 +1,106 @@
+package shared
+
+import (
+	"math"
+	"reflect"
+	"testing"
+)
+
+func TestParseChangeCursor(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    ChangeCursor
+		wantErr bool
+	}{
+		{in: "12:3", want: ChangeCursor{Position: 12, Index: 3}},
+		{in: " 0:0 ", want: ChangeCursor{Position: 0, Index: 0}},
+		{in: "12", want: ChangeCursor{Position: 12, Index: math.MaxInt}},
+		{in: "", wantErr: true},
+		{in: "12:", wantErr: true},
+		{in: ":3", wantErr: true},
+		{in: "-1", wantErr: true},
+		{in: "12:-1", wantErr: true},
+		{in: "12:3:4", wantErr: true},
+		{in: "abc", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.in, func(t *testing.T) {
+			got, err := ParseChangeCursor(tt.in)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("ParseChangeCursor(%q) = %+v, want an error", tt.in, got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("ParseChangeCursor(%q): %v", tt.in, err)
+			}
+			if got != tt.want {
+				t.Errorf("ParseChangeCursor(%q) = %+v, want %+v", tt.in, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestChangeCursorAfter(t *testing.T) {
+	tests := []struct {
+		cursor string
+		event  ChangeEvent
+		want   bool
+	}{
+		{cursor: "5:1", event: ChangeEvent{Position: 5, Index: 2}, want: true},
+		{cursor: "5:1", event: ChangeEvent{Position: 5, Index: 1}, want: false},
+		{cursor: "5:1", event: ChangeEvent{Position: 4, Index: 9}, want: false},
+		{cursor: "5:1", event: ChangeEvent{Position: 6, Index: 0}, want: true},
+		{cursor: "5", event: ChangeEvent{Position: 5, Index: 100}, want: false},
+		{cursor: "5", event: ChangeEvent{Position: 6, Index: 0}, want: true},
+	}
+	for _, tt := range tests {
+		c, err := ParseChangeCursor(tt.cursor)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := c.After(tt.event); got != tt.want {
+			t.Errorf("cursor %s After(%d:%d) = %v, want %v", tt.cursor, tt.event.Position, tt.event.Index, got, tt.want)
+		}
+	}
+}
+
+func TestChangeEvents(t *testing.T) {
+	tests := []struct {
+		name  string
+		entry ReplicationEntry
+		want  []ChangeEvent
+	}{
+		{
+			name:  "uncaptured statement",
+			entry: ReplicationEntry{Position: 7, Timestamp: 100, Query: "UPDATE shop.orders SET x = 1"},
+			want: []ChangeEvent{
+				{ID: "7:0", Position: 7, Timestamp: 100, Table: "orders", Op: ChangeStatement, Query: "UPDATE shop.orders SET x = 1"},
+			},
+		},
+		{
+			name: "captured rows",
+			entry: ReplicationEntry{Position: 8, Timestamp: 200, Captured: true, Changes: []RowChange{
+				{DB: "shop", Table: "orders", Op: RowInsert, Key: []string{"id"}, After: map[string]interface{}{"id": "1"}},
+				{DB: "shop", Table: "orders", Op: RowDelete, Key: []string{"id"}, Before: map[string]interface{}{"id": "2"}},
+			}},
+			want: []ChangeEvent{
+				{ID: "8:0", Position: 8, Timestamp: 200, DB: "shop", Table: "orders", Op: RowInsert, Key: []string{"id"}, After: map[string]interface{}{"id": "1"}},
+				{ID: "8:1", Position: 8, Index: 1, Timestamp: 200, DB: "shop", Table: "orders", Op: RowDelete, Key: []string{"id"}, Before: map[string]interface{}{"id": "2"}},
+			},
+		},
+		{
+			name:  "captured write that changed nothing",
+			entry: ReplicationEntry{Position: 9, Captured: true},
+			want:  []ChangeEvent{},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := ChangeEvents(tt.entry); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("ChangeEvents() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
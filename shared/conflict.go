@@ -0,0 +1,91 @@
+package shared
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Conflict resolution policies for writes merged from partitioned slaves.
+const (
+	ConflictLastWriterWins = "lww"
+	ConflictMasterWins     = "master-wins"
+	ConflictHook           = "hook"
+)
+
+// Conflict resolutions: keep the slave's row, keep the master's, or write a
+// row supplied by the conflict hook.
+const (
+	ResolvedLocal  = "local"
+	ResolvedMaster = "master"
+	ResolvedMerged = "merged"
+)
+
+// LocalWrite is a write a slave took while it could not reach the master.
+// Base is the master log position the slave had applied when it took the
+// write; the master treats anything it logged after Base as concurrent.
+type LocalWrite struct {
+	Seq       int64       `json:"seq"`
+	Base      int64       `json:"base"`
+	Version   HLC         `json:"version"`
+	Timestamp int64       `json:"timestamp"`
+	Query     string      `json:"query"`
+	Changes   []RowChange `json:"changes"`
+}
+
+// Conflict is a row changed both by a partitioned slave and, concurrently,
+// on the master. Remote is the master's latest change to the row, or is nil
+// when the master changed it with a statement whose rows were not captured,
+// given in RemoteQuery. Applied is the change written to settle it, if any.
+type Conflict struct {
+	ID             string     `json:"id"`
+	Time           int64      `json:"time"`
+	NodeID         string     `json:"node_id"`
+	Seq            int64      `json:"seq"`
+	Query          string     `json:"query"`
+	DB             string     `json:"db"`
+	Table          string     `json:"table"`
+	Local          RowChange  `json:"local"`
+	LocalVersion   HLC        `json:"local_version"`
+	Remote         *RowChange `json:"remote,omitempty"`
+	RemoteQuery    string     `json:"remote_query,omitempty"`
+	RemotePosition int64      `json:"remote_position"`
+	RemoteVersion  HLC        `json:"remote_version"`
+	Policy         string     `json:"policy"`
+	Resolution     string     `json:"resolution"`
+	Applied        *RowChange `json:"applied,omitempty"`
+	Error          string     `json:"error,omitempty"`
+}
+
+// ConflictDecision is a conflict hook's answer. Row is the row to write for
+// ResolvedMerged; a nil Row deletes it.
+type ConflictDecision struct {
+	Resolution string                 `json:"resolution"`
+	Row        map[string]interface{} `json:"row,omitempty"`
+}
+
+func ValidConflictPolicy(policy string) bool {
+	switch policy {
+	case ConflictLastWriterWins, ConflictMasterWins, ConflictHook:
+		return true
+	}
+	return false
+}
+
+// RowID names the row a change writes, the same way on every node.
+func RowID(c RowChange) string {
+	var b strings.Builder
+	b.WriteString(strings.ToLower(c.DB + "." + c.Table))
+	for _, v := range c.KeyValues() {
+		fmt.Fprintf(&b, "\x00%v", v)
+	}
+	return b.String()
+}
+
+// KeyImage is an image holding just the primary key of the row c writes.
+func KeyImage(c RowChange) map[string]interface{} {
+	image := make(map[string]interface{}, len(c.Key))
+	for i, v := range c.KeyValues() {
+		image[c.Key[i]] = v
+	}
+	return image
+}
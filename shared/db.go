@@ -1,72 +1,75 @@
 package shared
 
 import (
+	"context"
 	"database/sql"
 	"fmt"
+	"strconv"
 	"strings"
-
-	_ "github.com/go-sql-driver/mysql"
+	"sync"
+	"time"
 )
 
-type DBConfig struct {
-	Username string
-	Password string
-	Host     string
-	Port     string
-}
-
 type DBHandler struct {
-	db *sql.DB
-}
+	db     *sql.DB
+	config *DBConfig
 
-func NewDBConfig(username, password, host, port string) *DBConfig {
-	return &DBConfig{
-		Username: username,
-		Password: password,
-		Host:     host,
-		Port:     port,
-	}
+	runningMu sync.Mutex
+	running   map[string]*runningQuery
+
+	// connIDs caches the MySQL thread ID of each pooled connection, keyed
+	// by its driver connection.
+	connIDsMu sync.Mutex
+	connIDs   map[interface{}]int64
+
+	// keys caches primary key columns by lower-cased db.table.
+	keysMu sync.Mutex
+	keys   map[string][]string
 }
 
 func NewDBHandler(config *DBConfig) (*DBHandler, error) {
-	dsn := fmt.Sprintf("%s:%s@tcp(%s:%s)/",
-		config.Username,
-		config.Password,
-		config.Host,
-		config.Port,
-	)
+	dsn, err := config.DSN()
+	if err != nil {
+		return nil, err
+	}
 
 	db, err := sql.Open("mysql", dsn)
 	if err != nil {
 		return nil, fmt.Errorf("failed to connect to database: %v", err)
 	}
+	config.applyPool(db)
 
 	if err := db.Ping(); err != nil {
 		return nil, fmt.Errorf("failed to ping database: %v", err)
 	}
 
-	return &DBHandler{db: db}, nil
+	return &DBHandler{db: db, config: config, running: make(map[string]*runningQuery)}, nil
 }
 
 func (h *DBHandler) CreateDatabase(dbName string) error {
 	query := fmt.Sprintf("CREATE DATABASE IF NOT EXISTS %s", dbName)
-	_, err := h.db.Exec(query)
+	_, err := h.exec(query)
 	return err
 }
 
 func (h *DBHandler) DropDatabase(dbName string) error {
 	query := fmt.Sprintf("DROP DATABASE IF EXISTS %s", dbName)
-	_, err := h.db.Exec(query)
+	_, err := h.exec(query)
 	return err
 }
 
 func (h *DBHandler) UseDatabase(dbName string) error {
 	query := fmt.Sprintf("USE %s", dbName)
-	_, err := h.db.Exec(query)
+	_, err := h.exec(query)
 	return err
 }
 
 func (h *DBHandler) CreateTable(req *CreateTableRequest) error {
+	_, err := h.exec(CreateTableQuery(req))
+	return err
+}
+
+func CreateTableQuery(req *CreateTableRequest) string {
 	columns := make([]string, len(req.Columns))
 	for i, col := range req.Columns {
 		nullable := "NOT NULL"
@@ -80,61 +83,150 @@ func (h *DBHandler) CreateTable(req *CreateTableRequest) error {
 		columns[i] = fmt.Sprintf("%s %s %s %s", col.Name, col.Type, nullable, defaultVal)
 	}
 
-	query := fmt.Sprintf("CREATE TABLE IF NOT EXISTS %s.%s (%s)",
+	return fmt.Sprintf("CREATE TABLE IF NOT EXISTS %s.%s (%s)",
 		req.DBName, req.TableName, strings.Join(columns, ", "))
-	_, err := h.db.Exec(query)
-	return err
 }
 
 func (h *DBHandler) DropTable(dbName, tableName string) error {
 	query := fmt.Sprintf("DROP TABLE IF EXISTS %s.%s", dbName, tableName)
-	_, err := h.db.Exec(query)
+	_, err := h.exec(query)
 	return err
 }
 
-func (h *DBHandler) ExecuteQuery(query string) (int64, error) {
+func (h *DBHandler) exec(query string) (sql.Result, error) {
+	start := time.Now()
 	result, err := h.db.Exec(query)
-	if err != nil {
-		return 0, err
-	}
-	return result.RowsAffected()
+	ObserveQuery(query, start, err)
+	return result, err
+}
+
+func (h *DBHandler) ExecuteQuery(query string) (int64, error) {
+	return h.ExecuteQueryContext(context.Background(), query)
+}
+
+// ExecuteQueryContext runs a statement that returns no rows, killing it in
+// MySQL if ctx ends first.
+func (h *DBHandler) ExecuteQueryContext(ctx context.Context, query string) (int64, error) {
+	var affected int64
+	start := time.Now()
+	err := h.run(ctx, query, func(ctx context.Context, q queryer) error {
+		result, err := q.ExecContext(ctx, query)
+		if err != nil {
+			return err
+		}
+		affected, err = result.RowsAffected()
+		return err
+	})
+	ObserveQuery(query, start, err)
+	return affected, err
 }
 
 func (h *DBHandler) QueryRows(query string) (*sql.Rows, error) {
-	return h.db.Query(query)
+	return h.QueryRowsContext(context.Background(), query)
+}
+
+// QueryRowsContext starts a query on the shared pool. Cancelling ctx only
+// drops the client connection; use SelectRowsContext to have the statement
+// killed in MySQL and listed among the running queries.
+func (h *DBHandler) QueryRowsContext(ctx context.Context, query string) (*sql.Rows, error) {
+	start := time.Now()
+	rows, err := h.db.QueryContext(ctx, query)
+	ObserveQuery(query, start, err)
+	return rows, err
+}
+
+// SelectRows runs a query and returns its column names and rows, with byte
+// slices converted to strings so they encode cleanly as JSON.
+func (h *DBHandler) SelectRows(query string) ([]string, [][]interface{}, error) {
+	return h.SelectRowsContext(context.Background(), query)
+}
+
+// SelectRowsContext is SelectRows bounded by ctx, killing the query in MySQL
+// if ctx ends before all rows are read.
+func (h *DBHandler) SelectRowsContext(ctx context.Context, query string) ([]string, [][]interface{}, error) {
+	var cols []string
+	var result [][]interface{}
+	start := time.Now()
+	err := h.run(ctx, query, func(ctx context.Context, q queryer) error {
+		rows, err := q.QueryContext(ctx, query)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+		cols, result, err = scanRows(rows)
+		return err
+	})
+	ObserveQuery(query, start, err)
+	if err != nil {
+		return nil, nil, err
+	}
+	return cols, result, nil
 }
 
-func (h *DBHandler) Close() error {
-	return h.db.Close()
+func scanRows(rows *sql.Rows) ([]string, [][]interface{}, error) {
+	cols, err := rows.Columns()
+	if err != nil {
+		return nil, nil, err
+	}
+	var result [][]interface{}
+	for rows.Next() {
+		vals := make([]interface{}, len(cols))
+		ptrs := make([]interface{}, len(cols))
+		for i := range vals {
+			ptrs[i] = &vals[i]
+		}
+		if err := rows.Scan(ptrs...); err != nil {
+			return nil, nil, err
+		}
+		for i, val := range vals {
+			if b, ok := val.([]byte); ok {
+				vals[i] = string(b)
+			}
+		}
+		result = append(result, vals)
+	}
+	return cols, result, rows.Err()
 }
 
-func (h *DBHandler) ReplicateData(req *ReplicationRequest) error {
-	switch req.Operation {
-	case "INSERT":
-		return h.handleInsert(req)
-	case "UPDATE":
-		return h.handleUpdate(req)
-	case "DELETE":
-		return h.handleDelete(req)
-	default:
-		return fmt.Errorf("unsupported operation: %s", req.Operation)
+// EstimateRowsExamined sums the optimizer's row estimates from EXPLAIN.
+func (h *DBHandler) EstimateRowsExamined(query string) (int64, error) {
+	cols, rows, err := h.SelectRows("EXPLAIN " + query)
+	if err != nil {
+		return 0, err
+	}
+	idx := -1
+	for i, col := range cols {
+		if strings.EqualFold(col, "rows") {
+			idx = i
+		}
 	}
+	if idx < 0 {
+		return 0, fmt.Errorf("EXPLAIN returned no rows column")
+	}
+	var total int64
+	for _, row := range rows {
+		if n, err := strconv.ParseInt(fmt.Sprint(row[idx]), 10, 64); err == nil {
+			total += n
+		}
+	}
+	return total, nil
 }
 
-func (h *DBHandler) handleInsert(req *ReplicationRequest) error {
-	query := fmt.Sprintf("INSERT INTO %s.%s VALUES (%s)", req.DBName, req.TableName, string(req.Data))
-	_, err := h.db.Exec(query)
-	return err
+func (h *DBHandler) Stats() sql.DBStats {
+	return h.db.Stats()
 }
 
-func (h *DBHandler) handleUpdate(req *ReplicationRequest) error {
-	query := fmt.Sprintf("UPDATE %s.%s SET %s", req.DBName, req.TableName, string(req.Data))
-	_, err := h.db.Exec(query)
-	return err
+func (h *DBHandler) Ping() error {
+	return h.db.Ping()
 }
 
-func (h *DBHandler) handleDelete(req *ReplicationRequest) error {
-	query := fmt.Sprintf("DELETE FROM %s.%s WHERE %s", req.DBName, req.TableName, string(req.Data))
-	_, err := h.db.Exec(query)
-	return err
+func (h *DBHandler) Close() error {
+	return h.db.Close()
+}
+
+func (h *DBHandler) ReplicateData(req *ReplicationRequest) error {
+	if len(req.Changes) == 0 {
+		return fmt.Errorf("no row changes to replicate")
+	}
+	return h.ApplyRowChanges(context.Background(), req.Changes)
 }
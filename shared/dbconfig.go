@@ -0,0 +1,170 @@
+package shared
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"database/sql"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/go-sql-driver/mysql"
+)
+
+type DBConfig struct {
+	Username string
+	Password string
+	Host     string
+	Port     string
+
+	// Pool limits. Zero MaxOpenConns, ConnMaxLifetime and ConnMaxIdleTime
+	// mean no limit; zero MaxIdleConns keeps database/sql's default of 2.
+	MaxOpenConns    int
+	MaxIdleConns    int
+	ConnMaxLifetime time.Duration
+	ConnMaxIdleTime time.Duration
+
+	// DSN options. DialTimeout, ReadTimeout and WriteTimeout of zero wait
+	// forever. TLS is a go-sql-driver mode: false, true, skip-verify or
+	// preferred; TLSCAFile verifies the server against the given CA instead.
+	DialTimeout  time.Duration
+	ReadTimeout  time.Duration
+	WriteTimeout time.Duration
+	TLS          string
+	TLSCAFile    string
+	ParseTime    bool
+	Charset      string
+}
+
+// NewDBConfig returns a config with the default pool limits and DSN options.
+func NewDBConfig(username, password, host, port string) *DBConfig {
+	return &DBConfig{
+		Username:        username,
+		Password:        password,
+		Host:            host,
+		Port:            port,
+		MaxOpenConns:    50,
+		MaxIdleConns:    10,
+		ConnMaxLifetime: 30 * time.Minute,
+		ConnMaxIdleTime: 5 * time.Minute,
+		DialTimeout:     5 * time.Second,
+		TLS:             "false",
+		Charset:         "utf8mb4",
+	}
+}
+
+// RegisterFlags adds flags for the pool limits and DSN options to fs, with
+// the current values as defaults.
+func (c *DBConfig) RegisterFlags(fs *flag.FlagSet) {
+	fs.IntVar(&c.MaxOpenConns, "db-max-open-conns", c.MaxOpenConns, "maximum open MySQL connections (0 means no limit)")
+	fs.IntVar(&c.MaxIdleConns, "db-max-idle-conns", c.MaxIdleConns, "maximum idle MySQL connections kept in the pool")
+	fs.DurationVar(&c.ConnMaxLifetime, "db-conn-max-lifetime", c.ConnMaxLifetime, "close MySQL connections older than this (0 disables)")
+	fs.DurationVar(&c.ConnMaxIdleTime, "db-conn-max-idle-time", c.ConnMaxIdleTime, "close MySQL connections idle for longer than this (0 disables)")
+	fs.DurationVar(&c.DialTimeout, "db-dial-timeout", c.DialTimeout, "timeout for connecting to MySQL (0 disables)")
+	fs.DurationVar(&c.ReadTimeout, "db-read-timeout", c.ReadTimeout, "I/O read timeout on MySQL connections; keep above -query-timeout (0 disables)")
+	fs.DurationVar(&c.WriteTimeout, "db-write-timeout", c.WriteTimeout, "I/O write timeout on MySQL connections (0 disables)")
+	fs.StringVar(&c.TLS, "db-tls", c.TLS, "TLS to MySQL: false, true, skip-verify or preferred")
+	fs.StringVar(&c.TLSCAFile, "db-tls-ca", c.TLSCAFile, "PEM file of the CA that signed the MySQL server certificate; enables verified TLS")
+	fs.BoolVar(&c.ParseTime, "db-parse-time", c.ParseTime, "return DATE and DATETIME columns as times instead of strings")
+	fs.StringVar(&c.Charset, "db-charset", c.Charset, "connection character set")
+}
+
+const customTLSConfig = "ddb-custom-ca"
+
+// DSN returns the go-sql-driver data source name for the config.
+func (c *DBConfig) DSN() (string, error) {
+	cfg := mysql.NewConfig()
+	cfg.User = c.Username
+	cfg.Passwd = c.Password
+	cfg.Net = "tcp"
+	cfg.Addr = net.JoinHostPort(c.Host, c.Port)
+	cfg.Timeout = c.DialTimeout
+	cfg.ReadTimeout = c.ReadTimeout
+	cfg.WriteTimeout = c.WriteTimeout
+	cfg.ParseTime = c.ParseTime
+	if c.Charset != "" {
+		cfg.Params = map[string]string{"charset": c.Charset}
+	}
+
+	cfg.TLSConfig = c.TLS
+	if c.TLSCAFile != "" {
+		pem, err := os.ReadFile(c.TLSCAFile)
+		if err != nil {
+			return "", fmt.Errorf("failed to read TLS CA file: %v", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return "", fmt.Errorf("no certificates found in %s", c.TLSCAFile)
+		}
+		if err := mysql.RegisterTLSConfig(customTLSConfig, &tls.Config{RootCAs: pool, ServerName: c.Host}); err != nil {
+			return "", fmt.Errorf("failed to register TLS config: %v", err)
+		}
+		cfg.TLSConfig = customTLSConfig
+	}
+	return cfg.FormatDSN(), nil
+}
+
+func (c *DBConfig) applyPool(db *sql.DB) {
+	db.SetMaxOpenConns(c.MaxOpenConns)
+	if c.MaxIdleConns > 0 {
+		db.SetMaxIdleConns(c.MaxIdleConns)
+	}
+	db.SetConnMaxLifetime(c.ConnMaxLifetime)
+	db.SetConnMaxIdleTime(c.ConnMaxIdleTime)
+}
+
+// PoolStats reports a node's MySQL connection pool: its configured limits
+// and current usage.
+type PoolStats struct {
+	MaxOpenConns      int     `json:"max_open_conns"`
+	MaxIdleConns      int     `json:"max_idle_conns"`
+	ConnMaxLifetime   string  `json:"conn_max_lifetime"`
+	ConnMaxIdleTime   string  `json:"conn_max_idle_time"`
+	OpenConnections   int     `json:"open_connections"`
+	InUse             int     `json:"in_use"`
+	Idle              int     `json:"idle"`
+	WaitCount         int64   `json:"wait_count"`
+	WaitDurationMs    float64 `json:"wait_duration_ms"`
+	MaxIdleClosed     int64   `json:"max_idle_closed"`
+	MaxIdleTimeClosed int64   `json:"max_idle_time_closed"`
+	MaxLifetimeClosed int64   `json:"max_lifetime_closed"`
+	RunningQueries    int     `json:"running_queries"`
+}
+
+func (h *DBHandler) PoolStats() PoolStats {
+	s := h.db.Stats()
+	stats := PoolStats{
+		MaxOpenConns:      s.MaxOpenConnections,
+		OpenConnections:   s.OpenConnections,
+		InUse:             s.InUse,
+		Idle:              s.Idle,
+		WaitCount:         s.WaitCount,
+		WaitDurationMs:    float64(s.WaitDuration) / float64(time.Millisecond),
+		MaxIdleClosed:     s.MaxIdleClosed,
+		MaxIdleTimeClosed: s.MaxIdleTimeClosed,
+		MaxLifetimeClosed: s.MaxLifetimeClosed,
+		RunningQueries:    len(h.RunningQueries()),
+	}
+	if h.config != nil {
+		stats.MaxIdleConns = h.config.MaxIdleConns
+		stats.ConnMaxLifetime = h.config.ConnMaxLifetime.String()
+		stats.ConnMaxIdleTime = h.config.ConnMaxIdleTime.String()
+	}
+	return stats
+}
+
+// PoolStatsHandler serves GET /api/admin/pool.
+func PoolStatsHandler(h *DBHandler) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(h.PoolStats())
+	}
+}
@@ -0,0 +1,88 @@
+package shared
+
+import (
+	"context"
+	"errors"
+	"sync"
+)
+
+var errShuttingDown = errors.New("shutting down")
+
+// DrainGroup counts in-flight work so shutdown can wait for it to finish.
+// After Close, Enter refuses new work.
+type DrainGroup struct {
+	mu     sync.Mutex
+	active int
+	closed bool
+	idle   chan struct{}
+}
+
+// Enter registers a unit of work. It returns false once the group is
+// closed, in which case the caller must not call Leave.
+func (g *DrainGroup) Enter() bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	if g.closed {
+		return false
+	}
+	g.active++
+	return true
+}
+
+func (g *DrainGroup) Leave() {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	g.active--
+	if g.active == 0 && g.idle != nil {
+		close(g.idle)
+		g.idle = nil
+	}
+}
+
+func (g *DrainGroup) Close() {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	g.closed = true
+}
+
+func (g *DrainGroup) Closed() bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	return g.closed
+}
+
+// Wait blocks until no work is in flight or ctx is done.
+func (g *DrainGroup) Wait(ctx context.Context) error {
+	g.mu.Lock()
+	if g.active == 0 {
+		g.mu.Unlock()
+		return nil
+	}
+	if g.idle == nil {
+		g.idle = make(chan struct{})
+	}
+	idle := g.idle
+	g.mu.Unlock()
+
+	select {
+	case <-idle:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// ShutdownCheck fails once g is closed, so a draining node reports itself
+// unready.
+func ShutdownCheck(g *DrainGroup) HealthCheck {
+	return HealthCheck{Name: "shutdown", Check: func() error {
+		if g.Closed() {
+			return errShuttingDown
+		}
+		return nil
+	}}
+}
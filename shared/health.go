@@ -0,0 +1,132 @@
+package shared
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// HealthCheck is one named readiness condition.
+type HealthCheck struct {
+	Name  string
+	Check func() error
+}
+
+type CheckResult struct {
+	Name       string  `json:"name"`
+	Status     string  `json:"status"`
+	DurationMs float64 `json:"duration_ms"`
+	Error      string  `json:"error,omitempty"`
+}
+
+type HealthReport struct {
+	Status        string        `json:"status"`
+	NodeID        string        `json:"node_id"`
+	Version       string        `json:"version"`
+	UptimeSeconds float64       `json:"uptime_seconds"`
+	Checks        []CheckResult `json:"checks,omitempty"`
+	Time          time.Time     `json:"time"`
+}
+
+const (
+	HealthOK   = "ok"
+	HealthFail = "fail"
+
+	// HealthCheckTimeout bounds a single check so a hung dependency makes
+	// the node unready instead of hanging the probe.
+	HealthCheckTimeout = 2 * time.Second
+)
+
+var processStart = time.Now()
+
+// RunHealthChecks runs the checks concurrently and reports fail if any of
+// them fails or times out.
+func RunHealthChecks(nodeID string, checks []HealthCheck) HealthReport {
+	report := HealthReport{
+		Status:        HealthOK,
+		NodeID:        nodeID,
+		Version:       Version,
+		UptimeSeconds: time.Since(processStart).Seconds(),
+		Checks:        make([]CheckResult, len(checks)),
+		Time:          time.Now(),
+	}
+
+	var wg sync.WaitGroup
+	for i, check := range checks {
+		wg.Add(1)
+		go func(i int, check HealthCheck) {
+			defer wg.Done()
+			report.Checks[i] = runHealthCheck(check)
+		}(i, check)
+	}
+	wg.Wait()
+
+	for _, result := range report.Checks {
+		if result.Status != HealthOK {
+			report.Status = HealthFail
+		}
+	}
+	return report
+}
+
+func runHealthCheck(check HealthCheck) CheckResult {
+	start := time.Now()
+	done := make(chan error, 1)
+	go func() { done <- check.Check() }()
+
+	var err error
+	select {
+	case err = <-done:
+	case <-time.After(HealthCheckTimeout):
+		err = fmt.Errorf("timed out after %v", HealthCheckTimeout)
+	}
+
+	result := CheckResult{
+		Name:       check.Name,
+		Status:     HealthOK,
+		DurationMs: float64(time.Since(start)) / float64(time.Millisecond),
+	}
+	if err != nil {
+		result.Status = HealthFail
+		result.Error = err.Error()
+	}
+	return result
+}
+
+// HealthHandler serves a health report built from checks, with status 200
+// when every check passes and 503 otherwise. /healthz passes no checks, so
+// it only shows that the process is serving requests.
+func HealthHandler(nodeID string, checks func() []HealthCheck) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		var list []HealthCheck
+		if checks != nil {
+			list = checks()
+		}
+		report := RunHealthChecks(nodeID, list)
+
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Cache-Control", "no-store")
+		if report.Status != HealthOK {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+		json.NewEncoder(w).Encode(report)
+	}
+}
+
+// RaftLeaderCheck passes while node knows of an elected leader, which a
+// leader only remains while it can reach a quorum.
+func RaftLeaderCheck(node *RaftNode) HealthCheck {
+	return HealthCheck{Name: "raft_quorum", Check: func() error {
+		if leader, _ := node.Leader(); leader == "" {
+			return fmt.Errorf("no raft leader")
+		}
+		return nil
+	}}
+}
@@ -0,0 +1,72 @@
+package shared
+
+import (
+	"testing"
+	"time"
+)
+
+func TestHLC(t *testing.T) {
+	tests := []struct {
+		name        string
+		wall        int64
+		logical     int64
+		wantLogical int64
+		want        string
+	}{
+		{name: "zero", want: "0.0"},
+		{name: "wall only", wall: 1700000000000, want: "1700000000000.0"},
+		{name: "wall and logical", wall: 1700000000000, logical: 7, wantLogical: 7, want: "1700000000000.7"},
+		{name: "logical wraps to 16 bits", wall: 5, logical: 1<<16 + 3, wantLogical: 3, want: "5.3"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := NewHLC(tt.wall, tt.logical)
+			if c.Wall() != tt.wall || c.Logical() != tt.wantLogical {
+				t.Errorf("NewHLC(%d, %d) = %d.%d", tt.wall, tt.logical, c.Wall(), c.Logical())
+			}
+			if c.String() != tt.want {
+				t.Errorf("String() = %q, want %q", c.String(), tt.want)
+			}
+		})
+	}
+
+	if !(NewHLC(1, 9) < NewHLC(2, 0) && NewHLC(2, 0) < NewHLC(2, 1)) {
+		t.Error("readings do not order by wall time, then logical counter")
+	}
+}
+
+func TestClock(t *testing.T) {
+	ahead := NewHLC(time.Now().Add(time.Hour).UnixMilli(), 5)
+	tests := []struct {
+		name    string
+		observe HLC
+		// want, if set, is the reading expected right after observing.
+		want HLC
+	}{
+		{name: "without observations"},
+		{name: "reading from the past is ignored", observe: NewHLC(1, 0)},
+		{name: "reading from ahead moves the clock past it", observe: ahead, want: ahead + 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := &Clock{}
+			before := NewHLC(time.Now().UnixMilli(), 0)
+			c.Observe(tt.observe)
+			first := c.Now()
+			if tt.want != 0 && first != tt.want {
+				t.Errorf("Now() = %s, want %s", first, tt.want)
+			}
+			if first < before {
+				t.Errorf("Now() = %s, before the wall clock at %s", first, before)
+			}
+			last := first
+			for i := 0; i < 1000; i++ {
+				next := c.Now()
+				if next <= last {
+					t.Fatalf("Now() went from %s to %s", last, next)
+				}
+				last = next
+			}
+		})
+	}
+}
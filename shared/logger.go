@@ -0,0 +1,198 @@
+package shared
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"time"
+)
+
+type LogLevel int
+
+const (
+	LevelDebug LogLevel = iota
+	LevelInfo
+	LevelWarn
+	LevelError
+)
+
+func (l LogLevel) String() string {
+	switch l {
+	case LevelDebug:
+		return "debug"
+	case LevelInfo:
+		return "info"
+	case LevelWarn:
+		return "warn"
+	case LevelError:
+		return "error"
+	}
+	return "unknown"
+}
+
+func ParseLogLevel(s string) (LogLevel, error) {
+	switch strings.ToLower(s) {
+	case "debug":
+		return LevelDebug, nil
+	case "info":
+		return LevelInfo, nil
+	case "warn", "warning":
+		return LevelWarn, nil
+	case "error":
+		return LevelError, nil
+	}
+	return LevelInfo, fmt.Errorf("unknown log level %q", s)
+}
+
+// LogEntry is one line of a node's log file.
+type LogEntry struct {
+	Timestamp time.Time   `json:"timestamp"`
+	Level     string      `json:"level"`
+	Type      string      `json:"type"`
+	Message   string      `json:"message"`
+	NodeID    string      `json:"node_id,omitempty"`
+	TraceID   string      `json:"trace_id,omitempty"`
+	SpanID    string      `json:"span_id,omitempty"`
+	Data      interface{} `json:"data,omitempty"`
+}
+
+// Logger writes LogEntry values as JSON lines.
+type Logger struct {
+	mu       sync.Mutex
+	out      io.Writer
+	nodeID   string
+	minLevel LogLevel
+	subs     map[chan LogEntry]struct{}
+}
+
+func NewLogger(out io.Writer, nodeID string, minLevel LogLevel) *Logger {
+	return &Logger{out: out, nodeID: nodeID, minLevel: minLevel}
+}
+
+func (l *Logger) Log(level LogLevel, eventType, message string, data interface{}) {
+	l.LogSpan(SpanContext{}, level, eventType, message, data)
+}
+
+// LogSpan logs an event that happened within a traced span, so entries for
+// one request can be correlated across nodes.
+func (l *Logger) LogSpan(span SpanContext, level LogLevel, eventType, message string, data interface{}) {
+	if level < l.minLevel {
+		return
+	}
+	entry := LogEntry{
+		Timestamp: time.Now(),
+		Level:     level.String(),
+		Type:      eventType,
+		Message:   message,
+		NodeID:    l.nodeID,
+		TraceID:   span.TraceID,
+		SpanID:    span.SpanID,
+		Data:      data,
+	}
+	line, err := json.Marshal(entry)
+	if err != nil {
+		entry.Data = fmt.Sprintf("%v", data)
+		line, _ = json.Marshal(entry)
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.out.Write(append(line, '\n'))
+	for ch := range l.subs {
+		select {
+		case ch <- entry:
+		default:
+			// Slow subscribers miss entries rather than block logging.
+		}
+	}
+}
+
+// Subscribe returns a channel receiving every entry logged from now on,
+// and a function that ends the subscription.
+func (l *Logger) Subscribe(buffer int) (<-chan LogEntry, func()) {
+	ch := make(chan LogEntry, buffer)
+	l.mu.Lock()
+	if l.subs == nil {
+		l.subs = make(map[chan LogEntry]struct{})
+	}
+	l.subs[ch] = struct{}{}
+	l.mu.Unlock()
+
+	return ch, func() {
+		l.mu.Lock()
+		delete(l.subs, ch)
+		l.mu.Unlock()
+	}
+}
+
+// CloseSubscribers ends every subscription by closing its channel, for
+// example so log streams let an HTTP server shut down.
+func (l *Logger) CloseSubscribers() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	for ch := range l.subs {
+		close(ch)
+		delete(l.subs, ch)
+	}
+}
+
+// StdWriter adapts the logger for the standard log package so existing
+// log.Printf calls end up as structured entries of the given type.
+func (l *Logger) StdWriter(eventType string) io.Writer {
+	return stdLogWriter{logger: l, eventType: eventType}
+}
+
+type stdLogWriter struct {
+	logger    *Logger
+	eventType string
+}
+
+func (w stdLogWriter) Write(p []byte) (int, error) {
+	message := strings.TrimRight(string(p), "\n")
+	level := LevelInfo
+	lower := strings.ToLower(message)
+	if strings.HasPrefix(lower, "error") || strings.Contains(lower, "failed") {
+		level = LevelError
+	} else if strings.HasPrefix(lower, "warning") {
+		level = LevelWarn
+	}
+	w.logger.Log(level, w.eventType, message, nil)
+	return len(p), nil
+}
+
+// LogOptions configures a node's structured log file.
+type LogOptions struct {
+	Level      string
+	MaxSizeMB  int
+	MaxAge     time.Duration
+	MaxBackups int
+}
+
+func DefaultLogOptions() LogOptions {
+	return LogOptions{Level: "info", MaxSizeMB: 50, MaxAge: 24 * time.Hour, MaxBackups: 7}
+}
+
+// RegisterFlags binds the options to command line flags.
+func (o *LogOptions) RegisterFlags(fs *flag.FlagSet) {
+	fs.StringVar(&o.Level, "log-level", o.Level, "minimum log level: debug, info, warn or error")
+	fs.IntVar(&o.MaxSizeMB, "log-max-size-mb", o.MaxSizeMB, "rotate the log file once it exceeds this many megabytes (0 disables)")
+	fs.DurationVar(&o.MaxAge, "log-max-age", o.MaxAge, "rotate the log file once it is older than this (0 disables)")
+	fs.IntVar(&o.MaxBackups, "log-max-backups", o.MaxBackups, "number of rotated log files to keep (0 keeps all)")
+}
+
+// Open creates the rotating file at path and a logger writing to it.
+func (o LogOptions) Open(path, nodeID string) (*Logger, *RotatingFile, error) {
+	level, err := ParseLogLevel(o.Level)
+	if err != nil {
+		return nil, nil, err
+	}
+	file, err := OpenRotatingFile(path, int64(o.MaxSizeMB)*1024*1024, o.MaxAge, o.MaxBackups)
+	if err != nil {
+		return nil, nil, err
+	}
+	return NewLogger(file, nodeID, level), file, nil
+}
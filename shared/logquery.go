@@ -0,0 +1,272 @@
+package shared
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	DefaultLogLimit = 100
+	MaxLogLimit     = 1000
+)
+
+// LogFilter selects log entries. Zero values match everything.
+type LogFilter struct {
+	Since    time.Time
+	Until    time.Time
+	Types    []string
+	MinLevel LogLevel
+	Search   string
+	TraceID  string
+	Limit    int
+	Offset   int
+}
+
+// ParseLogFilter reads a filter from query parameters: since and until
+// (RFC 3339 or a duration ago such as 15m), type (comma separated), level
+// (minimum), q (case-insensitive text search), trace_id, limit and offset.
+func ParseLogFilter(values url.Values) (LogFilter, error) {
+	filter := LogFilter{Limit: DefaultLogLimit}
+
+	var err error
+	if filter.Since, err = parseLogTime(values.Get("since")); err != nil {
+		return filter, fmt.Errorf("invalid since: %v", err)
+	}
+	if filter.Until, err = parseLogTime(values.Get("until")); err != nil {
+		return filter, fmt.Errorf("invalid until: %v", err)
+	}
+	for _, t := range strings.Split(values.Get("type"), ",") {
+		if t = strings.TrimSpace(t); t != "" {
+			filter.Types = append(filter.Types, strings.ToUpper(t))
+		}
+	}
+	if level := values.Get("level"); level != "" {
+		if filter.MinLevel, err = ParseLogLevel(level); err != nil {
+			return filter, err
+		}
+	}
+	filter.Search = strings.ToLower(values.Get("q"))
+	filter.TraceID = strings.ToLower(values.Get("trace_id"))
+	if limit := values.Get("limit"); limit != "" {
+		if filter.Limit, err = strconv.Atoi(limit); err != nil || filter.Limit < 1 {
+			return filter, fmt.Errorf("invalid limit %q", limit)
+		}
+	}
+	if filter.Limit > MaxLogLimit {
+		filter.Limit = MaxLogLimit
+	}
+	if offset := values.Get("offset"); offset != "" {
+		if filter.Offset, err = strconv.Atoi(offset); err != nil || filter.Offset < 0 {
+			return filter, fmt.Errorf("invalid offset %q", offset)
+		}
+	}
+	return filter, nil
+}
+
+func parseLogTime(s string) (time.Time, error) {
+	if s == "" {
+		return time.Time{}, nil
+	}
+	if d, err := time.ParseDuration(s); err == nil {
+		return time.Now().Add(-d), nil
+	}
+	return time.Parse(time.RFC3339, s)
+}
+
+// Match reports whether entry passes the filter, ignoring paging.
+func (f LogFilter) Match(entry LogEntry) bool {
+	if !f.Since.IsZero() && entry.Timestamp.Before(f.Since) {
+		return false
+	}
+	if !f.Until.IsZero() && entry.Timestamp.After(f.Until) {
+		return false
+	}
+	if f.TraceID != "" && entry.TraceID != f.TraceID {
+		return false
+	}
+	if len(f.Types) > 0 {
+		found := false
+		for _, t := range f.Types {
+			if strings.EqualFold(t, entry.Type) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	if f.MinLevel > LevelDebug {
+		level, err := ParseLogLevel(entry.Level)
+		if err == nil && level < f.MinLevel {
+			return false
+		}
+	}
+	if f.Search != "" && !strings.Contains(strings.ToLower(entry.Message), f.Search) {
+		data, _ := json.Marshal(entry.Data)
+		if !strings.Contains(strings.ToLower(string(data)), f.Search) {
+			return false
+		}
+	}
+	return true
+}
+
+// QueryLogs returns matching entries newest first, reading rotated backups of
+// path as well as the live file, along with the total number of matches.
+// Only offset+limit entries are held in memory at a time.
+func QueryLogs(path string, filter LogFilter) ([]LogEntry, int, error) {
+	backups, _ := filepath.Glob(path + ".*")
+	sort.Strings(backups)
+	files := append(backups, path)
+
+	keep := filter.Offset + filter.Limit
+	var window []LogEntry
+	total := 0
+	for _, name := range files {
+		err := scanLogFile(name, func(entry LogEntry) {
+			if !filter.Match(entry) {
+				return
+			}
+			total++
+			window = append(window, entry)
+			if filter.Limit > 0 && len(window) > keep {
+				window = window[1:]
+			}
+		})
+		if err != nil && !(os.IsNotExist(err) && name != path) {
+			return nil, 0, err
+		}
+	}
+
+	for i, j := 0, len(window)-1; i < j; i, j = i+1, j-1 {
+		window[i], window[j] = window[j], window[i]
+	}
+	if filter.Offset >= len(window) {
+		return []LogEntry{}, total, nil
+	}
+	window = window[filter.Offset:]
+	if filter.Limit > 0 && len(window) > filter.Limit {
+		window = window[:filter.Limit]
+	}
+	return window, total, nil
+}
+
+// scanLogFile calls fn for each entry of a JSON lines log file, skipping
+// lines that are not structured entries (for example those written by older
+// versions).
+func scanLogFile(path string, fn func(LogEntry)) error {
+	return scanJSONLines(path, func(line []byte) {
+		var entry LogEntry
+		if err := json.Unmarshal(line, &entry); err != nil || entry.Type == "" {
+			return
+		}
+		fn(entry)
+	})
+}
+
+func scanJSONLines(path string, fn func([]byte)) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 4*1024*1024)
+	for scanner.Scan() {
+		fn(scanner.Bytes())
+	}
+	return scanner.Err()
+}
+
+// LogsHandler serves the entries of the log file at path, filtered by the
+// request's query parameters. The total match count is returned in the
+// X-Total-Count header.
+func LogsHandler(path string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		filter, err := ParseLogFilter(r.URL.Query())
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		logs, total, err := QueryLogs(path, filter)
+		if err != nil {
+			http.Error(w, "Failed to read logs", http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("X-Total-Count", strconv.Itoa(total))
+		json.NewEncoder(w).Encode(logs)
+	}
+}
+
+// LogStreamHandler tails l as Server-Sent Events. The filter parameters of
+// LogsHandler apply, except paging.
+func LogStreamHandler(l *Logger) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		filter, err := ParseLogFilter(r.URL.Query())
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		flusher, ok := w.(http.Flusher)
+		if !ok {
+			http.Error(w, "Streaming not supported", http.StatusInternalServerError)
+			return
+		}
+		// The stream outlives any server write timeout.
+		http.NewResponseController(w).SetWriteDeadline(time.Time{})
+
+		entries, cancel := l.Subscribe(256)
+		defer cancel()
+
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Header().Set("Cache-Control", "no-cache")
+		w.Header().Set("Connection", "keep-alive")
+		w.WriteHeader(http.StatusOK)
+		flusher.Flush()
+
+		keepAlive := time.NewTicker(15 * time.Second)
+		defer keepAlive.Stop()
+		for {
+			select {
+			case <-r.Context().Done():
+				return
+			case <-keepAlive.C:
+				fmt.Fprint(w, ": keep-alive\n\n")
+			case entry, ok := <-entries:
+				if !ok {
+					return
+				}
+				if !filter.Match(entry) {
+					continue
+				}
+				data, err := json.Marshal(entry)
+				if err != nil {
+					continue
+				}
+				fmt.Fprintf(w, "data: %s\n\n", data)
+			}
+			flusher.Flush()
+		}
+	}
+}
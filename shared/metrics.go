@@ -0,0 +1,358 @@
+package shared
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Metrics is a small Prometheus-compatible registry. It supports labelled
+// counters, gauges and histograms plus gauges computed at scrape time, and
+// renders them in the text exposition format.
+type Metrics struct {
+	mu       sync.Mutex
+	families map[string]*metricFamily
+	order    []string
+}
+
+type metricFamily struct {
+	name    string
+	help    string
+	kind    string
+	labels  []string
+	buckets []float64
+	series  map[string]*metricSeries
+	collect func() []MetricSample
+}
+
+type metricSeries struct {
+	labelValues []string
+	value       float64
+	counts      []uint64
+	sum         float64
+	count       uint64
+}
+
+// MetricSample is one value reported by a gauge function.
+type MetricSample struct {
+	Labels []string
+	Value  float64
+}
+
+// DefaultMetrics is the registry served by MetricsHandler.
+var DefaultMetrics = NewMetrics()
+
+// DefaultBuckets suit query and request latencies in seconds.
+var DefaultBuckets = []float64{0.001, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+func NewMetrics() *Metrics {
+	return &Metrics{families: make(map[string]*metricFamily)}
+}
+
+func (m *Metrics) family(name, help, kind string, labels []string, buckets []float64) *metricFamily {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if f, ok := m.families[name]; ok {
+		return f
+	}
+	f := &metricFamily{
+		name:    name,
+		help:    help,
+		kind:    kind,
+		labels:  labels,
+		buckets: buckets,
+		series:  make(map[string]*metricSeries),
+	}
+	m.families[name] = f
+	m.order = append(m.order, name)
+	return f
+}
+
+func (m *Metrics) series(f *metricFamily, labelValues []string) *metricSeries {
+	key := strings.Join(labelValues, "\xff")
+	s, ok := f.series[key]
+	if !ok {
+		s = &metricSeries{labelValues: append([]string(nil), labelValues...)}
+		if f.kind == "histogram" {
+			s.counts = make([]uint64, len(f.buckets))
+		}
+		f.series[key] = s
+	}
+	return s
+}
+
+type Counter struct {
+	m *Metrics
+	f *metricFamily
+}
+
+func (m *Metrics) Counter(name, help string, labels ...string) *Counter {
+	return &Counter{m: m, f: m.family(name, help, "counter", labels, nil)}
+}
+
+func (c *Counter) Inc(labelValues ...string) {
+	c.Add(1, labelValues...)
+}
+
+func (c *Counter) Add(v float64, labelValues ...string) {
+	c.m.mu.Lock()
+	defer c.m.mu.Unlock()
+
+	c.m.series(c.f, labelValues).value += v
+}
+
+type Gauge struct {
+	m *Metrics
+	f *metricFamily
+}
+
+func (m *Metrics) Gauge(name, help string, labels ...string) *Gauge {
+	return &Gauge{m: m, f: m.family(name, help, "gauge", labels, nil)}
+}
+
+func (g *Gauge) Set(v float64, labelValues ...string) {
+	g.m.mu.Lock()
+	defer g.m.mu.Unlock()
+
+	g.m.series(g.f, labelValues).value = v
+}
+
+func (g *Gauge) Add(v float64, labelValues ...string) {
+	g.m.mu.Lock()
+	defer g.m.mu.Unlock()
+
+	g.m.series(g.f, labelValues).value += v
+}
+
+// GaugeFunc registers a gauge whose samples are produced by collect at
+// scrape time, for values that already live elsewhere.
+func (m *Metrics) GaugeFunc(name, help string, labels []string, collect func() []MetricSample) {
+	f := m.family(name, help, "gauge", labels, nil)
+	m.mu.Lock()
+	f.collect = collect
+	m.mu.Unlock()
+}
+
+type Histogram struct {
+	m *Metrics
+	f *metricFamily
+}
+
+func (m *Metrics) Histogram(name, help string, buckets []float64, labels ...string) *Histogram {
+	return &Histogram{m: m, f: m.family(name, help, "histogram", labels, buckets)}
+}
+
+func (h *Histogram) Observe(v float64, labelValues ...string) {
+	h.m.mu.Lock()
+	defer h.m.mu.Unlock()
+
+	s := h.m.series(h.f, labelValues)
+	for i, upper := range h.f.buckets {
+		if v <= upper {
+			s.counts[i]++
+		}
+	}
+	s.sum += v
+	s.count++
+}
+
+// labelEscaper escapes a label value as the text exposition format asks:
+// only backslash, double quote and newline; everything else, including
+// non-ASCII text, is written as is.
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func formatLabels(names, values []string, extra ...string) string {
+	var parts []string
+	for i, name := range names {
+		value := ""
+		if i < len(values) {
+			value = values[i]
+		}
+		parts = append(parts, name+`="`+labelEscaper.Replace(value)+`"`)
+	}
+	for i := 0; i+1 < len(extra); i += 2 {
+		parts = append(parts, extra[i]+`="`+labelEscaper.Replace(extra[i+1])+`"`)
+	}
+	if len(parts) == 0 {
+		return ""
+	}
+	return "{" + strings.Join(parts, ",") + "}"
+}
+
+func formatFloat(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	case math.IsNaN(v):
+		return "NaN"
+	}
+	return fmt.Sprintf("%g", v)
+}
+
+// WriteText renders every metric in the Prometheus text format.
+func (m *Metrics) WriteText(w io.Writer) {
+	m.mu.Lock()
+	names := append([]string(nil), m.order...)
+	collectors := make(map[string]func() []MetricSample)
+	for _, name := range names {
+		if f := m.families[name]; f.collect != nil {
+			collectors[name] = f.collect
+		}
+	}
+	m.mu.Unlock()
+
+	// Collectors run without the lock so they may take their own locks.
+	collected := make(map[string][]MetricSample)
+	for name, collect := range collectors {
+		collected[name] = collect()
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, name := range names {
+		f := m.families[name]
+		fmt.Fprintf(w, "# HELP %s %s\n", f.name, f.help)
+		fmt.Fprintf(w, "# TYPE %s %s\n", f.name, f.kind)
+
+		if f.collect != nil {
+			for _, sample := range collected[name] {
+				fmt.Fprintf(w, "%s%s %s\n", f.name, formatLabels(f.labels, sample.Labels), formatFloat(sample.Value))
+			}
+			continue
+		}
+
+		keys := make([]string, 0, len(f.series))
+		for key := range f.series {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			s := f.series[key]
+			if f.kind != "histogram" {
+				fmt.Fprintf(w, "%s%s %s\n", f.name, formatLabels(f.labels, s.labelValues), formatFloat(s.value))
+				continue
+			}
+			for i, upper := range f.buckets {
+				fmt.Fprintf(w, "%s_bucket%s %d\n", f.name,
+					formatLabels(f.labels, s.labelValues, "le", formatFloat(upper)), s.counts[i])
+			}
+			fmt.Fprintf(w, "%s_bucket%s %d\n", f.name, formatLabels(f.labels, s.labelValues, "le", "+Inf"), s.count)
+			fmt.Fprintf(w, "%s_sum%s %s\n", f.name, formatLabels(f.labels, s.labelValues), formatFloat(s.sum))
+			fmt.Fprintf(w, "%s_count%s %d\n", f.name, formatLabels(f.labels, s.labelValues), s.count)
+		}
+	}
+}
+
+func MetricsHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		DefaultMetrics.WriteText(w)
+	})
+}
+
+var (
+	queriesTotal = DefaultMetrics.Counter("ddb_queries_total",
+		"Statements executed against MySQL by statement kind and status.", "kind", "status")
+	queryDuration = DefaultMetrics.Histogram("ddb_query_duration_seconds",
+		"Latency of statements executed against MySQL by statement kind and status.", DefaultBuckets, "kind", "status")
+	httpRequests = DefaultMetrics.Counter("ddb_http_requests_total",
+		"HTTP requests served by method, path and status code.", "method", "path", "code")
+	TCPConnections = DefaultMetrics.Gauge("ddb_tcp_connections_active",
+		"Open node-to-node TCP connections.")
+)
+
+// StatementKind classifies a statement by its leading keyword.
+func StatementKind(query string) string {
+	fields := strings.Fields(strings.TrimSpace(query))
+	if len(fields) == 0 {
+		return "OTHER"
+	}
+	switch kind := strings.ToUpper(strings.TrimLeft(fields[0], "(")); kind {
+	case "SELECT", "INSERT", "UPDATE", "DELETE", "REPLACE", "CREATE", "DROP", "ALTER", "TRUNCATE", "SHOW", "USE":
+		return kind
+	}
+	return "OTHER"
+}
+
+// ObserveQuery records one statement in the query metrics.
+func ObserveQuery(query string, start time.Time, err error) {
+	kind := StatementKind(query)
+	status := "ok"
+	if err != nil {
+		status = "error"
+	}
+	queriesTotal.Inc(kind, status)
+	queryDuration.Observe(time.Since(start).Seconds(), kind, status)
+}
+
+// RegisterDBMetrics exports the connection pool statistics of h.
+func RegisterDBMetrics(h *DBHandler) {
+	stat := func(name, help string, value func() float64) {
+		DefaultMetrics.GaugeFunc(name, help, nil, func() []MetricSample {
+			return []MetricSample{{Value: value()}}
+		})
+	}
+	stat("ddb_mysql_open_connections", "Established MySQL connections, in use and idle.",
+		func() float64 { return float64(h.Stats().OpenConnections) })
+	stat("ddb_mysql_in_use_connections", "MySQL connections currently in use.",
+		func() float64 { return float64(h.Stats().InUse) })
+	stat("ddb_mysql_idle_connections", "Idle MySQL connections.",
+		func() float64 { return float64(h.Stats().Idle) })
+	stat("ddb_mysql_max_open_connections", "Configured maximum of open MySQL connections.",
+		func() float64 { return float64(h.Stats().MaxOpenConnections) })
+	stat("ddb_mysql_wait_count", "Total waits for a free MySQL connection.",
+		func() float64 { return float64(h.Stats().WaitCount) })
+	stat("ddb_mysql_wait_duration_seconds", "Total time spent waiting for a MySQL connection.",
+		func() float64 { return h.Stats().WaitDuration.Seconds() })
+	stat("ddb_mysql_max_idle_closed", "Connections closed because of the idle limit.",
+		func() float64 { return float64(h.Stats().MaxIdleClosed) })
+	stat("ddb_mysql_max_idle_time_closed", "Connections closed because they sat idle too long.",
+		func() float64 { return float64(h.Stats().MaxIdleTimeClosed) })
+	stat("ddb_mysql_max_lifetime_closed", "Connections closed because of the lifetime limit.",
+		func() float64 { return float64(h.Stats().MaxLifetimeClosed) })
+}
+
+type statusRecorder struct {
+	http.ResponseWriter
+	code int
+}
+
+func (r *statusRecorder) WriteHeader(code int) {
+	r.code = code
+	r.ResponseWriter.WriteHeader(code)
+}
+
+func (r *statusRecorder) Unwrap() http.ResponseWriter {
+	return r.ResponseWriter
+}
+
+func (r *statusRecorder) Flush() {
+	if f, ok := r.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// InstrumentHTTP counts requests by method, path and status code. Static
+// files are folded into one path label to keep the series count bounded.
+func InstrumentHTTP(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rec := &statusRecorder{ResponseWriter: w, code: http.StatusOK}
+		next.ServeHTTP(rec, r)
+
+		path := r.URL.Path
+		if !strings.HasPrefix(path, "/api/") && !strings.HasPrefix(path, "/raft/") &&
+			path != "/metrics" && path != "/query" && path != "/connect" &&
+			path != "/healthz" && path != "/readyz" {
+			path = "static"
+		}
+		httpRequests.Inc(r.Method, path, fmt.Sprintf("%d", rec.code))
+	})
+}
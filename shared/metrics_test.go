@@ -0,0 +1,53 @@
+package shared
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestFormatLabels(t *testing.T) {
+	tests := []struct {
+		name   string
+		names  []string
+		values []string
+		extra  []string
+		want   string
+	}{
+		{name: "no labels", want: ""},
+		{name: "plain", names: []string{"kind", "status"}, values: []string{"SELECT", "ok"}, want: `{kind="SELECT",status="ok"}`},
+		{name: "missing value", names: []string{"kind"}, want: `{kind=""}`},
+		{name: "escaped characters", names: []string{"path"}, values: []string{"a\\b\"c\nd"}, want: `{path="a\\b\"c\nd"}`},
+		{name: "non-ASCII kept as is", names: []string{"table"}, values: []string{"bestellungen_ü\tæ"}, want: "{table=\"bestellungen_ü\tæ\"}"},
+		{name: "extra pairs", names: []string{"kind"}, values: []string{"INSERT"}, extra: []string{"le", "+Inf"}, want: `{kind="INSERT",le="+Inf"}`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := formatLabels(tt.names, tt.values, tt.extra...); got != tt.want {
+				t.Errorf("formatLabels() = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestWriteText(t *testing.T) {
+	m := NewMetrics()
+	m.Counter("test_total", "A counter.", "path").Inc("/ä\"")
+	h := m.Histogram("test_seconds", "A histogram.", []float64{0.5}, "kind", "status")
+	h.Observe(0.25, "SELECT", "ok")
+	h.Observe(1, "SELECT", "error")
+
+	var buf bytes.Buffer
+	m.WriteText(&buf)
+	for _, line := range []string{
+		"# TYPE test_total counter",
+		`test_total{path="/ä\""} 1`,
+		`test_seconds_bucket{kind="SELECT",status="ok",le="0.5"} 1`,
+		`test_seconds_bucket{kind="SELECT",status="error",le="0.5"} 0`,
+		`test_seconds_count{kind="SELECT",status="error"} 1`,
+	} {
+		if !strings.Contains(buf.String(), line+"\n") {
+			t.Errorf("output lacks %q:\n%s", line, buf.String())
+		}
+	}
+}
@@ -0,0 +1,33 @@
+package shared
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// LoadOrCreateNodeID returns the node ID stored at path, generating and
+// persisting a new one on first start so the ID survives restarts.
+func LoadOrCreateNodeID(path string) (string, error) {
+	data, err := os.ReadFile(path)
+	if err == nil {
+		if id := strings.TrimSpace(string(data)); id != "" {
+			return id, nil
+		}
+	} else if !os.IsNotExist(err) {
+		return "", fmt.Errorf("failed to read node id: %v", err)
+	}
+
+	buf := make([]byte, 8)
+	if _, err := rand.Read(buf); err != nil {
+		return "", fmt.Errorf("failed to generate node id: %v", err)
+	}
+	id := "node-" + hex.EncodeToString(buf)
+
+	if err := os.WriteFile(path, []byte(id+"\n"), 0644); err != nil {
+		return "", fmt.Errorf("failed to write node id: %v", err)
+	}
+	return id, nil
+}
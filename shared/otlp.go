@@ -0,0 +1,227 @@
+package shared
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// OTLPExporter batches spans and writes them in the OTLP/JSON format, either
+// as one ExportTraceServiceRequest per line of a file or by POSTing to an
+// OTLP/HTTP collector such as http://localhost:4318/v1/traces.
+type OTLPExporter struct {
+	resource []otlpKeyValue
+	target   string
+	file     *os.File
+	client   *http.Client
+
+	mu      sync.Mutex
+	pending []*Span
+	flushCh chan struct{}
+	done    chan struct{}
+	closed  bool
+}
+
+const otlpBatchSize = 100
+
+// NewOTLPExporter exports spans of the named service to target, which is a
+// file path or an http(s) collector URL.
+func NewOTLPExporter(serviceName, nodeID, target string) (*OTLPExporter, error) {
+	e := &OTLPExporter{
+		resource: []otlpKeyValue{
+			otlpString("service.name", serviceName),
+			otlpString("service.instance.id", nodeID),
+		},
+		target:  target,
+		flushCh: make(chan struct{}, 1),
+		done:    make(chan struct{}),
+	}
+	if strings.HasPrefix(target, "http://") || strings.HasPrefix(target, "https://") {
+		e.client = &http.Client{Timeout: 5 * time.Second}
+	} else {
+		file, err := os.OpenFile(target, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+		if err != nil {
+			return nil, fmt.Errorf("failed to open trace file: %v", err)
+		}
+		e.file = file
+	}
+	go e.run()
+	return e, nil
+}
+
+func (e *OTLPExporter) Export(span *Span) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if e.closed {
+		return
+	}
+	e.pending = append(e.pending, span)
+	if len(e.pending) >= otlpBatchSize {
+		select {
+		case e.flushCh <- struct{}{}:
+		default:
+		}
+	}
+}
+
+func (e *OTLPExporter) run() {
+	defer close(e.done)
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case _, ok := <-e.flushCh:
+			if !ok {
+				e.flush()
+				return
+			}
+		}
+		e.flush()
+	}
+}
+
+func (e *OTLPExporter) flush() {
+	e.mu.Lock()
+	batch := e.pending
+	e.pending = nil
+	e.mu.Unlock()
+	if len(batch) == 0 {
+		return
+	}
+
+	data, err := json.Marshal(e.request(batch))
+	if err != nil {
+		log.Printf("Failed to encode spans: %v", err)
+		return
+	}
+	if e.file != nil {
+		if _, err := e.file.Write(append(data, '\n')); err != nil {
+			log.Printf("Failed to write spans: %v", err)
+		}
+		return
+	}
+	resp, err := e.client.Post(e.target, "application/json", bytes.NewReader(data))
+	if err != nil {
+		log.Printf("Failed to export spans: %v", err)
+		return
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		log.Printf("Failed to export spans: collector returned %s", resp.Status)
+	}
+}
+
+// Close flushes pending spans and stops the exporter.
+func (e *OTLPExporter) Close() error {
+	e.mu.Lock()
+	if e.closed {
+		e.mu.Unlock()
+		return nil
+	}
+	e.closed = true
+	e.mu.Unlock()
+
+	close(e.flushCh)
+	<-e.done
+	if e.file != nil {
+		return e.file.Close()
+	}
+	return nil
+}
+
+type otlpKeyValue struct {
+	Key   string `json:"key"`
+	Value struct {
+		StringValue string `json:"stringValue"`
+	} `json:"value"`
+}
+
+func otlpString(key, value string) otlpKeyValue {
+	kv := otlpKeyValue{Key: key}
+	kv.Value.StringValue = value
+	return kv
+}
+
+type otlpSpan struct {
+	TraceID           string         `json:"traceId"`
+	SpanID            string         `json:"spanId"`
+	ParentSpanID      string         `json:"parentSpanId,omitempty"`
+	Name              string         `json:"name"`
+	Kind              SpanKind       `json:"kind"`
+	StartTimeUnixNano string         `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string         `json:"endTimeUnixNano"`
+	Attributes        []otlpKeyValue `json:"attributes,omitempty"`
+	Status            struct {
+		Code    int    `json:"code"`
+		Message string `json:"message,omitempty"`
+	} `json:"status"`
+}
+
+type otlpScopeSpans struct {
+	Scope struct {
+		Name    string `json:"name"`
+		Version string `json:"version"`
+	} `json:"scope"`
+	Spans []otlpSpan `json:"spans"`
+}
+
+type otlpResourceSpans struct {
+	Resource struct {
+		Attributes []otlpKeyValue `json:"attributes"`
+	} `json:"resource"`
+	ScopeSpans []otlpScopeSpans `json:"scopeSpans"`
+}
+
+type otlpRequest struct {
+	ResourceSpans []otlpResourceSpans `json:"resourceSpans"`
+}
+
+func (e *OTLPExporter) request(batch []*Span) otlpRequest {
+	var ss otlpScopeSpans
+	ss.Scope.Name = "distributed-db"
+	ss.Scope.Version = Version
+
+	for _, s := range batch {
+		s.mu.Lock()
+		span := otlpSpan{
+			TraceID:           s.TraceID,
+			SpanID:            s.SpanID,
+			ParentSpanID:      s.ParentSpanID,
+			Name:              s.Name,
+			Kind:              s.Kind,
+			StartTimeUnixNano: strconv.FormatInt(s.Start.UnixNano(), 10),
+			EndTimeUnixNano:   strconv.FormatInt(s.End.UnixNano(), 10),
+		}
+		keys := make([]string, 0, len(s.Attributes))
+		for k := range s.Attributes {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			span.Attributes = append(span.Attributes, otlpString(k, s.Attributes[k]))
+		}
+		if s.Error != "" {
+			span.Status.Code = 2
+			span.Status.Message = s.Error
+		} else {
+			span.Status.Code = 1
+		}
+		s.mu.Unlock()
+		ss.Spans = append(ss.Spans, span)
+	}
+
+	var rs otlpResourceSpans
+	rs.Resource.Attributes = e.resource
+	rs.ScopeSpans = []otlpScopeSpans{ss}
+	return otlpRequest{ResourceSpans: []otlpResourceSpans{rs}}
+}
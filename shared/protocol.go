@@ -1,5 +1,7 @@
 package shared
 
+import "time"
+
 type Request struct {
 	Token     string `json:"token"`
 	Query     string `json:"query"`
@@ -14,3 +16,72 @@ type Response struct {
 	Rows    [][]any  `json:"rows,omitempty"`
 	Header  []string `json:"header,omitempty"`
 }
+
+// Version is advertised by every node when it registers with the master.
+const Version = "1.1.0"
+
+// Message types carried in DBRequest.Type on the master TCP connection.
+// An empty type is a plain query, which keeps older slaves working.
+const (
+	MsgQuery     = ""
+	MsgRegister  = "register"
+	MsgHeartbeat = "heartbeat"
+	MsgFetch     = "fetch"
+	MsgAck       = "ack"
+	MsgCancel    = "cancel"
+
+	// MsgAttach ties a further connection of a registered slave, such as
+	// the one it fetches over, to its node ID. Fetches, acks and
+	// reconciles count for the slave the connection was registered or
+	// attached as, never for the node ID a request names.
+	MsgAttach = "attach"
+
+	// Two-phase commit messages from a coordinating master to the masters
+	// of the other shard groups.
+	MsgXAPrepare  = "xa_prepare"
+	MsgXACommit   = "xa_commit"
+	MsgXARollback = "xa_rollback"
+
+	// MsgSubscribe turns the connection into a stream of change events,
+	// one JSON ChangeEvent per line, starting after DBRequest.Cursor.
+	MsgSubscribe = "cdc_subscribe"
+
+	// MsgReconcile carries the writes a slave took while it could not
+	// reach the master, for the master to merge.
+	MsgReconcile = "reconcile"
+)
+
+// Durability modes for writes. Async acknowledges once the master commits,
+// semi-sync once enough slaves have received the write and sync once the
+// slaves have applied it.
+const (
+	DurabilityAsync    = "async"
+	DurabilitySemiSync = "semi-sync"
+	DurabilitySync     = "sync"
+)
+
+// HeartbeatInterval is how often slaves send heartbeats; the master's failure
+// detector derives its suspect and dead timeouts from it.
+const HeartbeatInterval = 5 * time.Second
+
+// FetchWait bounds how long the master holds a fetch open waiting for new
+// replication entries before answering with an empty batch.
+const FetchWait = time.Second
+
+// Connection states reported for slaves in the master registry.
+const (
+	SlaveConnected    = "connected"
+	SlaveSuspect      = "suspect"
+	SlaveDead         = "dead"
+	SlaveDisconnected = "disconnected"
+)
+
+// Node statuses a slave reports in its heartbeats.
+const (
+	NodeOK            = "ok"
+	NodeDBUnavailable = "db_unavailable"
+)
+
+// StatusShuttingDown is returned in DBResponse.Status by a master that is
+// shutting down, so slaves can fail over without waiting for timeouts.
+const StatusShuttingDown = "shutting_down"
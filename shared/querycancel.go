@@ -0,0 +1,298 @@
+package shared
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+var (
+	ErrQueryNotRunning = errors.New("no running query with that request ID")
+	ErrQueryTimedOut   = errors.New("query timed out")
+	ErrQueryCancelled  = errors.New("query cancelled")
+)
+
+// killTimeout bounds the KILL QUERY sent when a statement is cancelled.
+const killTimeout = 5 * time.Second
+
+// maxCachedConnIDs bounds the connection ID cache. Entries of connections the
+// pool has closed are never looked up again, so the cache starts over once
+// it is full.
+const maxCachedConnIDs = 1024
+
+// RunningQuery describes a statement in flight on a DBHandler.
+type RunningQuery struct {
+	RequestID    string    `json:"request_id"`
+	Query        string    `json:"query"`
+	ConnectionID int64     `json:"connection_id"`
+	Started      time.Time `json:"started"`
+	ElapsedMs    float64   `json:"elapsed_ms"`
+	TimeoutMs    int64     `json:"timeout_ms,omitempty"`
+}
+
+type runningQuery struct {
+	info   RunningQuery
+	cancel context.CancelFunc
+
+	// mu is held while KILL QUERY is in flight, so the connection is not
+	// handed back to the pool, and another statement killed, meanwhile.
+	mu       sync.Mutex
+	finished bool
+}
+
+type requestIDKey struct{}
+
+// WithRequestID tags statements run with ctx with requestID, under which they
+// are listed and can be cancelled.
+func WithRequestID(ctx context.Context, requestID string) context.Context {
+	return context.WithValue(ctx, requestIDKey{}, requestID)
+}
+
+func RequestIDFromContext(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey{}).(string)
+	return id
+}
+
+func NewRequestID() string {
+	return randomHex(8)
+}
+
+// Timeout returns the timeout the request asked for, or def if it did not
+// set one.
+func (r DBRequest) Timeout(def time.Duration) time.Duration {
+	if r.TimeoutMs > 0 {
+		return time.Duration(r.TimeoutMs) * time.Millisecond
+	}
+	return def
+}
+
+// QueryContext returns the context a request's statements run under: tagged
+// with its request ID and bounded by its timeout, or def when it has none.
+// A zero timeout means no limit.
+func (r DBRequest) QueryContext(def time.Duration) (context.Context, context.CancelFunc) {
+	ctx := WithRequestID(context.Background(), r.RequestID)
+	if timeout := r.Timeout(def); timeout > 0 {
+		return context.WithTimeout(ctx, timeout)
+	}
+	return context.WithCancel(ctx)
+}
+
+type queryer interface {
+	ExecContext(ctx context.Context, query string, args ...any) (sql.Result, error)
+	QueryContext(ctx context.Context, query string, args ...any) (*sql.Rows, error)
+}
+
+// run calls fn with a connection for query. Statements that can end early,
+// because ctx has a deadline or a request ID to cancel by, get a dedicated
+// connection whose MySQL thread is sent KILL QUERY when ctx ends, as closing
+// the client side alone leaves the statement running on the server.
+func (h *DBHandler) run(ctx context.Context, query string, fn func(ctx context.Context, q queryer) error) error {
+	if RequestIDFromContext(ctx) == "" && ctx.Done() == nil {
+		return fn(ctx, h.db)
+	}
+	return h.runOnConn(ctx, query, func(ctx context.Context, conn *sql.Conn) error {
+		return fn(ctx, conn)
+	})
+}
+
+// runOnConn is run for callers that need a connection of their own, such as
+// to hold a transaction, even when query cannot end early.
+func (h *DBHandler) runOnConn(ctx context.Context, query string, fn func(ctx context.Context, conn *sql.Conn) error) error {
+	requestID := RequestIDFromContext(ctx)
+	if requestID == "" {
+		requestID = NewRequestID()
+	}
+
+	conn, err := h.db.Conn(ctx)
+	if err != nil {
+		return queryContextError(ctx, requestID, err)
+	}
+	defer conn.Close()
+
+	connID, err := h.connectionID(ctx, conn)
+	if err != nil {
+		return queryContextError(ctx, requestID, err)
+	}
+
+	parent := ctx
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	rq := &runningQuery{
+		info: RunningQuery{
+			RequestID:    requestID,
+			Query:        query,
+			ConnectionID: connID,
+			Started:      time.Now(),
+		},
+		cancel: cancel,
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		rq.info.TimeoutMs = time.Until(deadline).Milliseconds()
+	}
+	if err := h.register(rq); err != nil {
+		return err
+	}
+	defer h.unregister(rq)
+
+	stop := context.AfterFunc(ctx, func() { h.kill(rq) })
+	err = fn(ctx, conn)
+	stop()
+	rq.mu.Lock()
+	rq.finished = true
+	rq.mu.Unlock()
+
+	if err != nil && ctx.Err() != nil {
+		if parent.Err() == nil {
+			return fmt.Errorf("%w (request %s)", ErrQueryCancelled, requestID)
+		}
+		return queryContextError(parent, requestID, err)
+	}
+	return err
+}
+
+// connectionID returns the MySQL thread ID of conn, asking the server only
+// the first time the underlying connection is used.
+func (h *DBHandler) connectionID(ctx context.Context, conn *sql.Conn) (int64, error) {
+	var key interface{}
+	if err := conn.Raw(func(driverConn interface{}) error {
+		key = driverConn
+		return nil
+	}); err != nil {
+		return 0, err
+	}
+
+	h.connIDsMu.Lock()
+	id, ok := h.connIDs[key]
+	h.connIDsMu.Unlock()
+	if ok {
+		return id, nil
+	}
+
+	if err := conn.QueryRowContext(ctx, "SELECT CONNECTION_ID()").Scan(&id); err != nil {
+		return 0, err
+	}
+	h.connIDsMu.Lock()
+	if h.connIDs == nil || len(h.connIDs) >= maxCachedConnIDs {
+		h.connIDs = make(map[interface{}]int64)
+	}
+	h.connIDs[key] = id
+	h.connIDsMu.Unlock()
+	return id, nil
+}
+
+func queryContextError(ctx context.Context, requestID string, err error) error {
+	switch ctx.Err() {
+	case context.DeadlineExceeded:
+		return fmt.Errorf("%w (request %s)", ErrQueryTimedOut, requestID)
+	case context.Canceled:
+		return fmt.Errorf("%w (request %s)", ErrQueryCancelled, requestID)
+	}
+	return err
+}
+
+func (h *DBHandler) register(rq *runningQuery) error {
+	h.runningMu.Lock()
+	defer h.runningMu.Unlock()
+
+	if _, ok := h.running[rq.info.RequestID]; ok {
+		return fmt.Errorf("a query with request ID %s is already running", rq.info.RequestID)
+	}
+	h.running[rq.info.RequestID] = rq
+	return nil
+}
+
+func (h *DBHandler) unregister(rq *runningQuery) {
+	h.runningMu.Lock()
+	defer h.runningMu.Unlock()
+
+	delete(h.running, rq.info.RequestID)
+}
+
+func (h *DBHandler) kill(rq *runningQuery) {
+	rq.mu.Lock()
+	defer rq.mu.Unlock()
+
+	if rq.finished {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), killTimeout)
+	defer cancel()
+	if _, err := h.db.ExecContext(ctx, fmt.Sprintf("KILL QUERY %d", rq.info.ConnectionID)); err != nil {
+		log.Printf("Failed to kill query %s on connection %d: %v", rq.info.RequestID, rq.info.ConnectionID, err)
+	}
+}
+
+// CancelQuery stops the running statement tagged with requestID.
+func (h *DBHandler) CancelQuery(requestID string) error {
+	h.runningMu.Lock()
+	rq, ok := h.running[requestID]
+	h.runningMu.Unlock()
+	if !ok {
+		return ErrQueryNotRunning
+	}
+	rq.cancel()
+	return nil
+}
+
+// RunningQueries lists the cancellable statements in flight, oldest first.
+func (h *DBHandler) RunningQueries() []RunningQuery {
+	h.runningMu.Lock()
+	list := make([]RunningQuery, 0, len(h.running))
+	for _, rq := range h.running {
+		info := rq.info
+		info.ElapsedMs = float64(time.Since(info.Started)) / float64(time.Millisecond)
+		list = append(list, info)
+	}
+	h.runningMu.Unlock()
+
+	sort.Slice(list, func(i, j int) bool { return list[i].Started.Before(list[j].Started) })
+	return list
+}
+
+// RunningQueriesHandler serves GET /api/queries/running.
+func RunningQueriesHandler(h *DBHandler) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(h.RunningQueries())
+	}
+}
+
+// CancelQueryHandler serves POST /api/queries/cancel with a body of
+// {"request_id": "..."}, passing the ID to cancel.
+func CancelQueryHandler(cancel func(requestID string) error) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		var req DBRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.RequestID == "" {
+			http.Error(w, "Request must name a request_id", http.StatusBadRequest)
+			return
+		}
+
+		resp := DBResponse{Status: "ok", Message: "Query cancelled", RequestID: req.RequestID}
+		w.Header().Set("Content-Type", "application/json")
+		if err := cancel(req.RequestID); err != nil {
+			resp.Status = "error"
+			resp.Message = err.Error()
+			if errors.Is(err, ErrQueryNotRunning) {
+				w.WriteHeader(http.StatusNotFound)
+			} else {
+				w.WriteHeader(http.StatusBadGateway)
+			}
+		}
+		json.NewEncoder(w).Encode(resp)
+	}
+}
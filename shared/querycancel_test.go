@@ -0,0 +1,124 @@
+package shared
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"fmt"
+	"io"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+// fakeDriver hands out connections numbered from 1 and counts how often a
+// connection ID is asked for.
+type fakeDriver struct {
+	opened  atomic.Int64
+	lookups atomic.Int64
+}
+
+func (d *fakeDriver) Open(string) (driver.Conn, error) {
+	return &fakeConn{driver: d, id: d.opened.Add(1)}, nil
+}
+
+type fakeConn struct {
+	driver *fakeDriver
+	id     int64
+}
+
+func (c *fakeConn) Prepare(query string) (driver.Stmt, error) {
+	return fakeStmt{conn: c, query: query}, nil
+}
+
+func (c *fakeConn) Close() error              { return nil }
+func (c *fakeConn) Begin() (driver.Tx, error) { return nil, fmt.Errorf("not supported") }
+
+type fakeStmt struct {
+	conn  *fakeConn
+	query string
+}
+
+func (s fakeStmt) Close() error  { return nil }
+func (s fakeStmt) NumInput() int { return -1 }
+
+func (s fakeStmt) Exec([]driver.Value) (driver.Result, error) {
+	return driver.RowsAffected(1), nil
+}
+
+func (s fakeStmt) Query([]driver.Value) (driver.Rows, error) {
+	if !strings.EqualFold(s.query, "SELECT CONNECTION_ID()") {
+		return nil, fmt.Errorf("unexpected query %q", s.query)
+	}
+	s.conn.driver.lookups.Add(1)
+	return &fakeRows{values: []driver.Value{s.conn.id}}, nil
+}
+
+type fakeRows struct {
+	values []driver.Value
+	done   bool
+}
+
+func (r *fakeRows) Columns() []string { return []string{"CONNECTION_ID()"} }
+func (r *fakeRows) Close() error      { return nil }
+
+func (r *fakeRows) Next(dest []driver.Value) error {
+	if r.done {
+		return io.EOF
+	}
+	r.done = true
+	copy(dest, r.values)
+	return nil
+}
+
+// fakeDrivers numbers the names fake drivers are registered under, as
+// sql.Register refuses a name twice.
+var fakeDrivers atomic.Int64
+
+func TestRunOnConnCachesConnectionID(t *testing.T) {
+	tests := []struct {
+		name        string
+		idleConns   int
+		runs        int
+		wantLookups int64
+		wantIDs     []int64
+	}{
+		{name: "reused connection is looked up once", idleConns: 1, runs: 3, wantLookups: 1, wantIDs: []int64{1, 1, 1}},
+		{name: "each new connection is looked up", idleConns: 0, runs: 3, wantLookups: 3, wantIDs: []int64{1, 2, 3}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d := &fakeDriver{}
+			name := fmt.Sprintf("ddb-fake-%d", fakeDrivers.Add(1))
+			sql.Register(name, d)
+			db, err := sql.Open(name, "")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer db.Close()
+			db.SetMaxOpenConns(1)
+			db.SetMaxIdleConns(tt.idleConns)
+			h := &DBHandler{db: db, running: make(map[string]*runningQuery)}
+
+			var ids []int64
+			for run := 0; run < tt.runs; run++ {
+				err := h.runOnConn(context.Background(), "UPDATE t SET x = 1", func(ctx context.Context, conn *sql.Conn) error {
+					for _, q := range h.RunningQueries() {
+						ids = append(ids, q.ConnectionID)
+					}
+					_, err := conn.ExecContext(ctx, "UPDATE t SET x = 1")
+					return err
+				})
+				if err != nil {
+					t.Fatalf("run %d: %v", run, err)
+				}
+			}
+			if got := d.lookups.Load(); got != tt.wantLookups {
+				t.Errorf("%d connection ID lookups, want %d", got, tt.wantLookups)
+			}
+			if fmt.Sprint(ids) != fmt.Sprint(tt.wantIDs) {
+				t.Errorf("running queries reported connections %v, want %v", ids, tt.wantIDs)
+			}
+		})
+	}
+}
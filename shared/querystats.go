@@ -0,0 +1,369 @@
+package shared
+
+import (
+	"encoding/json"
+	"log"
+	"math"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+)
+
+var (
+	operatorPattern  = regexp.MustCompile(`\s*([=<>!]+|,)\s*`)
+	valueListPattern = regexp.MustCompile(`\(\s*\?(?:\s*,\s*\?)*\s*\)`)
+	valueRowsPattern = regexp.MustCompile(`\(\?\+\)(?:\s*,\s*\(\?\+\))+`)
+)
+
+// Fingerprint normalizes a statement so that queries differing only in
+// literal values group together: literals become ?, value lists become
+// (?+), comments are dropped and whitespace and case are normalized.
+func Fingerprint(query string) string {
+	var b strings.Builder
+	space := false
+	emit := func(r rune) {
+		if space && b.Len() > 0 {
+			b.WriteRune(' ')
+		}
+		b.WriteRune(r)
+		space = false
+	}
+
+	runes := []rune(strings.TrimSpace(query))
+	for i := 0; i < len(runes); i++ {
+		r := runes[i]
+		switch {
+		case r == '\'' || r == '"':
+			for i++; i < len(runes) && runes[i] != r; i++ {
+				if runes[i] == '\\' {
+					i++
+				}
+			}
+			emit('?')
+		case r == '/' && i+1 < len(runes) && runes[i+1] == '*':
+			for i += 2; i+1 < len(runes) && !(runes[i] == '*' && runes[i+1] == '/'); i++ {
+			}
+			i++
+			space = true
+		case r == '-' && i+1 < len(runes) && runes[i+1] == '-':
+			for ; i < len(runes) && runes[i] != '\n'; i++ {
+			}
+			space = true
+		case unicode.IsDigit(r) && (i == 0 || !isIdentRune(runes[i-1])):
+			for i+1 < len(runes) && (unicode.IsDigit(runes[i+1]) || runes[i+1] == '.') {
+				i++
+			}
+			emit('?')
+		case unicode.IsSpace(r):
+			space = true
+		default:
+			emit(unicode.ToLower(r))
+		}
+	}
+
+	fp := operatorPattern.ReplaceAllString(strings.TrimRight(b.String(), "; "), "$1")
+	fp = valueListPattern.ReplaceAllString(fp, "(?+)")
+	return valueRowsPattern.ReplaceAllString(fp, "(?+)")
+}
+
+func isIdentRune(r rune) bool {
+	return unicode.IsLetter(r) || unicode.IsDigit(r) || r == '_' || r == '$' || r == '`'
+}
+
+// QueryRecord describes one executed statement.
+type QueryRecord struct {
+	Query        string
+	Origin       string
+	Start        time.Time
+	Duration     time.Duration
+	RowsReturned int64
+	RowsAffected int64
+	Err          error
+	TraceID      string
+}
+
+// SlowQueryEntry is one line of the slow query log. RowsExamined is the
+// optimizer's estimate from EXPLAIN, as MySQL does not report the actual
+// count to clients.
+type SlowQueryEntry struct {
+	Timestamp    time.Time `json:"timestamp"`
+	Fingerprint  string    `json:"fingerprint"`
+	Query        string    `json:"query"`
+	DurationMs   float64   `json:"duration_ms"`
+	RowsExamined int64     `json:"rows_examined"`
+	RowsReturned int64     `json:"rows_returned"`
+	RowsAffected int64     `json:"rows_affected"`
+	Origin       string    `json:"origin"`
+	NodeID       string    `json:"node_id,omitempty"`
+	TraceID      string    `json:"trace_id,omitempty"`
+	Error        string    `json:"error,omitempty"`
+}
+
+// FingerprintStats aggregates the statements sharing one fingerprint.
+// Percentiles cover the most recent samples only.
+type FingerprintStats struct {
+	Fingerprint  string    `json:"fingerprint"`
+	Example      string    `json:"example"`
+	Count        int64     `json:"count"`
+	Errors       int64     `json:"errors"`
+	SlowCount    int64     `json:"slow_count"`
+	TotalMs      float64   `json:"total_ms"`
+	MeanMs       float64   `json:"mean_ms"`
+	P50Ms        float64   `json:"p50_ms"`
+	P99Ms        float64   `json:"p99_ms"`
+	MaxMs        float64   `json:"max_ms"`
+	RowsReturned int64     `json:"rows_returned"`
+	RowsAffected int64     `json:"rows_affected"`
+	LastSeen     time.Time `json:"last_seen"`
+}
+
+const (
+	maxFingerprints   = 1000
+	samplesPerPattern = 1024
+)
+
+type fingerprintState struct {
+	stats   FingerprintStats
+	samples []float64
+	next    int
+}
+
+// QueryProfiler times statements, keeps per-fingerprint statistics and
+// writes statements slower than Threshold to a slow query log.
+type QueryProfiler struct {
+	Threshold time.Duration
+	NodeID    string
+	// Explain, if set, estimates the rows a slow statement examined.
+	Explain func(query string) (int64, error)
+
+	mu      sync.Mutex
+	byPrint map[string]*fingerprintState
+	slowLog *RotatingFile
+}
+
+// NewQueryProfiler writes slow statements to slowLogPath, rotated with the
+// given log options.
+func NewQueryProfiler(threshold time.Duration, nodeID, slowLogPath string, opts LogOptions) (*QueryProfiler, error) {
+	file, err := OpenRotatingFile(slowLogPath, int64(opts.MaxSizeMB)*1024*1024, opts.MaxAge, opts.MaxBackups)
+	if err != nil {
+		return nil, err
+	}
+	return &QueryProfiler{
+		Threshold: threshold,
+		NodeID:    nodeID,
+		byPrint:   make(map[string]*fingerprintState),
+		slowLog:   file,
+	}, nil
+}
+
+// Record adds rec to the statistics and, if it was slow, to the slow log.
+func (p *QueryProfiler) Record(rec QueryRecord) {
+	if p == nil {
+		return
+	}
+	fp := Fingerprint(rec.Query)
+	ms := float64(rec.Duration) / float64(time.Millisecond)
+	slow := p.Threshold > 0 && rec.Duration >= p.Threshold
+
+	p.mu.Lock()
+	state, ok := p.byPrint[fp]
+	if !ok {
+		if len(p.byPrint) >= maxFingerprints {
+			p.evictLocked()
+		}
+		state = &fingerprintState{stats: FingerprintStats{Fingerprint: fp}}
+		p.byPrint[fp] = state
+	}
+	s := &state.stats
+	s.Example = rec.Query
+	s.Count++
+	if rec.Err != nil {
+		s.Errors++
+	}
+	if slow {
+		s.SlowCount++
+	}
+	s.TotalMs += ms
+	s.MaxMs = math.Max(s.MaxMs, ms)
+	s.RowsReturned += rec.RowsReturned
+	s.RowsAffected += rec.RowsAffected
+	s.LastSeen = rec.Start.Add(rec.Duration)
+	if len(state.samples) < samplesPerPattern {
+		state.samples = append(state.samples, ms)
+	} else {
+		state.samples[state.next] = ms
+		state.next = (state.next + 1) % samplesPerPattern
+	}
+	p.mu.Unlock()
+
+	if slow {
+		go p.writeSlow(fp, rec)
+	}
+}
+
+// evictLocked drops the least recently seen fingerprint.
+func (p *QueryProfiler) evictLocked() {
+	var oldest string
+	var oldestAt time.Time
+	for fp, state := range p.byPrint {
+		if oldest == "" || state.stats.LastSeen.Before(oldestAt) {
+			oldest, oldestAt = fp, state.stats.LastSeen
+		}
+	}
+	delete(p.byPrint, oldest)
+}
+
+func explainable(query string) bool {
+	switch StatementKind(query) {
+	case "SELECT", "INSERT", "UPDATE", "DELETE", "REPLACE":
+		return true
+	}
+	return false
+}
+
+func (p *QueryProfiler) writeSlow(fp string, rec QueryRecord) {
+	entry := SlowQueryEntry{
+		Timestamp:    rec.Start,
+		Fingerprint:  fp,
+		Query:        rec.Query,
+		DurationMs:   float64(rec.Duration) / float64(time.Millisecond),
+		RowsReturned: rec.RowsReturned,
+		RowsAffected: rec.RowsAffected,
+		Origin:       rec.Origin,
+		NodeID:       p.NodeID,
+		TraceID:      rec.TraceID,
+	}
+	if rec.Err != nil {
+		entry.Error = rec.Err.Error()
+	}
+	if p.Explain != nil && rec.Err == nil && explainable(rec.Query) {
+		if rows, err := p.Explain(rec.Query); err == nil {
+			entry.RowsExamined = rows
+		}
+	}
+
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return
+	}
+	if _, err := p.slowLog.Write(append(data, '\n')); err != nil {
+		log.Printf("Failed to write slow query log: %v", err)
+	}
+}
+
+// Stats returns the per-fingerprint statistics sorted by sortBy, one of
+// total (the default), count, mean, p99, max or errors, largest first.
+func (p *QueryProfiler) Stats(sortBy string) []FingerprintStats {
+	p.mu.Lock()
+	stats := make([]FingerprintStats, 0, len(p.byPrint))
+	for _, state := range p.byPrint {
+		s := state.stats
+		s.MeanMs = s.TotalMs / float64(s.Count)
+		sorted := append([]float64(nil), state.samples...)
+		sort.Float64s(sorted)
+		s.P50Ms = percentile(sorted, 0.50)
+		s.P99Ms = percentile(sorted, 0.99)
+		stats = append(stats, s)
+	}
+	p.mu.Unlock()
+
+	key := func(s FingerprintStats) float64 {
+		switch sortBy {
+		case "count":
+			return float64(s.Count)
+		case "mean":
+			return s.MeanMs
+		case "p99":
+			return s.P99Ms
+		case "max":
+			return s.MaxMs
+		case "errors":
+			return float64(s.Errors)
+		}
+		return s.TotalMs
+	}
+	sort.Slice(stats, func(i, j int) bool { return key(stats[i]) > key(stats[j]) })
+	return stats
+}
+
+func percentile(sorted []float64, q float64) float64 {
+	if len(sorted) == 0 {
+		return 0
+	}
+	return sorted[int(math.Ceil(q*float64(len(sorted))))-1]
+}
+
+func (p *QueryProfiler) Reset() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.byPrint = make(map[string]*fingerprintState)
+}
+
+// SlowQueries returns up to limit slow log entries, newest first.
+func (p *QueryProfiler) SlowQueries(limit int) ([]SlowQueryEntry, error) {
+	var entries []SlowQueryEntry
+	err := scanJSONLines(p.slowLog.Path, func(line []byte) {
+		var entry SlowQueryEntry
+		if json.Unmarshal(line, &entry) != nil {
+			return
+		}
+		entries = append(entries, entry)
+		if limit > 0 && len(entries) > limit {
+			entries = entries[1:]
+		}
+	})
+	for i, j := 0, len(entries)-1; i < j; i, j = i+1, j-1 {
+		entries[i], entries[j] = entries[j], entries[i]
+	}
+	return entries, err
+}
+
+func (p *QueryProfiler) Close() error {
+	return p.slowLog.Close()
+}
+
+// RegisterHandlers serves GET /api/queries/stats (?sort=, ?limit=, DELETE
+// resets) and GET /api/queries/slow (?limit=).
+func (p *QueryProfiler) RegisterHandlers(mux *http.ServeMux) {
+	mux.HandleFunc("/api/queries/stats", func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+		case http.MethodDelete:
+			p.Reset()
+			w.WriteHeader(http.StatusNoContent)
+			return
+		default:
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		stats := p.Stats(r.URL.Query().Get("sort"))
+		if limit, err := strconv.Atoi(r.URL.Query().Get("limit")); err == nil && limit > 0 && limit < len(stats) {
+			stats = stats[:limit]
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(stats)
+	})
+	mux.HandleFunc("/api/queries/slow", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		limit := DefaultLogLimit
+		if l, err := strconv.Atoi(r.URL.Query().Get("limit")); err == nil && l > 0 {
+			limit = min(l, MaxLogLimit)
+		}
+		entries, err := p.SlowQueries(limit)
+		if err != nil {
+			http.Error(w, "Failed to read slow query log", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(entries)
+	})
+}
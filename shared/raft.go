@@ -0,0 +1,847 @@
+package shared
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"math/rand"
+	"sort"
+	"sync"
+	"time"
+)
+
+type RaftState int
+
+const (
+	RaftFollower RaftState = iota
+	RaftCandidate
+	RaftLeader
+)
+
+func (s RaftState) String() string {
+	switch s {
+	case RaftFollower:
+		return "follower"
+	case RaftCandidate:
+		return "candidate"
+	case RaftLeader:
+		return "leader"
+	}
+	return "unknown"
+}
+
+const (
+	RaftEntryCommand = "command"
+	RaftEntryConfig  = "config"
+	RaftEntryNoop    = "noop"
+)
+
+var (
+	ErrNotLeader        = errors.New("raft: not the leader")
+	ErrLeadershipLost   = errors.New("raft: leadership lost before entry committed")
+	ErrProposalTimeout  = errors.New("raft: timed out waiting for commit")
+	ErrConfigInProgress = errors.New("raft: a membership change is already in progress")
+	ErrRaftStopped      = errors.New("raft: node stopped")
+)
+
+type RaftEntry struct {
+	Index int64             `json:"index"`
+	Term  int64             `json:"term"`
+	Type  string            `json:"type"`
+	Data  []byte            `json:"data,omitempty"`
+	Peers map[string]string `json:"peers,omitempty"`
+}
+
+type RequestVoteArgs struct {
+	Term         int64  `json:"term"`
+	CandidateID  string `json:"candidate_id"`
+	LastLogIndex int64  `json:"last_log_index"`
+	LastLogTerm  int64  `json:"last_log_term"`
+}
+
+type RequestVoteReply struct {
+	Term        int64 `json:"term"`
+	VoteGranted bool  `json:"vote_granted"`
+}
+
+type AppendEntriesArgs struct {
+	Term         int64       `json:"term"`
+	LeaderID     string      `json:"leader_id"`
+	PrevLogIndex int64       `json:"prev_log_index"`
+	PrevLogTerm  int64       `json:"prev_log_term"`
+	Entries      []RaftEntry `json:"entries,omitempty"`
+	LeaderCommit int64       `json:"leader_commit"`
+}
+
+type AppendEntriesReply struct {
+	Term          int64 `json:"term"`
+	Success       bool  `json:"success"`
+	ConflictIndex int64 `json:"conflict_index,omitempty"`
+}
+
+// RaftTransport delivers RPCs to the peer listening at addr.
+type RaftTransport interface {
+	RequestVote(addr string, args RequestVoteArgs) (RequestVoteReply, error)
+	AppendEntries(addr string, args AppendEntriesArgs) (AppendEntriesReply, error)
+}
+
+type RaftConfig struct {
+	ID string
+	// Peers maps every voting member, including this node, to its address.
+	// It is only used until the log carries a configuration entry.
+	Peers     map[string]string
+	Transport RaftTransport
+	// StateDir holds the persisted term, vote and log. Empty keeps
+	// everything in memory, which is what the tests use.
+	StateDir          string
+	ElectionTimeout   time.Duration
+	HeartbeatInterval time.Duration
+	ProposeTimeout    time.Duration
+	// Apply is called once per committed command entry, in log order.
+	Apply func(entry RaftEntry) (interface{}, error)
+	// Applied is the last index Apply has recorded as applied, for a state
+	// machine that records it along with each entry. The node resumes after
+	// it rather than after the index saved in StateDir, which may lag.
+	Applied int64
+	// OnLeaderChange is called with the new leader ID ("" when unknown)
+	// whenever it changes. It runs on its own goroutine.
+	OnLeaderChange func(leaderID string)
+}
+
+type RaftStatus struct {
+	ID          string            `json:"id"`
+	State       string            `json:"state"`
+	Term        int64             `json:"term"`
+	Leader      string            `json:"leader"`
+	LeaderAddr  string            `json:"leader_addr,omitempty"`
+	CommitIndex int64             `json:"commit_index"`
+	LastApplied int64             `json:"last_applied"`
+	LastIndex   int64             `json:"last_index"`
+	Peers       map[string]string `json:"peers"`
+	LastError   string            `json:"last_error,omitempty"`
+}
+
+type applyResult struct {
+	value interface{}
+	err   error
+}
+
+type raftWaiter struct {
+	term int64
+	ch   chan applyResult
+}
+
+// RaftNode is a single member of a Raft group. It elects a leader, replicates
+// the log to a majority before committing and supports single-server
+// membership changes through configuration entries.
+type RaftNode struct {
+	mu  sync.Mutex
+	cfg RaftConfig
+
+	state       RaftState
+	term        int64
+	votedFor    string
+	log         []RaftEntry
+	commitIndex int64
+	lastApplied int64
+	leaderID    string
+	peers       map[string]string
+
+	nextIndex   map[string]int64
+	matchIndex  map[string]int64
+	inflight    map[string]bool
+	lastContact map[string]time.Time
+
+	electionDeadline time.Time
+	lastHeard        time.Time
+	lastBroadcast    time.Time
+
+	storage *raftStorage
+	// lastErr is the most recent failure to persist state, shown in Status.
+	lastErr error
+	waiters map[int64]raftWaiter
+	applyCh chan struct{}
+	stopCh  chan struct{}
+	stopped bool
+}
+
+func NewRaftNode(cfg RaftConfig) (*RaftNode, error) {
+	if cfg.ID == "" {
+		return nil, fmt.Errorf("raft: node ID is required")
+	}
+	if _, ok := cfg.Peers[cfg.ID]; !ok {
+		return nil, fmt.Errorf("raft: peers must include this node (%s)", cfg.ID)
+	}
+	if cfg.ElectionTimeout == 0 {
+		cfg.ElectionTimeout = 1500 * time.Millisecond
+	}
+	if cfg.HeartbeatInterval == 0 {
+		cfg.HeartbeatInterval = cfg.ElectionTimeout / 5
+	}
+	if cfg.ProposeTimeout == 0 {
+		cfg.ProposeTimeout = 5 * time.Second
+	}
+
+	n := &RaftNode{
+		cfg:         cfg,
+		log:         []RaftEntry{{Index: 0, Term: 0}},
+		peers:       copyPeers(cfg.Peers),
+		nextIndex:   make(map[string]int64),
+		matchIndex:  make(map[string]int64),
+		inflight:    make(map[string]bool),
+		lastContact: make(map[string]time.Time),
+		waiters:     make(map[int64]raftWaiter),
+		applyCh:     make(chan struct{}, 1),
+		stopCh:      make(chan struct{}),
+	}
+
+	if cfg.StateDir != "" {
+		storage, err := openRaftStorage(cfg.StateDir)
+		if err != nil {
+			return nil, err
+		}
+		n.storage = storage
+		n.term = storage.state.Term
+		n.votedFor = storage.state.VotedFor
+		n.log = append(n.log, storage.entries...)
+		n.lastApplied = storage.state.Applied
+		if cfg.Applied > 0 && cfg.Applied <= n.lastIndex() {
+			n.lastApplied = cfg.Applied
+		}
+		n.commitIndex = n.lastApplied
+		n.refreshPeers()
+	}
+
+	n.resetElectionTimer()
+	go n.run()
+	go n.applyLoop()
+	return n, nil
+}
+
+func copyPeers(peers map[string]string) map[string]string {
+	out := make(map[string]string, len(peers))
+	for id, addr := range peers {
+		out[id] = addr
+	}
+	return out
+}
+
+func (n *RaftNode) Stop() {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	if n.stopped {
+		return
+	}
+	n.stopped = true
+	close(n.stopCh)
+	for index, waiter := range n.waiters {
+		waiter.ch <- applyResult{err: ErrRaftStopped}
+		delete(n.waiters, index)
+	}
+	if n.storage != nil {
+		n.storage.Close()
+	}
+}
+
+func (n *RaftNode) ID() string {
+	return n.cfg.ID
+}
+
+func (n *RaftNode) IsLeader() bool {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	return n.state == RaftLeader
+}
+
+// Leader returns the current leader's ID and address, if known.
+func (n *RaftNode) Leader() (string, string) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	return n.leaderID, n.peers[n.leaderID]
+}
+
+func (n *RaftNode) Status() RaftStatus {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	status := RaftStatus{
+		ID:          n.cfg.ID,
+		State:       n.state.String(),
+		Term:        n.term,
+		Leader:      n.leaderID,
+		LeaderAddr:  n.peers[n.leaderID],
+		CommitIndex: n.commitIndex,
+		LastApplied: n.lastApplied,
+		LastIndex:   n.lastIndex(),
+		Peers:       copyPeers(n.peers),
+	}
+	if n.lastErr != nil {
+		status.LastError = n.lastErr.Error()
+	}
+	return status
+}
+
+// Propose appends a command to the log and waits until it has been committed
+// and applied locally, returning the value produced by Apply.
+func (n *RaftNode) Propose(data []byte) (interface{}, error) {
+	return n.propose(RaftEntry{Type: RaftEntryCommand, Data: data})
+}
+
+// WaitCaughtUp waits until this node leads, has committed an entry of its
+// own term and has applied every committed entry, so that its state machine
+// holds every write proposed before. It fails with ErrNotLeader if the node
+// does not lead and ErrProposalTimeout if it does not catch up in time.
+func (n *RaftNode) WaitCaughtUp() error {
+	deadline := time.Now().Add(n.cfg.ProposeTimeout)
+	for {
+		n.mu.Lock()
+		if n.stopped {
+			n.mu.Unlock()
+			return ErrRaftStopped
+		}
+		if n.state != RaftLeader {
+			n.mu.Unlock()
+			return ErrNotLeader
+		}
+		caughtUp := n.log[n.commitIndex].Term == n.term && n.lastApplied >= n.commitIndex
+		n.mu.Unlock()
+		if caughtUp {
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return ErrProposalTimeout
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+// AddPeer adds a voting member. Only one membership change may be in flight.
+func (n *RaftNode) AddPeer(id, addr string) error {
+	return n.changeConfig(func(peers map[string]string) { peers[id] = addr })
+}
+
+// RemovePeer removes a voting member. A leader that removes itself steps
+// down once the change commits.
+func (n *RaftNode) RemovePeer(id string) error {
+	return n.changeConfig(func(peers map[string]string) { delete(peers, id) })
+}
+
+func (n *RaftNode) changeConfig(mutate func(map[string]string)) error {
+	n.mu.Lock()
+	if n.state != RaftLeader {
+		n.mu.Unlock()
+		return ErrNotLeader
+	}
+	for i := n.lastIndex(); i > n.commitIndex; i-- {
+		if n.log[i].Type == RaftEntryConfig {
+			n.mu.Unlock()
+			return ErrConfigInProgress
+		}
+	}
+	peers := copyPeers(n.peers)
+	n.mu.Unlock()
+
+	mutate(peers)
+	_, err := n.propose(RaftEntry{Type: RaftEntryConfig, Peers: peers})
+	return err
+}
+
+func (n *RaftNode) propose(entry RaftEntry) (interface{}, error) {
+	n.mu.Lock()
+	if n.stopped {
+		n.mu.Unlock()
+		return nil, ErrRaftStopped
+	}
+	if n.state != RaftLeader {
+		n.mu.Unlock()
+		return nil, ErrNotLeader
+	}
+	entry.Index = n.lastIndex() + 1
+	entry.Term = n.term
+	if err := n.appendLocked([]RaftEntry{entry}); err != nil {
+		n.mu.Unlock()
+		return nil, err
+	}
+	n.matchIndex[n.cfg.ID] = entry.Index
+	ch := make(chan applyResult, 1)
+	n.waiters[entry.Index] = raftWaiter{term: entry.Term, ch: ch}
+	n.advanceCommitLocked()
+	n.broadcastLocked()
+	n.mu.Unlock()
+
+	select {
+	case res := <-ch:
+		return res.value, res.err
+	case <-time.After(n.cfg.ProposeTimeout):
+		n.mu.Lock()
+		delete(n.waiters, entry.Index)
+		n.mu.Unlock()
+		return nil, ErrProposalTimeout
+	}
+}
+
+func (n *RaftNode) lastIndex() int64 {
+	return n.log[len(n.log)-1].Index
+}
+
+func (n *RaftNode) lastTerm() int64 {
+	return n.log[len(n.log)-1].Term
+}
+
+func (n *RaftNode) quorum() int {
+	return len(n.peers)/2 + 1
+}
+
+func (n *RaftNode) resetElectionTimer() {
+	jitter := time.Duration(rand.Int63n(int64(n.cfg.ElectionTimeout)))
+	n.electionDeadline = time.Now().Add(n.cfg.ElectionTimeout + jitter)
+}
+
+// refreshPeers sets the active configuration to the latest configuration
+// entry in the log, falling back to the configured bootstrap peers.
+func (n *RaftNode) refreshPeers() {
+	for i := len(n.log) - 1; i > 0; i-- {
+		if n.log[i].Type == RaftEntryConfig {
+			n.peers = copyPeers(n.log[i].Peers)
+			return
+		}
+	}
+	n.peers = copyPeers(n.cfg.Peers)
+}
+
+func (n *RaftNode) appendLocked(entries []RaftEntry) error {
+	if n.storage != nil {
+		if err := n.storage.Append(entries); err != nil {
+			return err
+		}
+	}
+	n.log = append(n.log, entries...)
+	for _, entry := range entries {
+		if entry.Type == RaftEntryConfig {
+			n.refreshPeers()
+			break
+		}
+	}
+	return nil
+}
+
+func (n *RaftNode) truncateLocked(index int64) error {
+	n.log = n.log[:index]
+	if n.storage != nil {
+		if err := n.storage.Rewrite(n.log[1:]); err != nil {
+			return err
+		}
+	}
+	for i, waiter := range n.waiters {
+		if i >= index {
+			waiter.ch <- applyResult{err: ErrLeadershipLost}
+			delete(n.waiters, i)
+		}
+	}
+	n.refreshPeers()
+	return nil
+}
+
+// persistLocked saves term and vote before the node acts on them. On failure
+// neither changes, so the node never votes or leads in a term it could
+// forget after a restart.
+func (n *RaftNode) persistLocked(term int64, votedFor string) error {
+	if n.storage != nil {
+		prevTerm, prevVote := n.storage.state.Term, n.storage.state.VotedFor
+		n.storage.state.Term = term
+		n.storage.state.VotedFor = votedFor
+		if err := n.storage.SaveState(); err != nil {
+			n.storage.state.Term, n.storage.state.VotedFor = prevTerm, prevVote
+			n.lastErr = err
+			return err
+		}
+	}
+	n.term = term
+	n.votedFor = votedFor
+	return nil
+}
+
+func (n *RaftNode) setLeaderLocked(id string) {
+	if n.leaderID == id {
+		return
+	}
+	n.leaderID = id
+	if n.cfg.OnLeaderChange != nil {
+		go n.cfg.OnLeaderChange(id)
+	}
+}
+
+// becomeFollowerLocked steps down, moving to term if it is newer. The node
+// steps down even when the new term cannot be persisted; it then stays in
+// its old term and the error tells the caller to refuse the request.
+func (n *RaftNode) becomeFollowerLocked(term int64) error {
+	var err error
+	if term > n.term {
+		err = n.persistLocked(term, "")
+	}
+	if n.state == RaftLeader {
+		n.setLeaderLocked("")
+	}
+	n.state = RaftFollower
+	return err
+}
+
+func (n *RaftNode) run() {
+	ticker := time.NewTicker(10 * time.Millisecond)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-n.stopCh:
+			return
+		case <-ticker.C:
+		}
+
+		n.mu.Lock()
+		now := time.Now()
+		switch n.state {
+		case RaftLeader:
+			if !n.hasQuorumContactLocked(now) {
+				n.becomeFollowerLocked(n.term)
+				n.resetElectionTimer()
+			} else if now.Sub(n.lastBroadcast) >= n.cfg.HeartbeatInterval {
+				n.broadcastLocked()
+			}
+		default:
+			if now.After(n.electionDeadline) {
+				n.startElectionLocked()
+			}
+		}
+		n.mu.Unlock()
+	}
+}
+
+// hasQuorumContactLocked lets a leader that has been cut off from a majority
+// step down instead of believing it still leads.
+func (n *RaftNode) hasQuorumContactLocked(now time.Time) bool {
+	contacted := 0
+	for id := range n.peers {
+		if id == n.cfg.ID || now.Sub(n.lastContact[id]) < n.cfg.ElectionTimeout {
+			contacted++
+		}
+	}
+	return contacted >= n.quorum()
+}
+
+func (n *RaftNode) startElectionLocked() {
+	n.resetElectionTimer()
+	if _, member := n.peers[n.cfg.ID]; !member {
+		return
+	}
+
+	if err := n.persistLocked(n.term+1, n.cfg.ID); err != nil {
+		n.state = RaftFollower
+		return
+	}
+	n.state = RaftCandidate
+	n.setLeaderLocked("")
+
+	term := n.term
+	args := RequestVoteArgs{
+		Term:         term,
+		CandidateID:  n.cfg.ID,
+		LastLogIndex: n.lastIndex(),
+		LastLogTerm:  n.lastTerm(),
+	}
+	votes := 1
+	if votes >= n.quorum() {
+		n.becomeLeaderLocked()
+		return
+	}
+
+	for id, addr := range n.peers {
+		if id == n.cfg.ID {
+			continue
+		}
+		go func(addr string) {
+			reply, err := n.cfg.Transport.RequestVote(addr, args)
+			if err != nil {
+				return
+			}
+
+			n.mu.Lock()
+			defer n.mu.Unlock()
+			if reply.Term > n.term {
+				n.becomeFollowerLocked(reply.Term)
+				return
+			}
+			if n.state != RaftCandidate || n.term != term || !reply.VoteGranted {
+				return
+			}
+			votes++
+			if votes >= n.quorum() {
+				n.becomeLeaderLocked()
+			}
+		}(addr)
+	}
+}
+
+func (n *RaftNode) becomeLeaderLocked() {
+	n.state = RaftLeader
+	n.setLeaderLocked(n.cfg.ID)
+	now := time.Now()
+	for id := range n.peers {
+		n.nextIndex[id] = n.lastIndex() + 1
+		n.matchIndex[id] = 0
+		n.lastContact[id] = now
+	}
+
+	// A no-op in the new term lets entries from earlier terms commit.
+	noop := RaftEntry{Index: n.lastIndex() + 1, Term: n.term, Type: RaftEntryNoop}
+	if err := n.appendLocked([]RaftEntry{noop}); err != nil {
+		n.becomeFollowerLocked(n.term)
+		return
+	}
+	n.matchIndex[n.cfg.ID] = noop.Index
+	n.advanceCommitLocked()
+	n.broadcastLocked()
+}
+
+func (n *RaftNode) broadcastLocked() {
+	n.lastBroadcast = time.Now()
+	for id := range n.peers {
+		if id != n.cfg.ID {
+			n.replicateToLocked(id)
+		}
+	}
+}
+
+func (n *RaftNode) replicateToLocked(id string) {
+	if n.inflight[id] {
+		return
+	}
+	next := n.nextIndex[id]
+	if next < 1 {
+		next = 1
+	}
+	if next > n.lastIndex()+1 {
+		next = n.lastIndex() + 1
+	}
+	prev := n.log[next-1]
+	end := next + 256
+	if end > n.lastIndex()+1 {
+		end = n.lastIndex() + 1
+	}
+	args := AppendEntriesArgs{
+		Term:         n.term,
+		LeaderID:     n.cfg.ID,
+		PrevLogIndex: prev.Index,
+		PrevLogTerm:  prev.Term,
+		Entries:      append([]RaftEntry(nil), n.log[next:end]...),
+		LeaderCommit: n.commitIndex,
+	}
+	addr := n.peers[id]
+	n.inflight[id] = true
+
+	go func() {
+		reply, err := n.cfg.Transport.AppendEntries(addr, args)
+
+		n.mu.Lock()
+		defer n.mu.Unlock()
+		n.inflight[id] = false
+		if err != nil {
+			return
+		}
+		if reply.Term > n.term {
+			n.becomeFollowerLocked(reply.Term)
+			n.resetElectionTimer()
+			return
+		}
+		if n.state != RaftLeader || n.term != args.Term {
+			return
+		}
+		n.lastContact[id] = time.Now()
+		if reply.Success {
+			match := args.PrevLogIndex + int64(len(args.Entries))
+			if match > n.matchIndex[id] {
+				n.matchIndex[id] = match
+			}
+			n.nextIndex[id] = match + 1
+			n.advanceCommitLocked()
+			if n.nextIndex[id] <= n.lastIndex() {
+				n.replicateToLocked(id)
+			}
+			return
+		}
+		if reply.ConflictIndex > 0 {
+			n.nextIndex[id] = reply.ConflictIndex
+		} else if n.nextIndex[id] > 1 {
+			n.nextIndex[id]--
+		}
+		n.replicateToLocked(id)
+	}()
+}
+
+func (n *RaftNode) advanceCommitLocked() {
+	matches := make([]int64, 0, len(n.peers))
+	for id := range n.peers {
+		if id == n.cfg.ID {
+			matches = append(matches, n.lastIndex())
+		} else {
+			matches = append(matches, n.matchIndex[id])
+		}
+	}
+	sort.Slice(matches, func(i, j int) bool { return matches[i] > matches[j] })
+	candidate := matches[n.quorum()-1]
+	if candidate > n.commitIndex && n.log[candidate].Term == n.term {
+		n.commitIndex = candidate
+		n.signalApply()
+	}
+}
+
+func (n *RaftNode) signalApply() {
+	select {
+	case n.applyCh <- struct{}{}:
+	default:
+	}
+}
+
+func (n *RaftNode) applyLoop() {
+	for {
+		select {
+		case <-n.stopCh:
+			return
+		case <-n.applyCh:
+		}
+
+		for {
+			n.mu.Lock()
+			if n.stopped || n.lastApplied >= n.commitIndex {
+				n.mu.Unlock()
+				break
+			}
+			entry := n.log[n.lastApplied+1]
+			n.mu.Unlock()
+
+			var res applyResult
+			if entry.Type == RaftEntryCommand && n.cfg.Apply != nil {
+				res.value, res.err = n.cfg.Apply(entry)
+			}
+
+			n.mu.Lock()
+			n.lastApplied = entry.Index
+			if n.storage != nil {
+				n.storage.state.Applied = entry.Index
+				if err := n.storage.SaveState(); err != nil {
+					// Apply records the index itself when it must not
+					// repeat an entry; otherwise the entry is applied
+					// again after a restart.
+					log.Printf("raft: failed to save applied index %d: %v", entry.Index, err)
+					n.lastErr = err
+				}
+			}
+			if waiter, ok := n.waiters[entry.Index]; ok {
+				if waiter.term != entry.Term {
+					res = applyResult{err: ErrLeadershipLost}
+				}
+				waiter.ch <- res
+				delete(n.waiters, entry.Index)
+			}
+			if entry.Type == RaftEntryConfig && n.state == RaftLeader {
+				if _, member := n.peers[n.cfg.ID]; !member {
+					n.becomeFollowerLocked(n.term)
+				}
+			}
+			n.mu.Unlock()
+		}
+	}
+}
+
+func (n *RaftNode) HandleRequestVote(args RequestVoteArgs) RequestVoteReply {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	// Ignore candidates while a live leader is known, so a partitioned or
+	// removed server cannot force needless elections.
+	if n.state != RaftCandidate && n.leaderID != "" && time.Since(n.lastHeard) < n.cfg.ElectionTimeout {
+		return RequestVoteReply{Term: n.term}
+	}
+	if args.Term < n.term {
+		return RequestVoteReply{Term: n.term}
+	}
+	if args.Term > n.term {
+		if err := n.becomeFollowerLocked(args.Term); err != nil {
+			return RequestVoteReply{Term: n.term}
+		}
+	}
+
+	upToDate := args.LastLogTerm > n.lastTerm() ||
+		(args.LastLogTerm == n.lastTerm() && args.LastLogIndex >= n.lastIndex())
+	if (n.votedFor == "" || n.votedFor == args.CandidateID) && upToDate {
+		if err := n.persistLocked(n.term, args.CandidateID); err != nil {
+			return RequestVoteReply{Term: n.term}
+		}
+		n.resetElectionTimer()
+		return RequestVoteReply{Term: n.term, VoteGranted: true}
+	}
+	return RequestVoteReply{Term: n.term}
+}
+
+func (n *RaftNode) HandleAppendEntries(args AppendEntriesArgs) AppendEntriesReply {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	if args.Term < n.term {
+		return AppendEntriesReply{Term: n.term}
+	}
+	if args.Term > n.term || n.state != RaftFollower {
+		if err := n.becomeFollowerLocked(args.Term); err != nil {
+			return AppendEntriesReply{Term: n.term}
+		}
+	}
+	n.setLeaderLocked(args.LeaderID)
+	n.lastHeard = time.Now()
+	n.resetElectionTimer()
+
+	if args.PrevLogIndex > n.lastIndex() {
+		return AppendEntriesReply{Term: n.term, ConflictIndex: n.lastIndex() + 1}
+	}
+	if n.log[args.PrevLogIndex].Term != args.PrevLogTerm {
+		conflictTerm := n.log[args.PrevLogIndex].Term
+		index := args.PrevLogIndex
+		for index > 1 && n.log[index-1].Term == conflictTerm {
+			index--
+		}
+		return AppendEntriesReply{Term: n.term, ConflictIndex: index}
+	}
+
+	for i, entry := range args.Entries {
+		if entry.Index <= n.lastIndex() {
+			if n.log[entry.Index].Term == entry.Term {
+				continue
+			}
+			if entry.Index <= n.commitIndex {
+				// Committed entries never change; a leader asking for
+				// that indicates a bug, so refuse instead of diverging.
+				return AppendEntriesReply{Term: n.term}
+			}
+			if err := n.truncateLocked(entry.Index); err != nil {
+				return AppendEntriesReply{Term: n.term}
+			}
+		}
+		if err := n.appendLocked(args.Entries[i:]); err != nil {
+			return AppendEntriesReply{Term: n.term}
+		}
+		break
+	}
+
+	if args.LeaderCommit > n.commitIndex {
+		last := args.PrevLogIndex + int64(len(args.Entries))
+		if args.LeaderCommit < last {
+			last = args.LeaderCommit
+		}
+		if last > n.commitIndex {
+			n.commitIndex = last
+			n.signalApply()
+		}
+	}
+	return AppendEntriesReply{Term: n.term, Success: true}
+}
@@ -0,0 +1,171 @@
+package shared
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// RaftMemNetwork is an in-process RaftTransport that routes RPCs directly to
+// registered nodes. Nodes can be cut off to simulate partitions.
+type RaftMemNetwork struct {
+	mu       sync.Mutex
+	nodes    map[string]*RaftNode
+	isolated map[string]bool
+}
+
+func NewRaftMemNetwork() *RaftMemNetwork {
+	return &RaftMemNetwork{
+		nodes:    make(map[string]*RaftNode),
+		isolated: make(map[string]bool),
+	}
+}
+
+func (m *RaftMemNetwork) target(addr string) (*RaftNode, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	node, ok := m.nodes[addr]
+	if !ok || m.isolated[addr] {
+		return nil, fmt.Errorf("raft: %s unreachable", addr)
+	}
+	return node, nil
+}
+
+func (m *RaftMemNetwork) RequestVote(addr string, args RequestVoteArgs) (RequestVoteReply, error) {
+	if m.Isolated(args.CandidateID) {
+		return RequestVoteReply{}, fmt.Errorf("raft: %s isolated", args.CandidateID)
+	}
+	node, err := m.target(addr)
+	if err != nil {
+		return RequestVoteReply{}, err
+	}
+	return node.HandleRequestVote(args), nil
+}
+
+func (m *RaftMemNetwork) AppendEntries(addr string, args AppendEntriesArgs) (AppendEntriesReply, error) {
+	if m.Isolated(args.LeaderID) {
+		return AppendEntriesReply{}, fmt.Errorf("raft: %s isolated", args.LeaderID)
+	}
+	node, err := m.target(addr)
+	if err != nil {
+		return AppendEntriesReply{}, err
+	}
+	return node.HandleAppendEntries(args), nil
+}
+
+// Isolate cuts a node off from every other node until Heal is called. In the
+// harness node IDs double as addresses.
+func (m *RaftMemNetwork) Isolate(id string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.isolated[id] = true
+}
+
+func (m *RaftMemNetwork) Heal() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.isolated = make(map[string]bool)
+}
+
+func (m *RaftMemNetwork) Isolated(id string) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return m.isolated[id]
+}
+
+// RaftHarness runs a whole Raft group in one process. Each node records the
+// commands it applies.
+type RaftHarness struct {
+	Network *RaftMemNetwork
+	Nodes   map[string]*RaftNode
+
+	mu      sync.Mutex
+	applied map[string][]string
+}
+
+// NewRaftHarness starts n in-memory nodes named node-1 … node-n.
+func NewRaftHarness(n int) (*RaftHarness, error) {
+	h := &RaftHarness{
+		Network: NewRaftMemNetwork(),
+		Nodes:   make(map[string]*RaftNode),
+		applied: make(map[string][]string),
+	}
+	peers := make(map[string]string)
+	for i := 1; i <= n; i++ {
+		id := fmt.Sprintf("node-%d", i)
+		peers[id] = id
+	}
+	for id := range peers {
+		if err := h.AddNode(id, peers); err != nil {
+			h.Stop()
+			return nil, err
+		}
+	}
+	return h, nil
+}
+
+// AddNode starts a node with the given bootstrap peers. To join it to a
+// running group, start it with the current peers plus itself and then call
+// AddPeer on the leader.
+func (h *RaftHarness) AddNode(id string, peers map[string]string) error {
+	node, err := NewRaftNode(RaftConfig{
+		ID:                id,
+		Peers:             peers,
+		Transport:         h.Network,
+		ElectionTimeout:   150 * time.Millisecond,
+		HeartbeatInterval: 30 * time.Millisecond,
+		ProposeTimeout:    2 * time.Second,
+		Apply: func(entry RaftEntry) (interface{}, error) {
+			h.mu.Lock()
+			defer h.mu.Unlock()
+			h.applied[id] = append(h.applied[id], string(entry.Data))
+			return len(h.applied[id]), nil
+		},
+	})
+	if err != nil {
+		return err
+	}
+
+	h.Network.mu.Lock()
+	h.Network.nodes[id] = node
+	h.Network.mu.Unlock()
+	h.Nodes[id] = node
+	return nil
+}
+
+// WaitForLeader returns the single leader among reachable nodes, or an error
+// if none emerges before timeout.
+func (h *RaftHarness) WaitForLeader(timeout time.Duration) (*RaftNode, error) {
+	deadline := time.Now().Add(timeout)
+	for time.Now().Before(deadline) {
+		var leaders []*RaftNode
+		for id, node := range h.Nodes {
+			if !h.Network.Isolated(id) && node.IsLeader() {
+				leaders = append(leaders, node)
+			}
+		}
+		if len(leaders) == 1 {
+			return leaders[0], nil
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	return nil, fmt.Errorf("raft: no leader elected within %s", timeout)
+}
+
+// Applied returns the commands a node has applied so far.
+func (h *RaftHarness) Applied(id string) []string {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	return append([]string(nil), h.applied[id]...)
+}
+
+func (h *RaftHarness) Stop() {
+	for _, node := range h.Nodes {
+		node.Stop()
+	}
+}
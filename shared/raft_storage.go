@@ -0,0 +1,122 @@
+package shared
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+type raftPersistentState struct {
+	Term     int64  `json:"term"`
+	VotedFor string `json:"voted_for"`
+	Applied  int64  `json:"applied"`
+}
+
+// raftStorage keeps the term and vote in a small state file that is replaced
+// atomically, and the log as JSON lines that are appended to and only
+// rewritten when a follower truncates a conflicting suffix.
+type raftStorage struct {
+	dir     string
+	state   raftPersistentState
+	entries []RaftEntry
+	logFile *os.File
+}
+
+func openRaftStorage(dir string) (*raftStorage, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create raft directory: %v", err)
+	}
+	s := &raftStorage{dir: dir}
+
+	data, err := os.ReadFile(filepath.Join(dir, "state.json"))
+	if err == nil {
+		if err := json.Unmarshal(data, &s.state); err != nil {
+			return nil, fmt.Errorf("corrupt raft state: %v", err)
+		}
+	} else if !os.IsNotExist(err) {
+		return nil, fmt.Errorf("failed to read raft state: %v", err)
+	}
+
+	logPath := filepath.Join(dir, "log.jsonl")
+	s.logFile, err = os.OpenFile(logPath, os.O_CREATE|os.O_RDWR|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open raft log: %v", err)
+	}
+	scanner := bufio.NewScanner(s.logFile)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for scanner.Scan() {
+		var entry RaftEntry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			s.logFile.Close()
+			return nil, fmt.Errorf("corrupt raft log entry: %v", err)
+		}
+		s.entries = append(s.entries, entry)
+	}
+	if err := scanner.Err(); err != nil {
+		s.logFile.Close()
+		return nil, fmt.Errorf("failed to read raft log: %v", err)
+	}
+	return s, nil
+}
+
+func (s *raftStorage) SaveState() error {
+	data, err := json.Marshal(s.state)
+	if err != nil {
+		return fmt.Errorf("failed to encode raft state: %v", err)
+	}
+	tmp := filepath.Join(s.dir, "state.json.tmp")
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return fmt.Errorf("failed to write raft state: %v", err)
+	}
+	return os.Rename(tmp, filepath.Join(s.dir, "state.json"))
+}
+
+func (s *raftStorage) Append(entries []RaftEntry) error {
+	for _, entry := range entries {
+		data, err := json.Marshal(entry)
+		if err != nil {
+			return fmt.Errorf("failed to encode raft entry: %v", err)
+		}
+		if _, err := s.logFile.Write(append(data, '\n')); err != nil {
+			return fmt.Errorf("failed to write raft entry: %v", err)
+		}
+	}
+	return s.logFile.Sync()
+}
+
+// Rewrite replaces the whole log file with entries.
+func (s *raftStorage) Rewrite(entries []RaftEntry) error {
+	tmpPath := filepath.Join(s.dir, "log.jsonl.tmp")
+	tmp, err := os.Create(tmpPath)
+	if err != nil {
+		return fmt.Errorf("failed to rewrite raft log: %v", err)
+	}
+	w := bufio.NewWriter(tmp)
+	for _, entry := range entries {
+		data, err := json.Marshal(entry)
+		if err != nil {
+			tmp.Close()
+			return fmt.Errorf("failed to encode raft entry: %v", err)
+		}
+		w.Write(append(data, '\n'))
+	}
+	if err := w.Flush(); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to rewrite raft log: %v", err)
+	}
+	tmp.Close()
+
+	s.logFile.Close()
+	logPath := filepath.Join(s.dir, "log.jsonl")
+	if err := os.Rename(tmpPath, logPath); err != nil {
+		return fmt.Errorf("failed to replace raft log: %v", err)
+	}
+	s.logFile, err = os.OpenFile(logPath, os.O_WRONLY|os.O_APPEND, 0644)
+	return err
+}
+
+func (s *raftStorage) Close() error {
+	return s.logFile.Close()
+}
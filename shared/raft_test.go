@@ -0,0 +1,327 @@
+package shared
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+const raftTestTimeout = 3 * time.Second
+
+func newTestHarness(t *testing.T, n int) *RaftHarness {
+	t.Helper()
+	h, err := NewRaftHarness(n)
+	if err != nil {
+		t.Fatalf("NewRaftHarness(%d): %v", n, err)
+	}
+	t.Cleanup(h.Stop)
+	return h
+}
+
+func waitLeader(t *testing.T, h *RaftHarness) *RaftNode {
+	t.Helper()
+	leader, err := h.WaitForLeader(raftTestTimeout)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return leader
+}
+
+func waitUntil(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(raftTestTimeout)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting until %s", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestRaftElection(t *testing.T) {
+	for _, size := range []int{1, 3, 5} {
+		t.Run(fmt.Sprintf("%d nodes", size), func(t *testing.T) {
+			h := newTestHarness(t, size)
+			leader := waitLeader(t, h)
+
+			waitUntil(t, "every node follows the leader", func() bool {
+				for _, node := range h.Nodes {
+					if id, _ := node.Leader(); id != leader.ID() {
+						return false
+					}
+				}
+				return true
+			})
+			term := leader.Status().Term
+			for id, node := range h.Nodes {
+				if id != leader.ID() && node.IsLeader() {
+					t.Errorf("%s and %s both lead", id, leader.ID())
+				}
+				if got := node.Status().Term; got != term {
+					t.Errorf("%s is in term %d, leader in %d", id, got, term)
+				}
+			}
+		})
+	}
+}
+
+func TestRaftLeaderStickiness(t *testing.T) {
+	h := newTestHarness(t, 3)
+	leader := waitLeader(t, h)
+	term := leader.Status().Term
+
+	// Several election timeouts pass without the healthy leader losing
+	// its place or any node starting an election.
+	time.Sleep(10 * 150 * time.Millisecond)
+	for id, node := range h.Nodes {
+		status := node.Status()
+		if status.Leader != leader.ID() {
+			t.Errorf("%s follows %q, want %s", id, status.Leader, leader.ID())
+		}
+		if status.Term != term {
+			t.Errorf("%s moved from term %d to %d", id, term, status.Term)
+		}
+	}
+}
+
+func TestRaftPartitionAndHeal(t *testing.T) {
+	h := newTestHarness(t, 3)
+	old := waitLeader(t, h)
+	oldTerm := old.Status().Term
+
+	h.Network.Isolate(old.ID())
+	leader := waitLeader(t, h)
+	if leader.ID() == old.ID() {
+		t.Fatalf("isolated node %s is still the only leader", old.ID())
+	}
+	if term := leader.Status().Term; term <= oldTerm {
+		t.Errorf("new leader has term %d, want above %d", term, oldTerm)
+	}
+	waitUntil(t, "the isolated leader steps down", func() bool { return !old.IsLeader() })
+	if _, err := old.Propose([]byte("lost")); err == nil {
+		t.Error("isolated node accepted a proposal")
+	}
+
+	h.Network.Heal()
+	waitUntil(t, "the old leader follows the new one", func() bool {
+		id, _ := old.Leader()
+		return id == leader.ID() && !old.IsLeader()
+	})
+	if _, err := leader.Propose([]byte("after heal")); err != nil {
+		t.Fatalf("Propose after heal: %v", err)
+	}
+	waitUntil(t, "the old leader applies the new entry", func() bool {
+		applied := h.Applied(old.ID())
+		return len(applied) > 0 && applied[len(applied)-1] == "after heal"
+	})
+	for _, cmd := range h.Applied(old.ID()) {
+		if cmd == "lost" {
+			t.Error("entry proposed while isolated was applied")
+		}
+	}
+}
+
+func TestRaftLogReplication(t *testing.T) {
+	tests := []struct {
+		name string
+		// isolateFollower cuts one follower off while the commands are
+		// proposed; it must catch up once healed.
+		isolateFollower bool
+	}{
+		{name: "all connected"},
+		{name: "lagging follower catches up", isolateFollower: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := newTestHarness(t, 3)
+			leader := waitLeader(t, h)
+			if tt.isolateFollower {
+				for id := range h.Nodes {
+					if id != leader.ID() {
+						h.Network.Isolate(id)
+						break
+					}
+				}
+			}
+
+			var want []string
+			for i := 1; i <= 20; i++ {
+				cmd := fmt.Sprintf("cmd-%d", i)
+				value, err := leader.Propose([]byte(cmd))
+				if err != nil {
+					t.Fatalf("Propose(%s): %v", cmd, err)
+				}
+				if value != i {
+					t.Errorf("Propose(%s) returned %v, want %d", cmd, value, i)
+				}
+				want = append(want, cmd)
+			}
+
+			h.Network.Heal()
+			for id := range h.Nodes {
+				waitUntil(t, id+" applies every command", func() bool {
+					return len(h.Applied(id)) == len(want)
+				})
+				if got := h.Applied(id); !reflect.DeepEqual(got, want) {
+					t.Errorf("%s applied %v, want %v", id, got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestRaftRejectsProposalOnFollower(t *testing.T) {
+	h := newTestHarness(t, 3)
+	leader := waitLeader(t, h)
+	for id, node := range h.Nodes {
+		if id == leader.ID() {
+			continue
+		}
+		if _, err := node.Propose([]byte("x")); err != ErrNotLeader {
+			t.Errorf("Propose on follower %s: got %v, want ErrNotLeader", id, err)
+		}
+	}
+}
+
+func TestRaftUnsavedTermIsNotUsed(t *testing.T) {
+	dir := t.TempDir()
+	node, err := NewRaftNode(RaftConfig{
+		ID:              "a",
+		Peers:           map[string]string{"a": "a", "b": "b"},
+		Transport:       NewRaftMemNetwork(),
+		StateDir:        dir,
+		ElectionTimeout: 50 * time.Millisecond,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer node.Stop()
+	// With the directory gone the state file cannot be written.
+	if err := os.RemoveAll(dir); err != nil {
+		t.Fatal(err)
+	}
+
+	waitUntil(t, "the failed save is reported", func() bool { return node.Status().LastError != "" })
+	if status := node.Status(); status.Term != 0 || status.State != RaftFollower.String() {
+		t.Errorf("node moved to %s in term %d without saving it", status.State, status.Term)
+	}
+
+	tests := []struct {
+		name string
+		args RequestVoteArgs
+	}{
+		{name: "newer term", args: RequestVoteArgs{Term: 5, CandidateID: "b"}},
+		{name: "current term", args: RequestVoteArgs{Term: 0, CandidateID: "b"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if reply := node.HandleRequestVote(tt.args); reply.VoteGranted {
+				t.Error("vote granted without being saved")
+			}
+		})
+	}
+	if reply := node.HandleAppendEntries(AppendEntriesArgs{Term: 5, LeaderID: "b"}); reply.Success {
+		t.Error("entries accepted in a term that was not saved")
+	}
+}
+
+func TestRaftResumesAfterApplied(t *testing.T) {
+	dir := t.TempDir()
+	var applied []string
+	start := func(appliedIndex int64) *RaftNode {
+		node, err := NewRaftNode(RaftConfig{
+			ID:              "a",
+			Peers:           map[string]string{"a": "a"},
+			Transport:       NewRaftMemNetwork(),
+			StateDir:        dir,
+			ElectionTimeout: 50 * time.Millisecond,
+			Applied:         appliedIndex,
+			Apply: func(entry RaftEntry) (interface{}, error) {
+				applied = append(applied, string(entry.Data))
+				return nil, nil
+			},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		waitUntil(t, "the node leads", node.IsLeader)
+		return node
+	}
+
+	node := start(0)
+	for _, cmd := range []string{"one", "two", "three"} {
+		if _, err := node.Propose([]byte(cmd)); err != nil {
+			t.Fatalf("Propose(%s): %v", cmd, err)
+		}
+	}
+	node.Stop()
+
+	// The first term's no-op is index 1, so the state machine claiming
+	// index 3 has seen "one" and "two" but not "three".
+	applied = nil
+	node = start(3)
+	defer node.Stop()
+	waitUntil(t, "the remaining entry is applied", func() bool {
+		status := node.Status()
+		return status.LastApplied == status.LastIndex
+	})
+	if want := []string{"three"}; !reflect.DeepEqual(applied, want) {
+		t.Errorf("applied %v after restart, want %v", applied, want)
+	}
+}
+
+func TestRaftWaitCaughtUp(t *testing.T) {
+	h := newTestHarness(t, 3)
+	leader := waitLeader(t, h)
+	if err := leader.WaitCaughtUp(); err != nil {
+		t.Fatalf("WaitCaughtUp on the leader: %v", err)
+	}
+	if status := leader.Status(); status.LastApplied < status.CommitIndex {
+		t.Errorf("leader applied %d of %d committed entries", status.LastApplied, status.CommitIndex)
+	}
+	for id, node := range h.Nodes {
+		if id == leader.ID() {
+			continue
+		}
+		if err := node.WaitCaughtUp(); err != ErrNotLeader {
+			t.Errorf("WaitCaughtUp on follower %s: got %v, want ErrNotLeader", id, err)
+		}
+	}
+}
+
+func TestRaftHTTPRequiresToken(t *testing.T) {
+	h := newTestHarness(t, 1)
+	leader := waitLeader(t, h)
+	mux := http.NewServeMux()
+	leader.RegisterHTTP(mux, "cluster-token")
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+	addr := strings.TrimPrefix(srv.URL, "http://")
+
+	for _, path := range []string{"/raft/vote", "/raft/append", "/raft/status", "/raft/peers"} {
+		resp, err := http.Post(srv.URL+path, "application/json", strings.NewReader(`{"id":"intruder","addr":"10.0.0.9:1"}`))
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusUnauthorized {
+			t.Errorf("POST %s without a token: got %s, want 401", path, resp.Status)
+		}
+	}
+
+	args := RequestVoteArgs{Term: 0, CandidateID: "intruder"}
+	if _, err := NewHTTPRaftTransport(time.Second, "wrong").RequestVote(addr, args); err == nil {
+		t.Error("RequestVote with a wrong token succeeded")
+	}
+	if _, err := NewHTTPRaftTransport(time.Second, "cluster-token").RequestVote(addr, args); err != nil {
+		t.Errorf("RequestVote with the cluster token: %v", err)
+	}
+	if _, ok := leader.Status().Peers["intruder"]; ok {
+		t.Error("an unauthenticated request changed membership")
+	}
+}
@@ -0,0 +1,148 @@
+package shared
+
+import (
+	"bytes"
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// RaftTokenHeader carries the cluster token on every request to the /raft/
+// endpoints.
+const RaftTokenHeader = "X-Cluster-Token"
+
+// HTTPRaftTransport sends Raft RPCs as JSON to the /raft/ endpoints that
+// RegisterHTTP installs on each node's web server.
+type HTTPRaftTransport struct {
+	client *http.Client
+	token  string
+}
+
+func NewHTTPRaftTransport(timeout time.Duration, token string) *HTTPRaftTransport {
+	return &HTTPRaftTransport{client: &http.Client{Timeout: timeout}, token: token}
+}
+
+func (t *HTTPRaftTransport) RequestVote(addr string, args RequestVoteArgs) (RequestVoteReply, error) {
+	var reply RequestVoteReply
+	err := t.post(addr, "/raft/vote", args, &reply)
+	return reply, err
+}
+
+func (t *HTTPRaftTransport) AppendEntries(addr string, args AppendEntriesArgs) (AppendEntriesReply, error) {
+	var reply AppendEntriesReply
+	err := t.post(addr, "/raft/append", args, &reply)
+	return reply, err
+}
+
+func (t *HTTPRaftTransport) post(addr, path string, args, reply interface{}) error {
+	body, err := json.Marshal(args)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodPost, "http://"+addr+path, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(RaftTokenHeader, t.token)
+	resp, err := t.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("raft rpc %s to %s: %s", path, addr, resp.Status)
+	}
+	return json.NewDecoder(resp.Body).Decode(reply)
+}
+
+// RegisterHTTP installs the Raft RPC, status and membership endpoints. Each
+// of them rejects requests that do not carry token in RaftTokenHeader.
+func (n *RaftNode) RegisterHTTP(mux *http.ServeMux, token string) {
+	handle := func(path string, handler http.HandlerFunc) {
+		mux.HandleFunc(path, func(w http.ResponseWriter, r *http.Request) {
+			if subtle.ConstantTimeCompare([]byte(r.Header.Get(RaftTokenHeader)), []byte(token)) != 1 {
+				http.Error(w, "Unauthorized", http.StatusUnauthorized)
+				return
+			}
+			handler(w, r)
+		})
+	}
+
+	handle("/raft/vote", func(w http.ResponseWriter, r *http.Request) {
+		var args RequestVoteArgs
+		if err := json.NewDecoder(r.Body).Decode(&args); err != nil {
+			http.Error(w, "Invalid request", http.StatusBadRequest)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(n.HandleRequestVote(args))
+	})
+
+	handle("/raft/append", func(w http.ResponseWriter, r *http.Request) {
+		var args AppendEntriesArgs
+		if err := json.NewDecoder(r.Body).Decode(&args); err != nil {
+			http.Error(w, "Invalid request", http.StatusBadRequest)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(n.HandleAppendEntries(args))
+	})
+
+	handle("/raft/status", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(n.Status())
+	})
+
+	handle("/raft/peers", func(w http.ResponseWriter, r *http.Request) {
+		var req struct {
+			ID     string `json:"id"`
+			Addr   string `json:"addr"`
+			Remove bool   `json:"remove"`
+		}
+		if r.Method != http.MethodPost {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.ID == "" {
+			http.Error(w, "Invalid request", http.StatusBadRequest)
+			return
+		}
+
+		var err error
+		if req.Remove {
+			err = n.RemovePeer(req.ID)
+		} else {
+			err = n.AddPeer(req.ID, req.Addr)
+		}
+		resp := DBResponse{Status: "ok", Message: "Membership updated"}
+		if err != nil {
+			resp = DBResponse{Status: "error", Message: err.Error()}
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(resp)
+	})
+}
+
+// ParseRaftPeers parses a comma separated list of id=host:port pairs.
+func ParseRaftPeers(spec string) (map[string]string, error) {
+	peers := make(map[string]string)
+	for _, part := range strings.Split(spec, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		id, addr, ok := strings.Cut(part, "=")
+		if !ok || id == "" || addr == "" {
+			return nil, fmt.Errorf("invalid raft peer %q, want id=host:port", part)
+		}
+		peers[id] = addr
+	}
+	if len(peers) == 0 {
+		return nil, fmt.Errorf("no raft peers given")
+	}
+	return peers, nil
+}
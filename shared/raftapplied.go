@@ -0,0 +1,72 @@
+package shared
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+)
+
+// raftAppliedTable holds, per Raft node, the index of the last entry whose
+// write reached MySQL. It is written in the same transaction as the write,
+// so a node that restarts before saving its applied index to disk resumes
+// after the entries MySQL already holds instead of running them again.
+const raftAppliedTable = "`ddb_meta`.`raft_applied`"
+
+// ReplicationMark is the name under which a slave's last applied replication
+// log position is kept in the same table, so an entry and its position reach
+// MySQL together as Raft entries do.
+func ReplicationMark(node string) string {
+	return "replication/" + node
+}
+
+type raftIndexKey struct{}
+
+type raftIndex struct {
+	node  string
+	index int64
+}
+
+// WithRaftIndex marks the write run with ctx as Raft entry index of node.
+// ExecCapture records the index along with the write.
+func WithRaftIndex(ctx context.Context, node string, index int64) context.Context {
+	return context.WithValue(ctx, raftIndexKey{}, raftIndex{node: node, index: index})
+}
+
+func raftIndexFromContext(ctx context.Context) (raftIndex, bool) {
+	r, ok := ctx.Value(raftIndexKey{}).(raftIndex)
+	return r, ok
+}
+
+func (r raftIndex) record(ctx context.Context, q interface {
+	ExecContext(ctx context.Context, query string, args ...any) (sql.Result, error)
+}) error {
+	_, err := q.ExecContext(ctx, "INSERT INTO "+raftAppliedTable+" (node_id, applied_index) VALUES (?, ?) "+
+		"ON DUPLICATE KEY UPDATE applied_index = VALUES(applied_index)", r.node, r.index)
+	if err != nil {
+		return fmt.Errorf("failed to record applied raft index: %v", err)
+	}
+	return nil
+}
+
+// RaftAppliedIndex returns the last entry of node recorded as applied,
+// creating the table that holds it on first use.
+func (h *DBHandler) RaftAppliedIndex(ctx context.Context, node string) (int64, error) {
+	for _, stmt := range []string{
+		"CREATE DATABASE IF NOT EXISTS `ddb_meta`",
+		"CREATE TABLE IF NOT EXISTS " + raftAppliedTable + " (node_id VARCHAR(255) NOT NULL PRIMARY KEY, applied_index BIGINT NOT NULL)",
+	} {
+		if _, err := h.db.ExecContext(ctx, stmt); err != nil {
+			return 0, fmt.Errorf("failed to create raft applied table: %v", err)
+		}
+	}
+
+	var index int64
+	err := h.db.QueryRowContext(ctx, "SELECT applied_index FROM "+raftAppliedTable+" WHERE node_id = ?", node).Scan(&index)
+	if err == sql.ErrNoRows {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, fmt.Errorf("failed to read applied raft index: %v", err)
+	}
+	return index, nil
+}
@@ -0,0 +1,77 @@
+package shared
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sync"
+)
+
+// RaftWrite is the command a Raft leader proposes for a write. The leader
+// captures the rows the write changes and every member applies those rows
+// by key, so functions such as NOW() and generated AUTO_INCREMENT values
+// come out the same everywhere. Writes whose rows cannot be captured carry
+// only the statement, which each member runs itself.
+type RaftWrite struct {
+	Query    string      `json:"query"`
+	Affected int64       `json:"affected,omitempty"`
+	Captured bool        `json:"captured,omitempty"`
+	Changes  []RowChange `json:"changes,omitempty"`
+}
+
+// PrepareRaftWrite captures the rows query would change on h without
+// keeping them.
+func (h *DBHandler) PrepareRaftWrite(ctx context.Context, query string) (RaftWrite, error) {
+	affected, changes, captured, err := h.PreviewCapture(ctx, query)
+	if err != nil {
+		return RaftWrite{}, err
+	}
+	if !captured {
+		return RaftWrite{Query: query}, nil
+	}
+	return RaftWrite{Query: query, Affected: affected, Captured: true, Changes: changes}, nil
+}
+
+// raftProposeMu keeps a leader from capturing a write's rows while another
+// write it captured is still waiting to be applied.
+var raftProposeMu sync.Mutex
+
+// ProposeRaftWrite captures the rows query changes on h, once node has
+// applied every committed entry, and proposes them. It returns the value
+// node's Apply produced for the write.
+func ProposeRaftWrite(ctx context.Context, node *RaftNode, h *DBHandler, query string) (interface{}, error) {
+	raftProposeMu.Lock()
+	defer raftProposeMu.Unlock()
+
+	if err := node.WaitCaughtUp(); err != nil {
+		return nil, err
+	}
+	w, err := h.PrepareRaftWrite(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	data, err := w.Encode()
+	if err != nil {
+		return nil, err
+	}
+	return node.Propose(data)
+}
+
+// Encode returns the write as Raft entry data.
+func (w RaftWrite) Encode() ([]byte, error) {
+	data, err := json.Marshal(w)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode raft write: %v", err)
+	}
+	return data, nil
+}
+
+// DecodeRaftWrite reads Raft entry data. Entries written before writes were
+// captured hold the bare statement.
+func DecodeRaftWrite(data []byte) RaftWrite {
+	var w RaftWrite
+	if len(data) > 0 && data[0] == '{' && json.Unmarshal(data, &w) == nil {
+		return w
+	}
+	return RaftWrite{Query: string(data)}
+}
@@ -0,0 +1,40 @@
+package shared
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestRaftWriteEncoding(t *testing.T) {
+	tests := []struct {
+		name  string
+		write RaftWrite
+	}{
+		{name: "statement", write: RaftWrite{Query: "ALTER TABLE t ADD COLUMN x INT"}},
+		{
+			name: "captured rows",
+			write: RaftWrite{Query: "INSERT INTO t (v) VALUES (NOW())", Affected: 1, Captured: true, Changes: []RowChange{
+				{DB: "shop", Table: "t", Op: RowInsert, Key: []string{"id"}, After: map[string]interface{}{"id": "7", "v": "2026-10-19 06:00:00"}},
+			}},
+		},
+		{name: "captured write changing nothing", write: RaftWrite{Query: "DELETE FROM t WHERE id = 1", Captured: true}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			data, err := tt.write.Encode()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := DecodeRaftWrite(data); !reflect.DeepEqual(got, tt.write) {
+				t.Errorf("DecodeRaftWrite() = %+v, want %+v", got, tt.write)
+			}
+		})
+	}
+
+	// Entries from before writes were captured hold the statement itself.
+	for _, query := range []string{"UPDATE t SET n = n + 1", "{not json"} {
+		if got := DecodeRaftWrite([]byte(query)); !reflect.DeepEqual(got, RaftWrite{Query: query}) {
+			t.Errorf("DecodeRaftWrite(%q) = %+v", query, got)
+		}
+	}
+}
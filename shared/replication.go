@@ -0,0 +1,316 @@
+package shared
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+type ReplicationEntry struct {
+	Position  int64  `json:"position"`
+	Query     string `json:"query"`
+	Timestamp int64  `json:"timestamp"`
+	// Captured is set when Changes holds every row the write changed.
+	Captured bool        `json:"captured,omitempty"`
+	Changes  []RowChange `json:"changes,omitempty"`
+	// HLC orders the write among those taken on every node.
+	HLC HLC `json:"hlc,omitempty"`
+	// Origin and OriginSeq name a write a slave took while partitioned
+	// from the master, once the master has merged it.
+	Origin    string `json:"origin,omitempty"`
+	OriginSeq int64  `json:"origin_seq,omitempty"`
+}
+
+// maxMemoryEntries bounds how many of the most recent entries a
+// ReplicationLog keeps in memory; older ones are read back from the file.
+const maxMemoryEntries = 10000
+
+// ReplicationLog is an append-only, file-backed log of committed writes.
+// Positions start at 1 and increase by one per entry, so a replica's applied
+// position is also the number of entries it has applied. Every entry is
+// synced to disk before it is appended in memory. Only recent entries, above
+// the position Release was last given, are kept in memory.
+//
+// A write whose entry cannot be persisted has already committed, so the
+// entry is kept and appended ahead of the next one; until that succeeds the
+// log is behind the database and Flush reports it.
+type ReplicationLog struct {
+	mu   sync.Mutex
+	file *os.File
+	size int64
+	// offsets holds the file offset of every entry, by position-1.
+	offsets []int64
+	// entries holds the most recent entries, up to the last position.
+	entries  []ReplicationEntry
+	released int64
+	unlogged []ReplicationEntry
+	notify   chan struct{}
+}
+
+func OpenReplicationLog(path string) (*ReplicationLog, error) {
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open replication log: %v", err)
+	}
+
+	l := &ReplicationLog{file: file, notify: make(chan struct{})}
+	reader := bufio.NewReaderSize(file, 64*1024)
+	for {
+		line, err := reader.ReadBytes('\n')
+		if err == io.EOF && len(line) > 0 {
+			// The last write was cut short by a crash before it was
+			// synced, so it was never acknowledged.
+			if err := file.Truncate(l.size); err != nil {
+				file.Close()
+				return nil, fmt.Errorf("failed to drop partial replication log entry: %v", err)
+			}
+			break
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			file.Close()
+			return nil, fmt.Errorf("failed to read replication log: %v", err)
+		}
+		var entry ReplicationEntry
+		if err := json.Unmarshal(line, &entry); err != nil {
+			file.Close()
+			return nil, fmt.Errorf("corrupt replication log entry: %v", err)
+		}
+		l.offsets = append(l.offsets, l.size)
+		l.size += int64(len(line))
+		l.entries = append(l.entries, entry)
+		l.trimLocked()
+		DefaultClock.Observe(entry.HLC)
+	}
+	return l, nil
+}
+
+// Append assigns the next position to a new entry and persists it.
+func (l *ReplicationLog) Append(query string) (ReplicationEntry, error) {
+	return l.AppendChanges(query, nil, false)
+}
+
+// AppendChanges is Append for a write whose changed rows were captured.
+func (l *ReplicationLog) AppendChanges(query string, changes []RowChange, captured bool) (ReplicationEntry, error) {
+	return l.AppendWrite(ReplicationEntry{Query: query, Captured: captured, Changes: changes})
+}
+
+// AppendWrite assigns the next position to entry and persists it. The entry
+// is stamped with the current time and, unless it carries the HLC of the
+// node that took the write, with a reading of DefaultClock. If it cannot be
+// persisted it is kept for the next append or Flush and an error is
+// returned.
+func (l *ReplicationLog) AppendWrite(entry ReplicationEntry) (ReplicationEntry, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	entry.Timestamp = time.Now().UnixMilli()
+	if entry.HLC == 0 {
+		entry.HLC = DefaultClock.Now()
+	} else {
+		DefaultClock.Observe(entry.HLC)
+	}
+	if err := l.flushLocked(); err != nil {
+		l.unlogged = append(l.unlogged, entry)
+		return ReplicationEntry{}, err
+	}
+	entry.Position = l.lastPosition() + 1
+	if err := l.write(entry); err != nil {
+		l.unlogged = append(l.unlogged, entry)
+		return ReplicationEntry{}, err
+	}
+	return entry, nil
+}
+
+// Flush appends the entries of writes that could not be logged when they
+// were taken. While it fails, the log is missing committed writes and no
+// further writes should be accepted.
+func (l *ReplicationLog) Flush() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	return l.flushLocked()
+}
+
+func (l *ReplicationLog) flushLocked() error {
+	for len(l.unlogged) > 0 {
+		entry := l.unlogged[0]
+		entry.Position = l.lastPosition() + 1
+		if err := l.write(entry); err != nil {
+			return fmt.Errorf("%d committed writes are missing from the replication log: %v", len(l.unlogged), err)
+		}
+		l.unlogged = l.unlogged[1:]
+	}
+	l.unlogged = nil
+	return nil
+}
+
+// AppendEntry stores an entry received from another node, keeping its
+// original position. Entries at or below the current position are ignored.
+func (l *ReplicationLog) AppendEntry(entry ReplicationEntry) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if err := l.flushLocked(); err != nil {
+		return err
+	}
+	last := l.lastPosition()
+	if entry.Position <= last {
+		return nil
+	}
+	if entry.Position != last+1 {
+		return fmt.Errorf("replication gap: have %d, got %d", last, entry.Position)
+	}
+	DefaultClock.Observe(entry.HLC)
+	return l.write(entry)
+}
+
+func (l *ReplicationLog) write(entry ReplicationEntry) error {
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return fmt.Errorf("failed to encode replication entry: %v", err)
+	}
+	data = append(data, '\n')
+	if _, err := l.file.Write(data); err != nil {
+		// A partial line would corrupt the log for the next open.
+		l.file.Truncate(l.size)
+		return fmt.Errorf("failed to write replication entry: %v", err)
+	}
+	if err := l.file.Sync(); err != nil {
+		l.file.Truncate(l.size)
+		return fmt.Errorf("failed to sync replication entry: %v", err)
+	}
+	l.offsets = append(l.offsets, l.size)
+	l.size += int64(len(data))
+	l.entries = append(l.entries, entry)
+	l.trimLocked()
+	close(l.notify)
+	l.notify = make(chan struct{})
+	return nil
+}
+
+// Release lets the log drop entries up to position from memory, once every
+// reader that needs them quickly has them. They are still read from the
+// file when asked for.
+func (l *ReplicationLog) Release(position int64) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if position > l.released {
+		l.released = position
+		l.trimLocked()
+	}
+}
+
+func (l *ReplicationLog) trimLocked() {
+	drop := len(l.entries) - maxMemoryEntries
+	if released := int(l.released - l.firstLocked() + 1); released > drop {
+		drop = released
+	}
+	if drop <= 0 {
+		return
+	}
+	if drop > len(l.entries) {
+		drop = len(l.entries)
+	}
+	l.entries = append([]ReplicationEntry(nil), l.entries[drop:]...)
+}
+
+// firstLocked returns the position of the first entry held in memory.
+func (l *ReplicationLog) firstLocked() int64 {
+	return int64(len(l.offsets)-len(l.entries)) + 1
+}
+
+// Since returns up to limit entries with a position greater than position.
+func (l *ReplicationLog) Since(position int64, limit int) []ReplicationEntry {
+	l.mu.Lock()
+	if position < 0 {
+		position = 0
+	}
+	last := int64(len(l.offsets))
+	if position >= last {
+		l.mu.Unlock()
+		return nil
+	}
+	end := last
+	if limit > 0 && position+int64(limit) < end {
+		end = position + int64(limit)
+	}
+	if first := l.firstLocked(); position+1 >= first {
+		entries := append([]ReplicationEntry(nil), l.entries[position+1-first:end+1-first]...)
+		l.mu.Unlock()
+		return entries
+	}
+	from, to := l.offsets[position], l.size
+	if end < last {
+		to = l.offsets[end]
+	}
+	l.mu.Unlock()
+
+	// The file is only ever appended to past l.size, so the range can be
+	// read without holding the lock.
+	entries, err := l.read(from, to)
+	if err != nil {
+		log.Printf("Failed to read replication log from position %d: %v", position+1, err)
+	}
+	return entries
+}
+
+// Entry returns the entry at position, if the log holds it.
+func (l *ReplicationLog) Entry(position int64) (ReplicationEntry, bool) {
+	entries := l.Since(position-1, 1)
+	if position < 1 || len(entries) == 0 {
+		return ReplicationEntry{}, false
+	}
+	return entries[0], true
+}
+
+func (l *ReplicationLog) read(from, to int64) ([]ReplicationEntry, error) {
+	data := make([]byte, to-from)
+	if _, err := l.file.ReadAt(data, from); err != nil {
+		return nil, err
+	}
+	var entries []ReplicationEntry
+	for _, line := range bytes.SplitAfter(data, []byte{'\n'}) {
+		if len(line) == 0 {
+			continue
+		}
+		var entry ReplicationEntry
+		if err := json.Unmarshal(line, &entry); err != nil {
+			return entries, fmt.Errorf("corrupt replication log entry: %v", err)
+		}
+		entries = append(entries, entry)
+	}
+	return entries, nil
+}
+
+func (l *ReplicationLog) LastPosition() int64 {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	return l.lastPosition()
+}
+
+func (l *ReplicationLog) lastPosition() int64 {
+	return int64(len(l.offsets))
+}
+
+// Changed returns a channel that is closed the next time an entry is appended.
+func (l *ReplicationLog) Changed() <-chan struct{} {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	return l.notify
+}
+
+func (l *ReplicationLog) Close() error {
+	return l.file.Close()
+}
@@ -0,0 +1,153 @@
+package shared
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestReplicationLogKeepsUnloggedWrites(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "replication.log")
+	l, err := OpenReplicationLog(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := l.Append("INSERT INTO t VALUES (1)"); err != nil {
+		t.Fatal(err)
+	}
+
+	// Closing the file makes every write fail until it is replaced.
+	file := l.file
+	file.Close()
+	if _, err := l.Append("INSERT INTO t VALUES (2)"); err == nil {
+		t.Fatal("Append on a closed file succeeded")
+	}
+	if _, err := l.Append("INSERT INTO t VALUES (3)"); err == nil {
+		t.Fatal("Append behind an unlogged write succeeded")
+	}
+	if err := l.Flush(); err == nil {
+		t.Fatal("Flush with unlogged writes succeeded")
+	}
+	if got := l.LastPosition(); got != 1 {
+		t.Fatalf("LastPosition = %d, want 1", got)
+	}
+
+	l.file, err = os.OpenFile(path, os.O_RDWR|os.O_APPEND, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	entry, err := l.Append("INSERT INTO t VALUES (4)")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if entry.Position != 4 {
+		t.Errorf("Append position = %d, want 4", entry.Position)
+	}
+	if err := l.Flush(); err != nil {
+		t.Errorf("Flush: %v", err)
+	}
+	l.Close()
+
+	reopened, err := OpenReplicationLog(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reopened.Close()
+	want := []string{
+		"INSERT INTO t VALUES (1)",
+		"INSERT INTO t VALUES (2)",
+		"INSERT INTO t VALUES (3)",
+		"INSERT INTO t VALUES (4)",
+	}
+	entries := reopened.Since(0, 0)
+	if len(entries) != len(want) {
+		t.Fatalf("reopened log has %d entries, want %d", len(entries), len(want))
+	}
+	for i, e := range entries {
+		if e.Query != want[i] || e.Position != int64(i+1) {
+			t.Errorf("entry %d = %d %q, want %d %q", i, e.Position, e.Query, i+1, want[i])
+		}
+	}
+}
+
+func TestReplicationLogReadsReleasedEntriesFromDisk(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "replication.log")
+	l, err := OpenReplicationLog(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	for i := 1; i <= 10; i++ {
+		if _, err := l.Append(fmt.Sprintf("INSERT INTO t VALUES (%d)", i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	l.Release(7)
+	if got := len(l.entries); got != 3 {
+		t.Errorf("after Release(7) %d entries are in memory, want 3", got)
+	}
+
+	tests := []struct {
+		position int64
+		limit    int
+		want     []int64
+	}{
+		{position: 0, limit: 3, want: []int64{1, 2, 3}},
+		{position: 5, limit: 0, want: []int64{6, 7, 8, 9, 10}},
+		{position: 6, limit: 2, want: []int64{7, 8}},
+		{position: 8, limit: 5, want: []int64{9, 10}},
+		{position: 10, limit: 5, want: nil},
+	}
+	for _, tt := range tests {
+		var got []int64
+		for _, e := range l.Since(tt.position, tt.limit) {
+			got = append(got, e.Position)
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("Since(%d, %d) = %v, want %v", tt.position, tt.limit, got, tt.want)
+		}
+	}
+	if e, ok := l.Entry(2); !ok || e.Query != "INSERT INTO t VALUES (2)" {
+		t.Errorf("Entry(2) = %+v, %v", e, ok)
+	}
+	if _, ok := l.Entry(11); ok {
+		t.Error("Entry(11) found an entry past the end of the log")
+	}
+}
+
+func TestReplicationLogDropsPartialEntry(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "replication.log")
+	l, err := OpenReplicationLog(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := l.Append("INSERT INTO t VALUES (1)"); err != nil {
+		t.Fatal(err)
+	}
+	l.Close()
+
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.WriteString(`{"position":2,"query":"INSERT`)
+	f.Close()
+
+	l, err = OpenReplicationLog(path)
+	if err != nil {
+		t.Fatalf("reopening a log with a partial entry: %v", err)
+	}
+	defer l.Close()
+	entry, err := l.Append("INSERT INTO t VALUES (2)")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if entry.Position != 2 {
+		t.Errorf("Append position = %d, want 2", entry.Position)
+	}
+	if got := l.Since(0, 0); len(got) != 2 || got[1].Query != "INSERT INTO t VALUES (2)" {
+		t.Errorf("Since(0, 0) = %+v", got)
+	}
+}
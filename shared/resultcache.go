@@ -0,0 +1,353 @@
+package shared
+
+import (
+	"container/list"
+	"encoding/json"
+	"net/http"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+)
+
+var (
+	// fromListPattern matches a comma separated FROM list, whose tables
+	// after the first tableRefPattern misses.
+	fromListPattern = regexp.MustCompile("(?i)\\bfrom\\s+([\\w$.`]+(?:\\s+(?:as\\s+)?[\\w$]+)?(?:\\s*,\\s*[\\w$.`]+(?:\\s+(?:as\\s+)?[\\w$]+)?)+)")
+	// volatilePattern matches what makes a SELECT's result depend on more
+	// than the tables it reads.
+	volatilePattern = regexp.MustCompile(`(?i)\b(?:now|sysdate|curdate|curtime|current_date|current_time|current_timestamp|localtime|localtimestamp|unix_timestamp|utc_date|utc_time|utc_timestamp|rand|uuid|uuid_short|last_insert_id|found_rows|row_count|connection_id|sleep|get_lock|is_free_lock|user|current_user|session_user|system_user|database|schema)\s*\(|@|\bfor\s+update\b|\block\s+in\s+share\s+mode\b|\bfor\s+share\b|\binformation_schema\b|\bperformance_schema\b`)
+)
+
+// ResultCacheConfig limits a ResultCache. A zero MaxEntries or MaxBytes is
+// not checked; a zero TTL keeps entries until they are evicted or
+// invalidated.
+type ResultCacheConfig struct {
+	MaxEntries int
+	MaxBytes   int64
+	TTL        time.Duration
+}
+
+// ResultCacheStats counts what a ResultCache has done since it was created
+// or cleared.
+type ResultCacheStats struct {
+	Entries       int     `json:"entries"`
+	Bytes         int64   `json:"bytes"`
+	MaxEntries    int     `json:"max_entries"`
+	MaxBytes      int64   `json:"max_bytes"`
+	TTLSeconds    float64 `json:"ttl_seconds"`
+	Hits          int64   `json:"hits"`
+	Misses        int64   `json:"misses"`
+	HitRatio      float64 `json:"hit_ratio"`
+	Stores        int64   `json:"stores"`
+	Evictions     int64   `json:"evictions"`
+	Expirations   int64   `json:"expirations"`
+	Invalidations int64   `json:"invalidations"`
+}
+
+type cacheEntry struct {
+	key     string
+	tables  []string
+	header  []string
+	rows    [][]interface{}
+	size    int64
+	expires time.Time
+}
+
+// ResultCache is an LRU cache of SELECT results keyed by the normalized
+// statement and its literal values. Writes invalidate the entries reading
+// the tables they touch.
+type ResultCache struct {
+	mu      sync.Mutex
+	cfg     ResultCacheConfig
+	lru     *list.List
+	entries map[string]*list.Element
+	// byTable indexes entries by the tables they read.
+	byTable map[string]map[*list.Element]bool
+	bytes   int64
+
+	// seq counts invalidations. tableSeq holds the last one of each table
+	// and flushSeq the last that cleared everything, so a result read
+	// before an invalidation is not stored after it.
+	seq      uint64
+	tableSeq map[string]uint64
+	flushSeq uint64
+
+	stats ResultCacheStats
+}
+
+func NewResultCache(cfg ResultCacheConfig) *ResultCache {
+	return &ResultCache{
+		cfg:      cfg,
+		lru:      list.New(),
+		entries:  make(map[string]*list.Element),
+		byTable:  make(map[string]map[*list.Element]bool),
+		tableSeq: make(map[string]uint64),
+	}
+}
+
+// CacheKey identifies a statement for the cache: its fingerprint, which
+// normalizes case, whitespace and comments, followed by its literal values.
+func CacheKey(query string) string {
+	return Fingerprint(query) + "\x00" + strings.Join(queryLiterals(query), "\x00")
+}
+
+// queryLiterals returns the quoted strings and numbers of query in order,
+// as Fingerprint finds them.
+func queryLiterals(query string) []string {
+	var literals []string
+	runes := []rune(strings.TrimSpace(query))
+	for i := 0; i < len(runes); i++ {
+		r := runes[i]
+		switch {
+		case r == '\'' || r == '"':
+			start := i
+			for i++; i < len(runes) && runes[i] != r; i++ {
+				if runes[i] == '\\' {
+					i++
+				}
+			}
+			literals = append(literals, string(runes[start:min(i+1, len(runes))]))
+		case r == '/' && i+1 < len(runes) && runes[i+1] == '*':
+			for i += 2; i+1 < len(runes) && !(runes[i] == '*' && runes[i+1] == '/'); i++ {
+			}
+			i++
+		case r == '-' && i+1 < len(runes) && runes[i+1] == '-':
+			for ; i < len(runes) && runes[i] != '\n'; i++ {
+			}
+		case unicode.IsDigit(r) && (i == 0 || !isIdentRune(runes[i-1])):
+			start := i
+			for i+1 < len(runes) && (unicode.IsDigit(runes[i+1]) || runes[i+1] == '.') {
+				i++
+			}
+			literals = append(literals, string(runes[start:i+1]))
+		}
+	}
+	return literals
+}
+
+// ReferencedTables returns the lower-cased names, without database, of the
+// tables query reads or writes.
+func ReferencedTables(query string) []string {
+	masked := maskLiterals(query)
+	seen := make(map[string]bool)
+	var tables []string
+	add := func(ref string) {
+		ref = strings.ToLower(strings.ReplaceAll(ref, "`", ""))
+		if i := strings.LastIndexByte(ref, '.'); i >= 0 {
+			ref = ref[i+1:]
+		}
+		if ref != "" && !seen[ref] {
+			seen[ref] = true
+			tables = append(tables, ref)
+		}
+	}
+	for _, ref := range tableRefPattern.FindAllStringSubmatch(masked, -1) {
+		add(ref[1])
+	}
+	for _, from := range fromListPattern.FindAllStringSubmatch(masked, -1) {
+		for _, item := range strings.Split(from[1], ",") {
+			if fields := strings.Fields(item); len(fields) > 0 {
+				add(fields[0])
+			}
+		}
+	}
+	return tables
+}
+
+// Cacheable reports whether query is a SELECT whose result depends only on
+// the tables it names.
+func Cacheable(query string) bool {
+	return StatementKind(query) == "SELECT" &&
+		len(ReferencedTables(query)) > 0 &&
+		!volatilePattern.MatchString(maskLiterals(query))
+}
+
+// Lookup returns the cached result of query. On a miss it returns the
+// sequence number to pass to Store with the result.
+func (c *ResultCache) Lookup(query string) (header []string, rows [][]interface{}, seq uint64, ok bool) {
+	key := CacheKey(query)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if el, found := c.entries[key]; found {
+		e := el.Value.(*cacheEntry)
+		if e.expires.IsZero() || time.Now().Before(e.expires) {
+			c.lru.MoveToFront(el)
+			c.stats.Hits++
+			return e.header, e.rows, c.seq, true
+		}
+		c.removeLocked(el)
+		c.stats.Expirations++
+	}
+	c.stats.Misses++
+	return nil, nil, c.seq, false
+}
+
+// Store caches the result of query read at sequence number seq, unless a
+// table it reads has been invalidated since.
+func (c *ResultCache) Store(query string, seq uint64, header []string, rows [][]interface{}) {
+	tables := ReferencedTables(query)
+	e := &cacheEntry{key: CacheKey(query), tables: tables, header: header, rows: rows}
+	e.size = resultSize(e)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.flushSeq > seq || (c.cfg.MaxBytes > 0 && e.size > c.cfg.MaxBytes) {
+		return
+	}
+	for _, t := range tables {
+		if c.tableSeq[t] > seq {
+			return
+		}
+	}
+	if el, found := c.entries[e.key]; found {
+		c.removeLocked(el)
+	}
+	if c.cfg.TTL > 0 {
+		e.expires = time.Now().Add(c.cfg.TTL)
+	}
+	el := c.lru.PushFront(e)
+	c.entries[e.key] = el
+	for _, t := range tables {
+		if c.byTable[t] == nil {
+			c.byTable[t] = make(map[*list.Element]bool)
+		}
+		c.byTable[t][el] = true
+	}
+	c.bytes += e.size
+	c.stats.Stores++
+
+	for (c.cfg.MaxEntries > 0 && c.lru.Len() > c.cfg.MaxEntries) || (c.cfg.MaxBytes > 0 && c.bytes > c.cfg.MaxBytes) {
+		c.removeLocked(c.lru.Back())
+		c.stats.Evictions++
+	}
+}
+
+// Invalidate drops the results that the write query may have changed. A
+// write whose tables cannot be told drops everything.
+func (c *ResultCache) Invalidate(query string) {
+	tables := ReferencedTables(query)
+	if len(tables) == 0 {
+		c.Flush()
+		return
+	}
+	c.InvalidateTables(tables...)
+}
+
+// InvalidateTables drops the results that read any of tables.
+func (c *ResultCache) InvalidateTables(tables ...string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.seq++
+	for _, t := range tables {
+		t = strings.ToLower(t)
+		c.tableSeq[t] = c.seq
+		for el := range c.byTable[t] {
+			c.removeLocked(el)
+			c.stats.Invalidations++
+		}
+	}
+}
+
+// Flush drops every cached result.
+func (c *ResultCache) Flush() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.seq++
+	c.flushSeq = c.seq
+	c.stats.Invalidations += int64(c.lru.Len())
+	c.clearLocked()
+}
+
+// Reset drops every cached result and zeroes the statistics.
+func (c *ResultCache) Reset() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.seq++
+	c.flushSeq = c.seq
+	c.clearLocked()
+	c.stats = ResultCacheStats{}
+}
+
+func (c *ResultCache) clearLocked() {
+	c.lru.Init()
+	c.entries = make(map[string]*list.Element)
+	c.byTable = make(map[string]map[*list.Element]bool)
+	c.tableSeq = make(map[string]uint64)
+	c.bytes = 0
+}
+
+func (c *ResultCache) removeLocked(el *list.Element) {
+	e := el.Value.(*cacheEntry)
+	c.lru.Remove(el)
+	delete(c.entries, e.key)
+	for _, t := range e.tables {
+		delete(c.byTable[t], el)
+		if len(c.byTable[t]) == 0 {
+			delete(c.byTable, t)
+		}
+	}
+	c.bytes -= e.size
+}
+
+func (c *ResultCache) Stats() ResultCacheStats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	stats := c.stats
+	stats.Entries = c.lru.Len()
+	stats.Bytes = c.bytes
+	stats.MaxEntries = c.cfg.MaxEntries
+	stats.MaxBytes = c.cfg.MaxBytes
+	stats.TTLSeconds = c.cfg.TTL.Seconds()
+	if lookups := stats.Hits + stats.Misses; lookups > 0 {
+		stats.HitRatio = float64(stats.Hits) / float64(lookups)
+	}
+	return stats
+}
+
+// resultSize estimates the memory an entry holds.
+func resultSize(e *cacheEntry) int64 {
+	size := int64(len(e.key)) + 64
+	for _, h := range e.header {
+		size += int64(len(h)) + 16
+	}
+	for _, row := range e.rows {
+		size += 24
+		for _, v := range row {
+			switch v := v.(type) {
+			case string:
+				size += int64(len(v)) + 16
+			case []byte:
+				size += int64(len(v)) + 24
+			default:
+				size += 16
+			}
+		}
+	}
+	return size
+}
+
+// ResultCacheHandler serves GET with the cache's statistics and DELETE to
+// empty it and reset them.
+func ResultCacheHandler(c *ResultCache) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+		case http.MethodDelete:
+			c.Reset()
+		default:
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(c.Stats())
+	}
+}
@@ -0,0 +1,201 @@
+package shared
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestResultCacheInvalidation(t *testing.T) {
+	const (
+		lookup     = "lookup"
+		store      = "store"
+		invalidate = "invalidate"
+		flush      = "flush"
+	)
+	type step struct {
+		op    string
+		query string
+		// hit is what a lookup must report.
+		hit bool
+	}
+	tests := []struct {
+		name  string
+		steps []step
+	}{
+		{
+			name: "stored result is served",
+			steps: []step{
+				{op: lookup, query: "SELECT * FROM t WHERE id = 1"},
+				{op: store, query: "SELECT * FROM t WHERE id = 1"},
+				{op: lookup, query: "select *  from T where ID = 1", hit: true},
+				{op: lookup, query: "SELECT * FROM t WHERE id = 2"},
+			},
+		},
+		{
+			name: "write drops cached results of its table",
+			steps: []step{
+				{op: lookup, query: "SELECT * FROM t"},
+				{op: store, query: "SELECT * FROM t"},
+				{op: invalidate, query: "UPDATE shop.T SET x = 1"},
+				{op: lookup, query: "SELECT * FROM t"},
+			},
+		},
+		{
+			name: "write between read and store keeps the stale result out",
+			steps: []step{
+				{op: lookup, query: "SELECT * FROM t"},
+				{op: invalidate, query: "DELETE FROM t WHERE id = 1"},
+				{op: store, query: "SELECT * FROM t"},
+				{op: lookup, query: "SELECT * FROM t"},
+			},
+		},
+		{
+			name: "write to another table between read and store",
+			steps: []step{
+				{op: lookup, query: "SELECT * FROM t"},
+				{op: invalidate, query: "INSERT INTO u (id) VALUES (1)"},
+				{op: store, query: "SELECT * FROM t"},
+				{op: lookup, query: "SELECT * FROM t", hit: true},
+			},
+		},
+		{
+			name: "flush between read and store",
+			steps: []step{
+				{op: lookup, query: "SELECT * FROM t"},
+				{op: flush},
+				{op: store, query: "SELECT * FROM t"},
+				{op: lookup, query: "SELECT * FROM t"},
+			},
+		},
+		{
+			name: "read after the flush is stored",
+			steps: []step{
+				{op: flush},
+				{op: lookup, query: "SELECT * FROM t"},
+				{op: store, query: "SELECT * FROM t"},
+				{op: lookup, query: "SELECT * FROM t", hit: true},
+			},
+		},
+		{
+			name: "write to any joined table drops the result",
+			steps: []step{
+				{op: lookup, query: "SELECT * FROM a JOIN b ON a.id = b.a_id"},
+				{op: store, query: "SELECT * FROM a JOIN b ON a.id = b.a_id"},
+				{op: lookup, query: "SELECT * FROM c, d"},
+				{op: store, query: "SELECT * FROM c, d"},
+				{op: invalidate, query: "UPDATE b SET x = 1"},
+				{op: invalidate, query: "UPDATE d SET x = 1"},
+				{op: lookup, query: "SELECT * FROM a JOIN b ON a.id = b.a_id"},
+				{op: lookup, query: "SELECT * FROM c, d"},
+			},
+		},
+		{
+			name: "write to unknown tables drops everything",
+			steps: []step{
+				{op: lookup, query: "SELECT * FROM t"},
+				{op: store, query: "SELECT * FROM t"},
+				{op: invalidate, query: "CALL cleanup()"},
+				{op: lookup, query: "SELECT * FROM t"},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := NewResultCache(ResultCacheConfig{})
+			seqs := make(map[string]uint64)
+			for i, s := range tt.steps {
+				switch s.op {
+				case lookup:
+					_, _, seq, hit := c.Lookup(s.query)
+					if hit != s.hit {
+						t.Fatalf("step %d: Lookup(%q) hit = %v, want %v", i, s.query, hit, s.hit)
+					}
+					seqs[s.query] = seq
+				case store:
+					c.Store(s.query, seqs[s.query], []string{"id"}, [][]interface{}{{"1"}})
+				case invalidate:
+					c.Invalidate(s.query)
+				case flush:
+					c.Flush()
+				}
+			}
+		})
+	}
+}
+
+func TestResultCacheLimits(t *testing.T) {
+	rows := [][]interface{}{{"1"}}
+	tests := []struct {
+		name        string
+		cfg         ResultCacheConfig
+		wait        time.Duration
+		wantCached  []string
+		wantEvicted int64
+	}{
+		{
+			name:        "least recently used is evicted",
+			cfg:         ResultCacheConfig{MaxEntries: 2},
+			wantCached:  []string{"SELECT * FROM a", "SELECT * FROM c"},
+			wantEvicted: 1,
+		},
+		{
+			name:       "expired entries are not served",
+			cfg:        ResultCacheConfig{TTL: time.Millisecond},
+			wait:       5 * time.Millisecond,
+			wantCached: nil,
+		},
+		{
+			name:       "results over the byte limit are not stored",
+			cfg:        ResultCacheConfig{MaxBytes: 10},
+			wantCached: nil,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := NewResultCache(tt.cfg)
+			c.Store("SELECT * FROM a", 0, []string{"id"}, rows)
+			c.Store("SELECT * FROM b", 0, []string{"id"}, rows)
+			// Using a makes b the least recently used.
+			c.Lookup("SELECT * FROM a")
+			c.Store("SELECT * FROM c", 0, []string{"id"}, rows)
+			time.Sleep(tt.wait)
+
+			var cached []string
+			for _, q := range []string{"SELECT * FROM a", "SELECT * FROM b", "SELECT * FROM c"} {
+				if _, _, _, hit := c.Lookup(q); hit {
+					cached = append(cached, q)
+				}
+			}
+			if !reflect.DeepEqual(cached, tt.wantCached) {
+				t.Errorf("cached %q, want %q", cached, tt.wantCached)
+			}
+			if got := c.Stats().Evictions; got != tt.wantEvicted {
+				t.Errorf("%d evictions, want %d", got, tt.wantEvicted)
+			}
+		})
+	}
+}
+
+func TestCacheable(t *testing.T) {
+	tests := []struct {
+		query string
+		want  bool
+	}{
+		{"SELECT * FROM t WHERE id = 1", true},
+		{"SELECT name FROM shop.t WHERE note = 'now()'", true},
+		{"SELECT NOW() FROM t", false},
+		{"SELECT * FROM t WHERE id = @id", false},
+		{"SELECT * FROM t FOR UPDATE", false},
+		{"SELECT * FROM information_schema.tables", false},
+		{"SELECT 1", false},
+		{"UPDATE t SET x = 1", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.query, func(t *testing.T) {
+			if got := Cacheable(tt.query); got != tt.want {
+				t.Errorf("Cacheable() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,138 @@
+package shared
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+// RotatingFile is an append-only log file that is rotated once it exceeds
+// MaxSize bytes or has been open longer than MaxAge. Rotated files are
+// renamed with a timestamp suffix and only the newest MaxBackups are kept.
+type RotatingFile struct {
+	Path       string
+	MaxSize    int64
+	MaxAge     time.Duration
+	MaxBackups int
+
+	mu     sync.Mutex
+	file   *os.File
+	size   int64
+	opened time.Time
+	closed bool
+}
+
+// renameFile is os.Rename, replaced in tests.
+var renameFile = os.Rename
+
+func OpenRotatingFile(path string, maxSize int64, maxAge time.Duration, maxBackups int) (*RotatingFile, error) {
+	f := &RotatingFile{Path: path, MaxSize: maxSize, MaxAge: maxAge, MaxBackups: maxBackups}
+	if err := f.open(); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+func (f *RotatingFile) open() error {
+	file, err := os.OpenFile(f.Path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to open log file: %v", err)
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return fmt.Errorf("failed to stat log file: %v", err)
+	}
+	f.file = file
+	f.size = info.Size()
+	f.opened = time.Now()
+	return nil
+}
+
+func (f *RotatingFile) Write(p []byte) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.closed {
+		return 0, os.ErrClosed
+	}
+	if f.file == nil {
+		// An earlier rotation could not open the new file.
+		if err := f.open(); err != nil {
+			return 0, err
+		}
+	}
+	if (f.MaxSize > 0 && f.size+int64(len(p)) > f.MaxSize && f.size > 0) ||
+		(f.MaxAge > 0 && time.Since(f.opened) > f.MaxAge) {
+		if err := f.rotate(); err != nil && f.file == nil {
+			return 0, err
+		}
+	}
+	n, err := f.file.Write(p)
+	f.size += int64(n)
+	return n, err
+}
+
+// rotate moves the file to a backup and opens a new one. When the rename
+// fails the file is reopened where it is, so writes go on and the rotation
+// is tried again on the next one.
+func (f *RotatingFile) rotate() error {
+	f.file.Close()
+	f.file = nil
+	backup := fmt.Sprintf("%s.%s", f.Path, time.Now().Format("20060102-150405.000"))
+	if err := renameFile(f.Path, backup); err != nil && !os.IsNotExist(err) {
+		if err := f.open(); err != nil {
+			return err
+		}
+		return fmt.Errorf("failed to rotate log file: %v", err)
+	}
+	if err := f.open(); err != nil {
+		return err
+	}
+	f.prune()
+	return nil
+}
+
+// Backups lists rotated files, oldest first.
+func (f *RotatingFile) Backups() []string {
+	matches, _ := filepath.Glob(f.Path + ".*")
+	sort.Strings(matches)
+	return matches
+}
+
+func (f *RotatingFile) prune() {
+	if f.MaxBackups <= 0 {
+		return
+	}
+	backups := f.Backups()
+	for len(backups) > f.MaxBackups {
+		os.Remove(backups[0])
+		backups = backups[1:]
+	}
+}
+
+func (f *RotatingFile) Sync() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.file == nil {
+		return nil
+	}
+	return f.file.Sync()
+}
+
+func (f *RotatingFile) Close() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.closed = true
+	if f.file == nil {
+		return nil
+	}
+	err := f.file.Close()
+	f.file = nil
+	return err
+}
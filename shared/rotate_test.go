@@ -0,0 +1,76 @@
+package shared
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestRotatingFile(t *testing.T) {
+	tests := []struct {
+		name        string
+		renameFails bool
+		wantBackups int
+		wantContent string
+	}{
+		{name: "rotates past max size", wantBackups: 1, wantContent: "second\n"},
+		{name: "keeps writing when the rename fails", renameFails: true, wantContent: "first\nsecond\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.renameFails {
+				renameFile = func(string, string) error { return errors.New("rename refused") }
+				defer func() { renameFile = os.Rename }()
+			}
+			path := filepath.Join(t.TempDir(), "node.log")
+			f, err := OpenRotatingFile(path, 8, 0, 3)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer f.Close()
+
+			for _, line := range []string{"first\n", "second\n"} {
+				if _, err := f.Write([]byte(line)); err != nil {
+					t.Fatalf("Write(%q): %v", line, err)
+				}
+			}
+			if got := len(f.Backups()); got != tt.wantBackups {
+				t.Errorf("%d backups, want %d", got, tt.wantBackups)
+			}
+			data, err := os.ReadFile(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(data) != tt.wantContent {
+				t.Errorf("log holds %q, want %q", data, tt.wantContent)
+			}
+		})
+	}
+}
+
+func TestRotatingFileRetriesAfterFailedRename(t *testing.T) {
+	renameFile = func(string, string) error { return errors.New("rename refused") }
+	defer func() { renameFile = os.Rename }()
+
+	path := filepath.Join(t.TempDir(), "node.log")
+	f, err := OpenRotatingFile(path, 4, 0, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	f.Write([]byte("one\n"))
+	f.Write([]byte("two\n"))
+
+	renameFile = os.Rename
+	if _, err := f.Write([]byte("three\n")); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+	if got := len(f.Backups()); got != 1 {
+		t.Errorf("%d backups after the rename works again, want 1", got)
+	}
+	f.Close()
+	if _, err := f.Write([]byte("four\n")); !errors.Is(err, os.ErrClosed) {
+		t.Errorf("Write after Close: got %v, want os.ErrClosed", err)
+	}
+}
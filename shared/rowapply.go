@@ -0,0 +1,122 @@
+package shared
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// ApplyRowChanges writes captured rows in one transaction, finding each row
+// by its primary key. Inserted and updated rows are written from their after
+// image, so applying the same changes twice leaves the same rows. A Raft
+// index set on ctx with WithRaftIndex is recorded in the same transaction.
+func (h *DBHandler) ApplyRowChanges(ctx context.Context, changes []RowChange) error {
+	statements := make([]string, len(changes))
+	for i, c := range changes {
+		stmt, err := rowStatement(c)
+		if err != nil {
+			return err
+		}
+		statements[i] = stmt
+	}
+
+	tx, err := h.db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %v", err)
+	}
+	for _, stmt := range statements {
+		if _, err := tx.ExecContext(ctx, stmt); err != nil {
+			tx.Rollback()
+			return fmt.Errorf("failed to apply row change: %v", err)
+		}
+	}
+	if raft, ok := raftIndexFromContext(ctx); ok {
+		if err := raft.record(ctx, tx); err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// rowStatement is the statement writing one row change.
+func rowStatement(c RowChange) (string, error) {
+	if c.Table == "" || len(c.Key) == 0 {
+		return "", fmt.Errorf("row change on %q has no primary key", c.Table)
+	}
+	table := QuoteIdent(c.Table)
+	if c.DB != "" {
+		table = QuoteIdent(c.DB) + "." + table
+	}
+
+	for i, v := range c.KeyValues() {
+		if v == nil {
+			return "", fmt.Errorf("%s on %s is missing key column %s", c.Op, c.Table, c.Key[i])
+		}
+	}
+
+	switch c.Op {
+	case RowInsert, RowUpdate:
+		cols := make([]string, 0, len(c.After))
+		for col := range c.After {
+			cols = append(cols, col)
+		}
+		sort.Strings(cols)
+		names := make([]string, len(cols))
+		values := make([]string, len(cols))
+		assign := make([]string, len(cols))
+		for i, col := range cols {
+			names[i] = QuoteIdent(col)
+			values[i] = SQLValue(c.After[col])
+			assign[i] = names[i] + " = VALUES(" + names[i] + ")"
+		}
+		return fmt.Sprintf("INSERT INTO %s (%s) VALUES (%s) ON DUPLICATE KEY UPDATE %s",
+			table, strings.Join(names, ", "), strings.Join(values, ", "), strings.Join(assign, ", ")), nil
+	case RowDelete:
+		return fmt.Sprintf("DELETE FROM %s WHERE %s", table, keyIn(c.Key, [][]interface{}{keyValues(c.Before, c.Key)})), nil
+	}
+	return "", fmt.Errorf("unsupported row operation: %s", c.Op)
+}
+
+// CurrentRow returns the row of db.table whose primary key columns hold
+// values, as an image, or nil if there is no such row.
+func (h *DBHandler) CurrentRow(ctx context.Context, db, table string, key []string, values []interface{}) (map[string]interface{}, error) {
+	tx, err := h.db.BeginTx(ctx, &sql.TxOptions{ReadOnly: true})
+	if err != nil {
+		return nil, fmt.Errorf("failed to begin transaction: %v", err)
+	}
+	defer tx.Rollback()
+
+	name := QuoteIdent(table)
+	if db != "" {
+		name = QuoteIdent(db) + "." + name
+	}
+	images, err := selectImages(ctx, tx, "SELECT * FROM "+name+" WHERE "+keyIn(key, [][]interface{}{values}))
+	if err != nil || len(images) == 0 {
+		return nil, err
+	}
+	return images[0], nil
+}
+
+// KeyValues returns the primary key values of the row a change writes.
+func (c RowChange) KeyValues() []interface{} {
+	if c.Op == RowDelete {
+		return keyValues(c.Before, c.Key)
+	}
+	return keyValues(c.After, c.Key)
+}
+
+// ChangedTables returns the tables changes write to, each once.
+func ChangedTables(changes []RowChange) []string {
+	var tables []string
+	seen := make(map[string]bool)
+	for _, c := range changes {
+		if !seen[c.Table] {
+			seen[c.Table] = true
+			tables = append(tables, c.Table)
+		}
+	}
+	return tables
+}
@@ -0,0 +1,561 @@
+package shared
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// Row change operations.
+const (
+	RowInsert = "insert"
+	RowUpdate = "update"
+	RowDelete = "delete"
+)
+
+// RowChange is one row changed by a write, with its images before and after
+// the write. Key names the table's primary key columns. Image values are
+// strings, or nil for NULL, so they survive JSON unchanged.
+type RowChange struct {
+	DB     string                 `json:"db"`
+	Table  string                 `json:"table"`
+	Op     string                 `json:"op"`
+	Key    []string               `json:"key"`
+	Before map[string]interface{} `json:"before,omitempty"`
+	After  map[string]interface{} `json:"after,omitempty"`
+}
+
+var (
+	// insertRowsPattern matches an INSERT or REPLACE up to its VALUES rows,
+	// capturing the column list if there is one.
+	insertRowsPattern = regexp.MustCompile(`(?is)^\s*(?:insert|replace)\s+(?:ignore\s+)?into\s+[^\s(]+\s*(?:\(([^)]*)\)\s*)?values?\s*`)
+	insertIgnore      = regexp.MustCompile(`(?i)^\s*insert\s+ignore\b`)
+	onDuplicateKey    = regexp.MustCompile(`(?i)\bon\s+duplicate\s+key\s+update\b`)
+	// selectionPattern finds where an UPDATE or DELETE starts choosing rows.
+	selectionPattern = regexp.MustCompile(`(?i)\b(?:where|order\s+by|limit)\b`)
+)
+
+// captureTarget is a single-table write whose changed rows can be found.
+type captureTarget struct {
+	kind  string
+	db    string
+	table string
+	// alias is the text between the table and the SET or selection, such
+	// as an alias; selection is the WHERE, ORDER BY and LIMIT clauses.
+	alias     string
+	selection string
+	set       string
+}
+
+func parseCaptureTarget(query string) (captureTarget, bool) {
+	t := captureTarget{kind: StatementKind(query)}
+	switch t.kind {
+	case "INSERT", "REPLACE", "UPDATE", "DELETE":
+	default:
+		return t, false
+	}
+	masked := maskLiterals(query)
+	refs := tableRefPattern.FindAllStringSubmatchIndex(masked, -1)
+	if len(refs) != 1 || fromListPattern.MatchString(masked) {
+		return t, false
+	}
+	ref := strings.ReplaceAll(masked[refs[0][2]:refs[0][3]], "`", "")
+	if i := strings.IndexByte(ref, '.'); i >= 0 {
+		t.db, t.table = ref[:i], ref[i+1:]
+	} else {
+		t.table = ref
+	}
+
+	rest := refs[0][1]
+	switch t.kind {
+	case "UPDATE":
+		loc := setPattern.FindStringSubmatchIndex(masked)
+		if loc == nil || loc[0] < rest {
+			return t, false
+		}
+		t.alias = query[rest:loc[0]]
+		t.set = masked[loc[2]:loc[3]]
+		if sel := selectionPattern.FindStringIndex(masked[loc[2]:]); sel != nil {
+			t.set = masked[loc[2] : loc[2]+sel[0]]
+			t.selection = " " + query[loc[2]+sel[0]:]
+		}
+	case "DELETE":
+		if sel := selectionPattern.FindStringIndex(masked[rest:]); sel != nil {
+			t.alias = query[rest : rest+sel[0]]
+			t.selection = " " + query[rest+sel[0]:]
+		} else {
+			t.alias = query[rest:]
+		}
+	}
+	t.alias = strings.TrimRight(t.alias, "; \t\r\n")
+	t.selection = strings.TrimRight(t.selection, "; \t\r\n")
+	return t, true
+}
+
+// ExecCapture runs a write in a transaction and returns the rows it
+// changed. captured is false, and changes nil, when the rows cannot be
+// told: the statement is not a single-table INSERT, REPLACE, UPDATE or
+// DELETE, the table has no primary key, an UPDATE changes the key, or an
+// INSERT's keys are neither literals nor generated by AUTO_INCREMENT.
+// A Raft index set on ctx with WithRaftIndex is recorded in the write's
+// transaction; DDL commits on its own, so its index is recorded just after.
+func (h *DBHandler) ExecCapture(ctx context.Context, query string) (affected int64, changes []RowChange, captured bool, err error) {
+	return h.execCapture(ctx, query, false, nil)
+}
+
+// ErrNotCaptured is returned by ExecCaptureStrict for a write whose changed
+// rows cannot be told.
+var ErrNotCaptured = errors.New("the rows this statement changes cannot be captured")
+
+// ExecCaptureStrict is ExecCapture for callers that need the rows: a write
+// that cannot be captured is rolled back, or not run at all, and fails with
+// ErrNotCaptured. save, if set, is called with the rows before the write
+// commits; if it fails the write is rolled back.
+func (h *DBHandler) ExecCaptureStrict(ctx context.Context, query string, save func([]RowChange) error) (int64, []RowChange, error) {
+	affected, changes, _, err := h.execCapture(ctx, query, true, save)
+	return affected, changes, err
+}
+
+// PreviewCapture runs a write in a transaction that it rolls back, and
+// returns the rows the write would change. Statements ExecCapture could not
+// capture are not run at all.
+func (h *DBHandler) PreviewCapture(ctx context.Context, query string) (affected int64, changes []RowChange, captured bool, err error) {
+	target, ok := parseCaptureTarget(query)
+	if !ok {
+		return 0, nil, false, nil
+	}
+	err = h.runOnConn(ctx, query, func(ctx context.Context, conn *sql.Conn) error {
+		tx, err := conn.BeginTx(ctx, nil)
+		if err != nil {
+			return err
+		}
+		defer tx.Rollback()
+		affected, changes, captured, err = h.captureWrite(ctx, tx, target, query)
+		return err
+	})
+	if err != nil || !captured {
+		return 0, nil, false, err
+	}
+	return affected, changes, true, nil
+}
+
+func (h *DBHandler) execCapture(ctx context.Context, query string, strict bool, save func([]RowChange) error) (affected int64, changes []RowChange, captured bool, err error) {
+	raft, marked := raftIndexFromContext(ctx)
+	target, ok := parseCaptureTarget(query)
+	if !ok {
+		if strict {
+			return 0, nil, false, ErrNotCaptured
+		}
+		switch StatementKind(query) {
+		case "CREATE", "DROP", "ALTER", "RENAME", "TRUNCATE":
+			h.forgetKeys()
+			affected, err = h.ExecuteQueryContext(ctx, query)
+			if err == nil && marked {
+				err = raft.record(ctx, h.db)
+			}
+			return affected, nil, false, err
+		}
+		if !marked {
+			affected, err = h.ExecuteQueryContext(ctx, query)
+			return affected, nil, false, err
+		}
+	}
+
+	start := time.Now()
+	err = h.runOnConn(ctx, query, func(ctx context.Context, conn *sql.Conn) error {
+		tx, err := conn.BeginTx(ctx, nil)
+		if err != nil {
+			return err
+		}
+		if ok {
+			affected, changes, captured, err = h.captureWrite(ctx, tx, target, query)
+		} else {
+			affected, err = execTx(ctx, tx, query)
+		}
+		if err == nil && strict && !captured {
+			err = ErrNotCaptured
+		}
+		if err == nil && marked {
+			err = raft.record(ctx, tx)
+		}
+		if err == nil && save != nil {
+			err = save(changes)
+		}
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+		return tx.Commit()
+	})
+	ObserveQuery(query, start, err)
+	if err != nil {
+		return 0, nil, false, err
+	}
+	return affected, changes, captured, nil
+}
+
+// txConn is what a write is captured on: a transaction, or a connection
+// inside XA START.
+type txConn interface {
+	ExecContext(ctx context.Context, query string, args ...any) (sql.Result, error)
+	QueryContext(ctx context.Context, query string, args ...any) (*sql.Rows, error)
+	QueryRowContext(ctx context.Context, query string, args ...any) *sql.Row
+}
+
+func (h *DBHandler) captureWrite(ctx context.Context, tx txConn, t captureTarget, query string) (int64, []RowChange, bool, error) {
+	plain := func() (int64, []RowChange, bool, error) {
+		affected, err := execTx(ctx, tx, query)
+		return affected, nil, false, err
+	}
+
+	if t.db == "" {
+		var current sql.NullString
+		if err := tx.QueryRowContext(ctx, "SELECT DATABASE()").Scan(&current); err != nil || !current.Valid {
+			return plain()
+		}
+		t.db = current.String
+	}
+	key, err := h.primaryKey(ctx, tx, t.db, t.table)
+	if err != nil || len(key) == 0 {
+		return plain()
+	}
+	table := QuoteIdent(t.db) + "." + QuoteIdent(t.table)
+
+	var keys [][]interface{}
+	var before []map[string]interface{}
+	autoIncrement := false
+	switch t.kind {
+	case "UPDATE", "DELETE":
+		for _, col := range key {
+			if t.kind == "UPDATE" && columnPattern(col, `\s*=`).MatchString(t.set) {
+				return plain()
+			}
+		}
+		before, err = selectImages(ctx, tx, "SELECT * FROM "+table+t.alias+t.selection+" FOR UPDATE")
+		for _, image := range before {
+			keys = append(keys, keyValues(image, key))
+		}
+	case "INSERT", "REPLACE":
+		var ok bool
+		keys, autoIncrement, ok = insertKeys(ctx, tx, table, query, key)
+		if !ok || (autoIncrement && (t.kind == "REPLACE" || insertIgnore.MatchString(query) || onDuplicateKey.MatchString(maskLiterals(query)))) {
+			return plain()
+		}
+		if !autoIncrement {
+			before, err = selectImages(ctx, tx, "SELECT * FROM "+table+" WHERE "+keyIn(key, keys)+" FOR UPDATE")
+		}
+	}
+	if err == errNotCapturable {
+		return plain()
+	}
+	if err != nil {
+		return 0, nil, false, err
+	}
+
+	affected, err := execTx(ctx, tx, query)
+	if err != nil {
+		return 0, nil, false, err
+	}
+	if autoIncrement && affected > 0 {
+		var first, step int64
+		if err := tx.QueryRowContext(ctx, "SELECT LAST_INSERT_ID(), @@auto_increment_increment").Scan(&first, &step); err != nil {
+			return 0, nil, false, err
+		}
+		for i := int64(0); i < affected; i++ {
+			keys = append(keys, []interface{}{strconv.FormatInt(first+i*step, 10)})
+		}
+	}
+	after, err := selectImages(ctx, tx, "SELECT * FROM "+table+" WHERE "+keyIn(key, keys))
+	if err == errNotCapturable {
+		return affected, nil, false, nil
+	}
+	if err != nil {
+		return 0, nil, false, err
+	}
+
+	changes := diffImages(t.db, t.table, key, before, after)
+	// The write may have changed other rows than those looked up around
+	// it: UPDATE and DELETE with LIMIT and no ORDER BY, rows clashing on
+	// another unique key in REPLACE or ON DUPLICATE KEY UPDATE, generated
+	// keys that are not consecutive. MySQL's count of changed rows, where a
+	// row replaced or updated by an INSERT counts twice, catches them.
+	switch t.kind {
+	case "UPDATE", "DELETE":
+		if int64(len(changes)) != affected {
+			return affected, nil, false, nil
+		}
+	case "INSERT", "REPLACE":
+		inserted := 0
+		for _, c := range changes {
+			if c.Op == RowInsert {
+				inserted++
+			}
+		}
+		if (autoIncrement && int64(inserted) != affected) || affected > int64(inserted+2*(len(keys)-inserted)) {
+			return affected, nil, false, nil
+		}
+	}
+	return affected, changes, true, nil
+}
+
+// insertKeys returns the primary keys of the rows an INSERT or REPLACE
+// writes, or reports autoIncrement if the key is a single column the
+// statement leaves to MySQL to generate.
+func insertKeys(ctx context.Context, tx txConn, table, query string, key []string) (keys [][]interface{}, autoIncrement bool, ok bool) {
+	masked := maskLiterals(query)
+	m := insertRowsPattern.FindStringSubmatchIndex(masked)
+	if m == nil {
+		return nil, false, false
+	}
+	var cols []string
+	if m[2] >= 0 {
+		for _, col := range strings.Split(masked[m[2]:m[3]], ",") {
+			cols = append(cols, strings.Trim(strings.TrimSpace(col), "`"))
+		}
+	} else {
+		rows, err := tx.QueryContext(ctx, "SELECT * FROM "+table+" LIMIT 0")
+		if err != nil {
+			return nil, false, false
+		}
+		cols, err = rows.Columns()
+		rows.Close()
+		if err != nil {
+			return nil, false, false
+		}
+	}
+	index := make([]int, len(key))
+	for i, k := range key {
+		index[i] = -1
+		for j, col := range cols {
+			if strings.EqualFold(col, k) {
+				index[i] = j
+			}
+		}
+		if index[i] < 0 {
+			if len(key) != 1 {
+				return nil, false, false
+			}
+			return nil, true, true
+		}
+	}
+
+	for pos := m[1]; ; {
+		pos = skipSpace(masked, pos)
+		if pos >= len(masked) || masked[pos] != '(' {
+			return nil, false, false
+		}
+		end := matchingParen(masked, pos)
+		if end < 0 {
+			return nil, false, false
+		}
+		fields := splitTopLevel(masked, pos+1, end)
+		values := make([]interface{}, len(key))
+		for i, idx := range index {
+			if idx >= len(fields) {
+				return nil, false, false
+			}
+			value, valueEnd, ok := readLiteral(query, fields[idx][0])
+			if !ok || skipSpace(query, valueEnd) != fields[idx][1] {
+				return nil, false, false
+			}
+			values[i] = value
+		}
+		keys = append(keys, values)
+
+		pos = skipSpace(masked, end+1)
+		if pos < len(masked) && masked[pos] == ',' {
+			pos++
+			continue
+		}
+		return keys, false, true
+	}
+}
+
+// errNotCapturable reports a row image that cannot be carried as text.
+var errNotCapturable = errors.New("row cannot be captured")
+
+// selectImages runs query and returns its rows as images.
+func selectImages(ctx context.Context, tx txConn, query string) ([]map[string]interface{}, error) {
+	rows, err := tx.QueryContext(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	cols, values, err := scanRows(rows)
+	if err != nil {
+		return nil, err
+	}
+	images := make([]map[string]interface{}, len(values))
+	for i, row := range values {
+		image := make(map[string]interface{}, len(cols))
+		for j, v := range row {
+			text, ok := imageValue(v)
+			if !ok {
+				return nil, errNotCapturable
+			}
+			image[cols[j]] = text
+		}
+		images[i] = image
+	}
+	return images, nil
+}
+
+// imageValue gives a column value as it is kept in a row image. Binary
+// values that are not valid UTF-8 would be altered by JSON, so they are
+// refused.
+func imageValue(v interface{}) (interface{}, bool) {
+	switch v := v.(type) {
+	case nil:
+		return nil, true
+	case string:
+		return v, utf8.ValidString(v)
+	case time.Time:
+		return v.Format("2006-01-02 15:04:05.999999"), true
+	case int64:
+		return strconv.FormatInt(v, 10), true
+	case float64:
+		return strconv.FormatFloat(v, 'g', -1, 64), true
+	}
+	return fmt.Sprint(v), true
+}
+
+func keyValues(image map[string]interface{}, key []string) []interface{} {
+	values := make([]interface{}, len(key))
+	for i, col := range key {
+		values[i] = image[col]
+	}
+	return values
+}
+
+// keyIn is a condition matching the rows with the given primary keys.
+func keyIn(key []string, keys [][]interface{}) string {
+	if len(keys) == 0 {
+		return "FALSE"
+	}
+	cols := make([]string, len(key))
+	for i, col := range key {
+		cols[i] = QuoteIdent(col)
+	}
+	tuples := make([]string, len(keys))
+	for i, values := range keys {
+		literals := make([]string, len(values))
+		for j, v := range values {
+			literals[j] = SQLValue(v)
+		}
+		tuples[i] = "(" + strings.Join(literals, ", ") + ")"
+	}
+	return "(" + strings.Join(cols, ", ") + ") IN (" + strings.Join(tuples, ", ") + ")"
+}
+
+// diffImages pairs rows before and after a write by primary key.
+func diffImages(db, table string, key []string, before, after []map[string]interface{}) []RowChange {
+	keyOf := func(image map[string]interface{}) string {
+		var b strings.Builder
+		for _, v := range keyValues(image, key) {
+			fmt.Fprintf(&b, "%v\x00", v)
+		}
+		return b.String()
+	}
+	afterByKey := make(map[string]map[string]interface{}, len(after))
+	for _, image := range after {
+		afterByKey[keyOf(image)] = image
+	}
+
+	changes := []RowChange{}
+	seen := make(map[string]bool, len(before))
+	for _, b := range before {
+		k := keyOf(b)
+		seen[k] = true
+		switch a, ok := afterByKey[k]; {
+		case !ok:
+			changes = append(changes, RowChange{DB: db, Table: table, Op: RowDelete, Key: key, Before: b})
+		case !reflect.DeepEqual(a, b):
+			changes = append(changes, RowChange{DB: db, Table: table, Op: RowUpdate, Key: key, Before: b, After: a})
+		}
+	}
+	for _, a := range after {
+		if !seen[keyOf(a)] {
+			changes = append(changes, RowChange{DB: db, Table: table, Op: RowInsert, Key: key, After: a})
+		}
+	}
+	return changes
+}
+
+func execTx(ctx context.Context, tx txConn, query string) (int64, error) {
+	result, err := tx.ExecContext(ctx, query)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+// primaryKey returns the primary key columns of db.table, or nil if it has
+// none. Keys are cached until the next DDL statement.
+func (h *DBHandler) primaryKey(ctx context.Context, tx txConn, db, table string) ([]string, error) {
+	name := strings.ToLower(db + "." + table)
+	h.keysMu.Lock()
+	key, ok := h.keys[name]
+	h.keysMu.Unlock()
+	if ok {
+		return key, nil
+	}
+
+	rows, err := tx.QueryContext(ctx, `SELECT COLUMN_NAME FROM information_schema.KEY_COLUMN_USAGE
+		WHERE TABLE_SCHEMA = ? AND TABLE_NAME = ? AND CONSTRAINT_NAME = 'PRIMARY'
+		ORDER BY ORDINAL_POSITION`, db, table)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var col string
+		if err := rows.Scan(&col); err != nil {
+			return nil, err
+		}
+		key = append(key, col)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	h.keysMu.Lock()
+	if h.keys == nil {
+		h.keys = make(map[string][]string)
+	}
+	h.keys[name] = key
+	h.keysMu.Unlock()
+	return key, nil
+}
+
+func (h *DBHandler) forgetKeys() {
+	h.keysMu.Lock()
+	h.keys = nil
+	h.keysMu.Unlock()
+}
+
+// QuoteIdent quotes a MySQL identifier.
+func QuoteIdent(name string) string {
+	return "`" + strings.ReplaceAll(strings.Trim(name, "`"), "`", "``") + "`"
+}
+
+var sqlEscaper = strings.NewReplacer(`\`, `\\`, `'`, `\'`, "\x00", `\0`)
+
+// SQLValue writes v as a MySQL literal.
+func SQLValue(v interface{}) string {
+	switch v := v.(type) {
+	case nil:
+		return "NULL"
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	case string:
+		return "'" + sqlEscaper.Replace(v) + "'"
+	}
+	return "'" + sqlEscaper.Replace(fmt.Sprint(v)) + "'"
+}
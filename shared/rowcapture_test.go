@@ -0,0 +1,82 @@
+package shared
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestDiffImages(t *testing.T) {
+	row := func(kv ...interface{}) map[string]interface{} {
+		image := make(map[string]interface{})
+		for i := 0; i < len(kv); i += 2 {
+			image[kv[i].(string)] = kv[i+1]
+		}
+		return image
+	}
+	key := []string{"id"}
+	tests := []struct {
+		name   string
+		key    []string
+		before []map[string]interface{}
+		after  []map[string]interface{}
+		want   []RowChange
+	}{
+		{
+			name: "nothing changed",
+			key:  key,
+			before: []map[string]interface{}{
+				row("id", "1", "x", "a"),
+			},
+			after: []map[string]interface{}{
+				row("id", "1", "x", "a"),
+			},
+			want: []RowChange{},
+		},
+		{
+			name:   "insert",
+			key:    key,
+			before: nil,
+			after:  []map[string]interface{}{row("id", "1", "x", "a")},
+			want: []RowChange{
+				{DB: "shop", Table: "t", Op: RowInsert, Key: key, After: row("id", "1", "x", "a")},
+			},
+		},
+		{
+			name:   "update and delete",
+			key:    key,
+			before: []map[string]interface{}{row("id", "1", "x", "a"), row("id", "2", "x", "b")},
+			after:  []map[string]interface{}{row("id", "1", "x", "c")},
+			want: []RowChange{
+				{DB: "shop", Table: "t", Op: RowUpdate, Key: key, Before: row("id", "1", "x", "a"), After: row("id", "1", "x", "c")},
+				{DB: "shop", Table: "t", Op: RowDelete, Key: key, Before: row("id", "2", "x", "b")},
+			},
+		},
+		{
+			name:   "NULL becomes a value",
+			key:    key,
+			before: []map[string]interface{}{row("id", "1", "x", nil)},
+			after:  []map[string]interface{}{row("id", "1", "x", "0")},
+			want: []RowChange{
+				{DB: "shop", Table: "t", Op: RowUpdate, Key: key, Before: row("id", "1", "x", nil), After: row("id", "1", "x", "0")},
+			},
+		},
+		{
+			name:   "rows paired by the whole composite key",
+			key:    []string{"a", "b"},
+			before: []map[string]interface{}{row("a", "1", "b", "1", "v", "x")},
+			after:  []map[string]interface{}{row("a", "1", "b", "2", "v", "x")},
+			want: []RowChange{
+				{DB: "shop", Table: "t", Op: RowDelete, Key: []string{"a", "b"}, Before: row("a", "1", "b", "1", "v", "x")},
+				{DB: "shop", Table: "t", Op: RowInsert, Key: []string{"a", "b"}, After: row("a", "1", "b", "2", "v", "x")},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := diffImages("shop", "t", tt.key, tt.before, tt.after)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("diffImages() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,524 @@
+package shared
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+var (
+	aggregatePattern = regexp.MustCompile(`(?is)^(count|sum|min|max|avg)\s*\((.*)\)$`)
+	aggregateCall    = regexp.MustCompile(`(?i)\b(count|sum|min|max|avg)\s*\(`)
+	aliasPattern     = regexp.MustCompile("(?is)^(.*?)\\s+(?:as\\s+)?(`[^`]+`|[\\w$]+)$")
+	orderItemPattern = regexp.MustCompile(`(?is)^(.*?)(?:\s+(asc|desc))?$`)
+	limitPattern     = regexp.MustCompile(`(?is)^(\d+)(?:\s*,\s*(\d+)|\s+offset\s+(\d+))?$`)
+	selectClauses    = []string{"from", "where", "group by", "having", "order by", "limit"}
+	notAliases       = map[string]bool{"end": true, "null": true, "true": true, "false": true, "distinct": true}
+)
+
+// ScatterPlan runs a SELECT on every shard of a table and merges the
+// results. Shards return partial aggregates and, when a LIMIT applies
+// without aggregation, only the rows that can make the final result.
+type ScatterPlan struct {
+	// ShardQuery is the statement to run on each shard. It may select extra
+	// columns, after the requested ones, that are dropped when merging.
+	ShardQuery string
+
+	distinct  bool
+	aggregate bool
+	// aggs holds the merge function of each column of an aggregate query,
+	// empty for plain columns.
+	aggs []string
+	// avgCounts maps each AVG column to the column with its row count.
+	avgCounts map[int]int
+	// groupBy and orderBy refer to extra columns by negative index, counted
+	// from -1, since SELECT * leaves the column count unknown until results
+	// arrive.
+	groupBy []int
+	orderBy []scatterOrder
+	extra   int
+	offset  int
+	limit   int
+}
+
+type scatterOrder struct {
+	column int
+	desc   bool
+}
+
+type selectItem struct {
+	expr  string
+	alias string
+	// agg is the lower-case aggregate function and arg its argument, for
+	// items that are a single aggregate call.
+	agg string
+	arg string
+}
+
+// PlanScatter prepares a SELECT on a sharded table to run on every shard.
+// DISTINCT, GROUP BY, ORDER BY, LIMIT and the COUNT, SUM, MIN, MAX and AVG
+// aggregates are applied again when merging. HAVING, COUNT(DISTINCT ...)
+// and expressions over aggregates are rejected, as they cannot be merged.
+func PlanScatter(query string) (*ScatterPlan, error) {
+	query = strings.TrimRight(strings.TrimSpace(query), "; \t\r\n")
+	clauses, err := splitSelect(maskLiterals(query))
+	if err != nil {
+		return nil, err
+	}
+	if _, ok := clauses["having"]; ok {
+		return nil, fmt.Errorf("HAVING is not supported on queries across shards")
+	}
+	body := func(name string) string {
+		if c, ok := clauses[name]; ok {
+			return strings.TrimSpace(query[c[1]:c[2]])
+		}
+		return ""
+	}
+
+	p := &ScatterPlan{avgCounts: make(map[int]int), limit: -1}
+	list := body("select")
+	if f := strings.Fields(list); len(f) > 0 && strings.EqualFold(f[0], "distinct") {
+		p.distinct = true
+		list = strings.TrimSpace(list[len(f[0]):])
+	}
+	var items []selectItem
+	star := false
+	for _, text := range splitList(list) {
+		item, err := parseSelectItem(text)
+		if err != nil {
+			return nil, err
+		}
+		if item.expr == "*" || strings.HasSuffix(item.expr, ".*") {
+			star = true
+		}
+		p.aggregate = p.aggregate || item.agg != ""
+		items = append(items, item)
+	}
+	groupBy := body("group by")
+	p.aggregate = p.aggregate || groupBy != ""
+	if p.aggregate && star {
+		return nil, fmt.Errorf("SELECT * cannot be combined with aggregates on queries across shards")
+	}
+
+	var extra []selectItem
+	column := func(kind, expr string) (int, error) {
+		// A position counts result columns, which SELECT * leaves unknown;
+		// the shards reject one past the end.
+		if n, err := strconv.Atoi(expr); err == nil && n >= 1 && (star || n <= len(items)) {
+			return n - 1, nil
+		}
+		if !star {
+			norm := normalizeExpr(expr)
+			for i, it := range items {
+				if normalizeExpr(it.expr) == norm || (it.alias != "" && normalizeExpr(it.alias) == norm) {
+					return i, nil
+				}
+			}
+		}
+		item, err := parseSelectItem(expr)
+		if err != nil {
+			return 0, err
+		}
+		if item.agg != "" && !p.aggregate {
+			return 0, fmt.Errorf("cannot order by an aggregate without grouping")
+		}
+		item.alias = fmt.Sprintf("__ddb_%s_%d", kind, len(extra))
+		extra = append(extra, item)
+		return -len(extra), nil
+	}
+	for _, expr := range splitList(groupBy) {
+		col, err := column("group", expr)
+		if err != nil {
+			return nil, err
+		}
+		p.groupBy = append(p.groupBy, col)
+	}
+	for _, text := range splitList(body("order by")) {
+		m := orderItemPattern.FindStringSubmatch(text)
+		col, err := column("order", m[1])
+		if err != nil {
+			return nil, err
+		}
+		p.orderBy = append(p.orderBy, scatterOrder{column: col, desc: strings.EqualFold(m[2], "desc")})
+	}
+	if limit := body("limit"); limit != "" {
+		m := limitPattern.FindStringSubmatch(limit)
+		if m == nil {
+			return nil, fmt.Errorf("LIMIT must be numeric on queries across shards")
+		}
+		p.limit, _ = strconv.Atoi(m[1])
+		switch {
+		case m[2] != "":
+			p.offset = p.limit
+			p.limit, _ = strconv.Atoi(m[2])
+		case m[3] != "":
+			p.offset, _ = strconv.Atoi(m[3])
+		}
+	}
+
+	// Shards return SUM and COUNT for each AVG, so it can be averaged over
+	// all rows rather than over the shards' averages.
+	all := append(items, extra...)
+	var exprs, counts []string
+	for i, it := range all {
+		p.aggs = append(p.aggs, it.agg)
+		switch {
+		case it.agg == "avg":
+			p.avgCounts[i] = len(all) + len(counts)
+			counts = append(counts, fmt.Sprintf("COUNT(%s) AS `__ddb_count_%d`", it.arg, i))
+			exprs = append(exprs, fmt.Sprintf("SUM(%s) AS %s", it.arg, quoteAlias(it.header())))
+		case it.alias != "":
+			exprs = append(exprs, it.expr+" AS "+quoteAlias(it.alias))
+		default:
+			exprs = append(exprs, it.expr)
+		}
+	}
+	for range counts {
+		p.aggs = append(p.aggs, "count")
+	}
+	exprs = append(exprs, counts...)
+	p.extra = len(extra) + len(counts)
+
+	var b strings.Builder
+	b.WriteString("SELECT ")
+	if p.distinct {
+		b.WriteString("DISTINCT ")
+	}
+	b.WriteString(strings.Join(exprs, ", "))
+	end := len(query)
+	for _, name := range []string{"order by", "limit"} {
+		if c, ok := clauses[name]; ok && c[0] < end {
+			end = c[0]
+		}
+	}
+	b.WriteString(" ")
+	b.WriteString(strings.TrimSpace(query[clauses["from"][0]:end]))
+	if !p.aggregate {
+		if order := body("order by"); order != "" {
+			b.WriteString(" ORDER BY " + order)
+		}
+		if p.limit >= 0 {
+			fmt.Fprintf(&b, " LIMIT %d", p.offset+p.limit)
+		}
+	}
+	p.ShardQuery = b.String()
+	return p, nil
+}
+
+func (it selectItem) header() string {
+	if it.alias != "" {
+		return it.alias
+	}
+	return it.expr
+}
+
+func normalizeExpr(expr string) string {
+	return strings.ToLower(strings.Join(strings.Fields(strings.ReplaceAll(expr, "`", "")), ""))
+}
+
+func quoteAlias(name string) string {
+	return "`" + strings.ReplaceAll(name, "`", "``") + "`"
+}
+
+// splitList splits a comma separated list, ignoring commas inside
+// parentheses and literals.
+func splitList(list string) []string {
+	if list == "" {
+		return nil
+	}
+	var parts []string
+	for _, f := range splitTopLevel(maskLiterals(list), 0, len(list)) {
+		parts = append(parts, strings.TrimSpace(list[f[0]:f[1]]))
+	}
+	return parts
+}
+
+func parseSelectItem(text string) (selectItem, error) {
+	item := selectItem{expr: strings.TrimSpace(text)}
+	masked := maskLiterals(item.expr)
+	if m := aliasPattern.FindStringSubmatchIndex(masked); m != nil {
+		expr := strings.TrimSpace(masked[m[2]:m[3]])
+		alias := strings.Trim(masked[m[4]:m[5]], "`")
+		last := rune(expr[len(expr)-1])
+		if !notAliases[strings.ToLower(alias)] && !strings.EqualFold(expr, "distinct") &&
+			(isIdentRune(last) || strings.ContainsRune(")'\"`", last)) {
+			item.alias = strings.Trim(item.expr[m[4]:m[5]], "`")
+			item.expr = strings.TrimSpace(item.expr[m[2]:m[3]])
+			masked = maskLiterals(item.expr)
+		}
+	}
+
+	open := strings.Index(masked, "(")
+	if m := aggregatePattern.FindStringSubmatch(masked); m != nil && matchingParen(masked, open) == len(masked)-1 {
+		item.agg = strings.ToLower(m[1])
+		item.arg = strings.TrimSpace(item.expr[open+1 : len(item.expr)-1])
+		if f := strings.Fields(item.arg); len(f) > 0 && strings.EqualFold(f[0], "distinct") && item.agg != "min" && item.agg != "max" {
+			return item, fmt.Errorf("%s(DISTINCT ...) is not supported on queries across shards", strings.ToUpper(item.agg))
+		}
+		return item, nil
+	}
+	if aggregateCall.MatchString(masked) {
+		return item, fmt.Errorf("cannot merge %s across shards", item.expr)
+	}
+	return item, nil
+}
+
+// splitSelect finds the top-level clauses of a SELECT. Each clause maps to
+// the offsets of its keyword, its body and its end.
+func splitSelect(masked string) (map[string][3]int, error) {
+	lower := strings.ToLower(masked)
+	start := skipSpace(lower, 0)
+	if !strings.HasPrefix(lower[start:], "select") || (len(lower) > start+6 && isIdentRune(rune(lower[start+6]))) {
+		return nil, fmt.Errorf("not a SELECT statement")
+	}
+
+	clauses := map[string][3]int{}
+	name, current := "select", [3]int{start, start + len("select"), 0}
+	depth := 0
+	for i := current[1]; i < len(lower); i++ {
+		switch lower[i] {
+		case '(':
+			depth++
+		case ')':
+			depth--
+		}
+		if depth != 0 || isIdentRune(rune(lower[i-1])) || lower[i-1] == '.' || lower[i-1] == '`' {
+			continue
+		}
+		for _, next := range selectClauses {
+			end, ok := matchKeywords(lower, i, next)
+			if !ok {
+				continue
+			}
+			if _, seen := clauses[next]; seen || next == name {
+				return nil, fmt.Errorf("unsupported SELECT: repeated %s", strings.ToUpper(next))
+			}
+			current[2] = i
+			clauses[name] = current
+			name, current = next, [3]int{i, end, 0}
+			i = end - 1
+			break
+		}
+	}
+	current[2] = len(lower)
+	clauses[name] = current
+	if _, ok := clauses["from"]; !ok {
+		return nil, fmt.Errorf("SELECT without FROM cannot run across shards")
+	}
+	return clauses, nil
+}
+
+// matchKeywords reports whether the space separated keywords appear at
+// lower[i:], returning the offset just past them.
+func matchKeywords(lower string, i int, keywords string) (int, bool) {
+	for n, w := range strings.Fields(keywords) {
+		if n > 0 {
+			j := skipSpace(lower, i)
+			if j == i {
+				return 0, false
+			}
+			i = j
+		}
+		if !strings.HasPrefix(lower[i:], w) {
+			return 0, false
+		}
+		i += len(w)
+	}
+	if i < len(lower) && isIdentRune(rune(lower[i])) {
+		return 0, false
+	}
+	return i, true
+}
+
+// Merge combines the shards' responses into a single result.
+func (p *ScatterPlan) Merge(results []DBResponse) DBResponse {
+	var header []string
+	var rows [][]interface{}
+	for _, r := range results {
+		if header == nil {
+			header = r.Header
+		}
+		rows = append(rows, r.Rows...)
+	}
+	width := len(header)
+	if width == 0 && len(rows) > 0 {
+		width = len(rows[0])
+	}
+	visible := max(width-p.extra, 0)
+	resolve := func(col int) int {
+		if col < 0 {
+			return visible - col - 1
+		}
+		return col
+	}
+
+	if p.aggregate {
+		rows = p.mergeGroups(rows, resolve)
+	}
+	if p.distinct {
+		seen := make(map[string]bool)
+		unique := rows[:0]
+		for _, row := range rows {
+			if key := rowKey(row[:visible]); !seen[key] {
+				seen[key] = true
+				unique = append(unique, row)
+			}
+		}
+		rows = unique
+	}
+	if len(p.orderBy) > 0 {
+		sort.SliceStable(rows, func(i, j int) bool {
+			for _, o := range p.orderBy {
+				col := resolve(o.column)
+				if c := compareValues(rows[i][col], rows[j][col]); c != 0 {
+					return (c < 0) != o.desc
+				}
+			}
+			return false
+		})
+	}
+	rows = rows[min(p.offset, len(rows)):]
+	if p.limit >= 0 && len(rows) > p.limit {
+		rows = rows[:p.limit]
+	}
+
+	for i, row := range rows {
+		rows[i] = row[:visible]
+	}
+	if len(header) > visible {
+		header = header[:visible]
+	}
+	return DBResponse{
+		Status:  "ok",
+		Message: fmt.Sprintf("Select executed on %d shards", len(results)),
+		Header:  header,
+		Rows:    rows,
+	}
+}
+
+// mergeGroups combines the partial aggregates of rows with the same GROUP BY
+// key, keeping groups in the order they were first seen.
+func (p *ScatterPlan) mergeGroups(rows [][]interface{}, resolve func(int) int) [][]interface{} {
+	groups := make(map[string][]interface{})
+	var keys []string
+	for _, row := range rows {
+		key := make([]interface{}, len(p.groupBy))
+		for i, col := range p.groupBy {
+			key[i] = row[resolve(col)]
+		}
+		k := rowKey(key)
+		acc, ok := groups[k]
+		if !ok {
+			groups[k] = append([]interface{}(nil), row...)
+			keys = append(keys, k)
+			continue
+		}
+		for i, agg := range p.aggs {
+			switch agg {
+			case "count", "sum", "avg":
+				acc[i] = addValues(acc[i], row[i])
+			case "min":
+				if row[i] != nil && (acc[i] == nil || compareValues(row[i], acc[i]) < 0) {
+					acc[i] = row[i]
+				}
+			case "max":
+				if row[i] != nil && (acc[i] == nil || compareValues(row[i], acc[i]) > 0) {
+					acc[i] = row[i]
+				}
+			}
+		}
+	}
+
+	merged := make([][]interface{}, 0, len(keys))
+	for _, k := range keys {
+		row := groups[k]
+		for col, count := range p.avgCounts {
+			sum, ok := toNumber(row[col])
+			n, _ := toNumber(row[count])
+			if ok && n > 0 {
+				row[col] = strconv.FormatFloat(sum/n, 'f', 4, 64)
+			} else {
+				row[col] = nil
+			}
+		}
+		merged = append(merged, row)
+	}
+	return merged
+}
+
+func toNumber(v interface{}) (float64, bool) {
+	switch n := v.(type) {
+	case float64:
+		return n, true
+	case int64:
+		return float64(n), true
+	case string:
+		f, err := strconv.ParseFloat(n, 64)
+		return f, err == nil
+	}
+	return 0, false
+}
+
+// addValues adds two partial COUNTs or SUMs, keeping integers exact. NULL
+// counts as no value, as in SUM.
+func addValues(a, b interface{}) interface{} {
+	if a == nil {
+		return b
+	}
+	if b == nil {
+		return a
+	}
+	x, xerr := strconv.ParseInt(fmt.Sprint(a), 10, 64)
+	y, yerr := strconv.ParseInt(fmt.Sprint(b), 10, 64)
+	if xerr == nil && yerr == nil {
+		return strconv.FormatInt(x+y, 10)
+	}
+	f, _ := toNumber(a)
+	g, _ := toNumber(b)
+	return strconv.FormatFloat(f+g, 'f', -1, 64)
+}
+
+// compareValues orders NULL first, numbers numerically and anything else,
+// including dates, as strings.
+func compareValues(a, b interface{}) int {
+	switch {
+	case a == nil && b == nil:
+		return 0
+	case a == nil:
+		return -1
+	case b == nil:
+		return 1
+	}
+	if x, ok := toNumber(a); ok {
+		if y, ok := toNumber(b); ok {
+			switch {
+			case x < y:
+				return -1
+			case x > y:
+				return 1
+			}
+			return 0
+		}
+	}
+	return strings.Compare(fmt.Sprint(a), fmt.Sprint(b))
+}
+
+// rowKey encodes values so that equal values from different shards, which
+// may arrive as strings or numbers, give the same key.
+func rowKey(values []interface{}) string {
+	var b strings.Builder
+	for _, v := range values {
+		switch f, ok := toNumber(v); {
+		case v == nil:
+			b.WriteString("\x01")
+		case ok:
+			b.WriteString(strconv.FormatFloat(f, 'g', -1, 64))
+		default:
+			fmt.Fprint(&b, v)
+		}
+		b.WriteByte(0)
+	}
+	return b.String()
+}
@@ -0,0 +1,157 @@
+package shared
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestPlanScatter(t *testing.T) {
+	tests := []struct {
+		query   string
+		want    string
+		wantErr bool
+	}{
+		{query: "SELECT id, name FROM t ORDER BY id DESC LIMIT 2", want: "SELECT id, name FROM t ORDER BY id DESC LIMIT 2"},
+		{query: "SELECT name FROM t ORDER BY id LIMIT 1, 2", want: "SELECT name, id AS `__ddb_order_0` FROM t ORDER BY id LIMIT 3"},
+		{query: "SELECT * FROM t WHERE a = 'x; y' ORDER BY 1 LIMIT 3 OFFSET 2;", want: "SELECT * FROM t WHERE a = 'x; y' ORDER BY 1 LIMIT 5"},
+		{query: "SELECT k, COUNT(*) AS n FROM t GROUP BY k ORDER BY n DESC LIMIT 1", want: "SELECT k, COUNT(*) AS `n` FROM t GROUP BY k"},
+		{query: "SELECT k, AVG(x) avg_x FROM t GROUP BY k", want: "SELECT k, SUM(x) AS `avg_x`, COUNT(x) AS `__ddb_count_1` FROM t GROUP BY k"},
+		{query: "SELECT DISTINCT k FROM t", want: "SELECT DISTINCT k FROM t"},
+		{query: "SELECT k, COUNT(*) FROM t GROUP BY k HAVING COUNT(*) > 1", wantErr: true},
+		{query: "SELECT *, COUNT(*) FROM t", wantErr: true},
+		{query: "SELECT COUNT(DISTINCT x) FROM t", wantErr: true},
+		{query: "SELECT COUNT(*) + 1 FROM t", wantErr: true},
+		{query: "SELECT k FROM t ORDER BY COUNT(*)", wantErr: true},
+		{query: "SELECT id FROM t LIMIT ?", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.query, func(t *testing.T) {
+			plan, err := PlanScatter(tt.query)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("PlanScatter() = %q, want an error", plan.ShardQuery)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("PlanScatter(): %v", err)
+			}
+			if plan.ShardQuery != tt.want {
+				t.Errorf("ShardQuery = %q, want %q", plan.ShardQuery, tt.want)
+			}
+		})
+	}
+}
+
+func TestScatterMerge(t *testing.T) {
+	type rows = [][]interface{}
+	tests := []struct {
+		name       string
+		query      string
+		header     []string
+		shards     []rows
+		wantHeader []string
+		want       rows
+	}{
+		{
+			name:       "order and limit across shards",
+			query:      "SELECT id, name FROM t ORDER BY id DESC LIMIT 2",
+			header:     []string{"id", "name"},
+			shards:     []rows{{{"1", "a"}, {"3", "c"}}, {{"2", "b"}}},
+			wantHeader: []string{"id", "name"},
+			want:       rows{{"3", "c"}, {"2", "b"}},
+		},
+		{
+			name:       "numbers order numerically",
+			query:      "SELECT id FROM t ORDER BY id",
+			header:     []string{"id"},
+			shards:     []rows{{{"10"}, {int64(9)}}, {{nil}, {"100"}}},
+			wantHeader: []string{"id"},
+			want:       rows{{nil}, {int64(9)}, {"10"}, {"100"}},
+		},
+		{
+			name:       "offset and hidden order column",
+			query:      "SELECT name FROM t ORDER BY id LIMIT 1, 2",
+			header:     []string{"name", "__ddb_order_0"},
+			shards:     []rows{{{"a", "1"}, {"c", "3"}}, {{"b", "2"}, {"d", "4"}}},
+			wantHeader: []string{"name"},
+			want:       rows{{"b"}, {"c"}},
+		},
+		{
+			name:       "select star ordered by position",
+			query:      "SELECT * FROM t ORDER BY 2 DESC",
+			header:     []string{"id", "score"},
+			shards:     []rows{{{"1", "5"}, {"2", "7"}}, {{"3", "6"}}},
+			wantHeader: []string{"id", "score"},
+			want:       rows{{"2", "7"}, {"3", "6"}, {"1", "5"}},
+		},
+		{
+			name:   "aggregates without grouping",
+			query:  "SELECT COUNT(*), SUM(x), MIN(x), MAX(x), AVG(x) FROM t",
+			header: []string{"COUNT(*)", "SUM(x)", "MIN(x)", "MAX(x)", "AVG(x)", "__ddb_count_4"},
+			shards: []rows{
+				{{"2", "10", "1", "9", "10", "2"}},
+				{{"3", "5", "0", "4", "5", "3"}},
+				{{"0", nil, nil, nil, nil, "0"}},
+			},
+			wantHeader: []string{"COUNT(*)", "SUM(x)", "MIN(x)", "MAX(x)", "AVG(x)"},
+			want:       rows{{"5", "15", "0", "9", "3.0000"}},
+		},
+		{
+			name:       "groups merged and ordered by count",
+			query:      "SELECT k, COUNT(*) AS n FROM t GROUP BY k ORDER BY n DESC",
+			header:     []string{"k", "n"},
+			shards:     []rows{{{"a", "2"}, {"b", "1"}}, {{"b", "4"}, {"c", "1"}}},
+			wantHeader: []string{"k", "n"},
+			want:       rows{{"b", "5"}, {"a", "2"}, {"c", "1"}},
+		},
+		{
+			name:       "average per group over all rows",
+			query:      "SELECT k, AVG(x) avg_x FROM t GROUP BY k",
+			header:     []string{"k", "avg_x", "__ddb_count_1"},
+			shards:     []rows{{{"a", "10", "4"}}, {{"a", "2", "1"}, {"b", nil, "0"}}},
+			wantHeader: []string{"k", "avg_x"},
+			want:       rows{{"a", "2.4000"}, {"b", nil}},
+		},
+		{
+			name:       "distinct treats equal numbers and strings alike",
+			query:      "SELECT DISTINCT k FROM t",
+			header:     []string{"k"},
+			shards:     []rows{{{int64(1)}, {"x"}}, {{"1"}, {"y"}}},
+			wantHeader: []string{"k"},
+			want:       rows{{int64(1)}, {"x"}, {"y"}},
+		},
+		{
+			name:       "no rows",
+			query:      "SELECT id FROM t ORDER BY id LIMIT 5",
+			header:     []string{"id"},
+			shards:     []rows{nil, nil},
+			wantHeader: []string{"id"},
+			want:       rows{},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			plan, err := PlanScatter(tt.query)
+			if err != nil {
+				t.Fatalf("PlanScatter(): %v", err)
+			}
+			results := make([]DBResponse, len(tt.shards))
+			for i, shard := range tt.shards {
+				results[i] = DBResponse{Status: "ok", Header: tt.header, Rows: shard}
+			}
+			got := plan.Merge(results)
+			if got.Status != "ok" {
+				t.Fatalf("Merge() = %+v", got)
+			}
+			if !reflect.DeepEqual(got.Header, tt.wantHeader) {
+				t.Errorf("Header = %q, want %q", got.Header, tt.wantHeader)
+			}
+			if len(got.Rows) != 0 || len(tt.want) != 0 {
+				if !reflect.DeepEqual(got.Rows, tt.want) {
+					t.Errorf("Rows = %v, want %v", got.Rows, tt.want)
+				}
+			}
+		})
+	}
+}
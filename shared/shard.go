@@ -0,0 +1,406 @@
+package shared
+
+import (
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"math"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Shard strategies. Hash sharding maps keys to a fixed number of buckets,
+// each owned by one group; range sharding assigns integer key ranges.
+const (
+	ShardByHash  = "hash"
+	ShardByRange = "range"
+
+	DefaultShardBuckets = 64
+)
+
+// RoleShard marks a request one master sends another on behalf of the shard
+// router, so the receiver executes it instead of routing it again.
+const RoleShard = "shard"
+
+// ShardGroup is one master and its slaves holding a part of every sharded
+// table.
+type ShardGroup struct {
+	ID string `json:"id"`
+	// Master is the TCP address of the group's master; empty means the
+	// node that owns the shard map.
+	Master string   `json:"master,omitempty"`
+	Slaves []string `json:"slaves,omitempty"`
+}
+
+func (g ShardGroup) Local() bool {
+	return g.Master == ""
+}
+
+// ShardRange assigns the keys from Lower up to the next range's Lower to
+// Group. The first range also takes every key below its Lower.
+type ShardRange struct {
+	Lower int64  `json:"lower"`
+	Group string `json:"group"`
+}
+
+// ShardedTable records how one table is spread over the shard groups. Tables
+// in a ShardMap are replaced rather than modified, so a *ShardedTable taken
+// from the map can be read without locking.
+type ShardedTable struct {
+	DBName    string `json:"db_name"`
+	TableName string `json:"table_name"`
+	ShardKey  string `json:"shard_key"`
+	Strategy  string `json:"strategy"`
+	// Buckets holds the owning group of each hash bucket.
+	Buckets []string     `json:"buckets,omitempty"`
+	Ranges  []ShardRange `json:"ranges,omitempty"`
+}
+
+func (t *ShardedTable) Name() string {
+	return t.DBName + "." + t.TableName
+}
+
+// ShardBucket returns the hash bucket of a shard key value.
+func ShardBucket(key string, buckets int) int {
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	return int(h.Sum32() % uint32(buckets))
+}
+
+// Owner returns the group holding the row with the given shard key value.
+func (t *ShardedTable) Owner(key string) (string, error) {
+	if t.Strategy == ShardByRange {
+		n, err := strconv.ParseInt(key, 10, 64)
+		if err != nil {
+			return "", fmt.Errorf("shard key %s of %s must be an integer, got %q", t.ShardKey, t.Name(), key)
+		}
+		i := sort.Search(len(t.Ranges), func(i int) bool { return t.Ranges[i].Lower > n })
+		if i > 0 {
+			i--
+		}
+		return t.Ranges[i].Group, nil
+	}
+	return t.Buckets[ShardBucket(key, len(t.Buckets))], nil
+}
+
+// Groups returns the groups holding part of the table, sorted.
+func (t *ShardedTable) Groups() []string {
+	seen := make(map[string]bool)
+	var groups []string
+	add := func(g string) {
+		if !seen[g] {
+			seen[g] = true
+			groups = append(groups, g)
+		}
+	}
+	for _, g := range t.Buckets {
+		add(g)
+	}
+	for _, r := range t.Ranges {
+		add(r.Group)
+	}
+	sort.Strings(groups)
+	return groups
+}
+
+// NewShardedTable spreads a new table over groups: hash buckets are dealt out
+// in turn, and range tables get one range per split point, the first
+// starting at the lowest key.
+func NewShardedTable(req *CreateTableRequest, groups []string) (*ShardedTable, error) {
+	if len(groups) == 0 {
+		return nil, fmt.Errorf("no shard groups configured")
+	}
+	found := false
+	for _, col := range req.Columns {
+		if strings.EqualFold(col.Name, req.ShardKey) {
+			found = true
+		}
+	}
+	if !found {
+		return nil, fmt.Errorf("shard key %s is not a column of %s", req.ShardKey, req.TableName)
+	}
+
+	t := &ShardedTable{
+		DBName:    req.DBName,
+		TableName: req.TableName,
+		ShardKey:  req.ShardKey,
+		Strategy:  req.ShardStrategy,
+	}
+	switch t.Strategy {
+	case "", ShardByHash:
+		t.Strategy = ShardByHash
+		buckets := req.ShardBuckets
+		if buckets <= 0 {
+			buckets = DefaultShardBuckets
+		}
+		t.Buckets = make([]string, buckets)
+		for i := range t.Buckets {
+			t.Buckets[i] = groups[i%len(groups)]
+		}
+	case ShardByRange:
+		t.Ranges = []ShardRange{{Lower: math.MinInt64, Group: groups[0]}}
+		for i, lower := range req.ShardSplits {
+			if lower <= t.Ranges[i].Lower {
+				return nil, fmt.Errorf("shard splits must be increasing")
+			}
+			t.Ranges = append(t.Ranges, ShardRange{Lower: lower, Group: groups[(i+1)%len(groups)]})
+		}
+	default:
+		return nil, fmt.Errorf("unknown shard strategy %q", t.Strategy)
+	}
+	return t, nil
+}
+
+// Reassign returns a copy of the table with the keys named by req owned by
+// req.Target. Splitting a range at a point inside it starts a new range
+// there; splitting at a range's lower bound moves the whole range.
+func (t *ShardedTable) Reassign(req RebalanceRequest) (*ShardedTable, error) {
+	next := *t
+	moved := false
+	switch t.Strategy {
+	case ShardByRange:
+		if req.SplitAt == nil {
+			return nil, fmt.Errorf("range table %s needs split_at", t.Name())
+		}
+		at := *req.SplitAt
+		i := sort.Search(len(t.Ranges), func(i int) bool { return t.Ranges[i].Lower > at }) - 1
+		if i < 0 {
+			i = 0
+		}
+		next.Ranges = append([]ShardRange(nil), t.Ranges...)
+		if next.Ranges[i].Lower == at {
+			moved = next.Ranges[i].Group != req.Target
+			next.Ranges[i].Group = req.Target
+		} else if moved = t.Ranges[i].Group != req.Target; moved {
+			next.Ranges = append(next.Ranges[:i+1], append([]ShardRange{{Lower: at, Group: req.Target}}, t.Ranges[i+1:]...)...)
+		}
+	default:
+		if len(req.Buckets) == 0 {
+			return nil, fmt.Errorf("hash table %s needs buckets", t.Name())
+		}
+		next.Buckets = append([]string(nil), t.Buckets...)
+		for _, b := range req.Buckets {
+			if b < 0 || b >= len(next.Buckets) {
+				return nil, fmt.Errorf("table %s has no bucket %d", t.Name(), b)
+			}
+			moved = moved || next.Buckets[b] != req.Target
+			next.Buckets[b] = req.Target
+		}
+	}
+	if !moved {
+		return nil, fmt.Errorf("those keys of %s are already on %s", t.Name(), req.Target)
+	}
+	return &next, nil
+}
+
+// RangeOf returns where the range starting at lower ends. ok is false for
+// the last range, which has no upper bound.
+func (t *ShardedTable) RangeOf(lower int64) (upper int64, ok bool) {
+	for i, r := range t.Ranges {
+		if r.Lower == lower && i+1 < len(t.Ranges) {
+			return t.Ranges[i+1].Lower, true
+		}
+	}
+	return 0, false
+}
+
+// ShardMap is the set of shard groups and sharded tables, persisted as JSON.
+type ShardMap struct {
+	Version int64                    `json:"version"`
+	Groups  []ShardGroup             `json:"groups"`
+	Tables  map[string]*ShardedTable `json:"tables"`
+
+	mu   sync.RWMutex
+	path string
+}
+
+// LoadShardMap reads the map at path. A missing file gives a map with a
+// single local group.
+func LoadShardMap(path string) (*ShardMap, error) {
+	m := &ShardMap{
+		Groups: []ShardGroup{{ID: "local"}},
+		Tables: make(map[string]*ShardedTable),
+		path:   path,
+	}
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return m, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read shard map: %v", err)
+	}
+	if err := json.Unmarshal(data, m); err != nil {
+		return nil, fmt.Errorf("invalid shard map: %v", err)
+	}
+	if m.Tables == nil {
+		m.Tables = make(map[string]*ShardedTable)
+	}
+	return m, nil
+}
+
+// saveLocked writes the map to its file. The caller must hold mu.
+func (m *ShardMap) saveLocked() error {
+	data, err := json.MarshalIndent(m.snapshotLocked(), "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode shard map: %v", err)
+	}
+	tmp := m.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return fmt.Errorf("failed to write shard map: %v", err)
+	}
+	return os.Rename(tmp, m.path)
+}
+
+// update applies fn and persists the result, leaving the map unchanged if
+// either fails.
+func (m *ShardMap) update(fn func() error) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	groups := append([]ShardGroup(nil), m.Groups...)
+	tables := make(map[string]*ShardedTable, len(m.Tables))
+	for name, t := range m.Tables {
+		tables[name] = t
+	}
+	if err := fn(); err != nil {
+		m.Groups, m.Tables = groups, tables
+		return err
+	}
+	m.Version++
+	if err := m.saveLocked(); err != nil {
+		m.Groups, m.Tables = groups, tables
+		m.Version--
+		return err
+	}
+	return nil
+}
+
+func (m *ShardMap) Group(id string) (ShardGroup, bool) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	for _, g := range m.Groups {
+		if g.ID == id {
+			return g, true
+		}
+	}
+	return ShardGroup{}, false
+}
+
+func (m *ShardMap) GroupIDs() []string {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	ids := make([]string, len(m.Groups))
+	for i, g := range m.Groups {
+		ids[i] = g.ID
+	}
+	return ids
+}
+
+// SetGroup adds a group or replaces the one with the same ID.
+func (m *ShardMap) SetGroup(group ShardGroup) error {
+	return m.update(func() error {
+		if group.ID == "" {
+			return fmt.Errorf("shard group needs an id")
+		}
+		for i, g := range m.Groups {
+			if g.ID == group.ID {
+				m.Groups[i] = group
+				return nil
+			}
+		}
+		m.Groups = append(m.Groups, group)
+		return nil
+	})
+}
+
+// Table finds a sharded table by "db.table", or by table name alone when
+// only one sharded table has that name.
+func (m *ShardMap) Table(name string) *ShardedTable {
+	name = strings.ToLower(strings.ReplaceAll(name, "`", ""))
+
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	if t, ok := m.Tables[name]; ok {
+		return t
+	}
+	if strings.Contains(name, ".") {
+		return nil
+	}
+	var match *ShardedTable
+	for _, t := range m.Tables {
+		if strings.EqualFold(t.TableName, name) {
+			if match != nil {
+				return nil
+			}
+			match = t
+		}
+	}
+	return match
+}
+
+// TableNames returns the names of the sharded tables, without their
+// databases, in lower case.
+func (m *ShardMap) TableNames() []string {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	names := make([]string, 0, len(m.Tables))
+	for _, t := range m.Tables {
+		names = append(names, strings.ToLower(t.TableName))
+	}
+	sort.Strings(names)
+	return names
+}
+
+// PutTable adds or replaces a sharded table.
+func (m *ShardMap) PutTable(t *ShardedTable) error {
+	return m.update(func() error {
+		for _, g := range t.Groups() {
+			if !m.hasGroupLocked(g) {
+				return fmt.Errorf("unknown shard group %q", g)
+			}
+		}
+		m.Tables[strings.ToLower(t.Name())] = t
+		return nil
+	})
+}
+
+func (m *ShardMap) RemoveTable(name string) error {
+	return m.update(func() error {
+		delete(m.Tables, strings.ToLower(name))
+		return nil
+	})
+}
+
+func (m *ShardMap) hasGroupLocked(id string) bool {
+	for _, g := range m.Groups {
+		if g.ID == id {
+			return true
+		}
+	}
+	return false
+}
+
+// MarshalJSON encodes a consistent snapshot of the map.
+func (m *ShardMap) MarshalJSON() ([]byte, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	return json.Marshal(m.snapshotLocked())
+}
+
+type shardMapJSON struct {
+	Version int64                    `json:"version"`
+	Groups  []ShardGroup             `json:"groups"`
+	Tables  map[string]*ShardedTable `json:"tables"`
+}
+
+func (m *ShardMap) snapshotLocked() shardMapJSON {
+	return shardMapJSON{m.Version, m.Groups, m.Tables}
+}
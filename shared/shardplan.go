@@ -0,0 +1,417 @@
+package shared
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+var (
+	tableRefPattern = regexp.MustCompile("(?i)(?:^\\s*update|\\b(?:from|into|join|table(?:\\s+if\\s+(?:not\\s+)?exists)?))\\s+(`?[\\w$]+`?(?:\\.`?[\\w$]+`?)?)")
+	insertPattern   = regexp.MustCompile(`(?is)^\s*(?:insert|replace)\s+(?:ignore\s+)?into\s+\S+\s*\(([^)]*)\)\s*values\s*`)
+	wherePattern    = regexp.MustCompile(`(?i)\bwhere\b`)
+	// orPattern finds operators that let a WHERE clause match rows besides
+	// those its shard key condition selects.
+	orPattern = regexp.MustCompile(`(?i)\b(?:or|xor)\b|\|\||!(?:[^=]|$)`)
+	// notPattern finds NOT; only the forms negating a single comparison,
+	// such as NOT IN or IS NOT NULL, have the suffix.
+	notPattern = regexp.MustCompile(`(?i)\bnot\b(\s+(?:in|like|between|regexp|rlike|null)\b)?`)
+	// keyBeforePattern and keyAfterPattern match what may surround a shard
+	// key condition for it to restrict the whole WHERE clause.
+	keyBeforePattern = regexp.MustCompile(`(?i)(?:^|\band\b|&&|\()[\s(]*$`)
+	keyAfterPattern  = regexp.MustCompile(`(?i)^\s*(?:$|;|\)|&&|(?:and|order\s+by|group\s+by|having|limit|for\s+update|lock\s+in\s+share\s+mode)\b)`)
+	setPattern       = regexp.MustCompile(`(?is)\bset\b(.*?)(?:\bwhere\b|$)`)
+)
+
+// ShardPlan says where a statement on a sharded table has to run.
+type ShardPlan struct {
+	Table *ShardedTable
+	Kind  string
+	// Groups are the groups owning the rows the statement is restricted to,
+	// sorted. It is empty when the statement does not pin the shard key and
+	// so may touch every shard.
+	Groups []string
+	// Statements holds what to run on each of Groups. It differs from the
+	// original statement only for INSERTs whose rows are split up.
+	Statements map[string]string
+	// Broadcast is set for DDL, which runs on every group of the table.
+	Broadcast bool
+}
+
+// PlanShardedStatement works out which shard groups query must run on. It
+// returns nil if the statement touches no sharded table. The shard key is
+// recognized in INSERT column lists and in WHERE clauses of the form
+// key = literal or key IN (literals), combined with other conditions only
+// by AND.
+func PlanShardedStatement(m *ShardMap, query string) (*ShardPlan, error) {
+	masked := maskLiterals(query)
+	var table *ShardedTable
+	refs := make(map[string]bool)
+	for _, ref := range tableRefPattern.FindAllStringSubmatch(masked, -1) {
+		refs[strings.ToLower(strings.ReplaceAll(ref[1], "`", ""))] = true
+		if t := m.Table(ref[1]); t != nil {
+			table = t
+		}
+	}
+	if table == nil {
+		return nil, nil
+	}
+	if len(refs) > 1 {
+		return nil, fmt.Errorf("statements on sharded table %s cannot reference other tables", table.Name())
+	}
+
+	plan := &ShardPlan{Table: table, Kind: StatementKind(query)}
+	var keys []string
+	switch plan.Kind {
+	case "CREATE", "DROP", "ALTER", "TRUNCATE":
+		plan.Broadcast = true
+		plan.Groups = table.Groups()
+		plan.Statements = make(map[string]string)
+		for _, g := range plan.Groups {
+			plan.Statements[g] = query
+		}
+		return plan, nil
+	case "INSERT", "REPLACE":
+		return planInsert(plan, query, masked)
+	case "UPDATE":
+		if set := setPattern.FindStringSubmatch(masked); set != nil && columnPattern(table.ShardKey, `\s*=`).MatchString(set[1]) {
+			return nil, fmt.Errorf("cannot change shard key %s of %s", table.ShardKey, table.Name())
+		}
+		fallthrough
+	case "SELECT", "DELETE":
+		keys = pinnedKeys(query, masked, table.ShardKey)
+	default:
+		return nil, fmt.Errorf("%s statements are not supported on sharded table %s", plan.Kind, table.Name())
+	}
+
+	plan.Statements = make(map[string]string)
+	for _, key := range keys {
+		group, err := table.Owner(key)
+		if err != nil {
+			return nil, err
+		}
+		plan.Statements[group] = query
+	}
+	plan.Groups = sortedGroups(plan.Statements)
+	return plan, nil
+}
+
+func sortedGroups(statements map[string]string) []string {
+	groups := make([]string, 0, len(statements))
+	for g := range statements {
+		groups = append(groups, g)
+	}
+	sort.Strings(groups)
+	return groups
+}
+
+// columnPattern matches a reference to column, optionally qualified,
+// followed by suffix.
+func columnPattern(column, suffix string) *regexp.Regexp {
+	return regexp.MustCompile("(?i)(?:^|[^\\w$.`])(?:`?[\\w$]+`?\\.)?`?" + regexp.QuoteMeta(column) + "`?" + suffix)
+}
+
+// pinnedKeys returns the shard key values a WHERE clause restricts the
+// statement to, or nil if it may match rows with any key.
+func pinnedKeys(query, masked, key string) []string {
+	where := wherePattern.FindStringIndex(masked)
+	if where == nil || orPattern.MatchString(masked[where[1]:]) {
+		return nil
+	}
+	for _, m := range notPattern.FindAllStringSubmatch(masked[where[1]:], -1) {
+		if m[1] == "" {
+			return nil
+		}
+	}
+	loc := columnPattern(key, `\s*(=|\bin\b)\s*`).FindStringSubmatchIndex(masked[where[1]:])
+	if loc == nil {
+		return nil
+	}
+	before := masked[where[1] : where[1]+loc[0]]
+	if masked[where[1]+loc[0]] == '(' {
+		before += "("
+	}
+	if !keyBeforePattern.MatchString(before) {
+		return nil
+	}
+	pos := where[1] + loc[1]
+	if strings.EqualFold(masked[where[1]+loc[2]:where[1]+loc[3]], "=") {
+		value, end, ok := readLiteral(query, pos)
+		if !ok || !keyAfterPattern.MatchString(masked[end:]) {
+			return nil
+		}
+		return []string{value}
+	}
+
+	if pos >= len(query) || query[pos] != '(' {
+		return nil
+	}
+	var values []string
+	for pos++; ; {
+		value, end, ok := readLiteral(query, pos)
+		if !ok {
+			return nil
+		}
+		values = append(values, value)
+		end = skipSpace(query, end)
+		if end < len(query) && query[end] == ',' {
+			pos = end + 1
+			continue
+		}
+		if end < len(query) && query[end] == ')' && keyAfterPattern.MatchString(masked[end+1:]) {
+			return values
+		}
+		return nil
+	}
+}
+
+// planInsert assigns each row of a multi-row INSERT to its group, giving
+// every group an INSERT of just its rows.
+func planInsert(plan *ShardPlan, query, masked string) (*ShardPlan, error) {
+	rows, prefix, suffix, err := splitInsert(plan.Table, query, masked)
+	if err != nil {
+		return nil, err
+	}
+	tuples := make(map[string][]string)
+	for _, row := range rows {
+		group, err := plan.Table.Owner(row.key)
+		if err != nil {
+			return nil, err
+		}
+		tuples[group] = append(tuples[group], row.text)
+	}
+
+	plan.Statements = make(map[string]string)
+	for group, rows := range tuples {
+		if len(tuples) == 1 {
+			plan.Statements[group] = query
+		} else {
+			plan.Statements[group] = prefix + strings.Join(rows, ", ") + suffix
+		}
+	}
+	plan.Groups = sortedGroups(plan.Statements)
+	return plan, nil
+}
+
+type insertRow struct {
+	key  string
+	text string
+}
+
+// splitInsert returns the rows of an INSERT with their shard keys, and the
+// text before and after the rows.
+func splitInsert(table *ShardedTable, query, masked string) ([]insertRow, string, string, error) {
+	m := insertPattern.FindStringSubmatchIndex(masked)
+	if m == nil {
+		return nil, "", "", fmt.Errorf("INSERT into sharded table %s must list its columns and use VALUES", table.Name())
+	}
+	keyIndex := -1
+	for i, col := range strings.Split(masked[m[2]:m[3]], ",") {
+		if strings.EqualFold(strings.Trim(strings.TrimSpace(col), "`"), table.ShardKey) {
+			keyIndex = i
+		}
+	}
+	if keyIndex < 0 {
+		return nil, "", "", fmt.Errorf("INSERT into sharded table %s must set shard key %s", table.Name(), table.ShardKey)
+	}
+
+	var rows []insertRow
+	pos, tail := m[1], 0
+	for {
+		pos = skipSpace(masked, pos)
+		if pos >= len(masked) || masked[pos] != '(' {
+			return nil, "", "", fmt.Errorf("INSERT into sharded table %s must use literal VALUES rows", table.Name())
+		}
+		end := matchingParen(masked, pos)
+		if end < 0 {
+			return nil, "", "", fmt.Errorf("unbalanced parentheses in INSERT")
+		}
+		fields := splitTopLevel(masked, pos+1, end)
+		if keyIndex >= len(fields) {
+			return nil, "", "", fmt.Errorf("INSERT row has no value for shard key %s", table.ShardKey)
+		}
+		key, keyEnd, ok := readLiteral(query, fields[keyIndex][0])
+		if !ok || skipSpace(query, keyEnd) != fields[keyIndex][1] {
+			return nil, "", "", fmt.Errorf("shard key %s must be a literal in INSERT rows", table.ShardKey)
+		}
+		rows = append(rows, insertRow{key: key, text: query[pos : end+1]})
+
+		tail = end + 1
+		pos = skipSpace(masked, tail)
+		if pos < len(masked) && masked[pos] == ',' {
+			pos++
+			continue
+		}
+		break
+	}
+	return rows, query[:m[1]], query[tail:], nil
+}
+
+// StatementKeys returns the shard key values of the rows a write on table
+// can have changed. It reports false if the statement does not touch the
+// table, and fails if it does without pinning the shard key.
+func StatementKeys(table *ShardedTable, query string) ([]string, bool, error) {
+	masked := maskLiterals(query)
+	found := false
+	for _, ref := range tableRefPattern.FindAllStringSubmatch(masked, -1) {
+		name := strings.ToLower(strings.ReplaceAll(ref[1], "`", ""))
+		if name == strings.ToLower(table.Name()) || name == strings.ToLower(table.TableName) {
+			found = true
+		}
+	}
+	if !found {
+		return nil, false, nil
+	}
+
+	switch StatementKind(query) {
+	case "SELECT":
+		return nil, false, nil
+	case "INSERT", "REPLACE":
+		rows, _, _, err := splitInsert(table, query, masked)
+		if err != nil {
+			return nil, true, err
+		}
+		keys := make([]string, len(rows))
+		for i, row := range rows {
+			keys[i] = row.key
+		}
+		return keys, true, nil
+	case "UPDATE", "DELETE":
+		if keys := pinnedKeys(query, masked, table.ShardKey); keys != nil {
+			return keys, true, nil
+		}
+	}
+	return nil, true, fmt.Errorf("cannot tell which rows of %s are changed by: %s", table.Name(), query)
+}
+
+// ChangeKeys returns the shard key values, before and after, of the rows of
+// table among captured changes.
+func ChangeKeys(table *ShardedTable, changes []RowChange) []string {
+	var keys []string
+	for _, c := range changes {
+		if !strings.EqualFold(c.Table, table.TableName) || (c.DB != "" && !strings.EqualFold(c.DB, table.DBName)) {
+			continue
+		}
+		for _, image := range []map[string]interface{}{c.Before, c.After} {
+			for col, v := range image {
+				if strings.EqualFold(col, table.ShardKey) && v != nil {
+					keys = append(keys, fmt.Sprint(v))
+				}
+			}
+		}
+	}
+	return keys
+}
+
+// maskLiterals replaces the contents of quoted strings with underscores,
+// keeping byte offsets, so patterns can run over the statement without
+// matching inside literals.
+func maskLiterals(query string) string {
+	b := []byte(query)
+	for i := 0; i < len(b); i++ {
+		q := b[i]
+		if q != '\'' && q != '"' {
+			continue
+		}
+		for i++; i < len(b) && b[i] != q; i++ {
+			if b[i] == '\\' && i+1 < len(b) {
+				b[i] = '_'
+				i++
+			}
+			b[i] = '_'
+		}
+	}
+	return string(b)
+}
+
+func skipSpace(s string, i int) int {
+	for i < len(s) && (s[i] == ' ' || s[i] == '\t' || s[i] == '\n' || s[i] == '\r') {
+		i++
+	}
+	return i
+}
+
+func matchingParen(masked string, open int) int {
+	depth := 0
+	for i := open; i < len(masked); i++ {
+		switch masked[i] {
+		case '(':
+			depth++
+		case ')':
+			depth--
+			if depth == 0 {
+				return i
+			}
+		}
+	}
+	return -1
+}
+
+// splitTopLevel returns the [start, end) offsets of the comma separated
+// fields of masked[start:end], ignoring commas inside parentheses.
+func splitTopLevel(masked string, start, end int) [][2]int {
+	var fields [][2]int
+	depth, from := 0, start
+	for i := start; i < end; i++ {
+		switch masked[i] {
+		case '(':
+			depth++
+		case ')':
+			depth--
+		case ',':
+			if depth == 0 {
+				fields = append(fields, [2]int{skipSpace(masked, from), i})
+				from = i + 1
+			}
+		}
+	}
+	return append(fields, [2]int{skipSpace(masked, from), end})
+}
+
+// readLiteral reads a string or number literal at s[i:], skipping leading
+// space, and returns its value in the canonical form used for shard keys.
+func readLiteral(s string, i int) (string, int, bool) {
+	i = skipSpace(s, i)
+	if i >= len(s) {
+		return "", i, false
+	}
+	if q := s[i]; q == '\'' || q == '"' {
+		var b strings.Builder
+		for i++; i < len(s); i++ {
+			switch {
+			case s[i] == '\\' && i+1 < len(s):
+				i++
+				b.WriteByte(s[i])
+			case s[i] == q && i+1 < len(s) && s[i+1] == q:
+				i++
+				b.WriteByte(q)
+			case s[i] == q:
+				return b.String(), i + 1, true
+			default:
+				b.WriteByte(s[i])
+			}
+		}
+		return "", i, false
+	}
+
+	start := i
+	if s[i] == '-' || s[i] == '+' {
+		i++
+	}
+	for i < len(s) && (s[i] >= '0' && s[i] <= '9' || s[i] == '.') {
+		i++
+	}
+	if i < len(s) && isIdentRune(rune(s[i])) {
+		return "", i, false
+	}
+	value := s[start:i]
+	if n, err := strconv.ParseInt(value, 10, 64); err == nil {
+		return strconv.FormatInt(n, 10), i, true
+	}
+	if _, err := strconv.ParseFloat(value, 64); err != nil {
+		return "", i, false
+	}
+	return strings.TrimPrefix(value, "+"), i, true
+}
@@ -0,0 +1,287 @@
+package shared
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestChangeKeys(t *testing.T) {
+	table := &ShardedTable{DBName: "shop", TableName: "orders", ShardKey: "user_id"}
+	tests := []struct {
+		name    string
+		changes []RowChange
+		want    []string
+	}{
+		{
+			name: "insert",
+			changes: []RowChange{
+				{DB: "shop", Table: "orders", Op: RowInsert, After: map[string]interface{}{"id": "1", "user_id": "7"}},
+			},
+			want: []string{"7"},
+		},
+		{
+			name: "update moving the row reports both keys",
+			changes: []RowChange{
+				{DB: "shop", Table: "orders", Op: RowUpdate,
+					Before: map[string]interface{}{"id": "1", "user_id": "7"},
+					After:  map[string]interface{}{"id": "1", "user_id": "9"}},
+			},
+			want: []string{"7", "9"},
+		},
+		{
+			name: "delete",
+			changes: []RowChange{
+				{DB: "shop", Table: "orders", Op: RowDelete, Before: map[string]interface{}{"id": "1", "USER_ID": "3"}},
+			},
+			want: []string{"3"},
+		},
+		{
+			name: "other tables and NULL keys are skipped",
+			changes: []RowChange{
+				{DB: "shop", Table: "users", Op: RowInsert, After: map[string]interface{}{"user_id": "1"}},
+				{DB: "other", Table: "orders", Op: RowInsert, After: map[string]interface{}{"user_id": "2"}},
+				{DB: "shop", Table: "orders", Op: RowInsert, After: map[string]interface{}{"user_id": nil}},
+				{Table: "ORDERS", Op: RowInsert, After: map[string]interface{}{"user_id": "4"}},
+			},
+			want: []string{"4"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := ChangeKeys(table, tt.changes); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("ChangeKeys() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPinnedKeys(t *testing.T) {
+	tests := []struct {
+		query string
+		want  []string
+	}{
+		{"SELECT * FROM orders WHERE id = 5", []string{"5"}},
+		{"SELECT * FROM orders WHERE id = '5'", []string{"5"}},
+		{"SELECT * FROM orders WHERE o.id = 5 AND status = 'open'", []string{"5"}},
+		{"SELECT * FROM orders WHERE status = 'a or b' AND id = 5", []string{"5"}},
+		{"SELECT * FROM orders WHERE (id = 5) && x = 1", []string{"5"}},
+		{"SELECT * FROM orders WHERE id IN (1, 2, '3') ORDER BY id LIMIT 2", []string{"1", "2", "3"}},
+		{"DELETE FROM orders WHERE id = 5;", []string{"5"}},
+		{"SELECT * FROM orders WHERE id = 5 AND note IS NOT NULL AND x NOT IN (1)", []string{"5"}},
+		{"SELECT * FROM orders WHERE x != 1 AND id = 5", []string{"5"}},
+		{"SELECT * FROM orders WHERE id = 5 FOR UPDATE", []string{"5"}},
+
+		{"SELECT * FROM orders", nil},
+		{"SELECT * FROM orders WHERE id > 5", nil},
+		{"SELECT * FROM orders WHERE id = 1 OR id = 2", nil},
+		{"SELECT * FROM orders WHERE id = 1 || id = 2", nil},
+		{"SELECT * FROM orders WHERE id = 1 XOR x = 2", nil},
+		{"SELECT * FROM orders WHERE NOT id = 1", nil},
+		{"SELECT * FROM orders WHERE NOT (id = 1)", nil},
+		{"SELECT * FROM orders WHERE !(id = 1)", nil},
+		{"SELECT * FROM orders WHERE id = 5 + 1", nil},
+		{"SELECT * FROM orders WHERE id = 5 - x", nil},
+		{"SELECT * FROM orders WHERE id IN (1, 2) + 0", nil},
+		{"SELECT * FROM orders WHERE id = x", nil},
+		{"SELECT * FROM orders WHERE x + id = 5", nil},
+		{"SELECT * FROM orders WHERE id IN (SELECT id FROM t)", nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.query, func(t *testing.T) {
+			if got := pinnedKeys(tt.query, maskLiterals(tt.query), "id"); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("pinnedKeys() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func testShardMap() *ShardMap {
+	return &ShardMap{
+		Groups: []ShardGroup{{ID: "a"}, {ID: "b"}, {ID: "c"}},
+		Tables: map[string]*ShardedTable{
+			"shop.orders": {
+				DBName: "shop", TableName: "orders", ShardKey: "id", Strategy: ShardByRange,
+				Ranges: []ShardRange{{Lower: 0, Group: "a"}, {Lower: 100, Group: "b"}, {Lower: 200, Group: "c"}},
+			},
+		},
+	}
+}
+
+func TestPlanShardedStatement(t *testing.T) {
+	tests := []struct {
+		name       string
+		query      string
+		wantNil    bool
+		wantErr    bool
+		broadcast  bool
+		statements map[string]string
+	}{
+		{
+			name:    "unsharded table",
+			query:   "SELECT * FROM shop.users WHERE id = 1",
+			wantNil: true,
+		},
+		{
+			name:       "select pinned to one range",
+			query:      "SELECT * FROM orders WHERE id = 150",
+			statements: map[string]string{"b": "SELECT * FROM orders WHERE id = 150"},
+		},
+		{
+			name:  "select pinned to several ranges",
+			query: "SELECT * FROM shop.orders WHERE id IN (1, 250)",
+			statements: map[string]string{
+				"a": "SELECT * FROM shop.orders WHERE id IN (1, 250)",
+				"c": "SELECT * FROM shop.orders WHERE id IN (1, 250)",
+			},
+		},
+		{
+			name:       "select without the shard key",
+			query:      "SELECT * FROM orders WHERE total > 5",
+			statements: map[string]string{},
+		},
+		{
+			name:       "update pinned by key",
+			query:      "UPDATE orders SET total = 1 WHERE id = 250",
+			statements: map[string]string{"c": "UPDATE orders SET total = 1 WHERE id = 250"},
+		},
+		{
+			name:    "update of the shard key",
+			query:   "UPDATE orders SET id = 3 WHERE id = 250",
+			wantErr: true,
+		},
+		{
+			name:      "ddl runs everywhere",
+			query:     "ALTER TABLE orders ADD COLUMN x INT",
+			broadcast: true,
+			statements: map[string]string{
+				"a": "ALTER TABLE orders ADD COLUMN x INT",
+				"b": "ALTER TABLE orders ADD COLUMN x INT",
+				"c": "ALTER TABLE orders ADD COLUMN x INT",
+			},
+		},
+		{
+			name:       "insert on one group keeps the statement",
+			query:      "INSERT INTO orders (id, total) VALUES (1, 10), (2, 20)",
+			statements: map[string]string{"a": "INSERT INTO orders (id, total) VALUES (1, 10), (2, 20)"},
+		},
+		{
+			name:  "insert split by group",
+			query: "INSERT INTO orders (id, total) VALUES (1, 10), (150, 20), (2, 30) ON DUPLICATE KEY UPDATE total = VALUES(total)",
+			statements: map[string]string{
+				"a": "INSERT INTO orders (id, total) VALUES (1, 10), (2, 30) ON DUPLICATE KEY UPDATE total = VALUES(total)",
+				"b": "INSERT INTO orders (id, total) VALUES (150, 20) ON DUPLICATE KEY UPDATE total = VALUES(total)",
+			},
+		},
+		{
+			name:    "join with another table",
+			query:   "SELECT * FROM orders JOIN users ON users.id = orders.user_id WHERE orders.id = 1",
+			wantErr: true,
+		},
+		{
+			name:    "non-integer range key",
+			query:   "SELECT * FROM orders WHERE id = 'x'",
+			wantErr: true,
+		},
+		{
+			name:    "unsupported statement",
+			query:   "RENAME TABLE orders TO old_orders",
+			wantErr: true,
+		},
+	}
+	m := testShardMap()
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			plan, err := PlanShardedStatement(m, tt.query)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("PlanShardedStatement() = %+v, want an error", plan)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("PlanShardedStatement(): %v", err)
+			}
+			if tt.wantNil {
+				if plan != nil {
+					t.Fatalf("PlanShardedStatement() = %+v, want nil", plan)
+				}
+				return
+			}
+			if plan.Broadcast != tt.broadcast {
+				t.Errorf("Broadcast = %v, want %v", plan.Broadcast, tt.broadcast)
+			}
+			if !reflect.DeepEqual(plan.Statements, tt.statements) {
+				t.Errorf("Statements = %q, want %q", plan.Statements, tt.statements)
+			}
+			if want := sortedGroups(tt.statements); !reflect.DeepEqual(plan.Groups, want) {
+				t.Errorf("Groups = %v, want %v", plan.Groups, want)
+			}
+		})
+	}
+}
+
+func TestSplitInsert(t *testing.T) {
+	table := &ShardedTable{DBName: "shop", TableName: "orders", ShardKey: "user_id"}
+	tests := []struct {
+		name    string
+		query   string
+		keys    []string
+		rows    []string
+		prefix  string
+		suffix  string
+		wantErr bool
+	}{
+		{
+			name:   "single row",
+			query:  "INSERT INTO orders (id, user_id) VALUES (1, 7)",
+			keys:   []string{"7"},
+			rows:   []string{"(1, 7)"},
+			prefix: "INSERT INTO orders (id, user_id) VALUES ",
+		},
+		{
+			name:   "quoted keys, nested parentheses and a suffix",
+			query:  "INSERT INTO orders (`user_id`, note) VALUES ('a''b', CONCAT('x', '(')), (\"c\", 'd') ON DUPLICATE KEY UPDATE note = 'e'",
+			keys:   []string{"a'b", "c"},
+			rows:   []string{"('a''b', CONCAT('x', '('))", "(\"c\", 'd')"},
+			prefix: "INSERT INTO orders (`user_id`, note) VALUES ",
+			suffix: " ON DUPLICATE KEY UPDATE note = 'e'",
+		},
+		{
+			name:   "numbers are normalized",
+			query:  "REPLACE INTO orders (user_id) VALUES (+007), (-3)",
+			keys:   []string{"7", "-3"},
+			rows:   []string{"(+007)", "(-3)"},
+			prefix: "REPLACE INTO orders (user_id) VALUES ",
+		},
+		{name: "no column list", query: "INSERT INTO orders VALUES (1, 7)", wantErr: true},
+		{name: "shard key not set", query: "INSERT INTO orders (id) VALUES (1)", wantErr: true},
+		{name: "expression as key", query: "INSERT INTO orders (id, user_id) VALUES (1, 3 + 4)", wantErr: true},
+		{name: "row without the key", query: "INSERT INTO orders (id, user_id) VALUES (1)", wantErr: true},
+		{name: "insert from select", query: "INSERT INTO orders (id, user_id) SELECT id, 1 FROM t", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rows, prefix, suffix, err := splitInsert(table, tt.query, maskLiterals(tt.query))
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("splitInsert() = %+v, want an error", rows)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("splitInsert(): %v", err)
+			}
+			var keys, texts []string
+			for _, r := range rows {
+				keys = append(keys, r.key)
+				texts = append(texts, r.text)
+			}
+			if !reflect.DeepEqual(keys, tt.keys) || !reflect.DeepEqual(texts, tt.rows) {
+				t.Errorf("rows = %q %q, want %q %q", keys, texts, tt.keys, tt.rows)
+			}
+			if prefix != tt.prefix || suffix != tt.suffix {
+				t.Errorf("prefix, suffix = %q, %q, want %q, %q", prefix, suffix, tt.prefix, tt.suffix)
+			}
+		})
+	}
+}
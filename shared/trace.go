@@ -0,0 +1,171 @@
+package shared
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// TraceparentHeader carries a span context over HTTP in the W3C Trace
+// Context format.
+const TraceparentHeader = "traceparent"
+
+type SpanKind int
+
+// Span kinds use the OpenTelemetry numbering.
+const (
+	SpanInternal SpanKind = 1
+	SpanServer   SpanKind = 2
+	SpanClient   SpanKind = 3
+)
+
+// SpanContext identifies a span within a trace. IDs are lowercase hex, 32
+// characters for the trace and 16 for the span.
+type SpanContext struct {
+	TraceID string
+	SpanID  string
+}
+
+func (c SpanContext) Valid() bool {
+	return len(c.TraceID) == 32 && len(c.SpanID) == 16
+}
+
+func (c SpanContext) Traceparent() string {
+	return fmt.Sprintf("00-%s-%s-01", c.TraceID, c.SpanID)
+}
+
+// ParseTraceparent parses a traceparent header value.
+func ParseTraceparent(value string) (SpanContext, bool) {
+	parts := strings.Split(strings.TrimSpace(value), "-")
+	if len(parts) < 4 || len(parts[0]) != 2 {
+		return SpanContext{}, false
+	}
+	c := SpanContext{TraceID: strings.ToLower(parts[1]), SpanID: strings.ToLower(parts[2])}
+	if !c.Valid() || !isHex(c.TraceID) || !isHex(c.SpanID) ||
+		c.TraceID == strings.Repeat("0", 32) || c.SpanID == strings.Repeat("0", 16) {
+		return SpanContext{}, false
+	}
+	return c, true
+}
+
+func isHex(s string) bool {
+	_, err := hex.DecodeString(s)
+	return err == nil
+}
+
+// SpanContextFromHeader returns the span context propagated in h, if any.
+func SpanContextFromHeader(h http.Header) SpanContext {
+	c, _ := ParseTraceparent(h.Get(TraceparentHeader))
+	return c
+}
+
+// SpanContext returns the trace context propagated with the request.
+func (r DBRequest) SpanContext() SpanContext {
+	return SpanContext{TraceID: r.TraceID, SpanID: r.SpanID}
+}
+
+func randomHex(n int) string {
+	b := make([]byte, n)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// Span is one timed operation of a trace. Finished spans are handed to the
+// exporter set with SetSpanExporter.
+type Span struct {
+	Name         string
+	Kind         SpanKind
+	TraceID      string
+	SpanID       string
+	ParentSpanID string
+	Start        time.Time
+	End          time.Time
+	Attributes   map[string]string
+	Error        string
+
+	mu sync.Mutex
+}
+
+// StartSpan begins a span as a child of parent, or as the root of a new
+// trace when parent is not valid.
+func StartSpan(name string, kind SpanKind, parent SpanContext) *Span {
+	s := &Span{
+		Name:       name,
+		Kind:       kind,
+		SpanID:     randomHex(8),
+		Start:      time.Now(),
+		Attributes: make(map[string]string),
+	}
+	if parent.Valid() {
+		s.TraceID = parent.TraceID
+		s.ParentSpanID = parent.SpanID
+	} else {
+		s.TraceID = randomHex(16)
+	}
+	return s
+}
+
+func (s *Span) Context() SpanContext {
+	return SpanContext{TraceID: s.TraceID, SpanID: s.SpanID}
+}
+
+func (s *Span) SetAttribute(key, value string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.Attributes[key] = value
+}
+
+// Finish ends the span, marking it failed if err is not nil, and exports it.
+func (s *Span) Finish(err error) {
+	s.mu.Lock()
+	if !s.End.IsZero() {
+		s.mu.Unlock()
+		return
+	}
+	s.End = time.Now()
+	if err != nil {
+		s.Error = err.Error()
+	}
+	s.mu.Unlock()
+
+	exporterMu.Lock()
+	exporter := spanExporter
+	exporterMu.Unlock()
+	if exporter != nil {
+		exporter.Export(s)
+	}
+}
+
+// FinishResponse finishes the span, marking it failed if err is set or resp
+// reports an error.
+func (s *Span) FinishResponse(resp DBResponse, err error) {
+	if err == nil && resp.Status == "error" {
+		err = errors.New(resp.Message)
+	}
+	s.Finish(err)
+}
+
+// SpanExporter receives finished spans.
+type SpanExporter interface {
+	Export(span *Span)
+}
+
+var (
+	exporterMu   sync.Mutex
+	spanExporter SpanExporter
+)
+
+// SetSpanExporter sets where finished spans are sent. A nil exporter drops
+// them, which is the default.
+func SetSpanExporter(e SpanExporter) {
+	exporterMu.Lock()
+	defer exporterMu.Unlock()
+
+	spanExporter = e
+}
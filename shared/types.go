@@ -1,5 +1,7 @@
 package shared
 
+import "time"
+
 type DBRequest struct {
 	Query     string `json:"query"`
 	Token     string `json:"token"`
@@ -7,6 +9,42 @@ type DBRequest struct {
 	IsSelect  bool   `json:"is_select"`
 	IP        string `json:"ip"`
 	Role      string `json:"role"`
+	Type      string `json:"type,omitempty"`
+	NodeID    string `json:"node_id,omitempty"`
+	HTTPAddr  string `json:"http_addr,omitempty"`
+	ReplAddr  string `json:"repl_addr,omitempty"`
+	Version   string `json:"version,omitempty"`
+	Position  int64  `json:"position,omitempty"`
+	Status    string `json:"status,omitempty"`
+
+	Durability string `json:"durability,omitempty"`
+	MinAcks    int    `json:"min_acks,omitempty"`
+
+	// TraceID and SpanID identify the caller's span so the receiver can
+	// continue the trace.
+	TraceID string `json:"trace_id,omitempty"`
+	SpanID  string `json:"span_id,omitempty"`
+
+	// RequestID names the request's statements so they can be cancelled;
+	// one is generated when it is empty. TimeoutMs overrides the server's
+	// default query timeout.
+	RequestID string `json:"request_id,omitempty"`
+	TimeoutMs int64  `json:"timeout_ms,omitempty"`
+
+	// XID names a distributed transaction, and Statements holds the writes
+	// a participant runs in it.
+	XID        string   `json:"xid,omitempty"`
+	Statements []string `json:"statements,omitempty"`
+
+	// Prefer asks the master to read from itself or from a slave,
+	// overriding its read proxy setting.
+	Prefer string `json:"prefer,omitempty"`
+
+	// Cursor is where a change data capture subscription resumes.
+	Cursor string `json:"cursor,omitempty"`
+
+	// Writes are the writes a slave took while partitioned, in order.
+	Writes []LocalWrite `json:"writes,omitempty"`
 }
 
 type DBResponse struct {
@@ -15,6 +53,70 @@ type DBResponse struct {
 	Role    string          `json:"role,omitempty"`
 	Header  []string        `json:"header,omitempty"`
 	Rows    [][]interface{} `json:"rows,omitempty"`
+
+	Position int64              `json:"position,omitempty"`
+	Entries  []ReplicationEntry `json:"entries,omitempty"`
+	Peers    []SlaveInfo        `json:"peers,omitempty"`
+
+	Durability string `json:"durability,omitempty"`
+	Acks       int    `json:"acks,omitempty"`
+	Degraded   bool   `json:"degraded,omitempty"`
+
+	TraceID   string `json:"trace_id,omitempty"`
+	RequestID string `json:"request_id,omitempty"`
+	// Shard names the shard group that answered a routed statement.
+	Shard string `json:"shard,omitempty"`
+	// Affected counts the rows changed by a prepared transaction branch.
+	Affected int64 `json:"affected,omitempty"`
+	// Replica names the slave that answered a proxied read.
+	Replica string `json:"replica,omitempty"`
+	// Conflicts lists the rows of merged writes that conflicted.
+	Conflicts []Conflict `json:"conflicts,omitempty"`
+	// Sharded names the master's sharded tables in heartbeat responses;
+	// slaves leave reads of them to the master's shard router.
+	Sharded []string `json:"sharded,omitempty"`
+}
+
+type SlaveInfo struct {
+	NodeID        string    `json:"node_id"`
+	Address       string    `json:"address"`
+	HTTPAddr      string    `json:"http_addr,omitempty"`
+	ReplAddr      string    `json:"repl_addr,omitempty"`
+	Version       string    `json:"version,omitempty"`
+	Position      int64     `json:"position"`
+	Received      int64     `json:"received"`
+	PositionAt    time.Time `json:"position_at"`
+	State         string    `json:"state"`
+	NodeStatus    string    `json:"node_status,omitempty"`
+	ConnectedAt   time.Time `json:"connected_at"`
+	LastHeartbeat time.Time `json:"last_heartbeat"`
+}
+
+type ReplicationStatus struct {
+	NodeID     string `json:"node_id"`
+	Role       string `json:"role"`
+	Position   int64  `json:"position"`
+	ReplAddr   string `json:"repl_addr,omitempty"`
+	MasterAddr string `json:"master_addr,omitempty"`
+}
+
+type SlaveLag struct {
+	NodeID         string    `json:"node_id"`
+	State          string    `json:"state"`
+	Position       int64     `json:"position"`
+	MasterPosition int64     `json:"master_position"`
+	LagOps         int64     `json:"lag_ops"`
+	LagSeconds     float64   `json:"lag_seconds"`
+	AckedAt        time.Time `json:"acked_at"`
+	Lagging        bool      `json:"lagging"`
+}
+
+type SlaveEvent struct {
+	NodeID string    `json:"node_id"`
+	From   string    `json:"from"`
+	To     string    `json:"to"`
+	Reason string    `json:"reason"`
+	Time   time.Time `json:"time"`
 }
 
 type TableColumn struct {
@@ -28,13 +130,30 @@ type CreateTableRequest struct {
 	DBName    string        `json:"db_name"`
 	TableName string        `json:"table_name"`
 	Columns   []TableColumn `json:"columns"`
+
+	// ShardKey, if set, shards the table across the shard groups by this
+	// column. ShardStrategy is hash (the default) or range; hash tables have
+	// ShardBuckets buckets and range tables start a new range at each of
+	// ShardSplits.
+	ShardKey      string  `json:"shard_key,omitempty"`
+	ShardStrategy string  `json:"shard_strategy,omitempty"`
+	ShardBuckets  int     `json:"shard_buckets,omitempty"`
+	ShardSplits   []int64 `json:"shard_splits,omitempty"`
+}
+
+// RebalanceRequest moves part of a sharded table to the Target group: on a
+// range table the keys from SplitAt up to the next range, on a hash table
+// the listed Buckets.
+type RebalanceRequest struct {
+	Table   string `json:"table"`
+	Target  string `json:"target"`
+	SplitAt *int64 `json:"split_at,omitempty"`
+	Buckets []int  `json:"buckets,omitempty"`
 }
 
+// ReplicationRequest carries rows to write, each located by its primary key.
 type ReplicationRequest struct {
-	DBName    string `json:"db_name"`
-	TableName string `json:"table_name"`
-	Operation string `json:"operation"` 
-	Data      []byte `json:"data"`      
+	Changes []RowChange `json:"changes"`
 }
 
 type ReplicationResponse struct {
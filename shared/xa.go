@@ -0,0 +1,132 @@
+package shared
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"regexp"
+	"time"
+
+	"github.com/go-sql-driver/mysql"
+)
+
+// errXANotFound is MySQL's XAER_NOTA: no transaction has the given XID.
+const errXANotFound = 1397
+
+var xidPattern = regexp.MustCompile(`^[\w.-]{1,64}$`)
+
+// NewXID names a new distributed transaction.
+func NewXID() string {
+	return "ddb-" + randomHex(12)
+}
+
+func checkXID(xid string) error {
+	if !xidPattern.MatchString(xid) {
+		return fmt.Errorf("invalid transaction id %q", xid)
+	}
+	return nil
+}
+
+// XAWrite is a statement run in an XA transaction, with the rows it
+// changed when they could be captured as ExecCapture does.
+type XAWrite struct {
+	Query    string      `json:"query"`
+	Captured bool        `json:"captured"`
+	Changes  []RowChange `json:"changes,omitempty"`
+}
+
+// XAPrepare runs statements in XA transaction xid and prepares it, after
+// which it survives disconnects and restarts until committed or rolled
+// back. The writes are handed to save between XA END and XA PREPARE, so
+// they are known for every transaction that gets prepared. On failure the
+// transaction is rolled back.
+func (h *DBHandler) XAPrepare(ctx context.Context, xid string, statements []string, save func([]XAWrite) error) (int64, error) {
+	if err := checkXID(xid); err != nil {
+		return 0, err
+	}
+	conn, err := h.db.Conn(ctx)
+	if err != nil {
+		return 0, fmt.Errorf("failed to get connection: %v", err)
+	}
+	defer conn.Close()
+
+	if _, err := conn.ExecContext(ctx, fmt.Sprintf("XA START '%s'", xid)); err != nil {
+		return 0, err
+	}
+	var affected int64
+	writes := make([]XAWrite, len(statements))
+	for i, query := range statements {
+		start := time.Now()
+		var n int64
+		if target, ok := parseCaptureTarget(query); ok {
+			n, writes[i].Changes, writes[i].Captured, err = h.captureWrite(ctx, conn, target, query)
+		} else {
+			n, err = execTx(ctx, conn, query)
+		}
+		ObserveQuery(query, start, err)
+		if err != nil {
+			conn.ExecContext(context.Background(), fmt.Sprintf("XA END '%s'", xid))
+			conn.ExecContext(context.Background(), fmt.Sprintf("XA ROLLBACK '%s'", xid))
+			return 0, err
+		}
+		writes[i].Query = query
+		affected += n
+	}
+	if _, err := conn.ExecContext(ctx, fmt.Sprintf("XA END '%s'", xid)); err != nil {
+		conn.ExecContext(context.Background(), fmt.Sprintf("XA ROLLBACK '%s'", xid))
+		return 0, err
+	}
+	if err := save(writes); err != nil {
+		conn.ExecContext(context.Background(), fmt.Sprintf("XA ROLLBACK '%s'", xid))
+		return 0, err
+	}
+	if _, err := conn.ExecContext(ctx, fmt.Sprintf("XA PREPARE '%s'", xid)); err != nil {
+		conn.ExecContext(context.Background(), fmt.Sprintf("XA ROLLBACK '%s'", xid))
+		return 0, err
+	}
+	return affected, nil
+}
+
+// XACommit commits prepared transaction xid. It reports false if MySQL has
+// no such transaction, which happens when it was already resolved.
+func (h *DBHandler) XACommit(xid string) (bool, error) {
+	return h.xaEnd("XA COMMIT '%s'", xid)
+}
+
+// XARollback rolls back prepared transaction xid, reporting false if there
+// was no such transaction.
+func (h *DBHandler) XARollback(xid string) (bool, error) {
+	return h.xaEnd("XA ROLLBACK '%s'", xid)
+}
+
+func (h *DBHandler) xaEnd(stmt, xid string) (bool, error) {
+	if err := checkXID(xid); err != nil {
+		return false, err
+	}
+	_, err := h.db.Exec(fmt.Sprintf(stmt, xid))
+	var myErr *mysql.MySQLError
+	if errors.As(err, &myErr) && myErr.Number == errXANotFound {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// XARecover lists the XIDs of transactions MySQL holds prepared.
+func (h *DBHandler) XARecover() ([]string, error) {
+	rows, err := h.db.Query("XA RECOVER")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var xids []string
+	for rows.Next() {
+		var formatID, gtridLength, bqualLength int
+		var data string
+		if err := rows.Scan(&formatID, &gtridLength, &bqualLength, &data); err != nil {
+			return nil, err
+		}
+		xids = append(xids, data[:gtridLength])
+	}
+	return xids, rows.Err()
+}
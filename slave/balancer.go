@@ -0,0 +1,173 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"distributed-db/shared"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// readResponseMargin is added to a statement's timeout when waiting for the
+// peer slave running it.
+const readResponseMargin = 2 * time.Second
+
+var (
+	// readPolicy spreads the SELECTs clients send here over this slave and
+	// its peers; empty sends them all to the master.
+	readPolicy string
+	// readMaxLagOps leaves slaves further behind the master out of read
+	// balancing; zero does not check.
+	readMaxLagOps int64
+	readBalancer  *shared.Balancer
+
+	readClient = &http.Client{}
+
+	// shardedTables holds the names of the master's sharded tables, from
+	// its last heartbeat. Only its shard router can read them.
+	shardedMu     sync.Mutex
+	shardedTables = make(map[string]bool)
+)
+
+func setupReadBalancer() error {
+	if readPolicy == "" {
+		return nil
+	}
+	policy, err := shared.ParseBalancePolicy(readPolicy, readMaxLagOps, 0)
+	if err != nil {
+		return err
+	}
+	readBalancer = shared.NewBalancer(policy)
+	return nil
+}
+
+func setShardedTables(names []string) {
+	shardedMu.Lock()
+	defer shardedMu.Unlock()
+
+	shardedTables = make(map[string]bool, len(names))
+	for _, name := range names {
+		shardedTables[name] = true
+	}
+}
+
+// balancesRead reports whether req is read from a slave the balancer picks
+// rather than from the master.
+func balancesRead(req shared.DBRequest) bool {
+	if readBalancer == nil || isPromoted() || req.Prefer == shared.PreferMaster {
+		return false
+	}
+	shardedMu.Lock()
+	defer shardedMu.Unlock()
+
+	for _, ref := range shared.ReferencedTables(req.Query) {
+		if i := strings.LastIndex(ref, "."); i >= 0 {
+			ref = ref[i+1:]
+		}
+		if shardedTables[ref] {
+			return false
+		}
+	}
+	return true
+}
+
+// refreshReadBackends offers the balancer this slave and every connected
+// peer that serves HTTP, with how many entries each trails the master.
+func refreshReadBackends() {
+	master := masterPosition.Load()
+	behind := func(position int64) int64 {
+		if position >= master {
+			return 0
+		}
+		return master - position
+	}
+	backends := []shared.Backend{{ID: nodeID, Addr: advertisedHTTP, LagOps: behind(appliedPosition.Load())}}
+	for _, peer := range peerSnapshot() {
+		if peer.NodeID == nodeID || peer.State != shared.SlaveConnected || peer.HTTPAddr == "" {
+			continue
+		}
+		backends = append(backends, shared.Backend{ID: peer.NodeID, Addr: peer.HTTPAddr, LagOps: behind(peer.Position)})
+	}
+	readBalancer.SetBackends(backends)
+}
+
+// balancedRead runs a SELECT on the slave the read balancer picks, which
+// may be this one. A read no slave could answer goes to the master.
+func balancedRead(parent context.Context, req shared.DBRequest) (shared.DBResponse, error) {
+	refreshReadBackends()
+	backend, done, err := readBalancer.Pick(req.Query)
+	if err != nil {
+		return sendRequestToMaster(req)
+	}
+
+	var resp shared.DBResponse
+	if backend.ID == nodeID {
+		resp = readLocally(parent, req, "balancer")
+	} else {
+		resp, err = forwardRead(parent, backend, req)
+	}
+	done(err)
+	if err != nil {
+		logger.Log(shared.LevelWarn, "PROXY", "Balanced read failed, sending it to the master", map[string]string{
+			"slave": backend.ID,
+			"error": err.Error(),
+		})
+		return sendRequestToMaster(req)
+	}
+	resp.Replica = backend.ID
+	return resp, nil
+}
+
+// forwardRead sends a SELECT to a peer slave, which runs it as a proxied
+// read. The peer's statement ends if parent is cancelled.
+func forwardRead(parent context.Context, backend shared.Backend, req shared.DBRequest) (shared.DBResponse, error) {
+	timeout := req.Timeout(queryTimeout)
+	var ctx context.Context
+	var cancel context.CancelFunc
+	if timeout > 0 {
+		ctx, cancel = context.WithTimeout(parent, timeout+readResponseMargin)
+	} else {
+		ctx, cancel = context.WithCancel(parent)
+	}
+	defer cancel()
+
+	body, err := json.Marshal(shared.DBRequest{
+		Query:     req.Query,
+		Token:     validToken,
+		FromSlave: nodeID,
+		IsSelect:  true,
+		Role:      shared.RoleProxy,
+		RequestID: req.RequestID,
+		TimeoutMs: timeout.Milliseconds(),
+		TraceID:   req.TraceID,
+		SpanID:    req.SpanID,
+	})
+	if err != nil {
+		return shared.DBResponse{}, fmt.Errorf("failed to marshal request: %v", err)
+	}
+	httpReq, err := http.NewRequestWithContext(ctx, http.MethodPost, "http://"+backend.Addr+"/api/query", bytes.NewReader(body))
+	if err != nil {
+		return shared.DBResponse{}, err
+	}
+	httpReq.Header.Set("Content-Type", "application/json")
+
+	httpResp, err := readClient.Do(httpReq)
+	if err != nil {
+		return shared.DBResponse{}, err
+	}
+	defer httpResp.Body.Close()
+	if httpResp.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(io.LimitReader(httpResp.Body, 1024))
+		return shared.DBResponse{}, fmt.Errorf("slave %s returned %s: %s", backend.ID, httpResp.Status, strings.TrimSpace(string(msg)))
+	}
+	var resp shared.DBResponse
+	if err := json.NewDecoder(httpResp.Body).Decode(&resp); err != nil {
+		return shared.DBResponse{}, fmt.Errorf("invalid response from slave %s: %v", backend.ID, err)
+	}
+	return resp, nil
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"distributed-db/shared"
+	"net/http"
+	"time"
+)
+
+var (
+	// cacheConfig limits the result cache; a MaxEntries of zero turns it off.
+	cacheConfig = shared.ResultCacheConfig{MaxEntries: 1000, MaxBytes: 64 << 20, TTL: 30 * time.Second}
+	resultCache *shared.ResultCache
+
+	cacheLookups = shared.DefaultMetrics.Counter("ddb_result_cache_lookups_total",
+		"Result cache lookups by outcome.", "result")
+)
+
+func setupResultCache() {
+	if cacheConfig.MaxEntries > 0 {
+		resultCache = shared.NewResultCache(cacheConfig)
+	}
+}
+
+// cachedSelect answers a SELECT from the result cache, calling run on a miss
+// and caching what it returns.
+func cachedSelect(query string, run func() (shared.DBResponse, error)) (shared.DBResponse, error) {
+	if resultCache == nil || !shared.Cacheable(query) {
+		return run()
+	}
+	header, rows, seq, ok := resultCache.Lookup(query)
+	if ok {
+		cacheLookups.Inc("hit")
+		return shared.DBResponse{Status: "ok", Message: "Select executed (cached)", Header: header, Rows: rows}, nil
+	}
+	cacheLookups.Inc("miss")
+	resp, err := run()
+	if err == nil && resp.Status == "ok" {
+		resultCache.Store(query, seq, resp.Header, resp.Rows)
+	}
+	return resp, err
+}
+
+// invalidateCache drops the cached results a write may have changed. It is
+// called once the write has run, whether it succeeded or not.
+func invalidateCache(query string) {
+	if resultCache != nil {
+		resultCache.Invalidate(query)
+	}
+}
+
+func invalidateCacheTables(tables ...string) {
+	if resultCache != nil {
+		resultCache.InvalidateTables(tables...)
+	}
+}
+
+// handleCache serves GET /api/cache with the result cache's hit and miss
+// counts, and DELETE to empty it.
+func handleCache(w http.ResponseWriter, r *http.Request) {
+	if resultCache == nil {
+		http.Error(w, "Result cache is disabled", http.StatusNotFound)
+		return
+	}
+	shared.ResultCacheHandler(resultCache)(w, r)
+}
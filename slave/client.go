@@ -3,28 +3,34 @@ package main
 import (
 	"bufio"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"net"
 	"net/http"
 	"os"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"distributed-db/shared"
-	"log"
 )
 
-const (
-	masterHost        = "localhost"
-	masterPort        = "8083"
-	validToken        = "secret-token"
-	heartbeatInterval = 30 * time.Second
-)
+const validToken = "secret-token"
 
 var (
 	masterConn net.Conn
 	connMutex  sync.Mutex
+	// masterConnected mirrors whether masterConn is registered, for probes
+	// and metrics that must not wait on connMutex, which a forwarded query
+	// holds until the master answers.
+	masterConnected atomic.Bool
+	nodeID          string
+	advertisedHTTP  string
+	appliedPosition atomic.Int64
+	// masterPosition is the master's log position as of the last heartbeat.
+	masterPosition atomic.Int64
 )
 
 func isMasterQuery(query string) bool {
@@ -35,20 +41,20 @@ func isMasterQuery(query string) bool {
 func getLocalIP() string {
 	addrs, err := net.InterfaceAddrs()
 	if err != nil {
-		log.Printf("Error getting interface addresses: %v", err)
+		logger.Log(shared.LevelWarn, "SYSTEM", "Failed to list interface addresses", map[string]string{"error": err.Error()})
 		return "unknown"
 	}
 	for _, addr := range addrs {
 		if ipnet, ok := addr.(*net.IPNet); ok && !ipnet.IP.IsLoopback() && ipnet.IP.To4() != nil {
 			ip := ipnet.IP.String()
-			log.Printf("Found local IP address: %s", ip)
+			logger.Log(shared.LevelDebug, "SYSTEM", "Found local IP address", map[string]string{"ip": ip})
 			return ip
 		}
 	}
-	log.Printf("No suitable IP address found, using hostname")
+	logger.Log(shared.LevelDebug, "SYSTEM", "No suitable IP address found, using hostname", nil)
 	hostname, err := os.Hostname()
 	if err != nil {
-		log.Printf("Error getting hostname: %v", err)
+		logger.Log(shared.LevelWarn, "SYSTEM", "Failed to get hostname", map[string]string{"error": err.Error()})
 		return "unknown"
 	}
 	return hostname
@@ -59,78 +65,147 @@ func establishMasterConnection() error {
 	defer connMutex.Unlock()
 
 	if masterConn != nil {
-		req := shared.DBRequest{
-			Query:     "SELECT 1",
-			Token:     validToken,
-			FromSlave: getLocalIP(),
-			IsSelect:  true,
-		}
-		reqData, err := json.Marshal(req)
-		if err == nil {
-			reqData = append(reqData, '\n')
-			if _, err := masterConn.Write(reqData); err == nil {
-				scanner := bufio.NewScanner(masterConn)
-				if scanner.Scan() {
-					var resp shared.DBResponse
-					if err := json.Unmarshal([]byte(scanner.Text()), &resp); err == nil && resp.Status == "ok" {
-						return nil
-					}
-				}
-			}
-		}
-		if masterConn != nil {
-			masterConn.Close()
-			masterConn = nil
+		if masterConnAlive() {
+			return nil
 		}
+		logger.Log(shared.LevelWarn, "MASTER", "Connection to master was closed, reconnecting", nil)
+		closeMasterConn()
 	}
 
 	var err error
-	masterConn, err = net.Dial("tcp", masterHost+":"+masterPort)
+	masterConn, err = net.Dial("tcp", currentMasterAddr())
 	if err != nil {
 		return fmt.Errorf("failed to connect to master server: %v", err)
 	}
 
+	shared.TCPConnections.Add(1)
 	if tcpConn, ok := masterConn.(*net.TCPConn); ok {
 		tcpConn.SetKeepAlive(true)
 		tcpConn.SetKeepAlivePeriod(30 * time.Second)
 		tcpConn.SetNoDelay(true)
 	}
 
+	if err := registerWithMaster(); err != nil {
+		closeMasterConn()
+		return err
+	}
+
+	masterConnected.Store(true)
+	logger.Log(shared.LevelInfo, "MASTER", "Established persistent connection to master server", map[string]string{
+		"master": currentMasterAddr(),
+		"ip":     getLocalIP(),
+	})
+	return nil
+}
+
+// masterConnAlive reports whether the idle control connection can still be
+// used. The master only ever answers requests, so anything but a read
+// timeout, whether data, EOF or a reset, means it cannot. The caller must
+// hold connMutex.
+func masterConnAlive() bool {
+	masterConn.SetReadDeadline(time.Now().Add(time.Millisecond))
+	defer masterConn.SetReadDeadline(time.Time{})
+
+	var b [1]byte
+	_, err := masterConn.Read(b[:])
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
+
+// closeMasterConn drops the control connection. The caller must hold
+// connMutex.
+func closeMasterConn() {
+	if masterConn == nil {
+		return
+	}
+	masterConn.Close()
+	masterConn = nil
+	masterConnected.Store(false)
+	shared.TCPConnections.Add(-1)
+}
+
+// registerWithMaster announces this slave's node ID and metadata on a fresh
+// connection. The caller must hold connMutex.
+func registerWithMaster() error {
 	req := shared.DBRequest{
-		Query:     "SELECT 1",
+		Type:      shared.MsgRegister,
 		Token:     validToken,
 		FromSlave: getLocalIP(),
-		IsSelect:  true,
+		NodeID:    nodeID,
+		HTTPAddr:  advertisedHTTP,
+		ReplAddr:  advertisedRepl,
+		Version:   shared.Version,
+		Position:  appliedPosition.Load(),
 	}
 	reqData, err := json.Marshal(req)
 	if err != nil {
-		masterConn.Close()
-		masterConn = nil
-		return fmt.Errorf("failed to marshal initial request: %v", err)
+		return fmt.Errorf("failed to marshal registration: %v", err)
 	}
 	reqData = append(reqData, '\n')
 	if _, err := masterConn.Write(reqData); err != nil {
-		masterConn.Close()
-		masterConn = nil
-		return fmt.Errorf("failed to send initial request: %v", err)
+		return fmt.Errorf("failed to send registration: %v", err)
+	}
+
+	scanner := bufio.NewScanner(masterConn)
+	if !scanner.Scan() {
+		return fmt.Errorf("failed to read registration response: %v", scanner.Err())
+	}
+	var resp shared.DBResponse
+	if err := json.Unmarshal(scanner.Bytes(), &resp); err != nil {
+		return fmt.Errorf("invalid registration response: %v", err)
+	}
+	if resp.Status != "ok" {
+		return fmt.Errorf("registration rejected: %s", resp.Message)
 	}
+	return nil
+}
 
-	go func() {
-		ticker := time.NewTicker(heartbeatInterval)
-		defer ticker.Stop()
+// heartbeatLoop keeps the master informed of this slave's status and
+// replication position, reconnecting whenever a heartbeat fails.
+func heartbeatLoop() {
+	ticker := time.NewTicker(shared.HeartbeatInterval)
+	defer ticker.Stop()
 
-		for range ticker.C {
-			if err := sendHeartbeat(); err != nil {
-				log.Printf("Heartbeat failed: %v", err)
-				if err := establishMasterConnection(); err != nil {
-					log.Printf("Failed to reconnect to master: %v", err)
-				}
+	failures := 0
+	for range ticker.C {
+		if shuttingDown() {
+			return
+		}
+		if isPromoted() {
+			continue
+		}
+		if err := sendHeartbeat(); err != nil {
+			heartbeatFailures.Inc()
+			failures++
+			if errors.Is(err, errMasterShutdown) {
+				// The master said it is leaving, so there is no point
+				// waiting for more heartbeats to fail.
+				failures = failoverAfter
+			}
+			logger.Log(shared.LevelWarn, "MASTER", "Heartbeat failed", map[string]interface{}{
+				"failures":       failures,
+				"failover_after": failoverAfter,
+				"error":          err.Error(),
+			})
+			if failures >= failoverAfter && raftNode == nil {
+				runFailover()
+				failures = 0
+				continue
 			}
+			if err := establishMasterConnection(); err != nil {
+				logger.Log(shared.LevelWarn, "MASTER", "Failed to reconnect to master", map[string]string{"error": err.Error()})
+			}
+			continue
 		}
-	}()
+		failures = 0
+	}
+}
 
-	log.Printf("Established persistent connection to master server from %s", getLocalIP())
-	return nil
+func nodeStatus() string {
+	if err := dbHandler.Ping(); err != nil {
+		return shared.NodeDBUnavailable
+	}
+	return shared.NodeOK
 }
 
 func sendHeartbeat() error {
@@ -142,10 +217,12 @@ func sendHeartbeat() error {
 	}
 
 	req := shared.DBRequest{
-		Query:     "SELECT 1",
+		Type:      shared.MsgHeartbeat,
 		Token:     validToken,
 		FromSlave: getLocalIP(),
-		IsSelect:  true,
+		NodeID:    nodeID,
+		Status:    nodeStatus(),
+		Position:  appliedPosition.Load(),
 	}
 
 	reqData, err := json.Marshal(req)
@@ -153,39 +230,86 @@ func sendHeartbeat() error {
 		return fmt.Errorf("failed to marshal heartbeat request: %v", err)
 	}
 
+	masterConn.SetDeadline(time.Now().Add(shared.HeartbeatInterval))
+	defer func() {
+		if masterConn != nil {
+			masterConn.SetDeadline(time.Time{})
+		}
+	}()
+
 	reqData = append(reqData, '\n')
 	if _, err := masterConn.Write(reqData); err != nil {
-		masterConn.Close()
-		masterConn = nil
+		closeMasterConn()
 		return fmt.Errorf("failed to send heartbeat: %v", err)
 	}
 
 	scanner := bufio.NewScanner(masterConn)
 	if !scanner.Scan() {
-		masterConn.Close()
-		masterConn = nil
+		closeMasterConn()
 		return fmt.Errorf("failed to read heartbeat response: %v", scanner.Err())
 	}
 
 	response := scanner.Text()
 	var resp shared.DBResponse
 	if err := json.Unmarshal([]byte(response), &resp); err != nil {
-		masterConn.Close()
-		masterConn = nil
+		closeMasterConn()
 		return fmt.Errorf("invalid heartbeat response: %v", err)
 	}
 
+	if resp.Status == shared.StatusShuttingDown {
+		closeMasterConn()
+		return errMasterShutdown
+	}
 	if resp.Status != "ok" {
-		masterConn.Close()
-		masterConn = nil
+		closeMasterConn()
 		return fmt.Errorf("heartbeat failed: %s", resp.Message)
 	}
 
-	log.Printf("Heartbeat successful from slave %s", getLocalIP())
+	masterPosition.Store(resp.Position)
+	setKnownPeers(resp.Peers)
+	setShardedTables(resp.Sharded)
 	return nil
 }
 
 func sendQueryToMaster(query string) (shared.DBResponse, error) {
+	return sendRequestToMaster(shared.DBRequest{Query: query})
+}
+
+// sendRequestToMaster forwards a client request to the master, keeping
+// per-request options such as the durability mode and timeout.
+func sendRequestToMaster(clientReq shared.DBRequest) (shared.DBResponse, error) {
+	if clientReq.RequestID == "" {
+		clientReq.RequestID = shared.NewRequestID()
+	}
+	clientReq.TimeoutMs = clientReq.Timeout(queryTimeout).Milliseconds()
+
+	span := shared.StartSpan("slave.forward", shared.SpanClient, clientReq.SpanContext())
+	span.SetAttribute("db.statement", clientReq.Query)
+	span.SetAttribute("peer.address", currentMasterAddr())
+	clientReq.TraceID, clientReq.SpanID = span.TraceID, span.SpanID
+
+	resp, err := forwardToMaster(clientReq)
+	span.FinishResponse(resp, err)
+	if resp.TraceID == "" {
+		resp.TraceID = span.TraceID
+	}
+	if resp.RequestID == "" {
+		resp.RequestID = clientReq.RequestID
+	}
+	status := resp.Status
+	if err != nil {
+		status = "error"
+	}
+	forwardedQueries.Inc(shared.StatementKind(clientReq.Query), status)
+	return resp, err
+}
+
+func forwardToMaster(clientReq shared.DBRequest) (shared.DBResponse, error) {
+	query := clientReq.Query
+	if isPromoted() {
+		return executeLocalQuery(clientReq), nil
+	}
+
 	if isMasterQuery(query) {
 		return shared.DBResponse{
 			Status:  "error",
@@ -197,7 +321,7 @@ func sendQueryToMaster(query string) (shared.DBResponse, error) {
 		return shared.DBResponse{
 			Status:  "error",
 			Message: fmt.Sprintf("Failed to connect to master server: %v", err),
-		}, err
+		}, fmt.Errorf("%w: %v", errMasterUnreachable, err)
 	}
 
 	connMutex.Lock()
@@ -207,14 +331,20 @@ func sendQueryToMaster(query string) (shared.DBResponse, error) {
 		return shared.DBResponse{
 			Status:  "error",
 			Message: "No connection to master server",
-		}, fmt.Errorf("no connection to master")
+		}, fmt.Errorf("%w: no connection to master", errMasterUnreachable)
 	}
 
 	req := shared.DBRequest{
-		Query:     query,
-		Token:     validToken,
-		FromSlave: getLocalIP(),
-		IsSelect:  strings.HasPrefix(strings.ToUpper(strings.TrimSpace(query)), "SELECT"),
+		Query:      query,
+		Token:      validToken,
+		FromSlave:  getLocalIP(),
+		IsSelect:   strings.HasPrefix(strings.ToUpper(strings.TrimSpace(query)), "SELECT"),
+		Durability: clientReq.Durability,
+		MinAcks:    clientReq.MinAcks,
+		TraceID:    clientReq.TraceID,
+		SpanID:     clientReq.SpanID,
+		RequestID:  clientReq.RequestID,
+		TimeoutMs:  clientReq.TimeoutMs,
 	}
 
 	reqData, err := json.Marshal(req)
@@ -225,43 +355,63 @@ func sendQueryToMaster(query string) (shared.DBResponse, error) {
 		}, err
 	}
 
-	log.Printf("Sending request to master: %s", string(reqData))
+	logger.LogSpan(clientReq.SpanContext(), shared.LevelDebug, "QUERY", "Sending request to master", map[string]string{
+		"request": string(reqData),
+	})
+	masterConn.SetReadDeadline(responseDeadline(clientReq.Timeout(queryTimeout)))
+	defer func() {
+		if masterConn != nil {
+			masterConn.SetReadDeadline(time.Time{})
+		}
+	}()
+
 	reqData = append(reqData, '\n')
 	if _, err := masterConn.Write(reqData); err != nil {
-		masterConn.Close()
-		masterConn = nil
+		closeMasterConn()
 		return shared.DBResponse{
 			Status:  "error",
 			Message: fmt.Sprintf("Failed to send request: %v", err),
-		}, err
+		}, fmt.Errorf("%w: failed to send request: %v", errMasterUnreachable, err)
 	}
 
 	scanner := bufio.NewScanner(masterConn)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
 	if !scanner.Scan() {
-		masterConn.Close()
-		masterConn = nil
+		closeMasterConn()
+		err := scanner.Err()
+		if err == nil {
+			err = io.EOF
+		}
 		return shared.DBResponse{
 			Status:  "error",
 			Message: "Failed to read response from master server",
-		}, scanner.Err()
+		}, fmt.Errorf("%w: failed to read response: %v", errMasterUnreachable, err)
 	}
 
 	response := scanner.Text()
-	log.Printf("Received response from master: %s", response)
+	logger.LogSpan(clientReq.SpanContext(), shared.LevelDebug, "QUERY", "Received response from master", map[string]string{
+		"response": response,
+	})
 
 	var resp shared.DBResponse
 	if err := json.Unmarshal([]byte(response), &resp); err != nil {
+		// The connection is out of step with the master's responses.
+		closeMasterConn()
 		return shared.DBResponse{
 			Status:  "error",
 			Message: fmt.Sprintf("Invalid response from master server: %v", err),
 		}, nil
 	}
+	if resp.Status == shared.StatusShuttingDown {
+		closeMasterConn()
+		return shared.DBResponse{Status: "error", Message: resp.Message}, errMasterShutdown
+	}
 
 	return resp, nil
 }
 
 func replicateData(req *shared.ReplicationRequest) error {
-	conn, err := net.Dial("tcp", masterHost+":"+masterPort)
+	conn, err := net.Dial("tcp", currentMasterAddr())
 	if err != nil {
 		return fmt.Errorf("failed to connect to master server: %v", err)
 	}
@@ -0,0 +1,409 @@
+package main
+
+import (
+	"bufio"
+	"distributed-db/shared"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// failoverAfter is the number of consecutive failed heartbeats after which a
+// slave considers the master lost and starts an election.
+const failoverAfter = 3
+
+var (
+	masterAddr     string
+	masterAddrMu   sync.Mutex
+	advertisedRepl string
+	replPort       string
+	promoted       atomic.Bool
+	promotedLn     net.Listener
+
+	peersMu    sync.Mutex
+	knownPeers []shared.SlaveInfo
+
+	// followers is only populated once this node has been promoted.
+	followers    = make(map[string]shared.SlaveInfo)
+	localMu      sync.Mutex
+	localWriteMu sync.Mutex
+)
+
+func isPromoted() bool {
+	return promoted.Load()
+}
+
+func currentMasterAddr() string {
+	masterAddrMu.Lock()
+	defer masterAddrMu.Unlock()
+
+	return masterAddr
+}
+
+func setKnownPeers(peers []shared.SlaveInfo) {
+	peersMu.Lock()
+	defer peersMu.Unlock()
+
+	knownPeers = peers
+}
+
+func peerSnapshot() []shared.SlaveInfo {
+	peersMu.Lock()
+	defer peersMu.Unlock()
+
+	return append([]shared.SlaveInfo(nil), knownPeers...)
+}
+
+// repointTo switches this slave to a new master. The open control
+// connection is dropped so the next request dials the new address, and the
+// replication loop notices the change on its next fetch.
+func repointTo(addr string) {
+	masterAddrMu.Lock()
+	masterAddr = addr
+	masterAddrMu.Unlock()
+
+	connMutex.Lock()
+	closeMasterConn()
+	connMutex.Unlock()
+
+	logger.Log(shared.LevelInfo, "FAILOVER", "Repointed to new master", map[string]string{"master": addr})
+}
+
+func fetchPeerStatus(httpAddr string) (shared.ReplicationStatus, error) {
+	client := http.Client{Timeout: 2 * time.Second}
+	resp, err := client.Get("http://" + httpAddr + "/api/replication/status")
+	if err != nil {
+		return shared.ReplicationStatus{}, err
+	}
+	defer resp.Body.Close()
+
+	var status shared.ReplicationStatus
+	if err := json.NewDecoder(resp.Body).Decode(&status); err != nil {
+		return shared.ReplicationStatus{}, fmt.Errorf("invalid status from %s: %v", httpAddr, err)
+	}
+	return status, nil
+}
+
+// runFailover elects a new master among the reachable replicas. If a peer has
+// already been promoted it is followed; otherwise the replica with the
+// highest applied position wins, ties going to the lowest node ID so every
+// slave reaches the same decision. The election only goes ahead when a
+// majority of the slaves the master last reported can see each other, so
+// the two sides of a partition never both promote.
+func runFailover() {
+	if isPromoted() {
+		return
+	}
+	logger.Log(shared.LevelWarn, "FAILOVER", "Master lost, starting failover", map[string]string{"master": currentMasterAddr()})
+
+	peers := peerSnapshot()
+	voters := map[string]bool{nodeID: true}
+	for _, peer := range peers {
+		if peer.State != shared.SlaveDead && peer.State != shared.SlaveDisconnected {
+			voters[peer.NodeID] = true
+		}
+	}
+
+	candidates := []shared.ReplicationStatus{{
+		NodeID:   nodeID,
+		Role:     "slave",
+		Position: appliedPosition.Load(),
+		ReplAddr: advertisedRepl,
+	}}
+	for _, peer := range peers {
+		if peer.NodeID == nodeID || peer.HTTPAddr == "" {
+			continue
+		}
+		status, err := fetchPeerStatus(peer.HTTPAddr)
+		if err != nil {
+			logger.Log(shared.LevelWarn, "FAILOVER", "Peer unreachable during failover", map[string]string{
+				"peer":  peer.NodeID,
+				"error": err.Error(),
+			})
+			continue
+		}
+		if status.Role == "master" {
+			repointTo(status.ReplAddr)
+			return
+		}
+		candidates = append(candidates, status)
+	}
+
+	reachable := 0
+	for _, c := range candidates {
+		if voters[c.NodeID] {
+			reachable++
+		}
+	}
+	if quorum := len(voters)/2 + 1; reachable < quorum {
+		logger.Log(shared.LevelWarn, "FAILOVER", "Too few known slaves reached for failover, waiting", map[string]int{
+			"quorum":    quorum,
+			"voters":    len(voters),
+			"reachable": reachable,
+		})
+		return
+	}
+
+	sort.Slice(candidates, func(i, j int) bool {
+		if candidates[i].Position != candidates[j].Position {
+			return candidates[i].Position > candidates[j].Position
+		}
+		return candidates[i].NodeID < candidates[j].NodeID
+	})
+	winner := candidates[0]
+	logger.Log(shared.LevelInfo, "FAILOVER", "Failover elected a new master", map[string]interface{}{
+		"winner":     winner.NodeID,
+		"position":   winner.Position,
+		"candidates": len(candidates),
+	})
+
+	if winner.NodeID != nodeID {
+		repointTo(winner.ReplAddr)
+		return
+	}
+	if err := promote(); err != nil {
+		logger.Log(shared.LevelError, "FAILOVER", "Promotion failed", map[string]string{"error": err.Error()})
+	}
+}
+
+// promote turns this slave into the master: it starts accepting slave
+// connections on the replication port and executes writes locally.
+func promote() error {
+	listener, err := net.Listen("tcp", ":"+replPort)
+	if err != nil {
+		return fmt.Errorf("failed to listen on replication port: %v", err)
+	}
+	promoted.Store(true)
+	promotedLn = listener
+	logPendingWrites()
+
+	connMutex.Lock()
+	closeMasterConn()
+	connMutex.Unlock()
+
+	logger.Log(shared.LevelInfo, "FAILOVER", "Promoted to master", map[string]interface{}{
+		"position":    appliedPosition.Load(),
+		"replication": advertisedRepl,
+	})
+
+	go func() {
+		defer listener.Close()
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				if errors.Is(err, net.ErrClosed) {
+					return
+				}
+				logger.Log(shared.LevelError, "REPLICATION", "Failed to accept connection", map[string]string{"error": err.Error()})
+				continue
+			}
+			go handleFollower(conn)
+		}
+	}()
+	return nil
+}
+
+// demote stops serving as master after another node has taken over.
+func demote() {
+	if !promoted.CompareAndSwap(true, false) {
+		return
+	}
+	if promotedLn != nil {
+		promotedLn.Close()
+		promotedLn = nil
+	}
+	logger.Log(shared.LevelInfo, "FAILOVER", "Stepped down as master", nil)
+}
+
+func handleFollower(conn net.Conn) {
+	shared.TCPConnections.Add(1)
+	defer func() {
+		shared.TCPConnections.Add(-1)
+		conn.Close()
+	}()
+
+	scanner := bufio.NewScanner(conn)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for scanner.Scan() {
+		if !drain.Enter() {
+			writeResponse(conn, shared.DBResponse{Status: shared.StatusShuttingDown, Message: "Master is shutting down"})
+			return
+		}
+		handleFollowerRequest(conn, scanner.Bytes())
+		drain.Leave()
+	}
+}
+
+func handleFollowerRequest(conn net.Conn, line []byte) {
+	var req shared.DBRequest
+	if err := json.Unmarshal(line, &req); err != nil {
+		writeResponse(conn, shared.DBResponse{Status: "error", Message: fmt.Sprintf("Invalid request format: %v", err)})
+		return
+	}
+	if req.Token != validToken {
+		writeResponse(conn, shared.DBResponse{Status: "error", Message: "Invalid token"})
+		return
+	}
+
+	switch req.Type {
+	case shared.MsgRegister, shared.MsgHeartbeat:
+		trackFollower(req, conn.RemoteAddr().String())
+		writeResponse(conn, shared.DBResponse{
+			Status:   "ok",
+			Message:  "alive",
+			Role:     "slave",
+			Position: relayLog.LastPosition(),
+			Peers:    followerSnapshot(),
+		})
+	case shared.MsgFetch:
+		writeResponse(conn, serveFetch(req))
+	case shared.MsgAttach:
+		writeResponse(conn, shared.DBResponse{Status: "ok", Message: "Attached"})
+	case shared.MsgAck:
+		writeResponse(conn, shared.DBResponse{Status: "ok", Message: "ack"})
+	case shared.MsgCancel:
+		writeResponse(conn, handleCancel(req))
+	case shared.MsgQuery:
+		// Connections opened while this node led outlive a demotion; it
+		// then still answers reads but leaves writes to the new master.
+		if shared.StatementKind(req.Query) != "SELECT" && !isPromoted() {
+			writeResponse(conn, shared.DBResponse{
+				Status:    "error",
+				Message:   fmt.Sprintf("This node is no longer the master; send writes to %s", currentMasterAddr()),
+				RequestID: req.RequestID,
+			})
+			return
+		}
+		writeResponse(conn, executeLocalQuery(req))
+	default:
+		writeResponse(conn, shared.DBResponse{
+			Status:    "error",
+			Message:   fmt.Sprintf("Unsupported request type %q", req.Type),
+			RequestID: req.RequestID,
+		})
+	}
+}
+
+func trackFollower(req shared.DBRequest, addr string) {
+	localMu.Lock()
+	defer localMu.Unlock()
+
+	info, ok := followers[req.NodeID]
+	if !ok {
+		info = shared.SlaveInfo{NodeID: req.NodeID, ConnectedAt: time.Now()}
+	}
+	info.Address = addr
+	info.State = shared.SlaveConnected
+	info.Position = req.Position
+	info.LastHeartbeat = time.Now()
+	if req.HTTPAddr != "" {
+		info.HTTPAddr = req.HTTPAddr
+	}
+	if req.ReplAddr != "" {
+		info.ReplAddr = req.ReplAddr
+	}
+	if req.Version != "" {
+		info.Version = req.Version
+	}
+	if req.Status != "" {
+		info.NodeStatus = req.Status
+	}
+	followers[req.NodeID] = info
+}
+
+func followerSnapshot() []shared.SlaveInfo {
+	localMu.Lock()
+	defer localMu.Unlock()
+
+	list := make([]shared.SlaveInfo, 0, len(followers))
+	for _, info := range followers {
+		list = append(list, info)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].NodeID < list[j].NodeID })
+	return list
+}
+
+func serveFetch(req shared.DBRequest) shared.DBResponse {
+	changed := relayLog.Changed()
+	entries := relayLog.Since(req.Position, 500)
+	if len(entries) == 0 {
+		select {
+		case <-changed:
+			entries = relayLog.Since(req.Position, 500)
+		case <-time.After(shared.FetchWait):
+		}
+	}
+	return shared.DBResponse{
+		Status:   "ok",
+		Message:  fmt.Sprintf("%d entries", len(entries)),
+		Position: relayLog.LastPosition(),
+		Entries:  entries,
+	}
+}
+
+// executeLocalQuery runs a query against the local database once this node is
+// the master. Writes are appended to the relay log so followers replicate them.
+func executeLocalQuery(req shared.DBRequest) shared.DBResponse {
+	query := req.Query
+	if req.RequestID == "" {
+		req.RequestID = shared.NewRequestID()
+	}
+	ctx, cancel := req.QueryContext(queryTimeout)
+	defer cancel()
+
+	if strings.HasPrefix(strings.ToUpper(strings.TrimSpace(query)), "SELECT") {
+		cols, rows, err := selectProfiled(ctx, "local", query)
+		if err != nil {
+			return shared.DBResponse{Status: "error", Message: err.Error(), RequestID: req.RequestID}
+		}
+		return shared.DBResponse{Status: "ok", Message: "Select executed", Header: cols, Rows: rows, RequestID: req.RequestID}
+	}
+
+	// A write the relay log is still missing would reach neither this
+	// node's slaves nor its change streams, so writes wait until it is in.
+	if err := relayLog.Flush(); err != nil {
+		return shared.DBResponse{Status: "error", Message: fmt.Sprintf("writes are suspended: %v", err), RequestID: req.RequestID}
+	}
+	if raftNode != nil {
+		return proposeWrite(ctx, query)
+	}
+
+	localWriteMu.Lock()
+	defer localWriteMu.Unlock()
+
+	affected, changes, captured, err := captureProfiled(ctx, "local", query)
+	if err != nil {
+		return shared.DBResponse{Status: "error", Message: err.Error(), RequestID: req.RequestID}
+	}
+	entry, err := relayLog.AppendChanges(query, changes, captured)
+	if err != nil {
+		logger.Log(shared.LevelError, "REPLICATION", "Failed to append to replication log", map[string]string{"error": err.Error()})
+		return shared.DBResponse{
+			Status:    "error",
+			Message:   fmt.Sprintf("write committed but is not in the replication log yet: %v", err),
+			RequestID: req.RequestID,
+		}
+	}
+	appliedPosition.Store(entry.Position)
+	return shared.DBResponse{
+		Status:    "ok",
+		Message:   fmt.Sprintf("Query executed successfully. Rows affected: %d", affected),
+		RequestID: req.RequestID,
+	}
+}
+
+func writeResponse(conn net.Conn, resp shared.DBResponse) error {
+	respData, err := json.Marshal(resp)
+	if err != nil {
+		return err
+	}
+	_, err = conn.Write(append(respData, '\n'))
+	return err
+}
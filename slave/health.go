@@ -0,0 +1,43 @@
+package main
+
+import (
+	"distributed-db/shared"
+	"fmt"
+)
+
+// readyMaxLag is how many entries a slave may trail the master and still
+// report ready.
+var readyMaxLag int64 = 1000
+
+func readinessChecks() []shared.HealthCheck {
+	checks := []shared.HealthCheck{
+		shared.ShutdownCheck(&drain),
+		{Name: "mysql", Check: dbHandler.Ping},
+		{Name: "replication_log", Check: relayLog.Flush},
+	}
+	if raftNode != nil {
+		checks = append(checks, shared.RaftLeaderCheck(raftNode))
+	}
+	if isPromoted() {
+		return checks
+	}
+	return append(checks,
+		shared.HealthCheck{Name: "master_connection", Check: checkMasterConnection},
+		shared.HealthCheck{Name: "replication_lag", Check: checkReplicationLag},
+	)
+}
+
+func checkMasterConnection() error {
+	if !masterConnected.Load() {
+		return fmt.Errorf("not connected to master %s", currentMasterAddr())
+	}
+	return nil
+}
+
+func checkReplicationLag() error {
+	lag := masterPosition.Load() - appliedPosition.Load()
+	if readyMaxLag > 0 && lag > readyMaxLag {
+		return fmt.Errorf("%d entries behind the master, budget is %d", lag, readyMaxLag)
+	}
+	return nil
+}
@@ -2,17 +2,28 @@ package main
 
 import (
 	"bufio"
+	"context"
 	"distributed-db/shared"
 	"encoding/json"
+	"errors"
+	"flag"
 	"fmt"
 	"log"
 	"net/http"
 	"os"
+	"os/signal"
 	"strings"
+	"syscall"
 	"time"
 )
 
-var dbHandler *shared.DBHandler
+var (
+	dbHandler  *shared.DBHandler
+	logger     *shared.Logger
+	logOptions = shared.DefaultLogOptions()
+)
+
+const logPath = "slave_log.txt"
 
 func corsMiddleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
@@ -30,47 +41,140 @@ func corsMiddleware(next http.Handler) http.Handler {
 }
 
 func main() {
-	logFile, err := os.OpenFile("slave_log.txt", os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	idFile := flag.String("id-file", "node_id.txt", "file holding this slave's persistent node ID")
+	httpPort := flag.String("http-port", "8084", "port for the slave web interface")
+	flag.StringVar(&masterAddr, "master", "localhost:8083", "address of the master's TCP port")
+	flag.StringVar(&replPort, "repl-port", "8085", "port this slave serves replication on if promoted")
+	relayPath := flag.String("relay-log", "relay_log.jsonl", "file holding replicated entries applied by this slave")
+	raftID := flag.String("raft-id", "", "this node's ID in the raft group (defaults to the node ID)")
+	raftPeers := flag.String("raft-peers", "", "comma separated id=host:port HTTP addresses of all raft members, including this node; empty disables raft")
+	raftDir := flag.String("raft-dir", "raft", "directory for persisted raft state")
+	flag.DurationVar(&slowQueryThreshold, "slow-query-threshold", slowQueryThreshold, "log statements slower than this to the slow query log (0 disables)")
+	flag.DurationVar(&shutdownTimeout, "shutdown-timeout", shutdownTimeout, "how long to drain requests on SIGINT/SIGTERM or exit")
+	flag.DurationVar(&queryTimeout, "query-timeout", queryTimeout, "default limit on a query's run time; requests may set timeout_ms (0 disables)")
+	flag.IntVar(&cacheConfig.MaxEntries, "cache-entries", cacheConfig.MaxEntries, "most SELECT results to keep in the result cache (0 disables it)")
+	flag.Int64Var(&cacheConfig.MaxBytes, "cache-max-bytes", cacheConfig.MaxBytes, "approximate memory limit of the result cache in bytes (0 disables the limit)")
+	flag.DurationVar(&cacheConfig.TTL, "cache-ttl", cacheConfig.TTL, "how long a cached result is served (0 keeps it until invalidated)")
+	flag.Int64Var(&readyMaxLag, "ready-max-lag", readyMaxLag, "report not ready when more than this many entries behind the master (0 disables)")
+	flag.StringVar(&readPolicy, "read-balancer", "", "spread SELECTs over this slave and its peers: round-robin, least-outstanding, latency-weighted or consistent-hash; empty sends them to the master")
+	flag.Int64Var(&readMaxLagOps, "read-max-lag-ops", 0, "leave slaves more than this many entries behind the master out of read balancing (0 disables)")
+	flag.BoolVar(&multiWriter, "multi-writer", false, "take writes locally while the master is unreachable and merge them into its log on reconnect")
+	pendingPath := flag.String("pending-writes", "pending_writes.json", "file holding writes taken while partitioned that the master has not merged")
+	traceExport := flag.String("trace-export", "", "export spans as OTLP/JSON to this file or http(s) collector URL; empty disables tracing export")
+	logOptions.RegisterFlags(flag.CommandLine)
+	dbConfig := shared.NewDBConfig("Kaido440", "5277859MoKaido!", "127.0.0.1", "3307")
+	dbConfig.RegisterFlags(flag.CommandLine)
+	flag.Parse()
+
+	var err error
+	nodeID, err = shared.LoadOrCreateNodeID(*idFile)
+	if err != nil {
+		log.Fatalf("Failed to load node ID: %v", err)
+	}
+
+	var logFile *shared.RotatingFile
+	logger, logFile, err = logOptions.Open(logPath, nodeID)
 	if err != nil {
 		log.Fatalf("Failed to open log file: %v", err)
 	}
 	defer logFile.Close()
-	log.SetOutput(logFile)
-	log.SetFlags(log.Ldate | log.Ltime | log.Lmicroseconds)
-
-	dbHandler, err = shared.NewDBHandler(&shared.DBConfig{
-		Host:     "127.0.0.1",
-		Port:     "3307",
-		Username: "Kaido440",
-		Password: "5277859MoKaido!",
+	// Shared code that still logs through the standard log package ends
+	// up in the same file.
+	log.SetOutput(logger.StdWriter("SLAVE"))
+	log.SetFlags(0)
+
+	dbHandler, err = shared.NewDBHandler(dbConfig)
+	if err != nil {
+		fatal("Failed to initialize database handler", err)
+	}
+	defer dbHandler.Close()
+
+	if *traceExport != "" {
+		tracer, err := shared.NewOTLPExporter("ddb-slave", nodeID, *traceExport)
+		if err != nil {
+			fatal("Failed to set up tracing", err)
+		}
+		defer tracer.Close()
+		shared.SetSpanExporter(tracer)
+	}
+
+	advertisedHTTP = getLocalIP() + ":" + *httpPort
+	advertisedRepl = getLocalIP() + ":" + replPort
+	logger.Log(shared.LevelInfo, "SYSTEM", "Slave started", map[string]string{
+		"http":        advertisedHTTP,
+		"replication": advertisedRepl,
 	})
+
+	profiler, err = shared.NewQueryProfiler(slowQueryThreshold, nodeID, slowQueryLogPath, logOptions)
 	if err != nil {
-		log.Fatalf("Failed to initialize database handler: %v", err)
+		fatal("Failed to open slow query log", err)
+	}
+	defer profiler.Close()
+	profiler.Explain = dbHandler.EstimateRowsExamined
+
+	if err := openRelayLog(*relayPath); err != nil {
+		fatal("Failed to open relay log", err)
+	}
+	defer relayLog.Close()
+	logger.Log(shared.LevelInfo, "REPLICATION", "Resuming replication", map[string]int64{"position": appliedPosition.Load()})
+	if *raftPeers != "" && multiWriter {
+		fatal("-multi-writer cannot be used with raft", nil)
+	}
+	if pending, err = loadPendingStore(*pendingPath); err != nil {
+		fatal("Failed to load pending writes", err)
+	}
+	setupResultCache()
+	if err := setupReadBalancer(); err != nil {
+		fatal("Invalid read balancer", err)
 	}
+	registerMetrics()
 
-	log.Println("Connecting to master server...")
+	mux := http.NewServeMux()
+	profiler.RegisterHandlers(mux)
+	if *raftPeers != "" {
+		peers, err := shared.ParseRaftPeers(*raftPeers)
+		if err != nil {
+			fatal("Invalid -raft-peers", err)
+		}
+		if *raftID == "" {
+			*raftID = nodeID
+		}
+		if err := startRaft(*raftID, peers, *raftDir, mux); err != nil {
+			fatal("Failed to start raft", err)
+		}
+	}
+
+	logger.Log(shared.LevelInfo, "MASTER", "Connecting to master server", map[string]string{"master": currentMasterAddr()})
 	if err := establishMasterConnection(); err != nil {
-		log.Printf("Warning: Failed to connect to master server: %v", err)
-		log.Println("Will retry connection when sending queries")
-	} else {
-		log.Println("Successfully connected to master server")
+		logger.Log(shared.LevelWarn, "MASTER", "Failed to connect to master server, will retry when sending queries", map[string]string{"error": err.Error()})
 	}
+	go heartbeatLoop()
+	go replicationLoop()
+
+	server := &http.Server{
+		Addr:         ":" + *httpPort,
+		Handler:      shared.InstrumentHTTP(corsMiddleware(mux)),
+		ReadTimeout:  10 * time.Second,
+		WriteTimeout: 10 * time.Second,
+	}
+	server.RegisterOnShutdown(logger.CloseSubscribers)
 
 	go func() {
-		log.Printf("Starting Slave GUI server...")
+		logger.Log(shared.LevelInfo, "HTTP", "Starting Slave GUI server", nil)
 
 		webDir := "./web"
 		if _, err := os.Stat(webDir); os.IsNotExist(err) {
-			log.Fatalf("Web directory not found at %s: %v", webDir, err)
+			fatal("Web directory not found", err)
 		}
-		log.Printf("Found web directory at: %s", webDir)
+		logger.Log(shared.LevelDebug, "HTTP", "Found web directory", map[string]string{"dir": webDir})
 
-		mux := http.NewServeMux()
 		fs := http.FileServer(http.Dir(webDir))
 
 		loggedFs := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-			log.Printf("Received request: %s %s", r.Method, r.URL.Path)
-			log.Printf("Serving from directory: %s", webDir)
+			logger.Log(shared.LevelDebug, "HTTP", "Received request", map[string]string{
+				"method": r.Method,
+				"path":   r.URL.Path,
+			})
 
 			filePath := webDir + r.URL.Path
 			if r.URL.Path == "/" {
@@ -78,9 +182,7 @@ func main() {
 			}
 
 			if _, err := os.Stat(filePath); os.IsNotExist(err) {
-				log.Printf("File not found: %s", filePath)
-			} else {
-				log.Printf("File exists: %s", filePath)
+				logger.Log(shared.LevelDebug, "HTTP", "File not found", map[string]string{"file": filePath})
 			}
 
 			fs.ServeHTTP(w, r)
@@ -90,35 +192,69 @@ func main() {
 		mux.HandleFunc("/api/query", handleQueryRequest)
 		mux.HandleFunc("/connect", handleConnect)
 		mux.HandleFunc("/api/replicate", handleReplicationRequest)
-
-		log.Printf("Slave GUI running at http://localhost:8084/")
+		mux.HandleFunc("/api/replication/status", handleReplicationStatus)
+		mux.HandleFunc("/api/cache", handleCache)
+		mux.HandleFunc("/api/pending-writes", handlePendingWrites)
+		mux.HandleFunc("/api/admin/pool", shared.PoolStatsHandler(dbHandler))
+		mux.HandleFunc("/api/queries/running", shared.RunningQueriesHandler(dbHandler))
+		mux.HandleFunc("/api/queries/cancel", shared.CancelQueryHandler(cancelQuery))
+		mux.HandleFunc("/api/logs", shared.LogsHandler(logPath))
+		mux.HandleFunc("/api/logs/stream", shared.LogStreamHandler(logger))
+		mux.Handle("/metrics", shared.MetricsHandler())
+		mux.HandleFunc("/healthz", shared.HealthHandler(nodeID, nil))
+		mux.HandleFunc("/readyz", shared.HealthHandler(nodeID, readinessChecks))
+
+		logger.Log(shared.LevelInfo, "HTTP", "Slave GUI running", map[string]string{"url": "http://localhost:" + *httpPort + "/"})
 
 		for i := 0; i < 3; i++ {
-			log.Printf("Attempt %d: Starting server on port 8084...", i+1)
-			server := &http.Server{
-				Addr:         ":8084",
-				Handler:      corsMiddleware(mux),
-				ReadTimeout:  10 * time.Second,
-				WriteTimeout: 10 * time.Second,
-			}
-
-			if err := server.ListenAndServe(); err != nil {
-				log.Printf("Attempt %d: Failed to start web server: %v", i+1, err)
-				time.Sleep(time.Second * 2)
-			} else {
-				log.Printf("Server started successfully on port 8084")
-				break
+			logger.Log(shared.LevelDebug, "HTTP", "Starting server", map[string]interface{}{
+				"attempt": i + 1,
+				"port":    *httpPort,
+			})
+			err := server.ListenAndServe()
+			if errors.Is(err, http.ErrServerClosed) {
+				return
 			}
+			logger.Log(shared.LevelError, "HTTP", "Failed to start web server", map[string]interface{}{
+				"attempt": i + 1,
+				"error":   err.Error(),
+			})
+			time.Sleep(time.Second * 2)
 		}
 	}()
 
-	log.Println("Slave started. Type your SQL query (or 'exit' to quit):")
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	go readConsole(stop)
+
+	<-ctx.Done()
+	// A second signal kills the process instead of waiting for the drain.
+	stop()
+	shutdown(server)
+}
+
+// fatal logs a startup failure and exits.
+func fatal(message string, err error) {
+	var data interface{}
+	if err != nil {
+		data = map[string]string{"error": err.Error()}
+	}
+	logger.Log(shared.LevelError, "SYSTEM", message, data)
+	os.Exit(1)
+}
+
+// readConsole runs queries typed on stdin until "exit" or end of input, then
+// calls stop to shut the slave down.
+func readConsole(stop context.CancelFunc) {
+	defer stop()
+
+	logger.Log(shared.LevelInfo, "CONSOLE", "Reading SQL queries from stdin until 'exit'", nil)
 	scanner := bufio.NewScanner(os.Stdin)
 	for scanner.Scan() {
 		query := scanner.Text()
 		if query == "exit" {
-			log.Println("Exiting...")
-			break
+			logger.Log(shared.LevelInfo, "CONSOLE", "Exiting", nil)
+			return
 		}
 
 		if query == "" {
@@ -127,14 +263,14 @@ func main() {
 
 		response, err := sendQueryToMaster(query)
 		if err != nil {
-			log.Printf("Error: %v", err)
+			logger.Log(shared.LevelError, "CONSOLE", "Query failed", map[string]string{"error": err.Error()})
 			continue
 		}
 
 		if response.Status == "error" {
-			log.Printf("Error: %s", response.Message)
+			logger.Log(shared.LevelError, "CONSOLE", "Query failed", map[string]string{"error": response.Message})
 		} else {
-			log.Printf("Success: %s", response.Message)
+			logger.Log(shared.LevelInfo, "CONSOLE", "Query succeeded", map[string]string{"message": response.Message})
 			if len(response.Rows) > 0 {
 				for _, col := range response.Header {
 					fmt.Printf("%-20s", col)
@@ -155,33 +291,37 @@ func main() {
 	}
 
 	if err := scanner.Err(); err != nil {
-		log.Fatalf("Error reading input: %v", err)
+		logger.Log(shared.LevelError, "CONSOLE", "Failed to read input", map[string]string{"error": err.Error()})
 	}
 }
 
 func handleConnect(w http.ResponseWriter, r *http.Request) {
-	log.Printf("Received connection request from %s", r.RemoteAddr)
+	logger.Log(shared.LevelDebug, "HTTP", "Received connection request", map[string]string{"remote": r.RemoteAddr})
 
 	if r.Method != http.MethodPost {
-		log.Printf("Invalid method: %s", r.Method)
+		logger.Log(shared.LevelWarn, "HTTP", "Invalid method for connection request", map[string]string{"method": r.Method})
 		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
 		return
 	}
 
+	role := "slave"
+	if isPromoted() {
+		role = "master"
+	}
 	response := map[string]interface{}{
 		"status":  "ok",
 		"message": "Connected successfully",
-		"role":    "slave",
+		"role":    role,
 	}
 
 	w.Header().Set("Content-Type", "application/json")
 	if err := json.NewEncoder(w).Encode(response); err != nil {
-		log.Printf("Error encoding response: %v", err)
+		logger.Log(shared.LevelError, "HTTP", "Failed to encode response", map[string]string{"error": err.Error()})
 		http.Error(w, "Internal server error", http.StatusInternalServerError)
 		return
 	}
 
-	log.Printf("Sent connection response to %s", r.RemoteAddr)
+	logger.Log(shared.LevelDebug, "HTTP", "Sent connection response", map[string]string{"remote": r.RemoteAddr})
 }
 
 func handleQueryRequest(w http.ResponseWriter, r *http.Request) {
@@ -197,12 +337,61 @@ func handleQueryRequest(w http.ResponseWriter, r *http.Request) {
 	}
 
 	query := strings.ToUpper(strings.TrimSpace(req.Query))
-	if strings.HasPrefix(query, "CREATE") || strings.HasPrefix(query, "DROP") {
+	if !isPromoted() && (strings.HasPrefix(query, "CREATE") || strings.HasPrefix(query, "DROP")) {
 		http.Error(w, "CREATE and DROP operations are only allowed on the master server", http.StatusForbidden)
 		return
 	}
 
-	response, err := sendQueryToMaster(req.Query)
+	if req.RequestID == "" {
+		req.RequestID = shared.NewRequestID()
+	}
+	// The server's WriteTimeout would drop the client before a long query
+	// could finish or report its own timeout.
+	http.NewResponseController(w).SetWriteDeadline(responseDeadline(req.Timeout(queryTimeout)))
+
+	span := shared.StartSpan("slave.query", shared.SpanServer, shared.SpanContextFromHeader(r.Header))
+	span.SetAttribute("db.statement", req.Query)
+	req.TraceID, req.SpanID = span.TraceID, span.SpanID
+	logger.LogSpan(span.Context(), shared.LevelInfo, "QUERY", "Received query", map[string]string{
+		"query":  req.Query,
+		"remote": r.RemoteAddr,
+	})
+
+	var response shared.DBResponse
+	var err error
+	switch {
+	case req.Role == shared.RoleProxy:
+		response, err = cachedSelect(req.Query, func() (shared.DBResponse, error) {
+			return executeProxiedRead(r.Context(), req)
+		})
+	case shared.StatementKind(req.Query) == "SELECT" && balancesRead(req):
+		response, err = cachedSelect(req.Query, func() (shared.DBResponse, error) {
+			return balancedRead(r.Context(), req)
+		})
+	case shared.StatementKind(req.Query) == "SELECT":
+		response, err = cachedSelect(req.Query, func() (shared.DBResponse, error) {
+			return sendRequestToMaster(req)
+		})
+	case writesLocally():
+		response, err = executePartitionedWrite(req)
+	default:
+		response, err = sendRequestToMaster(req)
+		if multiWriter && errors.Is(err, errMasterUnreachable) {
+			response, err = executePartitionedWrite(req)
+		}
+		// The write reaches this node through replication later; until then
+		// results cached here would hide it from the client that made it.
+		invalidateCache(req.Query)
+	}
+	if response.RequestID == "" {
+		response.TraceID, response.RequestID = span.TraceID, req.RequestID
+	}
+	span.FinishResponse(response, err)
+	logger.LogSpan(span.Context(), shared.LevelInfo, "QUERY", "Query completed", map[string]string{
+		"status":  response.Status,
+		"message": response.Message,
+	})
+	w.Header().Set(shared.TraceparentHeader, span.Context().Traceparent())
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
@@ -215,6 +404,42 @@ func handleQueryRequest(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// executeProxiedRead runs a SELECT the master's read proxy, or another
+// slave's read balancer, sent here. The statement ends early if the sender
+// drops the request.
+func executeProxiedRead(parent context.Context, req shared.DBRequest) (shared.DBResponse, error) {
+	if req.Token != validToken {
+		return shared.DBResponse{}, fmt.Errorf("invalid token")
+	}
+	if shared.StatementKind(req.Query) != "SELECT" {
+		return shared.DBResponse{}, fmt.Errorf("only SELECTs can be proxied to a slave")
+	}
+	return readLocally(parent, req, req.FromSlave), nil
+}
+
+// readLocally runs a SELECT against this slave's database, recording it in
+// the query statistics under origin. SQL errors are returned in the
+// response.
+func readLocally(parent context.Context, req shared.DBRequest, origin string) shared.DBResponse {
+	ctx, cancel := req.QueryContext(queryTimeout)
+	defer cancel()
+	stop := context.AfterFunc(parent, cancel)
+	defer stop()
+
+	cols, rows, err := selectProfiled(ctx, origin, req.Query)
+	if err != nil {
+		return shared.DBResponse{Status: "error", Message: err.Error(), TraceID: req.TraceID, RequestID: req.RequestID}
+	}
+	return shared.DBResponse{
+		Status:    "ok",
+		Message:   "Select executed",
+		Header:    cols,
+		Rows:      rows,
+		TraceID:   req.TraceID,
+		RequestID: req.RequestID,
+	}
+}
+
 func handleReplicationRequest(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodPost {
 		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
@@ -227,7 +452,9 @@ func handleReplicationRequest(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if err := dbHandler.ReplicateData(&req); err != nil {
+	err := dbHandler.ReplicateData(&req)
+	invalidateCacheTables(shared.ChangedTables(req.Changes)...)
+	if err != nil {
 		http.Error(w, fmt.Sprintf("Replication failed: %v", err), http.StatusInternalServerError)
 		return
 	}
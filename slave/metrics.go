@@ -0,0 +1,45 @@
+package main
+
+import (
+	"distributed-db/shared"
+)
+
+var (
+	heartbeatFailures = shared.DefaultMetrics.Counter("ddb_heartbeat_failures_total",
+		"Heartbeats to the master that failed.")
+	forwardedQueries = shared.DefaultMetrics.Counter("ddb_forwarded_queries_total",
+		"Queries forwarded to the master by statement kind and status.", "kind", "status")
+)
+
+func registerMetrics() {
+	shared.RegisterDBMetrics(dbHandler)
+
+	shared.DefaultMetrics.GaugeFunc("ddb_replication_position", "Last replication position applied by this node.",
+		nil, func() []shared.MetricSample {
+			return []shared.MetricSample{{Value: float64(appliedPosition.Load())}}
+		})
+
+	shared.DefaultMetrics.GaugeFunc("ddb_master_connected", "1 while this slave holds a connection to the master.",
+		nil, func() []shared.MetricSample {
+			if masterConnected.Load() {
+				return []shared.MetricSample{{Value: 1}}
+			}
+			return []shared.MetricSample{{Value: 0}}
+		})
+
+	shared.DefaultMetrics.GaugeFunc("ddb_promoted", "1 while this slave acts as master after a failover.",
+		nil, func() []shared.MetricSample {
+			if isPromoted() {
+				return []shared.MetricSample{{Value: 1}}
+			}
+			return []shared.MetricSample{{Value: 0}}
+		})
+
+	shared.DefaultMetrics.GaugeFunc("ddb_result_cache_bytes", "Approximate memory held by cached SELECT results.",
+		nil, func() []shared.MetricSample {
+			if resultCache == nil {
+				return nil
+			}
+			return []shared.MetricSample{{Value: float64(resultCache.Stats().Bytes)}}
+		})
+}
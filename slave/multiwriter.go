@@ -0,0 +1,290 @@
+package main
+
+import (
+	"bufio"
+	"distributed-db/shared"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+// reconcileBatch is how many partitioned writes are sent to the master at
+// a time.
+const reconcileBatch = 100
+
+var (
+	// multiWriter lets this slave take writes itself while it cannot reach
+	// the master, and merge them into the master's log later.
+	multiWriter bool
+	pending     *pendingStore
+
+	errMasterUnreachable = errors.New("master is unreachable")
+)
+
+// pendingStore holds the writes taken while partitioned until the master
+// has merged them. NextSeq is kept across restarts so the master never
+// mistakes a new write for one it has merged.
+type pendingStore struct {
+	mu    sync.Mutex
+	path  string
+	state pendingState
+}
+
+type pendingState struct {
+	NextSeq int64               `json:"next_seq"`
+	Writes  []shared.LocalWrite `json:"writes"`
+}
+
+func loadPendingStore(path string) (*pendingStore, error) {
+	s := &pendingStore{path: path, state: pendingState{NextSeq: 1}}
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read pending writes: %v", err)
+	}
+	if err := json.Unmarshal(data, &s.state); err != nil {
+		return nil, fmt.Errorf("invalid pending writes file: %v", err)
+	}
+	return s, nil
+}
+
+func (s *pendingStore) saveLocked() error {
+	data, err := json.Marshal(s.state)
+	if err != nil {
+		return fmt.Errorf("failed to encode pending writes: %v", err)
+	}
+	tmp := s.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return fmt.Errorf("failed to write pending writes: %v", err)
+	}
+	return os.Rename(tmp, s.path)
+}
+
+// add gives w the next sequence number and persists it. A write that
+// cannot be saved is forgotten again.
+func (s *pendingStore) add(w shared.LocalWrite) (shared.LocalWrite, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	w.Seq = s.state.NextSeq
+	s.state.NextSeq++
+	s.state.Writes = append(s.state.Writes, w)
+	if err := s.saveLocked(); err != nil {
+		s.state.Writes = s.state.Writes[:len(s.state.Writes)-1]
+		return w, err
+	}
+	return w, nil
+}
+
+// remove forgets the write with sequence number seq.
+func (s *pendingStore) remove(seq int64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for i, w := range s.state.Writes {
+		if w.Seq == seq {
+			s.state.Writes = append(s.state.Writes[:i], s.state.Writes[i+1:]...)
+			return s.saveLocked()
+		}
+	}
+	return nil
+}
+
+func (s *pendingStore) batch(limit int) []shared.LocalWrite {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	n := len(s.state.Writes)
+	if n > limit {
+		n = limit
+	}
+	return append([]shared.LocalWrite{}, s.state.Writes[:n]...)
+}
+
+// drop forgets the writes up to and including seq.
+func (s *pendingStore) drop(seq int64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	i := 0
+	for i < len(s.state.Writes) && s.state.Writes[i].Seq <= seq {
+		i++
+	}
+	s.state.Writes = append([]shared.LocalWrite(nil), s.state.Writes[i:]...)
+	return s.saveLocked()
+}
+
+func (s *pendingStore) len() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return len(s.state.Writes)
+}
+
+// writesLocally reports whether writes must stay on this node: once one
+// write has been taken while partitioned, the following ones are too until
+// the master has merged them, so they reach it in order.
+func writesLocally() bool {
+	return multiWriter && !isPromoted() && pending.len() > 0
+}
+
+// executePartitionedWrite runs a write on this node while the master cannot
+// be reached and keeps it, with the rows it changed, for the master to
+// merge. Writes whose rows cannot be captured are refused, since they could
+// not be merged, and so are writes that cannot be saved for the merge.
+func executePartitionedWrite(req shared.DBRequest) (shared.DBResponse, error) {
+	ctx, cancel := req.QueryContext(queryTimeout)
+	defer cancel()
+
+	localWriteMu.Lock()
+	defer localWriteMu.Unlock()
+
+	version := shared.DefaultClock.Now()
+	start := time.Now()
+	var w shared.LocalWrite
+	saved := false
+	affected, _, err := dbHandler.ExecCaptureStrict(ctx, req.Query, func(changes []shared.RowChange) error {
+		var err error
+		w, err = pending.add(shared.LocalWrite{
+			Base:      appliedPosition.Load(),
+			Version:   version,
+			Timestamp: time.Now().UnixMilli(),
+			Query:     req.Query,
+			Changes:   changes,
+		})
+		if err != nil {
+			return fmt.Errorf("failed to save partitioned write: %v", err)
+		}
+		saved = true
+		return nil
+	})
+	if err != nil && saved {
+		// The write was saved but did not commit.
+		if err := pending.remove(w.Seq); err != nil {
+			logger.Log(shared.LevelError, "PARTITION", "Failed to remove uncommitted write", map[string]interface{}{
+				"seq":   w.Seq,
+				"error": err.Error(),
+			})
+		}
+	}
+	invalidateCache(req.Query)
+	profiler.Record(shared.QueryRecord{
+		Query:        req.Query,
+		Origin:       "partitioned",
+		Start:        start,
+		Duration:     time.Since(start),
+		RowsAffected: affected,
+		Err:          err,
+	})
+	if err != nil {
+		return shared.DBResponse{Status: "error", Message: err.Error(), RequestID: req.RequestID}, nil
+	}
+
+	logger.Log(shared.LevelWarn, "PARTITION", "Took write locally while the master is unreachable", map[string]interface{}{
+		"seq":     w.Seq,
+		"base":    w.Base,
+		"version": w.Version.String(),
+	})
+	return shared.DBResponse{
+		Status:    "ok",
+		Message:   fmt.Sprintf("Query executed locally while the master is unreachable, pending reconciliation. Rows affected: %d", affected),
+		RequestID: req.RequestID,
+	}, nil
+}
+
+// reconcilePending sends the oldest partitioned writes to the master over
+// the replication connection. They are forgotten once the master has
+// merged them; the merged rows then come back through replication.
+func reconcilePending(conn net.Conn, scanner *bufio.Scanner) error {
+	writes := pending.batch(reconcileBatch)
+	if len(writes) == 0 {
+		return nil
+	}
+	reqData, err := json.Marshal(shared.DBRequest{
+		Type:   shared.MsgReconcile,
+		Token:  validToken,
+		NodeID: nodeID,
+		Writes: writes,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to marshal reconciliation: %v", err)
+	}
+	conn.SetDeadline(time.Now().Add(30 * time.Second))
+	if _, err := conn.Write(append(reqData, '\n')); err != nil {
+		return fmt.Errorf("failed to send reconciliation: %v", err)
+	}
+	if !scanner.Scan() {
+		return fmt.Errorf("failed to read reconciliation response: %v", scanner.Err())
+	}
+	var resp shared.DBResponse
+	if err := json.Unmarshal(scanner.Bytes(), &resp); err != nil {
+		return fmt.Errorf("invalid reconciliation response: %v", err)
+	}
+	if resp.Status != "ok" {
+		return fmt.Errorf("reconciliation rejected: %s", resp.Message)
+	}
+	for _, c := range resp.Conflicts {
+		logger.Log(shared.LevelWarn, "CONFLICT", "Partitioned write conflicted", map[string]interface{}{
+			"seq":        c.Seq,
+			"table":      c.Table,
+			"key":        c.Local.KeyValues(),
+			"resolution": c.Resolution,
+		})
+	}
+	logger.Log(shared.LevelInfo, "PARTITION", "Master merged partitioned writes", map[string]int{
+		"writes":    len(writes),
+		"conflicts": len(resp.Conflicts),
+	})
+	return pending.drop(writes[len(writes)-1].Seq)
+}
+
+// logPendingWrites appends the partitioned writes to the relay log when
+// this node is promoted, so that its followers receive them.
+func logPendingWrites() {
+	if pending.len() == 0 {
+		return
+	}
+	localWriteMu.Lock()
+	defer localWriteMu.Unlock()
+
+	writes := pending.batch(pending.len())
+	for _, w := range writes {
+		entry, err := relayLog.AppendWrite(shared.ReplicationEntry{
+			Query:     w.Query,
+			Captured:  true,
+			Changes:   w.Changes,
+			HLC:       w.Version,
+			Origin:    nodeID,
+			OriginSeq: w.Seq,
+		})
+		if err != nil {
+			logger.Log(shared.LevelError, "PARTITION", "Failed to log partitioned write", map[string]interface{}{
+				"seq":   w.Seq,
+				"error": err.Error(),
+			})
+			return
+		}
+		appliedPosition.Store(entry.Position)
+		if err := pending.drop(w.Seq); err != nil {
+			logger.Log(shared.LevelError, "PARTITION", "Failed to save pending writes", map[string]string{"error": err.Error()})
+		}
+	}
+}
+
+// handlePendingWrites serves GET /api/pending-writes, the writes taken
+// while partitioned that the master has not merged yet.
+func handlePendingWrites(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(pending.batch(pending.len()))
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"bufio"
+	"distributed-db/shared"
+	"encoding/json"
+	"fmt"
+	"net"
+	"time"
+)
+
+// queryTimeout bounds statements whose request does not set timeout_ms. It
+// is passed on with forwarded requests so the master applies the same limit.
+var queryTimeout = 30 * time.Second
+
+// responseMargin is added to a query's timeout when waiting on the master or
+// writing the HTTP response, leaving time for the durability wait and for
+// the timeout error itself to arrive.
+const responseMargin = 5 * time.Second
+
+// responseDeadline returns when a request with the given timeout should have
+// been answered, or the zero time if it has no limit.
+func responseDeadline(timeout time.Duration) time.Time {
+	if timeout <= 0 {
+		return time.Time{}
+	}
+	return time.Now().Add(timeout + responseMargin)
+}
+
+// cancelQuery stops the statement running for requestID on this node or, for
+// forwarded requests, on the master.
+func cancelQuery(requestID string) error {
+	err := dbHandler.CancelQuery(requestID)
+	if err != shared.ErrQueryNotRunning || isPromoted() {
+		return err
+	}
+	return cancelOnMaster(requestID)
+}
+
+// cancelOnMaster sends the cancel on a connection of its own, as the control
+// connection is busy until the query being cancelled returns.
+func cancelOnMaster(requestID string) error {
+	conn, err := net.DialTimeout("tcp", currentMasterAddr(), 5*time.Second)
+	if err != nil {
+		return fmt.Errorf("failed to connect to master server: %v", err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+
+	reqData, err := json.Marshal(shared.DBRequest{
+		Type:      shared.MsgCancel,
+		Token:     validToken,
+		FromSlave: getLocalIP(),
+		NodeID:    nodeID,
+		RequestID: requestID,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to marshal cancel request: %v", err)
+	}
+	if _, err := conn.Write(append(reqData, '\n')); err != nil {
+		return fmt.Errorf("failed to send cancel request: %v", err)
+	}
+
+	scanner := bufio.NewScanner(conn)
+	if !scanner.Scan() {
+		return fmt.Errorf("failed to read cancel response: %v", scanner.Err())
+	}
+	var resp shared.DBResponse
+	if err := json.Unmarshal(scanner.Bytes(), &resp); err != nil {
+		return fmt.Errorf("invalid cancel response: %v", err)
+	}
+	if resp.Status == "ok" {
+		return nil
+	}
+	if resp.Message == shared.ErrQueryNotRunning.Error() {
+		return shared.ErrQueryNotRunning
+	}
+	return fmt.Errorf("master failed to cancel query: %s", resp.Message)
+}
+
+// handleCancel answers a follower's cancel message once this node has been
+// promoted.
+func handleCancel(req shared.DBRequest) shared.DBResponse {
+	if err := dbHandler.CancelQuery(req.RequestID); err != nil {
+		return shared.DBResponse{Status: "error", Message: err.Error(), RequestID: req.RequestID}
+	}
+	return shared.DBResponse{Status: "ok", Message: "Query cancelled", RequestID: req.RequestID}
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"context"
+	"distributed-db/shared"
+	"time"
+)
+
+var (
+	profiler           *shared.QueryProfiler
+	slowQueryThreshold = 200 * time.Millisecond
+)
+
+const slowQueryLogPath = "slave_slow_queries.jsonl"
+
+// captureProfiled runs a write locally, drops the cached results it may
+// have changed and records it in the query statistics under origin. The
+// rows it changed are returned for the relay log, so that followers apply
+// the rows rather than the statement.
+func captureProfiled(ctx context.Context, origin, query string) (int64, []shared.RowChange, bool, error) {
+	start := time.Now()
+	affected, changes, captured, err := dbHandler.ExecCapture(ctx, query)
+	invalidateCache(query)
+	profiler.Record(shared.QueryRecord{
+		Query:        query,
+		Origin:       origin,
+		Start:        start,
+		Duration:     time.Since(start),
+		RowsAffected: affected,
+		Err:          err,
+	})
+	return affected, changes, captured, err
+}
+
+// applyProfiled applies the rows a write changed on the master, recorded
+// under the write's statement.
+func applyProfiled(ctx context.Context, origin, query string, changes []shared.RowChange) error {
+	start := time.Now()
+	err := dbHandler.ApplyRowChanges(ctx, changes)
+	invalidateCacheTables(shared.ChangedTables(changes)...)
+	profiler.Record(shared.QueryRecord{
+		Query:        query,
+		Origin:       origin,
+		Start:        start,
+		Duration:     time.Since(start),
+		RowsAffected: int64(len(changes)),
+		Err:          err,
+	})
+	return err
+}
+
+// selectProfiled runs a SELECT locally and records it in the query
+// statistics under origin.
+func selectProfiled(ctx context.Context, origin, query string) ([]string, [][]interface{}, error) {
+	start := time.Now()
+	cols, rows, err := dbHandler.SelectRowsContext(ctx, query)
+	profiler.Record(shared.QueryRecord{
+		Query:        query,
+		Origin:       origin,
+		Start:        start,
+		Duration:     time.Since(start),
+		RowsReturned: int64(len(rows)),
+		Err:          err,
+	})
+	return cols, rows, err
+}
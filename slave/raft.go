@@ -0,0 +1,115 @@
+package main
+
+import (
+	"context"
+	"distributed-db/shared"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+var raftNode *shared.RaftNode
+
+// startRaft joins the Raft group when -raft-peers is set. The group then
+// replaces the heartbeat-driven failover: committed entries are applied
+// straight from the Raft log, as the rows the leader captured or, for writes
+// that cannot be captured, as statements. Each is logged with its rows so
+// that followers of the node replicate by row; the elected leader promotes itself
+// and every other member repoints to it.
+func startRaft(id string, peers map[string]string, dir string, mux *http.ServeMux) error {
+	applied, err := dbHandler.RaftAppliedIndex(context.Background(), id)
+	if err != nil {
+		return err
+	}
+	node, err := shared.NewRaftNode(shared.RaftConfig{
+		ID:        id,
+		Peers:     peers,
+		Transport: shared.NewHTTPRaftTransport(time.Second, validToken),
+		StateDir:  dir,
+		Applied:   applied,
+		Apply: func(entry shared.RaftEntry) (interface{}, error) {
+			localWriteMu.Lock()
+			defer localWriteMu.Unlock()
+
+			w := shared.DecodeRaftWrite(entry.Data)
+			ctx := shared.WithRaftIndex(context.Background(), id, entry.Index)
+			affected, changes, captured := w.Affected, w.Changes, w.Captured
+			var err error
+			if captured {
+				err = applyProfiled(ctx, "raft", w.Query, changes)
+			} else {
+				affected, changes, captured, err = captureProfiled(ctx, "raft", w.Query)
+			}
+			if err != nil {
+				return nil, err
+			}
+			applied, err := relayLog.AppendChanges(w.Query, changes, captured)
+			if err != nil {
+				logger.Log(shared.LevelError, "RAFT", "Failed to append to relay log", map[string]interface{}{
+					"index": entry.Index,
+					"error": err.Error(),
+				})
+				return nil, fmt.Errorf("write committed but is not in the relay log yet: %v", err)
+			}
+			appliedPosition.Store(applied.Position)
+			return affected, nil
+		},
+		OnLeaderChange: handleLeaderChange,
+	})
+	if err != nil {
+		return err
+	}
+	raftNode = node
+	raftNode.RegisterHTTP(mux, validToken)
+	logger.Log(shared.LevelInfo, "RAFT", "Joined raft group", map[string]interface{}{
+		"id":    id,
+		"peers": peers,
+	})
+	return nil
+}
+
+func handleLeaderChange(leaderID string) {
+	if leaderID == "" {
+		return
+	}
+	logger.Log(shared.LevelInfo, "RAFT", "Raft leader changed", map[string]string{"leader": leaderID})
+
+	if leaderID == raftNode.ID() {
+		if !isPromoted() {
+			if err := promote(); err != nil {
+				logger.Log(shared.LevelError, "RAFT", "Promotion failed", map[string]string{"error": err.Error()})
+			}
+		}
+		return
+	}
+	if isPromoted() {
+		demote()
+	}
+
+	_, httpAddr := raftNode.Leader()
+	status, err := fetchPeerStatus(httpAddr)
+	if err != nil {
+		logger.Log(shared.LevelWarn, "RAFT", "Failed to look up leader", map[string]string{
+			"leader": leaderID,
+			"error":  err.Error(),
+		})
+		return
+	}
+	if status.ReplAddr != "" {
+		repointTo(status.ReplAddr)
+	}
+}
+
+// proposeWrite captures the rows query changes and proposes them, so every
+// member writes the rows this leader computed.
+func proposeWrite(ctx context.Context, query string) shared.DBResponse {
+	value, err := shared.ProposeRaftWrite(ctx, raftNode, dbHandler, query)
+	if err != nil {
+		return shared.DBResponse{Status: "error", Message: err.Error()}
+	}
+	affected, _ := value.(int64)
+	return shared.DBResponse{
+		Status:  "ok",
+		Message: fmt.Sprintf("Query executed successfully. Rows affected: %d", affected),
+	}
+}
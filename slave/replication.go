@@ -0,0 +1,208 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"distributed-db/shared"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"time"
+)
+
+// relayLog holds every entry this slave has applied, in master order. It lets
+// the slave resume after a restart and serve the log if it is promoted.
+var relayLog *shared.ReplicationLog
+
+// mysqlPosition is the last replication position whose write MySQL holds.
+// It can be ahead of the relay log after a crash between the two; entries
+// up to it are then only added to the relay log. Guarded by localWriteMu.
+var mysqlPosition int64
+
+func openRelayLog(path string) error {
+	var err error
+	relayLog, err = shared.OpenReplicationLog(path)
+	if err != nil {
+		return err
+	}
+	appliedPosition.Store(relayLog.LastPosition())
+	mysqlPosition, err = dbHandler.RaftAppliedIndex(context.Background(), shared.ReplicationMark(nodeID))
+	return err
+}
+
+// replicationLoop pulls entries from the current master over a dedicated
+// connection and applies them in order. It stops once this node is promoted,
+// and is not needed at all when Raft delivers committed entries.
+func replicationLoop() {
+	if raftNode != nil {
+		return
+	}
+	for !isPromoted() && !shuttingDown() {
+		addr := currentMasterAddr()
+		if err := streamFrom(addr); err != nil {
+			logger.Log(shared.LevelWarn, "REPLICATION", "Replication interrupted", map[string]string{
+				"master": addr,
+				"error":  err.Error(),
+			})
+		}
+		time.Sleep(time.Second)
+	}
+}
+
+func streamFrom(addr string) error {
+	conn, err := net.DialTimeout("tcp", addr, 5*time.Second)
+	if err != nil {
+		return err
+	}
+	shared.TCPConnections.Add(1)
+	defer func() {
+		shared.TCPConnections.Add(-1)
+		conn.Close()
+	}()
+
+	scanner := bufio.NewScanner(conn)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	// The master counts fetches and acks for the slave a connection is
+	// attached to, so this one is tied to the registration first.
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	if err := exchange(conn, scanner, shared.DBRequest{Type: shared.MsgAttach, Token: validToken, NodeID: nodeID}); err != nil {
+		return fmt.Errorf("attach: %v", err)
+	}
+	for !isPromoted() && !shuttingDown() && currentMasterAddr() == addr {
+		// Writes taken while partitioned are merged before the master's
+		// own writes are fetched.
+		if err := reconcilePending(conn, scanner); err != nil {
+			return err
+		}
+		req := shared.DBRequest{
+			Type:     shared.MsgFetch,
+			Token:    validToken,
+			NodeID:   nodeID,
+			Position: appliedPosition.Load(),
+		}
+		reqData, err := json.Marshal(req)
+		if err != nil {
+			return fmt.Errorf("failed to marshal fetch: %v", err)
+		}
+		conn.SetDeadline(time.Now().Add(shared.FetchWait + 5*time.Second))
+		if _, err := conn.Write(append(reqData, '\n')); err != nil {
+			return fmt.Errorf("failed to send fetch: %v", err)
+		}
+		if !scanner.Scan() {
+			return fmt.Errorf("failed to read fetch response: %v", scanner.Err())
+		}
+
+		var resp shared.DBResponse
+		if err := json.Unmarshal(scanner.Bytes(), &resp); err != nil {
+			return fmt.Errorf("invalid fetch response: %v", err)
+		}
+		if resp.Status != "ok" {
+			return fmt.Errorf("fetch rejected: %s", resp.Message)
+		}
+		if len(resp.Entries) > 0 {
+			if err := ackReceipt(conn, scanner, resp.Entries[len(resp.Entries)-1].Position); err != nil {
+				return err
+			}
+		}
+		for _, entry := range resp.Entries {
+			if err := applyEntry(entry); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// ackReceipt tells the master a batch has arrived, before it is applied, so
+// semi-sync writes can be acknowledged as early as possible.
+func ackReceipt(conn net.Conn, scanner *bufio.Scanner, position int64) error {
+	err := exchange(conn, scanner, shared.DBRequest{
+		Type:     shared.MsgAck,
+		Token:    validToken,
+		NodeID:   nodeID,
+		Position: position,
+	})
+	if err != nil {
+		return fmt.Errorf("ack: %v", err)
+	}
+	return nil
+}
+
+// exchange sends req on the replication connection and fails unless the
+// master answers ok.
+func exchange(conn net.Conn, scanner *bufio.Scanner, req shared.DBRequest) error {
+	reqData, err := json.Marshal(req)
+	if err != nil {
+		return fmt.Errorf("failed to marshal request: %v", err)
+	}
+	if _, err := conn.Write(append(reqData, '\n')); err != nil {
+		return fmt.Errorf("failed to send request: %v", err)
+	}
+	if !scanner.Scan() {
+		return fmt.Errorf("failed to read response: %v", scanner.Err())
+	}
+	var resp shared.DBResponse
+	if err := json.Unmarshal(scanner.Bytes(), &resp); err != nil {
+		return fmt.Errorf("invalid response: %v", err)
+	}
+	if resp.Status != "ok" {
+		return fmt.Errorf("rejected: %s", resp.Message)
+	}
+	return nil
+}
+
+// applyEntry executes a replicated statement locally and then records it in
+// the relay log, which advances the applied position. The entry's position
+// is recorded in the same MySQL transaction as its write, so an entry that
+// reached MySQL but not the relay log is not applied again.
+func applyEntry(entry shared.ReplicationEntry) error {
+	// Writes taken while partitioned read the applied position as their
+	// base, so they must not interleave with an entry being applied.
+	localWriteMu.Lock()
+	defer localWriteMu.Unlock()
+
+	if entry.Position <= appliedPosition.Load() {
+		return nil
+	}
+	if entry.Position > mysqlPosition {
+		// Captured rows are applied by key, so the replica ends up with the
+		// values the master wrote even where the statement is not
+		// deterministic.
+		ctx := shared.WithRaftIndex(context.Background(), shared.ReplicationMark(nodeID), entry.Position)
+		var err error
+		if entry.Captured {
+			err = applyProfiled(ctx, "replication", entry.Query, entry.Changes)
+		} else {
+			_, _, _, err = captureProfiled(ctx, "replication", entry.Query)
+		}
+		if err != nil {
+			logger.Log(shared.LevelError, "REPLICATION", "Failed to apply replication entry", map[string]interface{}{
+				"position": entry.Position,
+				"error":    err.Error(),
+			})
+			return fmt.Errorf("failed to apply entry %d: %v", entry.Position, err)
+		}
+		mysqlPosition = entry.Position
+	}
+	if err := relayLog.AppendEntry(entry); err != nil {
+		return err
+	}
+	appliedPosition.Store(entry.Position)
+	return nil
+}
+
+func handleReplicationStatus(w http.ResponseWriter, r *http.Request) {
+	role := "slave"
+	if isPromoted() {
+		role = "master"
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(shared.ReplicationStatus{
+		NodeID:     nodeID,
+		Role:       role,
+		Position:   appliedPosition.Load(),
+		ReplAddr:   advertisedRepl,
+		MasterAddr: currentMasterAddr(),
+	})
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"context"
+	"distributed-db/shared"
+	"errors"
+	"net/http"
+	"time"
+)
+
+var (
+	// drain counts follower requests served while promoted; closing it also
+	// stops the heartbeat and replication loops.
+	drain           shared.DrainGroup
+	shutdownTimeout = 15 * time.Second
+
+	errMasterShutdown = errors.New("master is shutting down")
+)
+
+func shuttingDown() bool {
+	return drain.Closed()
+}
+
+// shutdown stops replication and the web server, lets in-flight requests
+// finish within shutdownTimeout and then drops the master connection. Open
+// files and the database are closed by main's deferred calls.
+func shutdown(server *http.Server) {
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+
+	logger.Log(shared.LevelInfo, "SYSTEM", "Shutting down", map[string]string{"drain_timeout": shutdownTimeout.String()})
+	drain.Close()
+
+	if err := server.Shutdown(ctx); err != nil {
+		logger.Log(shared.LevelWarn, "SYSTEM", "HTTP requests still running at shutdown deadline", map[string]string{"error": err.Error()})
+	}
+	if err := drain.Wait(ctx); err != nil {
+		logger.Log(shared.LevelWarn, "SYSTEM", "Follower requests still running at shutdown deadline", nil)
+	}
+	if isPromoted() {
+		demote()
+	}
+	if raftNode != nil {
+		raftNode.Stop()
+	}
+
+	connMutex.Lock()
+	closeMasterConn()
+	connMutex.Unlock()
+	logger.Log(shared.LevelInfo, "SYSTEM", "Shutdown complete", nil)
+}